@@ -0,0 +1,340 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package admin provides an HTTP API exposing the state and the metrics of
+// bs, meant to be used by health probes, node dashboards and Prometheus.
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/config"
+	"github.com/tsuru/bs/log"
+	"github.com/tsuru/bs/telemetry"
+)
+
+const (
+	stateRunning  = "running"
+	stateStarting = "starting"
+	stateFailed   = "failed"
+
+	redacted = "<redacted>"
+)
+
+// envPrefixes are the prefixes of the environment variables configuring bs,
+// shown by /config.
+var envPrefixes = []string{
+	"ADMIN_", "BS_", "CONTAINER_", "CRI_", "DOCKER_", "HOSTCHECK_", "HOST_PROC",
+	"LOG_", "METRICS_", "STATUS_", "SYSLOG_", "TSURU_",
+}
+
+// secretEnvSuffixes are the suffixes of environment variables holding
+// secrets, whose values are redacted by /config. Command arguments may hold
+// secrets too.
+var secretEnvSuffixes = []string{"TOKEN", "PASSWORD", "SECRET", "SHARED_KEY", "HEADERS", "ARGS"}
+
+// addressEnvSuffixes are the suffixes of environment variables holding
+// comma separated lists of urls or addresses. Entries other than urls and
+// plain host:port addresses are redacted by /config.
+var addressEnvSuffixes = []string{"URL", "URLS", "ENDPOINT", "ENDPOINTS", "ADDRESS", "ADDRESSES"}
+
+var hostnameRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// secretParams are parts of URL query parameter names holding secrets, whose
+// values are redacted by /config.
+var secretParams = []string{"token", "key", "secret", "pass", "auth", "sig"}
+
+// Component is a part of bs whose state is exposed by the API.
+type Component struct {
+	Name string
+	// Err is the error initializing the component, it isn't running when
+	// set.
+	Err error
+	// Ready reports whether the component finished starting, nil means it's
+	// ready once initialized.
+	Ready func() bool
+	// Status returns details about the component, like the result of its
+	// last run, encoded as JSON.
+	Status func() interface{}
+}
+
+type componentStatus struct {
+	Name    string      `json:"name"`
+	State   string      `json:"state"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Server serves the admin API on Address. The log backends are described
+// by Backends, when set.
+type Server struct {
+	Address    string
+	Components []Component
+	Backends   func() []log.BackendStats
+	listener   net.Listener
+	server     *http.Server
+}
+
+// Start starts listening, serving the API in the background.
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.Address)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.server = &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			bslog.Errorf("[admin] failed to serve: %s", err)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Stop stops the server, closing open connections.
+func (s *Server) Stop() {
+	if s.server != nil {
+		s.server.Close()
+	}
+}
+
+// Handler returns the handler serving the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.HandleFunc("/status", s.status)
+	mux.HandleFunc("/backends", s.backends)
+	mux.HandleFunc("/config", s.config)
+	mux.Handle("/metrics", telemetry.Default.Handler())
+	return mux
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// readyz fails while any initialized component is starting. Components
+// that failed to initialize are disabled and don't affect readiness.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	var starting []string
+	for _, status := range s.componentStatuses(false) {
+		if status.State == stateStarting {
+			starting = append(starting, status.Name)
+		}
+	}
+	if len(starting) > 0 {
+		http.Error(w, "starting: "+strings.Join(starting, ", "), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"components": s.componentStatuses(true),
+	})
+}
+
+func (s *Server) componentStatuses(details bool) []componentStatus {
+	statuses := make([]componentStatus, len(s.Components))
+	for i, component := range s.Components {
+		status := componentStatus{Name: component.Name, State: stateRunning}
+		if component.Err != nil {
+			status.State = stateFailed
+			status.Error = component.Err.Error()
+		} else if component.Ready != nil && !component.Ready() {
+			status.State = stateStarting
+		}
+		if details && component.Err == nil && component.Status != nil {
+			status.Details = component.Status()
+		}
+		statuses[i] = status
+	}
+	return statuses
+}
+
+func (s *Server) backends(w http.ResponseWriter, r *http.Request) {
+	backends := []log.BackendStats{}
+	if s.Backends != nil {
+		backends = s.Backends()
+	}
+	writeJSON(w, backends)
+}
+
+func (s *Server) config(w http.ResponseWriter, r *http.Request) {
+	cfg := config.Config
+	if cfg.TsuruToken != "" {
+		cfg.TsuruToken = redacted
+	}
+	cfg.TsuruEndpoint = redactURL(cfg.TsuruEndpoint)
+	cfg.TsuruEndpoints = append([]string(nil), cfg.TsuruEndpoints...)
+	for i := range cfg.TsuruEndpoints {
+		cfg.TsuruEndpoints[i] = redactURL(cfg.TsuruEndpoints[i])
+	}
+	writeJSON(w, map[string]interface{}{
+		"config":      cfg,
+		"environment": environment(),
+	})
+}
+
+// environment returns the environment variables configuring bs, with
+// secrets redacted.
+func environment() map[string]string {
+	env := make(map[string]string)
+	for _, entry := range os.Environ() {
+		parts := strings.SplitN(entry, "=", 2)
+		name, value := parts[0], ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		if !hasAnyPrefix(name, envPrefixes) {
+			continue
+		}
+		if isSecretEnv(name) && value != "" {
+			value = redacted
+		} else if hasAnySuffix(name, addressEnvSuffixes) {
+			value = redactAddresses(value)
+		} else {
+			value = redactURL(value)
+		}
+		env[name] = value
+	}
+	return env
+}
+
+func hasAnyPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnySuffix(name string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSecretEnv(name string) bool {
+	return hasAnySuffix(name, secretEnvSuffixes)
+}
+
+// redactAddresses redacts the urls in a comma separated list like redactURL,
+// and the entries that are neither urls nor host:port addresses, like urls
+// missing the scheme, which may hold credentials.
+func redactAddresses(value string) string {
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		trimmed := strings.TrimSpace(part)
+		if trimmed == "" {
+			continue
+		}
+		if strings.Contains(trimmed, "://") {
+			parts[i] = redactURL(part)
+		} else if !isHostPort(trimmed) {
+			parts[i] = redacted
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// isHostPort returns whether value is a host name or ip, optionally followed
+// by a numeric port.
+func isHostPort(value string) bool {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		host, port = value, "0"
+	}
+	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		return false
+	}
+	return hostnameRegexp.MatchString(host) || net.ParseIP(host) != nil
+}
+
+// redactURL redacts the passwords and the values of secret query parameters,
+// like token or api_key, of the URLs in a comma separated list.
+func redactURL(value string) string {
+	if !strings.Contains(value, "://") {
+		return value
+	}
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		u, err := url.Parse(strings.TrimSpace(part))
+		if err != nil || u.Host == "" {
+			continue
+		}
+		changed := false
+		if u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), "xxxxx")
+				changed = true
+			}
+		}
+		if u.RawQuery != "" {
+			params := strings.Split(u.RawQuery, "&")
+			for j, param := range params {
+				kv := strings.SplitN(param, "=", 2)
+				if len(kv) == 2 && kv[1] != "" && isSecretParam(kv[0]) {
+					params[j] = kv[0] + "=xxxxx"
+					changed = true
+				}
+			}
+			u.RawQuery = strings.Join(params, "&")
+		}
+		if changed {
+			parts[i] = u.String()
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// isSecretParam returns whether a query parameter name looks like it holds
+// a secret.
+func isSecretParam(name string) bool {
+	name, err := url.QueryUnescape(name)
+	if err != nil {
+		return true
+	}
+	name = strings.ToLower(name)
+	for _, secret := range secretParams {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(data)
+	if err != nil {
+		bslog.Errorf("[admin] failed to encode response: %s", err)
+	}
+}
@@ -16,6 +16,12 @@ import (
 
 const (
 	DefaultInterval       = 60
+	DefaultStatusDebounce = 1
+	DefaultCrashLoopCount = 3
+	DefaultCrashLoopTime  = 600
+	DefaultZombieCount    = 3
+	DefaultZombieTime     = 300
+	DefaultZombieRemovals = 10
 	DefaultBufferSize     = 1000000
 	DefaultWsPingInterval = 30
 	DefaultDockerEndpoint = "unix:///var/run/docker.sock"
@@ -24,12 +30,22 @@ const (
 var Config struct {
 	DockerEndpoint      string
 	TsuruEndpoint       string
+	TsuruEndpoints      []string
 	TsuruToken          string
 	MetricsInterval     time.Duration
 	MetricsBackend      string
 	StatusInterval      time.Duration
+	StatusDebounce      time.Duration
+	CrashLoopRestarts   int
+	CrashLoopWindow     time.Duration
+	ZombieConfirmations int
+	ZombieGracePeriod   time.Duration
+	ZombieDryRun        bool
+	ZombieProtected     []string
+	ZombieMaxRemovals   int
 	SyslogListenAddress string
 	LogBackends         []string
+	AdminListenAddress  string
 }
 
 func init() {
@@ -40,9 +56,19 @@ func LoadConfig() {
 	bslog.Debug, _ = strconv.ParseBool(os.Getenv("BS_DEBUG"))
 	Config.DockerEndpoint = StringEnvOrDefault(DefaultDockerEndpoint, "DOCKER_ENDPOINT")
 	Config.TsuruEndpoint = os.Getenv("TSURU_ENDPOINT")
+	Config.TsuruEndpoints = StringsEnvOrDefault(nil, "TSURU_ENDPOINT")
 	Config.TsuruToken = os.Getenv("TSURU_TOKEN")
 	Config.SyslogListenAddress = os.Getenv("SYSLOG_LISTEN_ADDRESS")
+	Config.AdminListenAddress = os.Getenv("ADMIN_LISTEN_ADDRESS")
 	Config.StatusInterval = SecondsEnvOrDefault(DefaultInterval, "STATUS_INTERVAL")
+	Config.StatusDebounce = SecondsEnvOrDefault(DefaultStatusDebounce, "STATUS_EVENTS_DEBOUNCE")
+	Config.CrashLoopRestarts = IntEnvOrDefault(DefaultCrashLoopCount, "STATUS_CRASHLOOP_RESTARTS")
+	Config.CrashLoopWindow = SecondsEnvOrDefault(DefaultCrashLoopTime, "STATUS_CRASHLOOP_WINDOW")
+	Config.ZombieConfirmations = IntEnvOrDefault(DefaultZombieCount, "STATUS_ZOMBIE_CONFIRMATIONS")
+	Config.ZombieGracePeriod = SecondsEnvOrDefault(DefaultZombieTime, "STATUS_ZOMBIE_GRACE_PERIOD")
+	Config.ZombieDryRun, _ = strconv.ParseBool(os.Getenv("STATUS_ZOMBIE_DRY_RUN"))
+	Config.ZombieProtected = StringsEnvOrDefault(nil, "STATUS_ZOMBIE_PROTECTED_LABELS")
+	Config.ZombieMaxRemovals = IntEnvOrDefault(DefaultZombieRemovals, "STATUS_ZOMBIE_MAX_REMOVALS")
 	Config.MetricsInterval = SecondsEnvOrDefault(DefaultInterval, "METRICS_INTERVAL")
 	Config.MetricsBackend = os.Getenv("METRICS_BACKEND")
 	Config.LogBackends = StringsEnvOrDefault([]string{"tsuru", "syslog"}, "LOG_BACKENDS")
@@ -25,18 +25,37 @@ type S struct{}
 
 func (S) TestLoadConfig(c *check.C) {
 	os.Setenv("DOCKER_ENDPOINT", "http://192.168.50.4:2375")
-	os.Setenv("TSURU_ENDPOINT", "http://192.168.50.4:8080")
+	os.Setenv("TSURU_ENDPOINT", "http://192.168.50.4:8080, https://tsuru.example.com")
 	os.Setenv("TSURU_TOKEN", "sometoken")
 	os.Setenv("STATUS_INTERVAL", "45")
+	os.Setenv("STATUS_EVENTS_DEBOUNCE", "0.5")
+	os.Setenv("STATUS_CRASHLOOP_RESTARTS", "5")
+	os.Setenv("STATUS_CRASHLOOP_WINDOW", "300")
+	os.Setenv("STATUS_ZOMBIE_CONFIRMATIONS", "5")
+	os.Setenv("STATUS_ZOMBIE_GRACE_PERIOD", "120")
+	os.Setenv("STATUS_ZOMBIE_DRY_RUN", "true")
+	os.Setenv("STATUS_ZOMBIE_PROTECTED_LABELS", "keep, tier=db")
+	os.Setenv("STATUS_ZOMBIE_MAX_REMOVALS", "0")
 	os.Setenv("SYSLOG_LISTEN_ADDRESS", "udp://0.0.0.0:1514")
 	os.Setenv("LOG_BACKENDS", "b1, b2 ")
+	os.Setenv("ADMIN_LISTEN_ADDRESS", "127.0.0.1:8080")
 	LoadConfig()
 	c.Check(Config.DockerEndpoint, check.Equals, "http://192.168.50.4:2375")
-	c.Check(Config.TsuruEndpoint, check.Equals, "http://192.168.50.4:8080")
+	c.Check(Config.TsuruEndpoint, check.Equals, "http://192.168.50.4:8080, https://tsuru.example.com")
+	c.Check(Config.TsuruEndpoints, check.DeepEquals, []string{"http://192.168.50.4:8080", "https://tsuru.example.com"})
 	c.Check(Config.TsuruToken, check.Equals, "sometoken")
 	c.Check(Config.StatusInterval, check.Equals, time.Duration(45e9))
+	c.Check(Config.StatusDebounce, check.Equals, 500*time.Millisecond)
+	c.Check(Config.CrashLoopRestarts, check.Equals, 5)
+	c.Check(Config.CrashLoopWindow, check.Equals, 5*time.Minute)
+	c.Check(Config.ZombieConfirmations, check.Equals, 5)
+	c.Check(Config.ZombieGracePeriod, check.Equals, 2*time.Minute)
+	c.Check(Config.ZombieDryRun, check.Equals, true)
+	c.Check(Config.ZombieProtected, check.DeepEquals, []string{"keep", "tier=db"})
+	c.Check(Config.ZombieMaxRemovals, check.Equals, 0)
 	c.Check(Config.SyslogListenAddress, check.Equals, "udp://0.0.0.0:1514")
 	c.Check(Config.LogBackends, check.DeepEquals, []string{"b1", "b2"})
+	c.Check(Config.AdminListenAddress, check.Equals, "127.0.0.1:8080")
 }
 
 func (S) TestLoadConfigInvalidDuration(c *check.C) {
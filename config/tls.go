@@ -0,0 +1,51 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfigFromEnv builds a tls config from the environment variables
+// <prefix>_CA_FILE, <prefix>_CERT_FILE, <prefix>_KEY_FILE and
+// <prefix>_SERVER_NAME.
+func TLSConfigFromEnv(prefix string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: StringEnvOrDefault("", prefix+"_SERVER_NAME"),
+	}
+	if caFile := StringEnvOrDefault("", prefix+"_CA_FILE"); caFile != "" {
+		caData, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read tls ca file: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("unable to read tls ca file: no certificates found in %q", caFile)
+		}
+	}
+	certFile := StringEnvOrDefault("", prefix+"_CERT_FILE")
+	keyFile := StringEnvOrDefault("", prefix+"_KEY_FILE")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load tls client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// TLSConfigForHost returns a copy of tlsConfig using host as server name,
+// unless one is already set.
+func TLSConfigForHost(tlsConfig *tls.Config, host string) *tls.Config {
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	return tlsConfig
+}
@@ -9,18 +9,50 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/hashicorp/golang-lru"
+	"github.com/tsuru/bs/config"
+	"github.com/tsuru/bs/telemetry"
 )
 
 var ErrTsuruVariablesNotFound = errors.New("could not find wanted envs")
 
+var (
+	apiCallDuration = telemetry.NewHistogramVec("bs_container_api_call_duration_seconds",
+		"Duration of the container runtime API calls made by bs.", nil, "call")
+	apiCallErrors = telemetry.NewCounterVec("bs_container_api_call_errors_total",
+		"Container runtime API calls that failed, missing containers aren't counted.", "call")
+)
+
 type InfoClient struct {
-	endpoint       string
-	client         *docker.Client
+	runtime        Runtime
 	containerCache *lru.Cache
+	negativeCache  *lru.Cache
+	negativeTTL    time.Duration
+	inflightMu     sync.Mutex
+	inflight       map[string]*inspectCall
+	eventsMu       sync.Mutex
+	eventsQuit     chan struct{}
+	eventsDone     chan struct{}
+	handlersMu     sync.RWMutex
+	eventHandlers  []func(*docker.APIEvents)
+}
+
+// inspectCall is an inspect in progress, shared by concurrent lookups of the
+// same container.
+type inspectCall struct {
+	wg   sync.WaitGroup
+	cont *Container
+	err  error
+}
+
+// negativeEntry is a failed lookup, returned until it expires.
+type negativeEntry struct {
+	err     error
+	expires time.Time
 }
 
 type Container struct {
@@ -28,11 +60,18 @@ type Container struct {
 	client      *InfoClient
 	AppName     string
 	ProcessName string
+	// Health is the state of the container health check, nil if the
+	// container has no health check or the runtime doesn't support them.
+	Health *Health
 }
 
 const (
 	dialTimeout = 10 * time.Second
 	fullTimeout = 1 * time.Minute
+
+	defaultCacheSize   = 100
+	defaultNegativeTTL = 30
+	shortIDSize        = 12
 )
 
 var (
@@ -49,29 +88,75 @@ var (
 	}
 )
 
+// NewClient creates a client for the runtime selected by CONTAINER_RUNTIME,
+// using endpoint for docker, see NewRuntime.
 func NewClient(endpoint string) (*InfoClient, error) {
-	c := InfoClient{endpoint: endpoint}
+	runtime, err := NewRuntime(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithRuntime(runtime)
+}
+
+// NewClientWithRuntime creates a client caching up to CONTAINER_CACHE_SIZE
+// containers and, for CONTAINER_CACHE_NEGATIVE_TTL seconds, containers not
+// found.
+func NewClientWithRuntime(runtime Runtime) (*InfoClient, error) {
+	c := InfoClient{
+		runtime:     runtime,
+		negativeTTL: config.SecondsEnvOrDefault(defaultNegativeTTL, "CONTAINER_CACHE_NEGATIVE_TTL"),
+		inflight:    make(map[string]*inspectCall),
+	}
+	size := config.IntEnvOrDefault(defaultCacheSize, "CONTAINER_CACHE_SIZE")
+	if size <= 0 {
+		size = defaultCacheSize
+	}
 	var err error
-	c.containerCache, err = lru.New(100)
+	c.containerCache, err = lru.New(size)
 	if err != nil {
 		return nil, err
 	}
-	c.client, err = docker.NewClient(endpoint)
+	c.negativeCache, err = lru.New(size)
 	if err != nil {
 		return nil, err
 	}
-	c.client.HTTPClient = timeoutHttpClient
-	c.client.Dialer = timeoutDialer
-	c.client.SetTimeout(timeoutHttpClient.Timeout)
 	return &c, nil
 }
 
-func (c *InfoClient) GetClient() *docker.Client {
-	return c.client
+func (c *InfoClient) Runtime() Runtime {
+	return c.runtime
 }
 
 func (c *InfoClient) ListContainers() ([]docker.APIContainers, error) {
-	return c.client.ListContainers(docker.ListContainersOptions{})
+	start := time.Now()
+	containers, err := c.runtime.ListContainers(false)
+	observeCall("list", start, err)
+	return containers, err
+}
+
+// ListAllContainers lists every container, including the stopped ones.
+func (c *InfoClient) ListAllContainers() ([]docker.APIContainers, error) {
+	start := time.Now()
+	containers, err := c.runtime.ListContainers(true)
+	observeCall("list_all", start, err)
+	return containers, err
+}
+
+// CreateContainer creates a container, without starting it, returning its
+// id.
+func (c *InfoClient) CreateContainer(opts CreateOptions) (string, error) {
+	start := time.Now()
+	id, err := c.runtime.CreateContainer(opts)
+	observeCall("create", start, err)
+	return id, err
+}
+
+// RemoveContainer removes the container, killing it if it's running.
+func (c *InfoClient) RemoveContainer(id string) error {
+	start := time.Now()
+	err := c.runtime.RemoveContainer(id)
+	observeCall("remove", start, err)
+	return err
 }
 
 // GetContainer returns the container with the provided id if the container has the required
@@ -101,12 +186,58 @@ func (c *InfoClient) getContainer(containerId string, useCache bool) (*Container
 		if val, ok := c.containerCache.Get(containerId); ok {
 			return val.(*Container), nil
 		}
+		if val, ok := c.negativeCache.Get(containerId); ok {
+			entry := val.(negativeEntry)
+			if time.Now().Before(entry.expires) {
+				return nil, entry.err
+			}
+			c.negativeCache.Remove(containerId)
+		}
+	}
+	return c.inspect(containerId)
+}
+
+// inspect inspects the container and updates the cache, concurrent calls for
+// the same container share a single call to the docker api.
+func (c *InfoClient) inspect(containerId string) (*Container, error) {
+	c.inflightMu.Lock()
+	if call, ok := c.inflight[containerId]; ok {
+		c.inflightMu.Unlock()
+		call.wg.Wait()
+		return call.cont, call.err
+	}
+	call := &inspectCall{}
+	call.wg.Add(1)
+	c.inflight[containerId] = call
+	c.inflightMu.Unlock()
+	call.cont, call.err = c.inspectContainer(containerId)
+	c.inflightMu.Lock()
+	delete(c.inflight, containerId)
+	c.inflightMu.Unlock()
+	call.wg.Done()
+	return call.cont, call.err
+}
+
+func (c *InfoClient) inspectContainer(containerId string) (*Container, error) {
+	var (
+		cont   *docker.Container
+		health *Health
+		err    error
+	)
+	start := time.Now()
+	if healthRuntime, ok := c.runtime.(HealthRuntime); ok {
+		cont, health, err = healthRuntime.InspectContainerHealth(containerId)
+	} else {
+		cont, err = c.runtime.InspectContainer(containerId)
 	}
-	cont, err := c.client.InspectContainer(containerId)
+	observeCall("inspect", start, err)
 	if err != nil {
+		if _, ok := err.(*docker.NoSuchContainer); ok && c.negativeTTL > 0 {
+			c.negativeCache.Add(containerId, negativeEntry{err: err, expires: time.Now().Add(c.negativeTTL)})
+		}
 		return nil, err
 	}
-	contData := Container{Container: *cont, client: c}
+	contData := Container{Container: *cont, client: c, Health: health}
 	toFill := map[string]*string{
 		"TSURU_APPNAME=":     &contData.AppName,
 		"TSURU_PROCESSNAME=": &contData.ProcessName,
@@ -118,31 +249,27 @@ func (c *InfoClient) getContainer(containerId string, useCache bool) (*Container
 			}
 		}
 	}
+	c.negativeCache.Remove(containerId)
 	c.containerCache.Add(containerId, &contData)
 	return &contData, nil
 }
 
 func (c *Container) Stats() (*docker.Stats, error) {
-	statsCh := make(chan *docker.Stats, 1)
-	errCh := make(chan error, 1)
-	opts := docker.StatsOptions{
-		ID:      c.ID,
-		Stream:  false,
-		Stats:   statsCh,
-		Timeout: 10 * time.Second,
-	}
-	go func() {
-		defer close(errCh)
-		err := c.client.client.Stats(opts)
-		if err != nil {
-			errCh <- err
-		}
-	}()
-	err := <-errCh
-	if err != nil {
-		return nil, err
+	start := time.Now()
+	stats, err := c.client.runtime.Stats(c.ID)
+	observeCall("stats", start, err)
+	return stats, err
+}
+
+// observeCall records the duration and the error of a runtime API call.
+func observeCall(call string, start time.Time, err error) {
+	apiCallDuration.With(call).Observe(time.Since(start).Seconds())
+	if err == nil {
+		return
+	}
+	if _, ok := err.(*docker.NoSuchContainer); !ok {
+		apiCallErrors.With(call).Inc()
 	}
-	return <-statsCh, nil
 }
 
 // HasEnvs checks if the container has the requiredEnvs variables set
@@ -5,12 +5,20 @@
 package container
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 	dTesting "github.com/fsouza/go-dockerclient/testing"
+	"github.com/tsuru/bs/telemetry"
 	"gopkg.in/check.v1"
 )
 
@@ -137,3 +145,135 @@ func (S) TestContainerHasEnvs(c *check.C) {
 	c.Assert(cont.HasEnvs([]string{"ENV"}), check.Equals, false)
 	c.Assert(cont.HasEnvs([]string{"TSURU_APPNAME", "ENV"}), check.Equals, false)
 }
+
+func (S) TestInfoClientGetContainerNegativeCache(c *check.C) {
+	os.Setenv("CONTAINER_CACHE_NEGATIVE_TTL", "0.2")
+	defer os.Unsetenv("CONTAINER_CACHE_NEGATIVE_TTL")
+	var dockerCalls int32
+	dockerServer, err := dTesting.NewServer("127.0.0.1:0", nil, func(req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/json") {
+			atomic.AddInt32(&dockerCalls, 1)
+		}
+	})
+	c.Assert(err, check.IsNil)
+	client, err := NewClient(dockerServer.URL())
+	c.Assert(err, check.IsNil)
+	for i := 0; i < 2; i++ {
+		_, err = client.GetContainer("xxxxxx", true, nil)
+		c.Assert(err, check.ErrorMatches, "No such container: xxxxxx")
+	}
+	c.Assert(atomic.LoadInt32(&dockerCalls), check.Equals, int32(1))
+	time.Sleep(300 * time.Millisecond)
+	_, err = client.GetContainer("xxxxxx", true, nil)
+	c.Assert(err, check.ErrorMatches, "No such container: xxxxxx")
+	c.Assert(atomic.LoadInt32(&dockerCalls), check.Equals, int32(2))
+	_, err = client.GetContainer("xxxxxx", false, nil)
+	c.Assert(err, check.ErrorMatches, "No such container: xxxxxx")
+	c.Assert(atomic.LoadInt32(&dockerCalls), check.Equals, int32(3))
+}
+
+func (S) TestInfoClientGetContainerConcurrentInspect(c *check.C) {
+	dockerServer, err := dTesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	var dockerCalls int32
+	dockerServer.CustomHandler("/containers/.*/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&dockerCalls, 1)
+		time.Sleep(100 * time.Millisecond)
+		dockerServer.DefaultHandler().ServeHTTP(w, r)
+	}))
+	id := createContainer(c, dockerServer.URL(), []string{"TSURU_APPNAME=coolappname"}, "myContName")
+	client, err := NewClient(dockerServer.URL())
+	c.Assert(err, check.IsNil)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cont, err := client.GetAppContainer(id, true)
+			c.Check(err, check.IsNil)
+			c.Check(cont.AppName, check.Equals, "coolappname")
+		}()
+	}
+	wg.Wait()
+	c.Assert(atomic.LoadInt32(&dockerCalls), check.Equals, int32(1))
+}
+
+func (S) TestInfoClientCacheSize(c *check.C) {
+	os.Setenv("CONTAINER_CACHE_SIZE", "1")
+	defer os.Unsetenv("CONTAINER_CACHE_SIZE")
+	dockerServer, err := dTesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	id1 := createContainer(c, dockerServer.URL(), nil, "cont1")
+	id2 := createContainer(c, dockerServer.URL(), nil, "cont2")
+	client, err := NewClient(dockerServer.URL())
+	c.Assert(err, check.IsNil)
+	_, err = client.GetContainer(id1, true, nil)
+	c.Assert(err, check.IsNil)
+	_, err = client.GetContainer(id2, true, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(client.containerCache.Keys(), check.DeepEquals, []interface{}{id2})
+}
+
+func (S) TestInfoClientWatchEvents(c *check.C) {
+	dockerServer, err := dTesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	eventsCh := make(chan string, 10)
+	queries := make(chan string, 10)
+	dockerServer.CustomHandler("/events", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.RawQuery
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event, ok := <-eventsCh:
+				if !ok {
+					return
+				}
+				if event == "" {
+					return
+				}
+				fmt.Fprintln(w, event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	id := createContainer(c, dockerServer.URL(), []string{"TSURU_APPNAME=coolappname"}, "myContName")
+	shortID := id[:12]
+	eventsRetryInterval = 10 * time.Millisecond
+	defer func() { eventsRetryInterval = 5 * time.Second }()
+	client, err := NewClient(dockerServer.URL())
+	c.Assert(err, check.IsNil)
+	client.WatchEvents()
+	defer client.Close()
+	c.Assert(<-queries, check.Equals, `filters=%7B%22type%22%3A%5B%22container%22%5D%7D`)
+	waitCache := func(key string, cached bool) {
+		for i := 0; i < 100 && client.containerCache.Contains(key) != cached; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Assert(client.containerCache.Contains(key), check.Equals, cached)
+	}
+	eventsCh <- fmt.Sprintf(`{"Type": "container", "Action": "create", "Actor": {"ID": "%s"}, "time": 10}`, id)
+	waitCache(shortID, true)
+	cont, err := client.GetAppContainer(shortID, true)
+	c.Assert(err, check.IsNil)
+	c.Assert(cont.AppName, check.Equals, "coolappname")
+	eventsCh <- ""
+	c.Assert(<-queries, check.Matches, `.*since=10`)
+	c.Assert(client.containerCache.Contains(id), check.Equals, true)
+	eventsCh <- fmt.Sprintf(`{"status": "destroy", "id": "%s", "time": 11}`, id)
+	waitCache(shortID, false)
+	waitCache(id, false)
+}
+
+func (S) TestObserveCall(c *check.C) {
+	observeCall("test", time.Now(), nil)
+	observeCall("test", time.Now(), errors.New("connection refused"))
+	observeCall("test", time.Now(), &docker.NoSuchContainer{ID: "abc"})
+	var buf bytes.Buffer
+	err := telemetry.Default.Write(&buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s).*bs_container_api_call_duration_seconds_count\{call="test"\} 3\n.*`)
+	c.Assert(buf.String(), check.Matches, `(?s).*bs_container_api_call_errors_total\{call="test"\} 1\n.*`)
+}
@@ -0,0 +1,203 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package containertest provides an in-memory container runtime for tests.
+package containertest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/bs/container"
+)
+
+var (
+	_ container.Runtime       = &FakeRuntime{}
+	_ container.HealthRuntime = &FakeRuntime{}
+)
+
+// FakeRuntime is a container.Runtime keeping containers in memory. Events
+// sent with SendEvent are delivered to the current Events call.
+type FakeRuntime struct {
+	mu         sync.Mutex
+	containers map[string]*docker.Container
+	stats      map[string]*docker.Stats
+	health     map[string]*container.Health
+	events     chan *docker.APIEvents
+	nextID     int
+	// Removed records the ids of removed containers, in order.
+	Removed []string
+}
+
+func NewFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{
+		containers: make(map[string]*docker.Container),
+		stats:      make(map[string]*docker.Stats),
+		health:     make(map[string]*container.Health),
+		events:     make(chan *docker.APIEvents),
+	}
+}
+
+// AddContainer adds the container to the runtime, generating its id if
+// empty, and returns the id.
+func (r *FakeRuntime) AddContainer(cont docker.Container) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cont.ID == "" {
+		r.nextID++
+		cont.ID = fmt.Sprintf("%064x", r.nextID)
+	}
+	if cont.Config == nil {
+		cont.Config = &docker.Config{}
+	}
+	r.containers[cont.ID] = &cont
+	return cont.ID
+}
+
+// SetStats sets the stats returned for the container.
+func (r *FakeRuntime) SetStats(id string, stats *docker.Stats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats[id] = stats
+}
+
+// SetHealth sets the health check state of the container.
+func (r *FakeRuntime) SetHealth(id string, health *container.Health) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.health[id] = health
+}
+
+// UpdateContainer calls update with the container, to change its state.
+func (r *FakeRuntime) UpdateContainer(id string, update func(*docker.Container)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cont := r.find(id); cont != nil {
+		update(cont)
+	}
+}
+
+// SendEvent blocks until the event is delivered to an Events handler.
+func (r *FakeRuntime) SendEvent(event *docker.APIEvents) {
+	r.events <- event
+}
+
+func (r *FakeRuntime) find(id string) *docker.Container {
+	if cont, ok := r.containers[id]; ok {
+		return cont
+	}
+	for _, cont := range r.containers {
+		if strings.TrimPrefix(cont.Name, "/") == strings.TrimPrefix(id, "/") {
+			return cont
+		}
+	}
+	return nil
+}
+
+func (r *FakeRuntime) ListContainers(all bool) ([]docker.APIContainers, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var result []docker.APIContainers
+	for _, cont := range r.containers {
+		if !all && !cont.State.Running {
+			continue
+		}
+		result = append(result, docker.APIContainers{
+			ID:      cont.ID,
+			Names:   []string{cont.Name},
+			Image:   cont.Config.Image,
+			State:   cont.State.StateString(),
+			Created: cont.Created.Unix(),
+			Labels:  cont.Config.Labels,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+func (r *FakeRuntime) InspectContainer(id string) (*docker.Container, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cont := r.find(id)
+	if cont == nil {
+		return nil, &docker.NoSuchContainer{ID: id}
+	}
+	result := *cont
+	return &result, nil
+}
+
+func (r *FakeRuntime) InspectContainerHealth(id string) (*docker.Container, *container.Health, error) {
+	cont, err := r.InspectContainer(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return cont, r.health[cont.ID], nil
+}
+
+func (r *FakeRuntime) Stats(id string) (*docker.Stats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cont := r.find(id)
+	if cont == nil {
+		return nil, &docker.NoSuchContainer{ID: id}
+	}
+	if stats, ok := r.stats[cont.ID]; ok {
+		return stats, nil
+	}
+	return &docker.Stats{Read: time.Now()}, nil
+}
+
+func (r *FakeRuntime) Events(ctx context.Context, since int64, handler func(*docker.APIEvents)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event := <-r.events:
+			handler(event)
+		}
+	}
+}
+
+func (r *FakeRuntime) CreateContainer(opts container.CreateOptions) (string, error) {
+	r.mu.Lock()
+	if r.find(opts.Name) != nil {
+		r.mu.Unlock()
+		return "", docker.ErrContainerAlreadyExists
+	}
+	r.mu.Unlock()
+	config := docker.Config{Cmd: opts.Cmd}
+	if opts.Base != nil && opts.Base.Config != nil {
+		config.Image = opts.Base.Config.Image
+	}
+	return r.AddContainer(docker.Container{
+		Name:    "/" + strings.TrimPrefix(opts.Name, "/"),
+		Created: time.Now(),
+		Config:  &config,
+	}), nil
+}
+
+// RemoveContainer removes the container with the given ID, names are not
+// accepted, like in the CRI runtime.
+func (r *FakeRuntime) RemoveContainer(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cont := r.containers[id]
+	if cont == nil {
+		return &docker.NoSuchContainer{ID: id}
+	}
+	delete(r.containers, cont.ID)
+	delete(r.stats, cont.ID)
+	delete(r.health, cont.ID)
+	r.Removed = append(r.Removed, cont.ID)
+	return nil
+}
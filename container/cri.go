@@ -0,0 +1,311 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	goruntime "runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// criMaxMessageSize is the maximum size of the messages received from the
+// runtime, the same used by the kubelet.
+const criMaxMessageSize = 16 << 20
+
+var (
+	criStates = map[runtimeapi.ContainerState]string{
+		runtimeapi.ContainerState_CONTAINER_CREATED: "created",
+		runtimeapi.ContainerState_CONTAINER_RUNNING: "running",
+		runtimeapi.ContainerState_CONTAINER_EXITED:  "exited",
+	}
+	criEventActions = map[runtimeapi.ContainerEventType]string{
+		runtimeapi.ContainerEventType_CONTAINER_CREATED_EVENT: "create",
+		runtimeapi.ContainerEventType_CONTAINER_STARTED_EVENT: "start",
+		runtimeapi.ContainerEventType_CONTAINER_STOPPED_EVENT: "die",
+		runtimeapi.ContainerEventType_CONTAINER_DELETED_EVENT: "destroy",
+	}
+)
+
+// CRIRuntime is a runtime implementing the kubernetes container runtime
+// interface, like containerd, accessed through its gRPC socket.
+type CRIRuntime struct {
+	client runtimeapi.RuntimeServiceClient
+	mu     sync.Mutex
+	// cpuSamples are the last cpu usage of each container, used to
+	// calculate the usage between calls to Stats like docker does.
+	cpuSamples map[string]criCPUSample
+}
+
+type criCPUSample struct {
+	usage     uint64
+	timestamp int64
+}
+
+// criInfo is the verbose information returned by containerd for a container.
+type criInfo struct {
+	SandboxID   string `json:"sandboxID"`
+	RuntimeSpec struct {
+		Hostname string `json:"hostname"`
+		Process  struct {
+			Env []string `json:"env"`
+		} `json:"process"`
+	} `json:"runtimeSpec"`
+}
+
+// NewCRIRuntime creates a runtime for the unix or tcp endpoint, connecting
+// lazily on the first call.
+func NewCRIRuntime(endpoint string) (*CRIRuntime, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	network, addr, authority := "tcp", u.Host, u.Host
+	switch u.Scheme {
+	case "unix":
+		network, addr, authority = "unix", u.Path, "localhost"
+	case "tcp", "http":
+	default:
+		return nil, fmt.Errorf("invalid CRI endpoint %q, expected unix or tcp url", endpoint)
+	}
+	conn, err := grpc.NewClient("passthrough:///"+addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithAuthority(authority),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return timeoutDialer.DialContext(ctx, network, addr)
+		}),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(criMaxMessageSize)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &CRIRuntime{
+		client:     runtimeapi.NewRuntimeServiceClient(conn),
+		cpuSamples: make(map[string]criCPUSample),
+	}, nil
+}
+
+// containerError converts not found errors to *docker.NoSuchContainer.
+func containerError(id string, err error) error {
+	if status.Code(err) == codes.NotFound {
+		return &docker.NoSuchContainer{ID: id}
+	}
+	return err
+}
+
+func (r *CRIRuntime) ListContainers(all bool) ([]docker.APIContainers, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fullTimeout)
+	defer cancel()
+	response, err := r.client.ListContainers(ctx, &runtimeapi.ListContainersRequest{})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]docker.APIContainers, 0, len(response.Containers))
+	for _, cont := range response.Containers {
+		if !all && cont.State != runtimeapi.ContainerState_CONTAINER_RUNNING {
+			continue
+		}
+		result = append(result, docker.APIContainers{
+			ID:      cont.Id,
+			Names:   []string{"/" + cont.GetMetadata().GetName()},
+			Image:   cont.GetImage().GetImage(),
+			State:   criStates[cont.State],
+			Created: time.Unix(0, cont.CreatedAt).Unix(),
+			Labels:  cont.Labels,
+		})
+	}
+	return result, nil
+}
+
+// containerStatus returns the container status and its verbose information.
+func (r *CRIRuntime) containerStatus(id string) (*runtimeapi.ContainerStatus, criInfo, error) {
+	var info criInfo
+	ctx, cancel := context.WithTimeout(context.Background(), fullTimeout)
+	defer cancel()
+	response, err := r.client.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{ContainerId: id, Verbose: true})
+	if err != nil {
+		return nil, info, containerError(id, err)
+	}
+	if response.Status == nil {
+		return nil, info, &docker.NoSuchContainer{ID: id}
+	}
+	if data := response.Info["info"]; data != "" {
+		if err = json.Unmarshal([]byte(data), &info); err != nil {
+			return nil, info, fmt.Errorf("unable to parse info of container %s: %s", id, err)
+		}
+	}
+	return response.Status, info, nil
+}
+
+func (r *CRIRuntime) InspectContainer(id string) (*docker.Container, error) {
+	status, info, err := r.containerStatus(id)
+	if err != nil {
+		return nil, err
+	}
+	return criContainer(status, info), nil
+}
+
+func criContainer(status *runtimeapi.ContainerStatus, info criInfo) *docker.Container {
+	cont := &docker.Container{
+		ID:      status.Id,
+		Name:    "/" + status.GetMetadata().GetName(),
+		Created: time.Unix(0, status.CreatedAt),
+		Image:   status.ImageRef,
+		State: docker.State{
+			Status:    criStates[status.State],
+			Running:   status.State == runtimeapi.ContainerState_CONTAINER_RUNNING,
+			ExitCode:  int(status.ExitCode),
+			Error:     status.Message,
+			OOMKilled: status.Reason == "OOMKilled",
+		},
+		Config: &docker.Config{
+			Image:    status.GetImage().GetImage(),
+			Labels:   status.Labels,
+			Env:      info.RuntimeSpec.Process.Env,
+			Hostname: info.RuntimeSpec.Hostname,
+		},
+		HostConfig: &docker.HostConfig{
+			Memory: status.GetResources().GetLinux().GetMemoryLimitInBytes(),
+		},
+	}
+	if status.StartedAt > 0 {
+		cont.State.StartedAt = time.Unix(0, status.StartedAt)
+	}
+	if status.FinishedAt > 0 {
+		cont.State.FinishedAt = time.Unix(0, status.FinishedAt)
+	}
+	return cont
+}
+
+// Stats returns the cpu and memory usage of the container, the network usage
+// is only available for pods in CRI. The previous cpu usage is the one from
+// the last call, as CRI runtimes only return the total usage.
+func (r *CRIRuntime) Stats(id string) (*docker.Stats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fullTimeout)
+	defer cancel()
+	response, err := r.client.ContainerStats(ctx, &runtimeapi.ContainerStatsRequest{ContainerId: id})
+	if err != nil {
+		return nil, containerError(id, err)
+	}
+	cpu, memory := response.GetStats().GetCpu(), response.GetStats().GetMemory()
+	sample := criCPUSample{usage: cpu.GetUsageCoreNanoSeconds().GetValue(), timestamp: cpu.GetTimestamp()}
+	result := &docker.Stats{Read: time.Unix(0, sample.timestamp)}
+	ncpu := goruntime.NumCPU()
+	setCPUStats := func(cpuStats *docker.CPUStats, sample criCPUSample) {
+		cpuStats.CPUUsage.TotalUsage = sample.usage
+		cpuStats.CPUUsage.PercpuUsage = make([]uint64, ncpu)
+		cpuStats.SystemCPUUsage = uint64(sample.timestamp) * uint64(ncpu)
+	}
+	setCPUStats(&result.CPUStats, sample)
+	r.mu.Lock()
+	previous, ok := r.cpuSamples[id]
+	r.cpuSamples[id] = sample
+	r.mu.Unlock()
+	if ok {
+		setCPUStats(&result.PreCPUStats, previous)
+	}
+	result.MemoryStats.Usage = memory.GetWorkingSetBytes().GetValue()
+	status, _, err := r.containerStatus(id)
+	if err == nil {
+		result.MemoryStats.Limit = uint64(status.GetResources().GetLinux().GetMemoryLimitInBytes())
+	}
+	return result, nil
+}
+
+func (r *CRIRuntime) Events(ctx context.Context, since int64, handler func(*docker.APIEvents)) error {
+	start := time.Now()
+	stream, err := r.client.GetContainerEvents(ctx, &runtimeapi.GetEventsRequest{})
+	observeCall("events", start, err)
+	if err != nil {
+		return err
+	}
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		action, ok := criEventActions[event.ContainerEventType]
+		if !ok {
+			continue
+		}
+		id := event.ContainerId
+		apiEvent := &docker.APIEvents{
+			Type:     "container",
+			Action:   action,
+			Status:   action,
+			ID:       id,
+			Time:     time.Unix(0, event.CreatedAt).Unix(),
+			TimeNano: event.CreatedAt,
+			Actor:    docker.APIActor{ID: id},
+		}
+		for _, status := range event.ContainersStatuses {
+			if status.Id == id {
+				apiEvent.Actor.Attributes = map[string]string{"name": status.GetMetadata().GetName()}
+			}
+		}
+		handler(apiEvent)
+	}
+}
+
+// CreateContainer creates a container in the pod sandbox of the base
+// container.
+func (r *CRIRuntime) CreateContainer(opts CreateOptions) (string, error) {
+	_, info, err := r.containerStatus(opts.Base.ID)
+	if err != nil {
+		return "", err
+	}
+	if info.SandboxID == "" {
+		return "", fmt.Errorf("unable to find the pod sandbox of container %s", opts.Base.ID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fullTimeout)
+	defer cancel()
+	sandbox, err := r.client.PodSandboxStatus(ctx, &runtimeapi.PodSandboxStatusRequest{PodSandboxId: info.SandboxID})
+	if err != nil {
+		return "", err
+	}
+	image := opts.Base.Image
+	if image == "" {
+		image = opts.Base.Config.Image
+	}
+	response, err := r.client.CreateContainer(ctx, &runtimeapi.CreateContainerRequest{
+		PodSandboxId: info.SandboxID,
+		Config: &runtimeapi.ContainerConfig{
+			Metadata: &runtimeapi.ContainerMetadata{Name: strings.TrimPrefix(opts.Name, "/")},
+			Image:    &runtimeapi.ImageSpec{Image: image},
+			Command:  opts.Cmd,
+		},
+		SandboxConfig: &runtimeapi.PodSandboxConfig{Metadata: sandbox.GetStatus().GetMetadata()},
+	})
+	if err != nil {
+		return "", err
+	}
+	return response.ContainerId, nil
+}
+
+func (r *CRIRuntime) RemoveContainer(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), fullTimeout)
+	defer cancel()
+	_, err := r.client.RemoveContainer(ctx, &runtimeapi.RemoveContainerRequest{ContainerId: id})
+	r.mu.Lock()
+	delete(r.cpuSamples, id)
+	r.mu.Unlock()
+	return containerError(id, err)
+}
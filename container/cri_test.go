@@ -0,0 +1,347 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package container
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/check.v1"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// fakeCRIServer is a CRI runtime service listening on a unix socket, serving
+// the configured containers and recording the requests.
+type fakeCRIServer struct {
+	runtimeapi.UnimplementedRuntimeServiceServer
+	server         *grpc.Server
+	dir            string
+	endpoint       string
+	mu             sync.Mutex
+	containers     []*runtimeapi.Container
+	statuses       map[string]*runtimeapi.ContainerStatusResponse
+	stats          []*runtimeapi.ContainerStats
+	sandboxes      map[string]*runtimeapi.PodSandboxStatus
+	events         []*runtimeapi.ContainerEventResponse
+	created        map[string]bool
+	statusRequests []*runtimeapi.ContainerStatusRequest
+	createRequests []*runtimeapi.CreateContainerRequest
+}
+
+func newFakeCRIServer(c *check.C) *fakeCRIServer {
+	dir, err := ioutil.TempDir("", "cri")
+	c.Assert(err, check.IsNil)
+	path := filepath.Join(dir, "cri.sock")
+	listener, err := net.Listen("unix", path)
+	c.Assert(err, check.IsNil)
+	s := &fakeCRIServer{
+		server:    grpc.NewServer(),
+		dir:       dir,
+		endpoint:  "unix://" + path,
+		statuses:  make(map[string]*runtimeapi.ContainerStatusResponse),
+		sandboxes: make(map[string]*runtimeapi.PodSandboxStatus),
+		created:   make(map[string]bool),
+	}
+	runtimeapi.RegisterRuntimeServiceServer(s.server, s)
+	go s.server.Serve(listener)
+	return s
+}
+
+func (s *fakeCRIServer) stop() {
+	s.server.Stop()
+	os.RemoveAll(s.dir)
+}
+
+func (s *fakeCRIServer) ListContainers(ctx context.Context, req *runtimeapi.ListContainersRequest) (*runtimeapi.ListContainersResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &runtimeapi.ListContainersResponse{Containers: s.containers}, nil
+}
+
+func (s *fakeCRIServer) ContainerStatus(ctx context.Context, req *runtimeapi.ContainerStatusRequest) (*runtimeapi.ContainerStatusResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statusRequests = append(s.statusRequests, req)
+	response, ok := s.statuses[req.ContainerId]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "container %s not found", req.ContainerId)
+	}
+	return response, nil
+}
+
+func (s *fakeCRIServer) ContainerStats(ctx context.Context, req *runtimeapi.ContainerStatsRequest) (*runtimeapi.ContainerStatsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.stats) == 0 {
+		return nil, status.Errorf(codes.NotFound, "container %s not found", req.ContainerId)
+	}
+	stats := s.stats[0]
+	s.stats = s.stats[1:]
+	return &runtimeapi.ContainerStatsResponse{Stats: stats}, nil
+}
+
+func (s *fakeCRIServer) PodSandboxStatus(ctx context.Context, req *runtimeapi.PodSandboxStatusRequest) (*runtimeapi.PodSandboxStatusResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sandbox, ok := s.sandboxes[req.PodSandboxId]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "sandbox %s not found", req.PodSandboxId)
+	}
+	return &runtimeapi.PodSandboxStatusResponse{Status: sandbox}, nil
+}
+
+func (s *fakeCRIServer) CreateContainer(ctx context.Context, req *runtimeapi.CreateContainerRequest) (*runtimeapi.CreateContainerResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.createRequests = append(s.createRequests, req)
+	s.created["newid"] = true
+	return &runtimeapi.CreateContainerResponse{ContainerId: "newid"}, nil
+}
+
+func (s *fakeCRIServer) RemoveContainer(ctx context.Context, req *runtimeapi.RemoveContainerRequest) (*runtimeapi.RemoveContainerResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.created[req.ContainerId] {
+		return nil, status.Errorf(codes.NotFound, "container %s not found", req.ContainerId)
+	}
+	delete(s.created, req.ContainerId)
+	return &runtimeapi.RemoveContainerResponse{}, nil
+}
+
+func (s *fakeCRIServer) GetContainerEvents(req *runtimeapi.GetEventsRequest, stream runtimeapi.RuntimeService_GetContainerEventsServer) error {
+	s.mu.Lock()
+	events := s.events
+	s.mu.Unlock()
+	for _, event := range events {
+		if err := stream.Send(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (S) TestNewRuntime(c *check.C) {
+	defer os.Unsetenv("CONTAINER_RUNTIME")
+	defer os.Unsetenv("CRI_ENDPOINT")
+	r, err := NewRuntime("http://localhost:2375")
+	c.Assert(err, check.IsNil)
+	c.Assert(r, check.FitsTypeOf, &DockerRuntime{})
+	os.Setenv("CONTAINER_RUNTIME", "cri")
+	os.Setenv("CRI_ENDPOINT", "unix:///tmp/cri.sock")
+	r, err = NewRuntime("http://localhost:2375")
+	c.Assert(err, check.IsNil)
+	c.Assert(r, check.FitsTypeOf, &CRIRuntime{})
+	os.Setenv("CRI_ENDPOINT", "ftp://localhost")
+	_, err = NewRuntime("http://localhost:2375")
+	c.Assert(err, check.ErrorMatches, `invalid CRI endpoint "ftp://localhost", expected unix or tcp url`)
+	os.Setenv("CONTAINER_RUNTIME", "rkt")
+	_, err = NewRuntime("http://localhost:2375")
+	c.Assert(err, check.ErrorMatches, `invalid container runtime "rkt", expected docker or cri`)
+}
+
+func (S) TestCRIRuntimeListContainers(c *check.C) {
+	server := newFakeCRIServer(c)
+	defer server.stop()
+	createdAt := time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+	server.containers = []*runtimeapi.Container{
+		{
+			Id:        "id1",
+			Metadata:  &runtimeapi.ContainerMetadata{Name: "app1"},
+			Image:     &runtimeapi.ImageSpec{Image: "tsuru/python"},
+			State:     runtimeapi.ContainerState_CONTAINER_RUNNING,
+			CreatedAt: createdAt.UnixNano(),
+			Labels:    map[string]string{"app": "myapp"},
+		},
+		{
+			Id:       "id2",
+			Metadata: &runtimeapi.ContainerMetadata{Name: "app2"},
+			State:    runtimeapi.ContainerState_CONTAINER_EXITED,
+		},
+	}
+	r, err := NewCRIRuntime(server.endpoint)
+	c.Assert(err, check.IsNil)
+	containers, err := r.ListContainers(false)
+	c.Assert(err, check.IsNil)
+	c.Assert(containers, check.DeepEquals, []docker.APIContainers{
+		{
+			ID:      "id1",
+			Names:   []string{"/app1"},
+			Image:   "tsuru/python",
+			State:   "running",
+			Created: createdAt.Unix(),
+			Labels:  map[string]string{"app": "myapp"},
+		},
+	})
+	containers, err = r.ListContainers(true)
+	c.Assert(err, check.IsNil)
+	c.Assert(containers, check.HasLen, 2)
+	c.Assert(containers[1].ID, check.Equals, "id2")
+	c.Assert(containers[1].State, check.Equals, "exited")
+}
+
+func (S) TestCRIRuntimeInspectContainer(c *check.C) {
+	server := newFakeCRIServer(c)
+	defer server.stop()
+	startedAt := time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+	server.statuses["id1"] = &runtimeapi.ContainerStatusResponse{
+		Status: &runtimeapi.ContainerStatus{
+			Id:        "id1",
+			Metadata:  &runtimeapi.ContainerMetadata{Name: "app1"},
+			State:     runtimeapi.ContainerState_CONTAINER_RUNNING,
+			StartedAt: startedAt.UnixNano(),
+			Image:     &runtimeapi.ImageSpec{Image: "tsuru/python"},
+			ImageRef:  "sha256:abc",
+			Labels:    map[string]string{"app": "myapp"},
+			Resources: &runtimeapi.ContainerResources{
+				Linux: &runtimeapi.LinuxContainerResources{MemoryLimitInBytes: 1024},
+			},
+		},
+		Info: map[string]string{
+			"info": `{"sandboxID":"sandbox1","runtimeSpec":{"hostname":"host1","process":{"env":["TSURU_APPNAME=myapp"]}}}`,
+		},
+	}
+	server.statuses["oom"] = &runtimeapi.ContainerStatusResponse{
+		Status: &runtimeapi.ContainerStatus{
+			Id:       "oom",
+			State:    runtimeapi.ContainerState_CONTAINER_EXITED,
+			ExitCode: 137,
+			Reason:   "OOMKilled",
+		},
+	}
+	r, err := NewCRIRuntime(server.endpoint)
+	c.Assert(err, check.IsNil)
+	cont, err := r.InspectContainer("id1")
+	c.Assert(err, check.IsNil)
+	c.Assert(cont.ID, check.Equals, "id1")
+	c.Assert(cont.Name, check.Equals, "/app1")
+	c.Assert(cont.Image, check.Equals, "sha256:abc")
+	c.Assert(cont.State.Running, check.Equals, true)
+	c.Assert(cont.State.StartedAt.Equal(startedAt), check.Equals, true)
+	c.Assert(cont.Config.Image, check.Equals, "tsuru/python")
+	c.Assert(cont.Config.Hostname, check.Equals, "host1")
+	c.Assert(cont.Config.Env, check.DeepEquals, []string{"TSURU_APPNAME=myapp"})
+	c.Assert(cont.Config.Labels, check.DeepEquals, map[string]string{"app": "myapp"})
+	c.Assert(cont.HostConfig.Memory, check.Equals, int64(1024))
+	c.Assert(server.statusRequests[0].Verbose, check.Equals, true)
+	cont, err = r.InspectContainer("oom")
+	c.Assert(err, check.IsNil)
+	c.Assert(cont.State.Status, check.Equals, "exited")
+	c.Assert(cont.State.ExitCode, check.Equals, 137)
+	c.Assert(cont.State.OOMKilled, check.Equals, true)
+	_, err = r.InspectContainer("id2")
+	c.Assert(err, check.DeepEquals, &docker.NoSuchContainer{ID: "id2"})
+}
+
+func (S) TestCRIRuntimeStats(c *check.C) {
+	server := newFakeCRIServer(c)
+	defer server.stop()
+	for i := uint64(1); i <= 2; i++ {
+		server.stats = append(server.stats, &runtimeapi.ContainerStats{
+			Cpu: &runtimeapi.CpuUsage{
+				Timestamp:            int64(i * 1000),
+				UsageCoreNanoSeconds: &runtimeapi.UInt64Value{Value: i * 500},
+			},
+			Memory: &runtimeapi.MemoryUsage{WorkingSetBytes: &runtimeapi.UInt64Value{Value: 2048}},
+		})
+	}
+	server.statuses["id1"] = &runtimeapi.ContainerStatusResponse{
+		Status: &runtimeapi.ContainerStatus{
+			Id: "id1",
+			Resources: &runtimeapi.ContainerResources{
+				Linux: &runtimeapi.LinuxContainerResources{MemoryLimitInBytes: 4096},
+			},
+		},
+	}
+	r, err := NewCRIRuntime(server.endpoint)
+	c.Assert(err, check.IsNil)
+	stats, err := r.Stats("id1")
+	c.Assert(err, check.IsNil)
+	c.Assert(stats.CPUStats.CPUUsage.TotalUsage, check.Equals, uint64(500))
+	c.Assert(stats.PreCPUStats.CPUUsage.TotalUsage, check.Equals, uint64(0))
+	c.Assert(stats.MemoryStats.Usage, check.Equals, uint64(2048))
+	c.Assert(stats.MemoryStats.Limit, check.Equals, uint64(4096))
+	stats, err = r.Stats("id1")
+	c.Assert(err, check.IsNil)
+	c.Assert(stats.CPUStats.CPUUsage.TotalUsage, check.Equals, uint64(1000))
+	c.Assert(stats.PreCPUStats.CPUUsage.TotalUsage, check.Equals, uint64(500))
+	c.Assert(stats.CPUStats.SystemCPUUsage > stats.PreCPUStats.SystemCPUUsage, check.Equals, true)
+	c.Assert(stats.CPUStats.CPUUsage.PercpuUsage, check.Not(check.HasLen), 0)
+	_, err = r.Stats("id1")
+	c.Assert(err, check.DeepEquals, &docker.NoSuchContainer{ID: "id1"})
+}
+
+func (S) TestCRIRuntimeEvents(c *check.C) {
+	server := newFakeCRIServer(c)
+	defer server.stop()
+	server.events = []*runtimeapi.ContainerEventResponse{
+		{
+			ContainerId:        "id1",
+			ContainerEventType: runtimeapi.ContainerEventType_CONTAINER_STARTED_EVENT,
+			CreatedAt:          time.Unix(1488362400, 0).UnixNano(),
+			ContainersStatuses: []*runtimeapi.ContainerStatus{
+				{Id: "id1", Metadata: &runtimeapi.ContainerMetadata{Name: "app1"}},
+			},
+		},
+		{ContainerId: "id3", ContainerEventType: 10},
+		{ContainerId: "id2", ContainerEventType: runtimeapi.ContainerEventType_CONTAINER_DELETED_EVENT},
+	}
+	r, err := NewCRIRuntime(server.endpoint)
+	c.Assert(err, check.IsNil)
+	var events []*docker.APIEvents
+	err = r.Events(context.Background(), 0, func(event *docker.APIEvents) {
+		events = append(events, event)
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 2)
+	c.Assert(events[0].Action, check.Equals, "start")
+	c.Assert(events[0].ID, check.Equals, "id1")
+	c.Assert(events[0].Time, check.Equals, int64(1488362400))
+	c.Assert(events[0].Actor.Attributes, check.DeepEquals, map[string]string{"name": "app1"})
+	c.Assert(events[1].Action, check.Equals, "destroy")
+	c.Assert(events[1].ID, check.Equals, "id2")
+}
+
+func (S) TestCRIRuntimeCreateAndRemoveContainer(c *check.C) {
+	server := newFakeCRIServer(c)
+	defer server.stop()
+	server.statuses["base"] = &runtimeapi.ContainerStatusResponse{
+		Status: &runtimeapi.ContainerStatus{Id: "base"},
+		Info:   map[string]string{"info": `{"sandboxID":"sandbox1"}`},
+	}
+	server.sandboxes["sandbox1"] = &runtimeapi.PodSandboxStatus{
+		Id:       "sandbox1",
+		Metadata: &runtimeapi.PodSandboxMetadata{Name: "pod1", Namespace: "default"},
+	}
+	r, err := NewCRIRuntime(server.endpoint)
+	c.Assert(err, check.IsNil)
+	id, err := r.CreateContainer(CreateOptions{
+		Name: "bs-hostcheck-container",
+		Base: &docker.Container{ID: "base", Config: &docker.Config{Image: "tsuru/python"}},
+		Cmd:  []string{"echo", "-n", "ok"},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(id, check.Equals, "newid")
+	c.Assert(server.createRequests, check.HasLen, 1)
+	req := server.createRequests[0]
+	c.Assert(req.PodSandboxId, check.Equals, "sandbox1")
+	c.Assert(req.Config.Metadata.Name, check.Equals, "bs-hostcheck-container")
+	c.Assert(req.Config.Image.Image, check.Equals, "tsuru/python")
+	c.Assert(req.Config.Command, check.DeepEquals, []string{"echo", "-n", "ok"})
+	c.Assert(req.SandboxConfig.Metadata.Name, check.Equals, "pod1")
+	c.Assert(req.SandboxConfig.Metadata.Namespace, check.Equals, "default")
+	err = r.RemoveContainer("newid")
+	c.Assert(err, check.IsNil)
+	err = r.RemoveContainer("otherid")
+	c.Assert(err, check.DeepEquals, &docker.NoSuchContainer{ID: "otherid"})
+}
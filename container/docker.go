@@ -0,0 +1,233 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package container
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// DockerRuntime is the docker container runtime.
+type DockerRuntime struct {
+	client *docker.Client
+	// httpClient and baseURL are used for the requests made directly to the
+	// docker API, for data missing in the docker client. They are built from
+	// the same endpoint and dialer used by the docker client.
+	httpClient *http.Client
+	baseURL    string
+}
+
+func NewDockerRuntime(endpoint string) (*DockerRuntime, error) {
+	client, err := docker.NewClient(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	client.HTTPClient = timeoutHttpClient
+	client.Dialer = timeoutDialer
+	client.SetTimeout(timeoutHttpClient.Timeout)
+	// Endpoints are parsed like the docker client does: tcp endpoints, with
+	// or without the scheme, are http and http and https endpoints keep
+	// their path.
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "tcp://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Dial:                client.Dialer.Dial,
+		TLSHandshakeTimeout: dialTimeout,
+	}
+	if clientTransport, ok := client.HTTPClient.Transport.(*http.Transport); ok {
+		transport.TLSClientConfig = clientTransport.TLSClientConfig
+	}
+	switch u.Scheme {
+	case "unix":
+		socketPath := u.Path
+		transport.Dial = func(string, string) (net.Conn, error) {
+			return client.Dialer.Dial("unix", socketPath)
+		}
+		u = &url.URL{Scheme: "http", Host: "docker"}
+	case "tcp":
+		u.Scheme = "http"
+	}
+	return &DockerRuntime{
+		client:     client,
+		httpClient: &http.Client{Transport: transport},
+		baseURL:    strings.TrimRight(u.String(), "/"),
+	}, nil
+}
+
+func (r *DockerRuntime) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := r.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return r.httpClient.Do(req.WithContext(ctx))
+}
+
+func (r *DockerRuntime) ListContainers(all bool) ([]docker.APIContainers, error) {
+	return r.client.ListContainers(docker.ListContainersOptions{All: all})
+}
+
+func (r *DockerRuntime) InspectContainer(id string) (*docker.Container, error) {
+	cont, _, err := r.InspectContainerHealth(id)
+	return cont, err
+}
+
+// InspectContainerHealth inspects the container directly, as the docker
+// client doesn't decode the health check state.
+func (r *DockerRuntime) InspectContainerHealth(id string) (*docker.Container, *Health, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fullTimeout)
+	defer cancel()
+	resp, err := r.get(ctx, "/containers/"+url.PathEscape(id)+"/json", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil, &docker.NoSuchContainer{ID: id}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status %d inspecting container %s", resp.StatusCode, id)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cont docker.Container
+	if err = json.Unmarshal(data, &cont); err != nil {
+		return nil, nil, err
+	}
+	var state struct {
+		State struct {
+			Health *Health
+		}
+	}
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, nil, err
+	}
+	return &cont, state.State.Health, nil
+}
+
+func (r *DockerRuntime) Stats(id string) (*docker.Stats, error) {
+	statsCh := make(chan *docker.Stats, 1)
+	errCh := make(chan error, 1)
+	opts := docker.StatsOptions{
+		ID:      id,
+		Stream:  false,
+		Stats:   statsCh,
+		Timeout: 10 * time.Second,
+	}
+	go func() {
+		defer close(errCh)
+		err := r.client.Stats(opts)
+		if err != nil {
+			errCh <- err
+		}
+	}()
+	err := <-errCh
+	if err != nil {
+		return nil, err
+	}
+	return <-statsCh, nil
+}
+
+// Events reads the docker events stream directly, as the event monitor in
+// the docker client can't be stopped safely.
+func (r *DockerRuntime) Events(ctx context.Context, since int64, handler func(*docker.APIEvents)) error {
+	query := url.Values{"filters": []string{`{"type":["container"]}`}}
+	if since > 0 {
+		query.Set("since", strconv.FormatInt(since, 10))
+	}
+	start := time.Now()
+	resp, err := r.get(ctx, "/events", query)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	observeCall("events", start, err)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event docker.APIEvents
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if event.Type != "" && event.Type != "container" {
+			continue
+		}
+		handler(&event)
+	}
+}
+
+func (r *DockerRuntime) CreateContainer(opts CreateOptions) (string, error) {
+	cont, err := r.client.CreateContainer(docker.CreateContainerOptions{
+		Name: opts.Name,
+		Config: &docker.Config{
+			AttachStdout: true,
+			AttachStderr: true,
+			Image:        opts.Base.Image,
+			Entrypoint:   []string{},
+			Cmd:          opts.Cmd,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return cont.ID, nil
+}
+
+func (r *DockerRuntime) RemoveContainer(id string) error {
+	return r.client.RemoveContainer(docker.RemoveContainerOptions{ID: id, Force: true})
+}
+
+// RunContainer starts a created container, returning its output after it
+// exits.
+func (r *DockerRuntime) RunContainer(id string) (string, error) {
+	output := bytes.NewBuffer(nil)
+	attachOptions := docker.AttachToContainerOptions{
+		Container:    id,
+		OutputStream: output,
+		Stream:       true,
+		Stdout:       true,
+		Success:      make(chan struct{}),
+	}
+	waiter, err := r.client.AttachToContainerNonBlocking(attachOptions)
+	if err != nil {
+		return "", err
+	}
+	<-attachOptions.Success
+	close(attachOptions.Success)
+	err = r.client.StartContainer(id, nil)
+	if err != nil {
+		return "", err
+	}
+	waiter.Wait()
+	return output.String(), nil
+}
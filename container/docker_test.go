@@ -0,0 +1,136 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package container
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	dTesting "github.com/fsouza/go-dockerclient/testing"
+	"github.com/tsuru/bs/telemetry"
+	"gopkg.in/check.v1"
+)
+
+func (S) TestDockerRuntimeInspectContainerHealth(c *check.C) {
+	dockerServer, err := dTesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	defer dockerServer.Stop()
+	dockerServer.CustomHandler("/containers/healthy/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"Id": "healthy",
+			"Name": "/healthy",
+			"RestartCount": 3,
+			"Config": {"Env": ["TSURU_APPNAME=myapp"]},
+			"State": {
+				"Running": true,
+				"Health": {
+					"Status": "unhealthy",
+					"FailingStreak": 2,
+					"Log": [{"ExitCode": 0, "Output": "ok"}, {"ExitCode": 1, "Output": "refused"}]
+				}
+			}
+		}`))
+	}))
+	r, err := NewDockerRuntime(dockerServer.URL())
+	c.Assert(err, check.IsNil)
+	cont, health, err := r.InspectContainerHealth("healthy")
+	c.Assert(err, check.IsNil)
+	c.Assert(cont.ID, check.Equals, "healthy")
+	c.Assert(cont.RestartCount, check.Equals, 3)
+	c.Assert(cont.State.Running, check.Equals, true)
+	c.Assert(cont.Config.Env, check.DeepEquals, []string{"TSURU_APPNAME=myapp"})
+	c.Assert(health.Status, check.Equals, "unhealthy")
+	c.Assert(health.FailingStreak, check.Equals, 2)
+	c.Assert(health.LastResult(), check.DeepEquals, &HealthResult{ExitCode: 1, Output: "refused"})
+	_, _, err = r.InspectContainerHealth("missing")
+	c.Assert(err, check.DeepEquals, &docker.NoSuchContainer{ID: "missing"})
+	client, err := NewClientWithRuntime(r)
+	c.Assert(err, check.IsNil)
+	appCont, err := client.GetAppContainer("healthy", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(appCont.AppName, check.Equals, "myapp")
+	c.Assert(appCont.Health.Status, check.Equals, "unhealthy")
+}
+
+func (S) TestHealthLastResultEmpty(c *check.C) {
+	var health *Health
+	c.Assert(health.LastResult(), check.IsNil)
+	health = &Health{Status: "starting"}
+	c.Assert(health.LastResult(), check.IsNil)
+}
+
+func (S) TestNewDockerRuntimeBaseURL(c *check.C) {
+	tests := []struct {
+		endpoint string
+		baseURL  string
+	}{
+		{"unix:///var/run/docker.sock", "http://docker"},
+		{"tcp://10.0.0.1:2375", "http://10.0.0.1:2375"},
+		{"10.0.0.1:2375", "http://10.0.0.1:2375"},
+		{"http://10.0.0.1:2375/", "http://10.0.0.1:2375"},
+		{"https://docker.example.com:2376/prefix", "https://docker.example.com:2376/prefix"},
+	}
+	for _, tt := range tests {
+		r, err := NewDockerRuntime(tt.endpoint)
+		c.Assert(err, check.IsNil)
+		c.Check(r.baseURL, check.Equals, tt.baseURL, check.Commentf("endpoint %s", tt.endpoint))
+	}
+}
+
+func (S) TestDockerRuntimeRawRequestsUseEndpointPath(c *check.C) {
+	pathCh := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pathCh <- r.URL.Path
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer srv.Close()
+	r, err := NewDockerRuntime(srv.URL + "/prefix")
+	c.Assert(err, check.IsNil)
+	_, _, err = r.InspectContainerHealth("abc")
+	c.Assert(err, check.DeepEquals, &docker.NoSuchContainer{ID: "abc"})
+	c.Assert(<-pathCh, check.Equals, "/prefix/containers/abc/json")
+}
+
+func (S) TestDockerRuntimeEventsDecodeError(c *check.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Type": "container", "Action": "start", "id": "abc"}{invalid`))
+	}))
+	defer srv.Close()
+	r, err := NewDockerRuntime(srv.URL)
+	c.Assert(err, check.IsNil)
+	var events []string
+	err = r.Events(context.Background(), 0, func(event *docker.APIEvents) {
+		events = append(events, event.ID)
+	})
+	c.Assert(err, check.NotNil)
+	c.Assert(events, check.DeepEquals, []string{"abc"})
+}
+
+func (S) TestDockerRuntimeEventsObservesOnlyRequest(c *check.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Type": "container", "Action": "start", "id": "abc"}`))
+		w.(http.Flusher).Flush()
+		time.Sleep(1100 * time.Millisecond)
+	}))
+	defer srv.Close()
+	r, err := NewDockerRuntime(srv.URL)
+	c.Assert(err, check.IsNil)
+	err = r.Events(context.Background(), 0, func(event *docker.APIEvents) {})
+	c.Assert(err, check.IsNil)
+	var buf bytes.Buffer
+	err = telemetry.Default.Write(&buf)
+	c.Assert(err, check.IsNil)
+	bucket := regexp.MustCompile(`bs_container_api_call_duration_seconds_bucket\{call="events",le="1"\} (\d+)`).FindStringSubmatch(buf.String())
+	count := regexp.MustCompile(`bs_container_api_call_duration_seconds_count\{call="events"\} (\d+)`).FindStringSubmatch(buf.String())
+	c.Assert(bucket, check.HasLen, 2)
+	c.Assert(count, check.HasLen, 2)
+	c.Assert(bucket[1], check.Equals, count[1])
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package container
+
+import (
+	"context"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/bs/bslog"
+)
+
+// Overridden by tests to reconnect faster.
+var eventsRetryInterval = 5 * time.Second
+
+// WatchEvents keeps the cache up to date using the runtime events stream:
+// containers are inspected and cached when created or started and removed
+// from the cache when destroyed. Watching stops when Close is called.
+func (c *InfoClient) WatchEvents() {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+	if c.eventsQuit != nil {
+		return
+	}
+	c.eventsQuit = make(chan struct{})
+	c.eventsDone = make(chan struct{})
+	go c.watchEvents(c.eventsQuit, c.eventsDone)
+}
+
+// OnEvent registers a handler called with every container event received
+// after the cache is updated, allowing components sharing the client to
+// share a single events stream. Handlers may be registered before or after
+// WatchEvents is called and must not block.
+func (c *InfoClient) OnEvent(handler func(*docker.APIEvents)) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	c.eventHandlers = append(c.eventHandlers, handler)
+}
+
+// Close stops watching container events.
+func (c *InfoClient) Close() {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+	if c.eventsQuit == nil {
+		return
+	}
+	close(c.eventsQuit)
+	<-c.eventsDone
+	c.eventsQuit = nil
+	c.eventsDone = nil
+}
+
+func (c *InfoClient) watchEvents(quit, done chan struct{}) {
+	defer close(done)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-quit
+		cancel()
+	}()
+	var since int64
+	for {
+		err := c.runtime.Events(ctx, since, func(event *docker.APIEvents) {
+			if event.Time > since {
+				since = event.Time
+			}
+			c.handleEvent(event)
+			c.handlersMu.RLock()
+			handlers := c.eventHandlers
+			c.handlersMu.RUnlock()
+			for _, handler := range handlers {
+				handler(event)
+			}
+		})
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		if err != nil {
+			bslog.Warnf("[container cache] unable to watch container events: %s", err)
+		}
+		select {
+		case <-quit:
+			return
+		case <-time.After(eventsRetryInterval):
+		}
+	}
+}
+
+// EventAction returns the action and container id of a container event,
+// using the fields of older docker API versions if needed.
+func EventAction(event *docker.APIEvents) (action, id string) {
+	action, id = event.Action, event.Actor.ID
+	if action == "" {
+		action = event.Status
+	}
+	if id == "" {
+		id = event.ID
+	}
+	return action, id
+}
+
+func (c *InfoClient) handleEvent(event *docker.APIEvents) {
+	action, id := EventAction(event)
+	if id == "" {
+		return
+	}
+	shortID := id
+	if len(shortID) > shortIDSize {
+		shortID = shortID[:shortIDSize]
+	}
+	switch action {
+	case "create", "start":
+		cont, err := c.inspect(id)
+		if err != nil {
+			bslog.Debugf("[container cache] unable to inspect container %s: %s", id, err)
+			return
+		}
+		// Log messages identify containers by their short id.
+		c.negativeCache.Remove(shortID)
+		c.containerCache.Add(shortID, cont)
+	case "destroy":
+		for _, key := range []string{id, shortID} {
+			c.containerCache.Remove(key)
+			c.negativeCache.Remove(key)
+		}
+	}
+}
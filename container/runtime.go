@@ -0,0 +1,93 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package container
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/bs/config"
+)
+
+const (
+	RuntimeDocker = "docker"
+	RuntimeCRI    = "cri"
+
+	defaultCRIEndpoint = "unix:///run/containerd/containerd.sock"
+)
+
+// Runtime is a container runtime bs gets containers from. Containers, stats
+// and events are represented using the docker API types regardless of the
+// runtime, runtimes return *docker.NoSuchContainer for unknown containers.
+type Runtime interface {
+	// ListContainers lists the running containers, or all containers if all
+	// is true.
+	ListContainers(all bool) ([]docker.APIContainers, error)
+	InspectContainer(id string) (*docker.Container, error)
+	Stats(id string) (*docker.Stats, error)
+	// Events calls handler with each container event until the stream ends
+	// or ctx is done. Runtimes supporting it only send events since the
+	// given unix time, when it's not zero.
+	Events(ctx context.Context, since int64, handler func(*docker.APIEvents)) error
+	// CreateContainer creates a container, without starting it, returning
+	// its id.
+	CreateContainer(opts CreateOptions) (string, error)
+	// RemoveContainer removes the container, killing it if it's running.
+	RemoveContainer(id string) error
+}
+
+// HealthRuntime is implemented by runtimes supporting container health
+// checks, returning the health check state along with the container.
+type HealthRuntime interface {
+	InspectContainerHealth(id string) (*docker.Container, *Health, error)
+}
+
+// Health is the state of the health check of a container.
+type Health struct {
+	Status        string         `json:"Status"`
+	FailingStreak int            `json:"FailingStreak"`
+	Log           []HealthResult `json:"Log"`
+}
+
+// HealthResult is the result of a single health check probe.
+type HealthResult struct {
+	Start    time.Time `json:"Start"`
+	End      time.Time `json:"End"`
+	ExitCode int       `json:"ExitCode"`
+	Output   string    `json:"Output"`
+}
+
+// LastResult returns the result of the last health check probe, nil if the
+// health check didn't run yet.
+func (h *Health) LastResult() *HealthResult {
+	if h == nil || len(h.Log) == 0 {
+		return nil
+	}
+	return &h.Log[len(h.Log)-1]
+}
+
+// CreateOptions are the options for creating a container next to a base
+// container, using its image.
+type CreateOptions struct {
+	Name string
+	Base *docker.Container
+	Cmd  []string
+}
+
+// NewRuntime returns the runtime in CONTAINER_RUNTIME: docker, the default,
+// connecting to dockerEndpoint or cri, connecting to the CRI socket in
+// CRI_ENDPOINT.
+func NewRuntime(dockerEndpoint string) (Runtime, error) {
+	switch name := config.StringEnvOrDefault(RuntimeDocker, "CONTAINER_RUNTIME"); name {
+	case RuntimeDocker:
+		return NewDockerRuntime(dockerEndpoint)
+	case RuntimeCRI:
+		return NewCRIRuntime(config.StringEnvOrDefault(defaultCRIEndpoint, "CRI_ENDPOINT"))
+	default:
+		return nil, fmt.Errorf("invalid container runtime %q, expected %s or %s", name, RuntimeDocker, RuntimeCRI)
+	}
+}
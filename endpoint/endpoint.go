@@ -0,0 +1,270 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package endpoint selects the tsuru API endpoint used by bs, failing over
+// between the configured endpoints and between the addresses each endpoint
+// host resolves to.
+package endpoint
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/config"
+)
+
+const (
+	dialTimeout          = 10 * time.Second
+	defaultRetryInterval = 30
+)
+
+var (
+	// Overridden by tests to resolve hosts to fixed addresses.
+	lookupHost = net.LookupHost
+
+	ErrNoEndpoints = errors.New("tsuru endpoint must be set")
+)
+
+// Target is a single address of a tsuru API endpoint.
+type Target struct {
+	// URL is the endpoint as configured, its host is used in requests and
+	// for tls server name verification.
+	URL *url.URL
+	// Addr is the host:port dialed, the host is one of the addresses the
+	// endpoint host resolves to.
+	Addr string
+	key  string
+}
+
+// URLWithPath returns the target URL with path appended to the endpoint
+// path.
+func (t Target) URLWithPath(path string) *url.URL {
+	u := *t.URL
+	u.Path = strings.TrimRight(u.Path, "/") + path
+	return &u
+}
+
+func (t Target) String() string {
+	return fmt.Sprintf("%s (%s)", t.URL, t.Addr)
+}
+
+// Pool holds the tsuru API endpoints in order of preference. The target last
+// used successfully is preferred while it stays healthy, targets that fail are
+// only tried again after the retry interval, unless every target failed.
+type Pool struct {
+	endpoints     []*url.URL
+	tlsConfig     *tls.Config
+	retryInterval time.Duration
+	mu            sync.Mutex
+	resolved      map[string][]string
+	downUntil     map[string]time.Time
+	current       string
+	transports    map[string]*http.Transport
+}
+
+// NewPool creates a pool with the given endpoints, tlsConfig is used for https
+// endpoints and may be nil.
+func NewPool(endpoints []string, tlsConfig *tls.Config, retryInterval time.Duration) (*Pool, error) {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	p := &Pool{
+		tlsConfig:     tlsConfig,
+		retryInterval: retryInterval,
+		resolved:      make(map[string][]string),
+		downUntil:     make(map[string]time.Time),
+		transports:    make(map[string]*http.Transport),
+	}
+	for _, endpoint := range endpoints {
+		endpoint = strings.TrimSpace(endpoint)
+		if endpoint == "" {
+			continue
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tsuru endpoint %q: %s", endpoint, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid tsuru endpoint %q, expected http or https url", endpoint)
+		}
+		p.endpoints = append(p.endpoints, u)
+	}
+	if len(p.endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	return p, nil
+}
+
+// NewPoolFromEnv creates a pool with the endpoints in TSURU_ENDPOINT, using
+// the TSURU_TLS_* environment variables for https endpoints.
+func NewPoolFromEnv() (*Pool, error) {
+	tlsConfig, err := config.TLSConfigFromEnv("TSURU_TLS")
+	if err != nil {
+		return nil, err
+	}
+	retryInterval := config.SecondsEnvOrDefault(defaultRetryInterval, "TSURU_ENDPOINT_RETRY_INTERVAL")
+	return NewPool(config.Config.TsuruEndpoints, tlsConfig, retryInterval)
+}
+
+// Targets returns the targets to try in order: the current target, the other
+// healthy targets in order of preference and then the targets marked as down.
+func (p *Pool) Targets() []Target {
+	addrs := make([][]string, len(p.endpoints))
+	for i, u := range p.endpoints {
+		addrs[i] = p.resolve(u)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var current, healthy, down []Target
+	for i, u := range p.endpoints {
+		for _, addr := range addrs[i] {
+			t := Target{URL: u, Addr: addr, key: u.String() + "|" + addr}
+			switch {
+			case now.Before(p.downUntil[t.key]):
+				down = append(down, t)
+			case t.key == p.current:
+				current = append(current, t)
+			default:
+				healthy = append(healthy, t)
+			}
+		}
+	}
+	return append(append(current, healthy...), down...)
+}
+
+// resolve returns the addresses of the endpoint host, keeping the last
+// successful resolution if resolving fails.
+func (p *Pool) resolve(u *url.URL) []string {
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if net.ParseIP(host) != nil {
+		return []string{net.JoinHostPort(host, port)}
+	}
+	ips, err := lookupHost(host)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil || len(ips) == 0 {
+		if cached := p.resolved[u.Host]; cached != nil {
+			return cached
+		}
+		bslog.Warnf("[tsuru endpoint] unable to resolve %q: %v", host, err)
+		return []string{net.JoinHostPort(host, port)}
+	}
+	sort.Strings(ips)
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+	p.resolved[u.Host] = addrs
+	return addrs
+}
+
+// MarkDown marks the target as failed until the retry interval elapses.
+func (p *Pool) MarkDown(t Target, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	bslog.Warnf("[tsuru endpoint] %s failed, retrying in %v: %s", t, p.retryInterval, err)
+	p.downUntil[t.key] = time.Now().Add(p.retryInterval)
+	if p.current == t.key {
+		p.current = ""
+	}
+}
+
+// MarkUp marks the target as healthy and preferred over the others.
+func (p *Pool) MarkUp(t Target) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.downUntil, t.key)
+	p.current = t.key
+}
+
+// Dial connects to the target address, using tls for https endpoints. The
+// timeout includes the tls handshake, callers like the log forwarder use a
+// shorter timeout than the one used for requests.
+func (p *Pool) Dial(t Target, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if t.URL.Scheme == "https" {
+		return tls.DialWithDialer(dialer, "tcp", t.Addr, config.TLSConfigForHost(p.tlsConfig, t.URL.Hostname()))
+	}
+	return dialer.Dial("tcp", t.Addr)
+}
+
+// transport returns the http transport connecting only to the target
+// address, so connections to different addresses are not mixed.
+func (p *Pool) transport(t Target) *http.Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	transport := p.transports[t.key]
+	if transport == nil {
+		dialer := &net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+		addr := t.Addr
+		transport = &http.Transport{
+			Dial: func(network, _ string) (net.Conn, error) {
+				return dialer.Dial(network, addr)
+			},
+			TLSClientConfig:     p.tlsConfig,
+			TLSHandshakeTimeout: dialTimeout,
+		}
+		p.transports[t.key] = transport
+	}
+	return transport
+}
+
+// Do sends a request to path on each target in turn, until one is reachable
+// and does not respond with a bad gateway, service unavailable or gateway
+// timeout status. The response from the last target is always returned.
+func (p *Pool) Do(method, path string, header http.Header, body []byte, timeout time.Duration) (*http.Response, error) {
+	targets := p.Targets()
+	var lastErr error
+	for i, t := range targets {
+		request, err := http.NewRequest(method, t.URLWithPath(path).String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			request.Header[k] = v
+		}
+		client := &http.Client{Transport: p.transport(t), Timeout: timeout}
+		resp, err := client.Do(request)
+		if err != nil {
+			p.MarkDown(t, err)
+			lastErr = err
+			continue
+		}
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			p.MarkDown(t, fmt.Errorf("unexpected status %d", resp.StatusCode))
+			if i < len(targets)-1 {
+				resp.Body.Close()
+				continue
+			}
+		default:
+			p.MarkUp(t)
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,188 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package endpoint
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&S{})
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type S struct {
+	hosts map[string][]string
+}
+
+func (s *S) SetUpTest(c *check.C) {
+	s.hosts = map[string][]string{}
+	lookupHost = func(host string) ([]string, error) {
+		addrs, ok := s.hosts[host]
+		if !ok {
+			return nil, fmt.Errorf("no such host %q", host)
+		}
+		return addrs, nil
+	}
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	lookupHost = net.LookupHost
+}
+
+func targetAddrs(targets []Target) []string {
+	addrs := make([]string, len(targets))
+	for i, t := range targets {
+		addrs[i] = t.Addr
+	}
+	return addrs
+}
+
+func (s *S) TestNewPoolInvalid(c *check.C) {
+	_, err := NewPool(nil, nil, time.Minute)
+	c.Assert(err, check.Equals, ErrNoEndpoints)
+	_, err = NewPool([]string{"tcp://localhost:8080"}, nil, time.Minute)
+	c.Assert(err, check.ErrorMatches, `invalid tsuru endpoint "tcp://localhost:8080", expected http or https url`)
+}
+
+func (s *S) TestTargetsFailoverAndSticky(c *check.C) {
+	s.hosts["api.example.com"] = []string{"10.0.0.2", "10.0.0.1"}
+	s.hosts["other.example.com"] = []string{"10.1.0.1"}
+	pool, err := NewPool([]string{"http://api.example.com:8080", "https://other.example.com"}, nil, time.Minute)
+	c.Assert(err, check.IsNil)
+	targets := pool.Targets()
+	c.Assert(targetAddrs(targets), check.DeepEquals, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.1.0.1:443"})
+	c.Assert(targets[0].URLWithPath("/logs").String(), check.Equals, "http://api.example.com:8080/logs")
+	pool.MarkDown(targets[0], errors.New("connection refused"))
+	c.Assert(targetAddrs(pool.Targets()), check.DeepEquals, []string{"10.0.0.2:8080", "10.1.0.1:443", "10.0.0.1:8080"})
+	pool.MarkUp(targets[2])
+	c.Assert(targetAddrs(pool.Targets()), check.DeepEquals, []string{"10.1.0.1:443", "10.0.0.2:8080", "10.0.0.1:8080"})
+	pool.MarkUp(targets[0])
+	c.Assert(targetAddrs(pool.Targets()), check.DeepEquals, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.1.0.1:443"})
+}
+
+func (s *S) TestTargetsRetryInterval(c *check.C) {
+	pool, err := NewPool([]string{"http://127.0.0.1:8080", "http://127.0.0.2:8080"}, nil, 50*time.Millisecond)
+	c.Assert(err, check.IsNil)
+	targets := pool.Targets()
+	pool.MarkDown(targets[0], errors.New("timeout"))
+	c.Assert(targetAddrs(pool.Targets()), check.DeepEquals, []string{"127.0.0.2:8080", "127.0.0.1:8080"})
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(targetAddrs(pool.Targets()), check.DeepEquals, []string{"127.0.0.1:8080", "127.0.0.2:8080"})
+}
+
+func (s *S) TestTargetsResolveFailureKeepsAddresses(c *check.C) {
+	s.hosts["api.example.com"] = []string{"10.0.0.1"}
+	pool, err := NewPool([]string{"http://api.example.com"}, nil, time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(targetAddrs(pool.Targets()), check.DeepEquals, []string{"10.0.0.1:80"})
+	delete(s.hosts, "api.example.com")
+	c.Assert(targetAddrs(pool.Targets()), check.DeepEquals, []string{"10.0.0.1:80"})
+	pool, err = NewPool([]string{"http://api.example.com"}, nil, time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(targetAddrs(pool.Targets()), check.DeepEquals, []string{"api.example.com:80"})
+}
+
+func (s *S) TestDoFailover(c *check.C) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "deploying", http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	closed := httptest.NewServer(nil)
+	closed.Close()
+	paths := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		paths <- r.Method + " " + r.URL.Path + " " + r.Header.Get("Authorization") + " " + string(body)
+	}))
+	defer srv.Close()
+	pool, err := NewPool([]string{closed.URL, unavailable.URL + "/", srv.URL + "/api"}, nil, time.Minute)
+	c.Assert(err, check.IsNil)
+	header := http.Header{"Authorization": []string{"bearer mytoken"}}
+	resp, err := pool.Do("POST", "/node/status", header, []byte("data"), time.Second)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	c.Assert(<-paths, check.Equals, "POST /api/node/status bearer mytoken data")
+	c.Assert(pool.Targets()[0].URL.String(), check.Equals, srv.URL+"/api")
+	resp, err = pool.Do("POST", "/node/status", header, []byte("data2"), time.Second)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Assert(<-paths, check.Equals, "POST /api/node/status bearer mytoken data2")
+}
+
+func (s *S) TestDoAllTargetsFailing(c *check.C) {
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "deploying", http.StatusBadGateway)
+	}))
+	defer unavailable.Close()
+	closed := httptest.NewServer(nil)
+	closed.Close()
+	pool, err := NewPool([]string{unavailable.URL, unavailable.URL + "/other"}, nil, time.Minute)
+	c.Assert(err, check.IsNil)
+	resp, err := pool.Do("GET", "/", nil, nil, time.Second)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, check.Equals, http.StatusBadGateway)
+	pool, err = NewPool([]string{closed.URL}, nil, time.Minute)
+	c.Assert(err, check.IsNil)
+	_, err = pool.Do("GET", "/", nil, nil, time.Second)
+	c.Assert(err, check.ErrorMatches, `.*connection refused.*`)
+}
+
+func (s *S) TestDoTLSResolvedAddress(c *check.C) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.TLS.ServerName))
+	}))
+	defer srv.Close()
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	c.Assert(err, check.IsNil)
+	s.hosts["example.com"] = []string{"127.0.0.1"}
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	pool, err := NewPool([]string{"https://example.com:" + port}, &tls.Config{RootCAs: roots}, time.Minute)
+	c.Assert(err, check.IsNil)
+	resp, err := pool.Do("GET", "/", nil, nil, time.Second)
+	c.Assert(err, check.IsNil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(body), check.Equals, "example.com:"+port+" example.com")
+	conn, err := pool.Dial(pool.Targets()[0], time.Second)
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	c.Assert(conn.(*tls.Conn).ConnectionState().ServerName, check.Equals, "example.com")
+}
+
+func (s *S) TestPoolDialTimeout(c *check.C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+	go func() {
+		conn, acceptErr := listener.Accept()
+		if acceptErr == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	pool, err := NewPool([]string{"https://" + listener.Addr().String()}, nil, time.Minute)
+	c.Assert(err, check.IsNil)
+	start := time.Now()
+	_, err = pool.Dial(pool.Targets()[0], 100*time.Millisecond)
+	c.Assert(err, check.NotNil)
+	c.Assert(time.Since(start) < 500*time.Millisecond, check.Equals, true)
+}
@@ -0,0 +1,318 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tsuru/bs/bslog"
+)
+
+var errBatchNotSent = errors.New("batch not sent, reconnecting to send it again")
+
+// batchEntry is an encoded log message, ts is the timestamp of the message
+// used to measure the forwarding latency once the batch is sent.
+type batchEntry struct {
+	key  string
+	data []byte
+	ts   time.Time
+}
+
+// droppedBatchError is returned by send functions for batches that must not
+// be sent again, like the ones refused by the server.
+type droppedBatchError struct {
+	error
+}
+
+// partialBatchError is returned by send functions for batches sent only in
+// part, only the unsent entries are kept to be sent again.
+type partialBatchError struct {
+	error
+	sent   []batchEntry
+	unsent []batchEntry
+}
+
+// batchRetry keeps the entries of batches that could not be sent, it's
+// shared by the connections of a forwarder so the entries are sent again
+// after reconnecting. When more than max entries are kept the oldest ones are
+// dropped.
+type batchRetry struct {
+	mu      sync.Mutex
+	max     int
+	stats   *backendStats
+	entries []batchEntry
+}
+
+func newBatchRetry(max int, stats *backendStats) *batchRetry {
+	return &batchRetry{max: max, stats: stats}
+}
+
+func (r *batchRetry) keep(entries []batchEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entries...)
+	if excess := len(r.entries) - r.max; excess > 0 {
+		bslog.Errorf("[log forwarder] dropping %d log messages not sent, too many messages waiting to be sent again", excess)
+		r.drop(excess)
+		r.entries = append([]batchEntry(nil), r.entries[excess:]...)
+	}
+}
+
+func (r *batchRetry) take() []batchEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := r.entries
+	r.entries = nil
+	return entries
+}
+
+func (r *batchRetry) drop(n int) {
+	if r.stats != nil {
+		atomic.AddUint64(&r.stats.dropped, uint64(n))
+	}
+}
+
+// maxQueuedBatches is the number of full batches waiting to be sent after
+// which adds block until the batch being sent is done.
+const maxQueuedBatches = 2
+
+// batchConn accumulates encoded entries and queues them as a single batch
+// when the batch is full or when the batch interval elapses. Queued batches
+// are handed to send, in order, by a separate goroutine so adds don't wait
+// for slow sends.
+//
+// When send fails, failed is closed so the forwarder reconnects. With retry
+// set, the entries of the failed batch and of the following ones are kept
+// and sent again by the batchConn of the new connection, and the following
+// adds fail. Otherwise send is responsible for the entries of failed batches.
+// Batches failing with a droppedBatchError are never sent again.
+//
+// When stats is set, the entries are counted as sent once their batch is
+// sent and as dropped when their batch is not sent and won't be retried.
+type batchConn struct {
+	net.Conn
+	send       func([]batchEntry) error
+	stats      *backendStats
+	retry      *batchRetry
+	maxEntries int
+	maxBytes   int
+	interval   time.Duration
+	mu         sync.Mutex
+	cond       *sync.Cond
+	entries    []batchEntry
+	size       int
+	queue      [][]batchEntry
+	ts         time.Time
+	err        error
+	closing    bool
+	failOnce   sync.Once
+	failed     chan struct{}
+	done       chan struct{}
+	wg         sync.WaitGroup
+}
+
+func newBatchConn(conn net.Conn, stats *backendStats, retry *batchRetry, maxEntries, maxBytes int, interval time.Duration, send func([]batchEntry) error) *batchConn {
+	bConn := &batchConn{
+		Conn:       conn,
+		send:       send,
+		stats:      stats,
+		retry:      retry,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		interval:   interval,
+		failed:     make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	bConn.cond = sync.NewCond(&bConn.mu)
+	if retry != nil {
+		bConn.entries = retry.take()
+		for _, entry := range bConn.entries {
+			bConn.size += len(entry.data)
+		}
+	}
+	bConn.wg.Add(1)
+	go bConn.sendLoop()
+	if bConn.interval > 0 {
+		bConn.wg.Add(1)
+		go bConn.flushLoop()
+	}
+	return bConn
+}
+
+// setTimestamp sets the timestamp of the message whose entry is added next,
+// it's called by processMessages before processing each message.
+func (c *batchConn) setTimestamp(ts time.Time) {
+	c.mu.Lock()
+	c.ts = ts
+	c.mu.Unlock()
+}
+
+func (c *batchConn) add(entry batchEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry.ts.IsZero() {
+		entry.ts = c.ts
+	}
+	c.entries = append(c.entries, entry)
+	c.size += len(entry.data)
+	if c.err != nil {
+		return c.err
+	}
+	if len(c.entries) >= c.maxEntries || (c.maxBytes > 0 && c.size >= c.maxBytes) {
+		for len(c.queue) >= maxQueuedBatches && c.err == nil {
+			c.cond.Wait()
+		}
+		if c.err != nil {
+			return c.err
+		}
+		c.enqueue()
+	}
+	return nil
+}
+
+// enqueue moves the pending entries to the queue of batches to be sent, c.mu
+// must be held.
+func (c *batchConn) enqueue() {
+	if len(c.entries) == 0 || c.err != nil {
+		return
+	}
+	c.queue = append(c.queue, c.entries)
+	c.entries = nil
+	c.size = 0
+	c.cond.Broadcast()
+}
+
+// sendLoop sends the queued batches until the connection is closed or a
+// batch fails to be sent, c.mu is released while each batch is sent.
+func (c *batchConn) sendLoop() {
+	defer c.wg.Done()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		for len(c.queue) == 0 && !c.closing && c.err == nil {
+			c.cond.Wait()
+		}
+		if len(c.queue) == 0 || c.err != nil {
+			return
+		}
+		entries := c.queue[0]
+		c.queue[0] = nil
+		c.queue = c.queue[1:]
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		err := c.send(entries)
+		c.mu.Lock()
+		c.sent(entries, err)
+	}
+}
+
+// sent handles the result of sending a batch, c.mu must be held.
+func (c *batchConn) sent(entries []batchEntry, err error) {
+	if partial, ok := err.(partialBatchError); ok {
+		c.forwarded(partial.sent)
+		entries, err = partial.unsent, partial.error
+	}
+	if err == nil {
+		c.forwarded(entries)
+		return
+	}
+	if _, dropped := err.(droppedBatchError); dropped || c.retry == nil {
+		bslog.Errorf("[log forwarder] error sending batch: %s", err)
+		c.drop(len(entries))
+		if !dropped {
+			c.fail()
+		}
+		return
+	}
+	c.err = err
+	for _, batch := range c.queue {
+		entries = append(entries, batch...)
+	}
+	c.entries = append(entries, c.entries...)
+	c.queue = nil
+	c.fail()
+	c.cond.Broadcast()
+}
+
+func (c *batchConn) forwarded(entries []batchEntry) {
+	if c.stats != nil {
+		for _, entry := range entries {
+			c.stats.forwarded(entry.ts)
+		}
+	}
+}
+
+func (c *batchConn) fail() {
+	c.failOnce.Do(func() {
+		close(c.failed)
+	})
+}
+
+func (c *batchConn) drop(n int) {
+	if c.stats != nil {
+		atomic.AddUint64(&c.stats.dropped, uint64(n))
+	}
+}
+
+func (c *batchConn) flushLoop() {
+	defer c.wg.Done()
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			c.mu.Lock()
+			if len(c.queue) < maxQueuedBatches {
+				c.enqueue()
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// Close waits for the queued batches and sends the pending entries, keeping
+// them to be sent again if it fails, and closes the underlying connection.
+func (c *batchConn) Close() error {
+	close(c.done)
+	c.mu.Lock()
+	c.closing = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.wg.Wait()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	if c.err == nil {
+		var entries []batchEntry
+		for _, batch := range c.queue {
+			entries = append(entries, batch...)
+		}
+		entries = append(entries, c.entries...)
+		c.queue = nil
+		c.entries = nil
+		c.size = 0
+		if len(entries) > 0 {
+			err = c.send(entries)
+			c.sent(entries, err)
+		}
+	}
+	if c.retry != nil && len(c.entries) > 0 {
+		c.retry.keep(c.entries)
+		c.entries = nil
+		c.size = 0
+	}
+	if c.Conn != nil {
+		if closeErr := c.Conn.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
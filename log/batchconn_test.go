@@ -0,0 +1,160 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func batchData(entries []batchEntry) []string {
+	var data []string
+	for _, entry := range entries {
+		data = append(data, string(entry.data))
+	}
+	return data
+}
+
+func waitBatchFailed(c *check.C, conn *batchConn) {
+	select {
+	case <-conn.failed:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for failed batch")
+	}
+}
+
+func (s *S) TestBatchConnRetriesFailedBatch(c *check.C) {
+	var sent [][]string
+	sendErr := errors.New("no ack")
+	send := func(entries []batchEntry) error {
+		if sendErr != nil {
+			return sendErr
+		}
+		sent = append(sent, batchData(entries))
+		return nil
+	}
+	stats := &backendStats{}
+	retry := newBatchRetry(10, stats)
+	conn := newBatchConn(nil, stats, retry, 2, 0, 0, send)
+	err := conn.add(batchEntry{data: []byte("a")})
+	c.Assert(err, check.IsNil)
+	err = conn.add(batchEntry{data: []byte("b")})
+	c.Assert(err, check.IsNil)
+	waitBatchFailed(c, conn)
+	err = conn.add(batchEntry{data: []byte("c")})
+	c.Assert(err, check.Equals, sendErr)
+	conn.Close()
+	sendErr = nil
+	conn = newBatchConn(nil, stats, retry, 2, 0, 0, send)
+	err = conn.add(batchEntry{data: []byte("d")})
+	c.Assert(err, check.IsNil)
+	err = conn.Close()
+	c.Assert(err, check.IsNil)
+	c.Assert(sent, check.DeepEquals, [][]string{{"a", "b", "c", "d"}})
+	c.Assert(stats.sent, check.Equals, uint64(4))
+	c.Assert(stats.dropped, check.Equals, uint64(0))
+}
+
+func (s *S) TestBatchConnCountsSentEntries(c *check.C) {
+	var sent []batchEntry
+	send := func(entries []batchEntry) error {
+		sent = append(sent, entries...)
+		return nil
+	}
+	stats := &backendStats{latency: forwardLatency.With("test")}
+	conn := newBatchConn(nil, stats, nil, 3, 0, 0, send)
+	ts := time.Now().Add(-time.Minute)
+	conn.setTimestamp(ts)
+	conn.add(batchEntry{data: []byte("a")})
+	conn.add(batchEntry{data: []byte("b"), ts: ts.Add(time.Second)})
+	c.Assert(atomic.LoadUint64(&stats.sent), check.Equals, uint64(0))
+	err := conn.Close()
+	c.Assert(err, check.IsNil)
+	c.Assert(sent, check.HasLen, 2)
+	c.Assert(sent[0].ts.Equal(ts), check.Equals, true)
+	c.Assert(sent[1].ts.Equal(ts.Add(time.Second)), check.Equals, true)
+	c.Assert(stats.sent, check.Equals, uint64(2))
+	c.Assert(stats.dropped, check.Equals, uint64(0))
+}
+
+func (s *S) TestBatchConnAddDoesNotWaitForSend(c *check.C) {
+	release := make(chan struct{})
+	var sent [][]string
+	send := func(entries []batchEntry) error {
+		<-release
+		sent = append(sent, batchData(entries))
+		return nil
+	}
+	conn := newBatchConn(nil, nil, nil, 1, 0, 0, send)
+	added := make(chan struct{})
+	go func() {
+		defer close(added)
+		for _, data := range []string{"a", "b", "c"} {
+			c.Check(conn.add(batchEntry{data: []byte(data)}), check.IsNil)
+		}
+	}()
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		c.Fatal("add blocked while a batch was being sent")
+	}
+	close(release)
+	err := conn.Close()
+	c.Assert(err, check.IsNil)
+	c.Assert(sent, check.DeepEquals, [][]string{{"a"}, {"b"}, {"c"}})
+}
+
+func (s *S) TestBatchConnWithoutRetryDropsFailedBatch(c *check.C) {
+	send := func(entries []batchEntry) error {
+		return errors.New("connection refused")
+	}
+	stats := &backendStats{}
+	conn := newBatchConn(nil, stats, nil, 2, 0, 0, send)
+	conn.add(batchEntry{data: []byte("a")})
+	err := conn.add(batchEntry{data: []byte("b")})
+	c.Assert(err, check.IsNil)
+	waitBatchFailed(c, conn)
+	conn.add(batchEntry{data: []byte("c")})
+	err = conn.Close()
+	c.Assert(err, check.ErrorMatches, "connection refused")
+	c.Assert(stats.sent, check.Equals, uint64(0))
+	c.Assert(stats.dropped, check.Equals, uint64(3))
+}
+
+func (s *S) TestBatchConnDropsRejectedBatch(c *check.C) {
+	calls := 0
+	send := func(entries []batchEntry) error {
+		calls++
+		return droppedBatchError{errors.New("bad request")}
+	}
+	stats := &backendStats{}
+	retry := newBatchRetry(10, stats)
+	conn := newBatchConn(nil, stats, retry, 2, 0, 0, send)
+	conn.add(batchEntry{data: []byte("a")})
+	err := conn.add(batchEntry{data: []byte("b")})
+	c.Assert(err, check.IsNil)
+	err = conn.Close()
+	c.Assert(err, check.IsNil)
+	c.Assert(calls, check.Equals, 1)
+	c.Assert(retry.take(), check.IsNil)
+	c.Assert(stats.dropped, check.Equals, uint64(2))
+	select {
+	case <-conn.failed:
+		c.Fatal("failed closed for a dropped batch")
+	default:
+	}
+}
+
+func (s *S) TestBatchRetryDropsOldest(c *check.C) {
+	stats := &backendStats{}
+	retry := newBatchRetry(2, stats)
+	retry.keep([]batchEntry{{data: []byte("a")}, {data: []byte("b")}})
+	retry.keep([]batchEntry{{data: []byte("c")}})
+	c.Assert(batchData(retry.take()), check.DeepEquals, []string{"b", "c"})
+	c.Assert(stats.dropped, check.Equals, uint64(1))
+}
@@ -41,6 +41,14 @@ func (c *bufferedConn) Write(msg []byte) (int, error) {
 	return c.w.Write(msg)
 }
 
+// Flush writes the buffered data to the connection, returning the write
+// error instead of leaving it to a later Write.
+func (c *bufferedConn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flush()
+}
+
 func (c *bufferedConn) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -0,0 +1,110 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/tsuru/bs/container"
+	"github.com/tsuru/bs/node"
+)
+
+const (
+	enrichNode          = "node"
+	enrichNodeAddrs     = "node_addrs"
+	enrichContainerName = "container_name"
+	enrichImage         = "image"
+
+	enrichLabelPrefix = "label."
+)
+
+var enrichFieldNames = []string{enrichNode, enrichNodeAddrs, enrichContainerName, enrichImage}
+
+// fieldEnricher adds node and container metadata to the fields of log
+// messages, after the fields extracted from their content.
+type fieldEnricher struct {
+	static        map[string]interface{}
+	containerName bool
+	image         bool
+	labels        []string
+}
+
+func newFieldEnricher(names, labels []string) (*fieldEnricher, error) {
+	if len(names) == 0 && len(labels) == 0 {
+		return nil, nil
+	}
+	e := &fieldEnricher{
+		static: map[string]interface{}{},
+		labels: labels,
+	}
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case enrichNode:
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, fmt.Errorf("unable to get hostname: %s", err)
+			}
+			e.static[enrichNode] = hostname
+		case enrichNodeAddrs:
+			addrs, err := nodeAddrs()
+			if err != nil {
+				return nil, fmt.Errorf("unable to get network addresses: %s", err)
+			}
+			e.static[enrichNodeAddrs] = strings.Join(addrs, ",")
+		case enrichContainerName:
+			e.containerName = true
+		case enrichImage:
+			e.image = true
+		default:
+			return nil, fmt.Errorf("invalid enrichment field %q, expected one of: %s", name, strings.Join(enrichFieldNames, ", "))
+		}
+	}
+	return e, nil
+}
+
+// nodeAddrs returns the node addresses, except loopback addresses.
+func nodeAddrs() ([]string, error) {
+	addrs, err := node.GetNodeAddrs()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.IsLoopback() {
+			continue
+		}
+		result = append(result, addr)
+	}
+	return result, nil
+}
+
+// enrich adds the metadata to fields, allocating a new map if fields is nil.
+// Metadata replaces extracted fields with the same name.
+func (e *fieldEnricher) enrich(fields map[string]interface{}, cont *container.Container) map[string]interface{} {
+	if fields == nil {
+		fields = make(map[string]interface{}, len(e.static)+len(e.labels)+2)
+	}
+	for k, v := range e.static {
+		fields[k] = v
+	}
+	if e.containerName && cont.Name != "" {
+		fields[enrichContainerName] = strings.TrimPrefix(cont.Name, "/")
+	}
+	if cont.Config == nil {
+		return fields
+	}
+	if e.image && cont.Config.Image != "" {
+		fields[enrichImage] = cont.Config.Image
+	}
+	for _, label := range e.labels {
+		if value, ok := cont.Config.Labels[label]; ok {
+			fields[enrichLabelPrefix+label] = value
+		}
+	}
+	return fields
+}
@@ -0,0 +1,209 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Graylog2/go-gelf/gelf"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/bs/container"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestFieldEnricherEnrich(c *check.C) {
+	enricher, err := newFieldEnricher(nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(enricher, check.IsNil)
+	enricher, err = newFieldEnricher([]string{"node", "node_addrs", "container_name", "image"}, []string{"label1", "missing"})
+	c.Assert(err, check.IsNil)
+	hostname, err := os.Hostname()
+	c.Assert(err, check.IsNil)
+	addrs, err := nodeAddrs()
+	c.Assert(err, check.IsNil)
+	for _, addr := range addrs {
+		c.Assert(net.ParseIP(addr).IsLoopback(), check.Equals, false)
+	}
+	cont := &container.Container{}
+	cont.Name = "/myContName"
+	cont.Config = &docker.Config{Image: "myimg", Labels: map[string]string{"label1": "val1", "label2": "val2"}}
+	fields := enricher.enrich(map[string]interface{}{"level": "info", "image": "other"}, cont)
+	c.Assert(fields, check.DeepEquals, map[string]interface{}{
+		"level":          "info",
+		"node":           hostname,
+		"node_addrs":     strings.Join(addrs, ","),
+		"container_name": "myContName",
+		"image":          "myimg",
+		"label.label1":   "val1",
+	})
+	enricher, err = newFieldEnricher(nil, []string{"label1"})
+	c.Assert(err, check.IsNil)
+	c.Assert(enricher.enrich(nil, &container.Container{}), check.DeepEquals, map[string]interface{}{})
+	_, err = newFieldEnricher([]string{"pod"}, nil)
+	c.Assert(err, check.ErrorMatches, `invalid enrichment field "pod", expected one of: node, node_addrs, container_name, image`)
+}
+
+func (s *S) TestFieldEnricherHTTPBackend(c *check.C) {
+	srv, reqCh := startHTTPReceiver(c, nil)
+	defer srv.Close()
+	os.Setenv("LOG_PARSERS", "logfmt")
+	os.Setenv("LOG_ENRICH_FIELDS", "container_name,image")
+	os.Setenv("LOG_ENRICH_LABELS", "label1")
+	os.Setenv("LOG_HTTP_URL", srv.URL)
+	os.Setenv("LOG_HTTP_BATCH_SIZE", "2")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"http"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "level=info", "plain msg")
+	req := recvHTTPTimeout(c, reqCh)
+	var entries []jsonLogEntry
+	err = json.Unmarshal(req.body, &entries)
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 2)
+	metadata := map[string]interface{}{"container_name": "myContName", "image": "myimg", "label.label1": "val1"}
+	c.Assert(entries[1].Fields, check.DeepEquals, metadata)
+	metadata["level"] = "info"
+	c.Assert(entries[0].Fields, check.DeepEquals, metadata)
+}
+
+func (s *S) TestFieldEnricherGelfBackend(c *check.C) {
+	reader, err := gelf.NewReader("127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	os.Setenv("LOG_ENRICH_FIELDS", "node_addrs")
+	os.Setenv("LOG_ENRICH_LABELS", "label1")
+	os.Setenv("LOG_GELF_HOST", reader.Addr())
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"gelf"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg")
+	msg, err := reader.ReadMessage()
+	c.Assert(err, check.IsNil)
+	addrs, err := nodeAddrs()
+	c.Assert(err, check.IsNil)
+	c.Assert(msg.Extra["_node_addrs"], check.Equals, strings.Join(addrs, ","))
+	c.Assert(msg.Extra["_label.label1"], check.Equals, "val1")
+}
+
+func (s *S) TestFieldEnricherGelfBackendNativeFields(c *check.C) {
+	reader, err := gelf.NewReader("127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	os.Setenv("LOG_ENRICH_FIELDS", "node,image,container_name")
+	os.Setenv("LOG_GELF_HOST", reader.Addr())
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"gelf"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg")
+	msg, err := reader.ReadMessage()
+	c.Assert(err, check.IsNil)
+	s.checkGelfMessage(c, msg, "mymsg")
+	for _, name := range []string{"_field_node", "_field_image", "_field_container_name"} {
+		_, ok := msg.Extra[name]
+		c.Check(ok, check.Equals, false, check.Commentf("unexpected field %s", name))
+	}
+}
+
+func (s *S) TestFieldEnricherRFC5424(c *check.C) {
+	os.Setenv("LOG_ENRICH_FIELDS", "container_name,image")
+	os.Setenv("LOG_SYSLOG_HOSTNAME", "mynode")
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	udpConn, err := net.ListenUDP("udp", addr)
+	c.Assert(err, check.IsNil)
+	defer udpConn.Close()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", fmt.Sprintf("udp://%s?format=rfc5424", udpConn.LocalAddr()))
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg")
+	buffer := make([]byte, 1024)
+	udpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := udpConn.Read(buffer)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buffer[:n]), check.Equals, fmt.Sprintf(`<30>1 2015-06-05T13:13:47-03:00 mynode coolappname procx - [tsuru@32473 container_id="%s" image="myimg" container_name="myContName"] mymsg`+"\n", s.id))
+}
+
+func (s *S) TestFieldEnricherRFC5424NativeFields(c *check.C) {
+	os.Setenv("LOG_ENRICH_FIELDS", "node,image")
+	os.Setenv("LOG_ENRICH_LABELS", "label1,label2")
+	os.Setenv("LOG_SYSLOG_RFC5424_LABELS", "label1")
+	hostname, err := os.Hostname()
+	c.Assert(err, check.IsNil)
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	udpConn, err := net.ListenUDP("udp", addr)
+	c.Assert(err, check.IsNil)
+	defer udpConn.Close()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", fmt.Sprintf("udp://%s?format=rfc5424", udpConn.LocalAddr()))
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg")
+	buffer := make([]byte, 1024)
+	udpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := udpConn.Read(buffer)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buffer[:n]), check.Equals, fmt.Sprintf(`<30>1 2015-06-05T13:13:47-03:00 %s coolappname procx - [tsuru@32473 container_id="%s" image="myimg" label1="val1" label.label2="v\"2\]"] mymsg`+"\n", hostname, s.id))
+}
+
+func (s *S) TestSendContainerEvent(c *check.C) {
+	srv, reqCh := startHTTPReceiver(c, nil)
+	defer srv.Close()
+	os.Setenv("LOG_ENRICH_FIELDS", "container_name")
+	os.Setenv("LOG_HTTP_URL", srv.URL)
+	os.Setenv("LOG_HTTP_BATCH_SIZE", "1")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"http"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	cont := &container.Container{AppName: "coolappname", ProcessName: "procx"}
+	cont.ID = "abc"
+	cont.Name = "/myContName"
+	lf.SendContainerEvent(cont, "container removed", map[string]interface{}{"event": "zombie_removal"})
+	req := recvHTTPTimeout(c, reqCh)
+	var entries []jsonLogEntry
+	err = json.Unmarshal(req.body, &entries)
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 1)
+	c.Assert(entries[0].Message, check.Equals, "container removed")
+	c.Assert(entries[0].AppName, check.Equals, "coolappname")
+	c.Assert(entries[0].Container, check.Equals, "abc")
+	c.Assert(entries[0].Process, check.Equals, "procx")
+	c.Assert(entries[0].Priority, check.Equals, 29)
+	c.Assert(entries[0].Fields, check.DeepEquals, map[string]interface{}{"event": "zombie_removal", "container_name": "myContName"})
+}
@@ -0,0 +1,285 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/config"
+)
+
+// fieldExtractor extracts structured fields from the content of log
+// messages, trying each configured parser in order until one matches.
+type fieldExtractor struct {
+	parsers []fieldParser
+}
+
+type fieldParser func(content []byte) map[string]interface{}
+
+var fieldParsers = map[string]fieldParser{
+	"json":     parseJSONFields,
+	"logfmt":   parseLogfmtFields,
+	"combined": parseCombinedFields,
+	"nginx":    parseCombinedFields,
+	"apache":   parseCombinedFields,
+	"go":       parseGoFields,
+	"python":   parsePythonFields,
+}
+
+var (
+	// combinedLogRegexp matches the nginx and Apache combined access log
+	// formats, the referer and user agent are optional to also match the
+	// common log format.
+	combinedLogRegexp = regexp.MustCompile(`^(\S+) \S+ (\S+) \[([^\]]+)\] "(\S+) (\S+) ([^"]+)" (\d{3}) (\d+|-)(?: "([^"]*)" "([^"]*)")?`)
+	// goLogRegexp matches the standard library log package format with
+	// optional microseconds and file name.
+	goLogRegexp = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?) (?:(\S+\.go):(\d+): )?(.*)$`)
+	// pythonLogRegexp matches the logging module default format
+	// (LEVEL:logger:message) and the common "asctime - name - levelname -
+	// message" format.
+	pythonLogRegexp     = regexp.MustCompile(`^(DEBUG|INFO|WARNING|ERROR|CRITICAL):([^:]*):(.*)$`)
+	pythonLogTimeRegexp = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2},\d{3}) - (\S+) - (DEBUG|INFO|WARNING|ERROR|CRITICAL) - (.*)$`)
+)
+
+// parserNamesFromEnv returns the parsers in LOG_PARSERS. LOG_GELF_TRY_JSON is
+// a deprecated alias for adding the json parser.
+func parserNamesFromEnv() []string {
+	names := config.StringsEnvOrDefault(nil, "LOG_PARSERS")
+	if tryJSON, _ := strconv.ParseBool(os.Getenv("LOG_GELF_TRY_JSON")); !tryJSON {
+		return names
+	}
+	bslog.Warnf("LOG_GELF_TRY_JSON is deprecated, add json to LOG_PARSERS instead")
+	for _, name := range names {
+		if strings.ToLower(name) == "json" {
+			return names
+		}
+	}
+	return append(names, "json")
+}
+
+func newFieldExtractor(names []string) (*fieldExtractor, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	extractor := &fieldExtractor{}
+	for _, name := range names {
+		parser, ok := fieldParsers[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("invalid log parser %q, expected one of: %s", name, strings.Join(fieldParserNames(), ", "))
+		}
+		extractor.parsers = append(extractor.parsers, parser)
+	}
+	return extractor, nil
+}
+
+func fieldParserNames() []string {
+	names := make([]string, 0, len(fieldParsers))
+	for name := range fieldParsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (e *fieldExtractor) extract(content []byte) map[string]interface{} {
+	content = bytes.TrimSpace(content)
+	if len(content) == 0 {
+		return nil
+	}
+	for _, parser := range e.parsers {
+		if fields := parser(content); len(fields) > 0 {
+			return fields
+		}
+	}
+	return nil
+}
+
+func parseJSONFields(content []byte) map[string]interface{} {
+	if content[0] != '{' || content[len(content)-1] != '}' {
+		return nil
+	}
+	var data map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.UseNumber()
+	if dec.Decode(&data) != nil {
+		return nil
+	}
+	fields := map[string]interface{}{}
+	flattenFields(fields, "", data)
+	return fields
+}
+
+// flattenFields adds the leaves of nested objects and arrays to fields,
+// joining their keys with dots.
+func flattenFields(fields map[string]interface{}, prefix string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			flattenFields(fields, prefix+k+".", item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			flattenFields(fields, prefix+strconv.Itoa(i)+".", item)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			fields[prefix[:len(prefix)-1]] = n
+		} else if f, err := v.Float64(); err == nil {
+			fields[prefix[:len(prefix)-1]] = f
+		} else {
+			fields[prefix[:len(prefix)-1]] = string(v)
+		}
+	default:
+		if prefix != "" {
+			fields[prefix[:len(prefix)-1]] = v
+		}
+	}
+}
+
+// parseLogfmtFields parses lines where every element is a key=value pair,
+// values may be double quoted.
+func parseLogfmtFields(content []byte) map[string]interface{} {
+	fields := map[string]interface{}{}
+	for len(content) > 0 {
+		eqIdx := bytes.IndexByte(content, '=')
+		if eqIdx <= 0 {
+			return nil
+		}
+		key := content[:eqIdx]
+		for _, c := range key {
+			if !isLogfmtKeyChar(c) {
+				return nil
+			}
+		}
+		content = content[eqIdx+1:]
+		var value string
+		if len(content) > 0 && content[0] == '"' {
+			end := 1
+			for end < len(content) && content[end] != '"' {
+				if content[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(content) {
+				return nil
+			}
+			unquoted, err := strconv.Unquote(string(content[:end+1]))
+			if err != nil {
+				return nil
+			}
+			value = unquoted
+			content = content[end+1:]
+			if len(content) > 0 && content[0] != ' ' {
+				return nil
+			}
+		} else {
+			end := bytes.IndexByte(content, ' ')
+			if end < 0 {
+				end = len(content)
+			}
+			value = string(content[:end])
+			content = content[end:]
+		}
+		fields[string(key)] = value
+		content = bytes.TrimLeft(content, " ")
+	}
+	return fields
+}
+
+func isLogfmtKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '-' || c == '.' || c == '/'
+}
+
+func parseCombinedFields(content []byte) map[string]interface{} {
+	m := combinedLogRegexp.FindSubmatch(content)
+	if m == nil {
+		return nil
+	}
+	status, _ := strconv.Atoi(string(m[7]))
+	fields := map[string]interface{}{
+		"remote_addr": string(m[1]),
+		"remote_user": string(m[2]),
+		"time_local":  string(m[3]),
+		"method":      string(m[4]),
+		"path":        string(m[5]),
+		"protocol":    string(m[6]),
+		"status":      status,
+	}
+	if bodySize, err := strconv.Atoi(string(m[8])); err == nil {
+		fields["body_bytes_sent"] = bodySize
+	}
+	if m[9] != nil {
+		fields["http_referer"] = string(m[9])
+		fields["http_user_agent"] = string(m[10])
+	}
+	return fields
+}
+
+func parseGoFields(content []byte) map[string]interface{} {
+	m := goLogRegexp.FindSubmatch(content)
+	if m == nil {
+		return nil
+	}
+	fields := map[string]interface{}{
+		"time":    string(m[1]),
+		"message": string(m[4]),
+	}
+	if m[2] != nil {
+		line, _ := strconv.Atoi(string(m[3]))
+		fields["file"] = string(m[2])
+		fields["line"] = line
+	}
+	return fields
+}
+
+func parsePythonFields(content []byte) map[string]interface{} {
+	if m := pythonLogTimeRegexp.FindSubmatch(content); m != nil {
+		return map[string]interface{}{
+			"time":    string(m[1]),
+			"logger":  string(m[2]),
+			"level":   string(m[3]),
+			"message": string(m[4]),
+		}
+	}
+	if m := pythonLogRegexp.FindSubmatch(content); m != nil {
+		return map[string]interface{}{
+			"level":   string(m[1]),
+			"logger":  string(m[2]),
+			"message": string(m[3]),
+		}
+	}
+	return nil
+}
+
+// sortedFieldKeys returns the keys of fields in a deterministic order.
+func sortedFieldKeys(fields map[string]interface{}) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// fieldString formats a field value as text.
+func fieldString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(value)
+}
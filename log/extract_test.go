@@ -0,0 +1,216 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"github.com/Graylog2/go-gelf/gelf"
+	"golang.org/x/net/websocket"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestFieldExtractorParsers(c *check.C) {
+	tests := []struct {
+		parser   string
+		content  string
+		expected map[string]interface{}
+	}{
+		{
+			parser:  "json",
+			content: ` {"level": "info", "count": 2, "ratio": 0.5, "ok": true, "req": {"id": "x", "tags": ["a", "b"]}} `,
+			expected: map[string]interface{}{
+				"level": "info", "count": int64(2), "ratio": 0.5, "ok": true,
+				"req.id": "x", "req.tags.0": "a", "req.tags.1": "b",
+			},
+		},
+		{parser: "json", content: `{"invalid": }`},
+		{parser: "json", content: `prefix {"a": 1}`},
+		{
+			parser:   "logfmt",
+			content:  `level=warn msg="hello \"world\"" duration=10ms path=/api`,
+			expected: map[string]interface{}{"level": "warn", "msg": `hello "world"`, "duration": "10ms", "path": "/api"},
+		},
+		{parser: "logfmt", content: `starting server on port=8080`},
+		{parser: "logfmt", content: `msg="unterminated`},
+		{
+			parser:  "nginx",
+			content: `10.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08"`,
+			expected: map[string]interface{}{
+				"remote_addr": "10.0.0.1", "remote_user": "frank", "time_local": "10/Oct/2000:13:55:36 -0700",
+				"method": "GET", "path": "/apache_pb.gif", "protocol": "HTTP/1.0", "status": 200,
+				"body_bytes_sent": 2326, "http_referer": "http://www.example.com/start.html", "http_user_agent": "Mozilla/4.08",
+			},
+		},
+		{
+			parser:  "apache",
+			content: `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "POST /login HTTP/1.1" 302 -`,
+			expected: map[string]interface{}{
+				"remote_addr": "127.0.0.1", "remote_user": "-", "time_local": "10/Oct/2000:13:55:36 -0700",
+				"method": "POST", "path": "/login", "protocol": "HTTP/1.1", "status": 302,
+			},
+		},
+		{
+			parser:   "go",
+			content:  `2017/03/21 18:28:52.123456 main.go:42: listening on :8080`,
+			expected: map[string]interface{}{"time": "2017/03/21 18:28:52.123456", "file": "main.go", "line": 42, "message": "listening on :8080"},
+		},
+		{
+			parser:   "go",
+			content:  `2017/03/21 18:28:52 listening`,
+			expected: map[string]interface{}{"time": "2017/03/21 18:28:52", "message": "listening"},
+		},
+		{
+			parser:   "python",
+			content:  `WARNING:root:Watch out!`,
+			expected: map[string]interface{}{"level": "WARNING", "logger": "root", "message": "Watch out!"},
+		},
+		{
+			parser:   "python",
+			content:  `2017-03-21 18:28:52,123 - myapp.views - ERROR - something failed`,
+			expected: map[string]interface{}{"time": "2017-03-21 18:28:52,123", "logger": "myapp.views", "level": "ERROR", "message": "something failed"},
+		},
+		{parser: "python", content: `just a message`},
+	}
+	for _, tt := range tests {
+		extractor, err := newFieldExtractor([]string{tt.parser})
+		c.Assert(err, check.IsNil)
+		c.Check(extractor.extract([]byte(tt.content)), check.DeepEquals, tt.expected, check.Commentf("%s: %s", tt.parser, tt.content))
+	}
+}
+
+func (s *S) TestFieldExtractorOrder(c *check.C) {
+	extractor, err := newFieldExtractor([]string{"json", "logfmt"})
+	c.Assert(err, check.IsNil)
+	c.Assert(extractor.extract([]byte(`{"a": "b"}`)), check.DeepEquals, map[string]interface{}{"a": "b"})
+	c.Assert(extractor.extract([]byte(`a=b`)), check.DeepEquals, map[string]interface{}{"a": "b"})
+	c.Assert(extractor.extract([]byte(`plain text`)), check.IsNil)
+	extractor, err = newFieldExtractor(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(extractor, check.IsNil)
+	_, err = newFieldExtractor([]string{"xml"})
+	c.Assert(err, check.ErrorMatches, `invalid log parser "xml", expected one of: apache, combined, go, json, logfmt, nginx, python`)
+}
+
+func (s *S) TestFieldExtractorHTTPBackend(c *check.C) {
+	srv, reqCh := startHTTPReceiver(c, nil)
+	defer srv.Close()
+	os.Setenv("LOG_PARSERS", "json,logfmt")
+	os.Setenv("LOG_HTTP_URL", srv.URL)
+	os.Setenv("LOG_HTTP_BATCH_SIZE", "2")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"http"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, `{"level": "info", "user": {"id": 7}}`, "plain msg")
+	req := recvHTTPTimeout(c, reqCh)
+	var entries []jsonLogEntry
+	err = json.Unmarshal(req.body, &entries)
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 2)
+	c.Assert(entries[0].Fields, check.DeepEquals, map[string]interface{}{"level": "info", "user.id": float64(7)})
+	c.Assert(entries[1].Fields, check.IsNil)
+}
+
+func (s *S) TestFieldExtractorGelfBackend(c *check.C) {
+	reader, err := gelf.NewReader("127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	os.Setenv("LOG_PARSERS", "logfmt")
+	os.Setenv("LOG_GELF_HOST", reader.Addr())
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"gelf"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, `level=error id=1 http/status=500 app=other`)
+	msg, err := reader.ReadMessage()
+	c.Assert(err, check.IsNil)
+	c.Assert(msg.Extra["_level"], check.Equals, "error")
+	c.Assert(msg.Extra["_http_status"], check.Equals, "500")
+	_, ok := msg.Extra["_id"]
+	c.Assert(ok, check.Equals, false)
+	c.Assert(msg.Extra["_field_id"], check.Equals, "1")
+	c.Assert(msg.Extra["_app"], check.Equals, "coolappname")
+	c.Assert(msg.Extra["_field_app"], check.Equals, "other")
+}
+
+func (s *S) TestFieldExtractorTsuruBackend(c *check.C) {
+	bodyCh := make(chan string, 1)
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		scanner := bufio.NewScanner(ws)
+		for scanner.Scan() {
+			bodyCh <- scanner.Text()
+		}
+	}))
+	defer srv.Close()
+	os.Setenv("LOG_PARSERS", "json")
+	os.Setenv("TSURU_ENDPOINT", srv.URL)
+	os.Setenv("TSURU_TOKEN", "mytoken")
+	os.Setenv("LOG_TSURU_BATCH_SIZE", "0")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"tsuru"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, `{"level": "info"}`)
+	var entry tsuruLogEntry
+	err = json.Unmarshal([]byte(recvTimeout(c, bodyCh)), &entry)
+	c.Assert(err, check.IsNil)
+	c.Assert(entry.Message, check.Equals, `{"level": "info"}`)
+	c.Assert(entry.AppName, check.Equals, "coolappname")
+	c.Assert(entry.Fields, check.DeepEquals, map[string]interface{}{"level": "info"})
+}
+
+func (s *S) TestParserNamesFromEnv(c *check.C) {
+	c.Assert(parserNamesFromEnv(), check.IsNil)
+	os.Setenv("LOG_GELF_TRY_JSON", "true")
+	defer os.Unsetenv("LOG_GELF_TRY_JSON")
+	c.Assert(parserNamesFromEnv(), check.DeepEquals, []string{"json"})
+	os.Setenv("LOG_PARSERS", "logfmt")
+	c.Assert(parserNamesFromEnv(), check.DeepEquals, []string{"logfmt", "json"})
+	os.Setenv("LOG_PARSERS", "JSON,logfmt")
+	c.Assert(parserNamesFromEnv(), check.DeepEquals, []string{"JSON", "logfmt"})
+}
+
+func (s *S) TestFieldExtractorRFC5424(c *check.C) {
+	os.Setenv("LOG_PARSERS", "logfmt")
+	os.Setenv("LOG_SYSLOG_HOSTNAME", "mynode")
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	udpConn, err := net.ListenUDP("udp", addr)
+	c.Assert(err, check.IsNil)
+	defer udpConn.Close()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", fmt.Sprintf("udp://%s?format=rfc5424", udpConn.LocalAddr()))
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, `b=2 a="x y"`)
+	buffer := make([]byte, 1024)
+	udpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := udpConn.Read(buffer)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buffer[:n]), check.Equals, fmt.Sprintf(`<30>1 2015-06-05T13:13:47-03:00 mynode coolappname procx - [tsuru@32473 container_id="%s" image="myimg" a="x y" b="2"] b=2 a="x y"`+"\n", s.id))
+}
@@ -0,0 +1,417 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/config"
+)
+
+const (
+	fileFormatSyslog = "syslog"
+	fileFormatJSON   = "json"
+	fileFormatRaw    = "raw"
+
+	fileRotateTimeFormat = "20060102-150405.000000000"
+
+	// fileIdleCheckInterval is the minimum interval between checks for idle
+	// log files.
+	fileIdleCheckInterval = 10 * time.Second
+)
+
+type fileBackend struct {
+	backendStats
+	msgCh      chan<- LogMessage
+	quitCh     chan<- bool
+	nextNotify *time.Timer
+}
+
+type fileForwarder struct {
+	dir         string
+	format      string
+	maxSize     int64
+	maxAge      time.Duration
+	retention   int
+	maxOpen     int
+	idleTimeout time.Duration
+}
+
+type fileLogEntry struct {
+	jsonLogEntry
+	rawPriority []byte
+}
+
+func (b *fileBackend) initialize() error {
+	bufferSize := config.IntEnvOrDefault(config.DefaultBufferSize, "LOG_FILE_BUFFER_SIZE", "LOG_BUFFER_SIZE")
+	format := config.StringEnvOrDefault(fileFormatSyslog, "LOG_FILE_FORMAT")
+	switch format {
+	case fileFormatSyslog, fileFormatJSON, fileFormatRaw:
+	default:
+		return fmt.Errorf("invalid file log format %q, expected %s, %s or %s", format, fileFormatSyslog, fileFormatJSON, fileFormatRaw)
+	}
+	dir := config.StringEnvOrDefault("/var/log/bs", "LOG_FILE_DIR")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create log directory %q: %s", dir, err)
+	}
+	b.nextNotify = time.NewTimer(0)
+	b.msgCh, b.quitCh, err = processMessages(&fileForwarder{
+		dir:         dir,
+		format:      format,
+		maxSize:     int64(config.IntEnvOrDefault(100*1024*1024, "LOG_FILE_MAX_SIZE")),
+		maxAge:      config.SecondsEnvOrDefault(24*60*60, "LOG_FILE_MAX_AGE"),
+		retention:   config.IntEnvOrDefault(5, "LOG_FILE_RETENTION"),
+		maxOpen:     config.IntEnvOrDefault(256, "LOG_FILE_MAX_OPEN_FILES"),
+		idleTimeout: config.SecondsEnvOrDefault(5*60, "LOG_FILE_IDLE_TIMEOUT"),
+	}, bufferSize, &b.backendStats)
+	return err
+}
+
+func (b *fileBackend) sendMessage(parts *rawLogParts, appName, processName, container string) {
+	if len(container) > containerIDTrimSize {
+		container = container[:containerIDTrimSize]
+	}
+	priority, _ := strconv.Atoi(string(parts.priority))
+	msg := &fileLogEntry{
+		jsonLogEntry: jsonLogEntry{
+			Date:      parts.ts,
+			AppName:   appName,
+			Process:   processName,
+			Container: container,
+			Priority:  priority,
+			Message:   string(parts.content),
+			Fields:    parts.fields,
+		},
+		rawPriority: parts.priority,
+	}
+	if !b.enqueue(b.msgCh, msg, parts.ts) {
+		select {
+		case <-b.nextNotify.C:
+			bslog.Errorf("Dropping log messages to file due to full channel buffer.")
+			b.nextNotify.Reset(time.Minute)
+		default:
+		}
+	}
+}
+
+func (b *fileBackend) stop() {
+	close(b.quitCh)
+}
+
+func (f *fileForwarder) connect() (net.Conn, error) {
+	maxOpen := f.maxOpen
+	if maxOpen <= 0 {
+		maxOpen = 256
+	}
+	files, err := lru.NewWithEvict(maxOpen, func(key, value interface{}) {
+		if err := value.(*rotatingFile).close(); err != nil {
+			bslog.Errorf("[log forwarder] unable to close log file %q: %s", key, err)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &fileSetConn{
+		forwarder: f,
+		files:     files,
+		lastCheck: time.Now(),
+	}, nil
+}
+
+func (f *fileForwarder) process(conn net.Conn, msg LogMessage) error {
+	entry := msg.(*fileLogEntry)
+	var line []byte
+	switch f.format {
+	case fileFormatJSON:
+		data, err := json.Marshal(entry.jsonLogEntry)
+		if err != nil {
+			return fmt.Errorf("error encoding message: %s", err)
+		}
+		line = append(data, '\n')
+	case fileFormatRaw:
+		line = make([]byte, 0, len(entry.Message)+1)
+		line = append(line, entry.Message...)
+		line = append(line, '\n')
+	default:
+		line = make([]byte, 0, len(entry.Message)+64)
+		line = append(line, '<')
+		line = append(line, entry.rawPriority...)
+		line = append(line, '>')
+		line = append(line, entry.Date.In(time.Local).Format(time.Stamp)...)
+		line = append(line, ' ')
+		line = append(line, entry.Container...)
+		line = append(line, ' ')
+		line = append(line, entry.AppName...)
+		line = append(line, '[')
+		line = append(line, entry.Process...)
+		line = append(line, ']', ':', ' ')
+		line = append(line, entry.Message...)
+		line = append(line, '\n')
+	}
+	path := filepath.Join(f.dir, sanitizePathElement(entry.AppName), sanitizePathElement(entry.Process)+".log")
+	return conn.(*fileSetConn).write(path, line)
+}
+
+func (f *fileForwarder) close(conn net.Conn) {
+	conn.Close()
+}
+
+func sanitizePathElement(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == os.PathSeparator || r == 0 {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		return "_" + name
+	}
+	return name
+}
+
+// fileSetConn keeps the log files recently written by the forwarder open,
+// opening and rotating them as needed. The least recently written file is
+// closed when there are too many open files, and files not written for the
+// idle timeout are closed too, so files of removed apps aren't kept open.
+type fileSetConn struct {
+	net.Conn
+	forwarder *fileForwarder
+	files     *lru.Cache
+	lastCheck time.Time
+}
+
+func (c *fileSetConn) write(path string, data []byte) error {
+	var file *rotatingFile
+	if value, ok := c.files.Get(path); ok {
+		file = value.(*rotatingFile)
+	} else {
+		file = &rotatingFile{
+			path:      path,
+			maxSize:   c.forwarder.maxSize,
+			maxAge:    c.forwarder.maxAge,
+			retention: c.forwarder.retention,
+		}
+		c.files.Add(path, file)
+	}
+	now := time.Now()
+	file.lastWrite = now
+	err := file.write(data)
+	if now.Sub(c.lastCheck) >= fileIdleCheckInterval {
+		c.closeIdle(now)
+	}
+	return err
+}
+
+// closeIdle closes the files not written since the idle timeout.
+func (c *fileSetConn) closeIdle(now time.Time) {
+	c.lastCheck = now
+	if c.forwarder.idleTimeout <= 0 {
+		return
+	}
+	for _, key := range c.files.Keys() {
+		value, ok := c.files.Peek(key)
+		if !ok {
+			continue
+		}
+		if now.Sub(value.(*rotatingFile).lastWrite) < c.forwarder.idleTimeout {
+			return
+		}
+		c.files.Remove(key)
+	}
+}
+
+func (c *fileSetConn) Close() error {
+	c.files.Purge()
+	return nil
+}
+
+type rotatingFile struct {
+	path      string
+	maxSize   int64
+	maxAge    time.Duration
+	retention int
+	file      *os.File
+	size      int64
+	createdAt time.Time
+	lastWrite time.Time
+}
+
+// createdPath returns the path of the hidden file keeping the time the log
+// file was created or last rotated, so its age survives reopening the file
+// and restarting bs.
+func (f *rotatingFile) createdPath() string {
+	return filepath.Join(filepath.Dir(f.path), "."+filepath.Base(f.path)+".created")
+}
+
+// loadCreatedAt sets the creation time of the open log file. Empty files are
+// considered new, files without a valid creation time, like the ones written
+// by older versions, use their modification time.
+func (f *rotatingFile) loadCreatedAt(info os.FileInfo) {
+	if info.Size() > 0 {
+		data, err := ioutil.ReadFile(f.createdPath())
+		if err == nil {
+			if createdAt, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data))); err == nil {
+				f.createdAt = createdAt
+				return
+			}
+		}
+		f.createdAt = info.ModTime()
+	} else {
+		f.createdAt = time.Now()
+	}
+	err := ioutil.WriteFile(f.createdPath(), []byte(f.createdAt.UTC().Format(time.RFC3339Nano)+"\n"), 0644)
+	if err != nil {
+		bslog.Errorf("[log forwarder] unable to write creation time of log file %q: %s", f.path, err)
+	}
+}
+
+func (f *rotatingFile) open() error {
+	err := os.MkdirAll(filepath.Dir(f.path), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.loadCreatedAt(info)
+	return nil
+}
+
+func (f *rotatingFile) write(data []byte) error {
+	if f.file == nil {
+		err := f.open()
+		if err != nil {
+			return err
+		}
+	}
+	if f.needsRotation(len(data)) {
+		err := f.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return err
+}
+
+func (f *rotatingFile) needsRotation(toWrite int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.maxSize > 0 && f.size+int64(toWrite) > f.maxSize {
+		return true
+	}
+	return f.maxAge > 0 && time.Since(f.createdAt) >= f.maxAge
+}
+
+func (f *rotatingFile) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return err
+	}
+	rotatedPath := f.path + "." + time.Now().UTC().Format(fileRotateTimeFormat)
+	err = os.Rename(f.path, rotatedPath)
+	if err != nil {
+		return err
+	}
+	err = f.open()
+	if err != nil {
+		return err
+	}
+	// compression is waited for by LogForwarder.Wait, so rotated files
+	// aren't left half compressed when bs stops.
+	stopWg.Add(1)
+	go func() {
+		defer stopWg.Done()
+		if err := compressFile(rotatedPath); err != nil {
+			bslog.Errorf("[log forwarder] unable to compress rotated file %q: %s", rotatedPath, err)
+			return
+		}
+		if err := f.removeExpired(); err != nil {
+			bslog.Errorf("[log forwarder] unable to remove expired files for %q: %s", f.path, err)
+		}
+	}()
+	return nil
+}
+
+func (f *rotatingFile) removeExpired() error {
+	if f.retention <= 0 {
+		return nil
+	}
+	rotated, err := filepath.Glob(f.path + ".*.gz")
+	if err != nil {
+		return err
+	}
+	if len(rotated) <= f.retention {
+		return nil
+	}
+	sort.Strings(rotated)
+	for _, name := range rotated[:len(rotated)-f.retention] {
+		err = os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *rotatingFile) close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gzipWriter := gzip.NewWriter(dst)
+	_, err = io.Copy(gzipWriter, src)
+	if err == nil {
+		err = gzipWriter.Close()
+	}
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,213 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func waitForFile(c *check.C, path string, expected string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		data, err := ioutil.ReadFile(path)
+		if err == nil && string(data) == expected {
+			return
+		}
+		select {
+		case <-timeout:
+			c.Fatalf("timeout waiting for %q, last content %q: %v", path, string(data), err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (s *S) TestFileForwarder(c *check.C) {
+	dirName, err := ioutil.TempDir("", "bs-file-log")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dirName)
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{format: "syslog", expected: fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: mymsg\n", s.idShort)},
+		{format: "raw", expected: "mymsg\n"},
+		{format: "json", expected: fmt.Sprintf(`{"date":"2015-06-05T16:13:47Z","app":"coolappname","process":"procx","container":"%s","priority":30,"message":"mymsg"}`+"\n", s.idShort)},
+	}
+	for _, tt := range tests {
+		dir := filepath.Join(dirName, tt.format)
+		os.Setenv("LOG_FILE_DIR", dir)
+		os.Setenv("LOG_FILE_FORMAT", tt.format)
+		lf := LogForwarder{
+			BindAddress:     "udp://127.0.0.1:59317",
+			DockerEndpoint:  s.dockerServer.URL(),
+			EnabledBackends: []string{"file"},
+		}
+		err = lf.Start()
+		c.Assert(err, check.IsNil)
+		s.sendUDPMessages(c, "mymsg")
+		waitForFile(c, filepath.Join(dir, "coolappname", "procx.log"), tt.expected)
+		lf.stopWait()
+	}
+}
+
+func (s *S) TestFileForwarderInvalidFormat(c *check.C) {
+	os.Setenv("LOG_FILE_FORMAT", "xml")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"file"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.ErrorMatches, `unable to initialize log backend "file": invalid file log format "xml", expected syslog, json or raw`)
+}
+
+func (s *S) TestRotatingFileRotateAndRetention(c *check.C) {
+	dirName, err := ioutil.TempDir("", "bs-file-log")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dirName)
+	path := filepath.Join(dirName, "app", "web.log")
+	f := &rotatingFile{path: path, maxSize: 10, retention: 2}
+	defer f.close()
+	for i := 0; i < 5; i++ {
+		err = f.write([]byte(fmt.Sprintf("line-%d\n", i)))
+		c.Assert(err, check.IsNil)
+		time.Sleep(10 * time.Millisecond)
+	}
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "line-4\n")
+	var rotated []string
+	timeout := time.After(5 * time.Second)
+	for {
+		rotated, err = filepath.Glob(path + ".*")
+		c.Assert(err, check.IsNil)
+		if len(rotated) == 2 && strings.HasSuffix(rotated[0], ".gz") && strings.HasSuffix(rotated[1], ".gz") {
+			break
+		}
+		select {
+		case <-timeout:
+			c.Fatalf("timeout waiting for rotated files, got %v", rotated)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	file, err := os.Open(rotated[1])
+	c.Assert(err, check.IsNil)
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	c.Assert(err, check.IsNil)
+	data, err = ioutil.ReadAll(reader)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "line-3\n")
+}
+
+func (s *S) TestRotatingFileRotateByAge(c *check.C) {
+	dirName, err := ioutil.TempDir("", "bs-file-log")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dirName)
+	path := filepath.Join(dirName, "app", "web.log")
+	f := &rotatingFile{path: path, maxAge: time.Millisecond}
+	defer f.close()
+	err = f.write([]byte("line-0\n"))
+	c.Assert(err, check.IsNil)
+	time.Sleep(10 * time.Millisecond)
+	err = f.write([]byte("line-1\n"))
+	c.Assert(err, check.IsNil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "line-1\n")
+}
+
+func (s *S) TestRotatingFileAgeSurvivesReopen(c *check.C) {
+	dirName, err := ioutil.TempDir("", "bs-file-log")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dirName)
+	path := filepath.Join(dirName, "app", "web.log")
+	f := &rotatingFile{path: path, maxAge: time.Hour}
+	err = f.write([]byte("line-0\n"))
+	c.Assert(err, check.IsNil)
+	createdAt := f.createdAt
+	c.Assert(f.close(), check.IsNil)
+	f = &rotatingFile{path: path, maxAge: time.Hour}
+	err = f.write([]byte("line-1\n"))
+	c.Assert(err, check.IsNil)
+	c.Assert(f.createdAt.Equal(createdAt), check.Equals, true)
+	c.Assert(f.close(), check.IsNil)
+	err = ioutil.WriteFile(f.createdPath(), []byte(time.Now().Add(-2*time.Hour).UTC().Format(time.RFC3339Nano)), 0644)
+	c.Assert(err, check.IsNil)
+	f = &rotatingFile{path: path, maxAge: time.Hour}
+	defer f.close()
+	err = f.write([]byte("line-2\n"))
+	c.Assert(err, check.IsNil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "line-2\n")
+	c.Assert(time.Since(f.createdAt) < time.Minute, check.Equals, true)
+}
+
+func (s *S) TestRotatingFileAgeWithoutCreatedFile(c *check.C) {
+	dirName, err := ioutil.TempDir("", "bs-file-log")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dirName)
+	path := filepath.Join(dirName, "web.log")
+	err = ioutil.WriteFile(path, []byte("line-0\n"), 0644)
+	c.Assert(err, check.IsNil)
+	modTime := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(path, modTime, modTime)
+	c.Assert(err, check.IsNil)
+	f := &rotatingFile{path: path, maxAge: time.Hour}
+	defer f.close()
+	err = f.write([]byte("line-1\n"))
+	c.Assert(err, check.IsNil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "line-1\n")
+}
+
+func (s *S) TestFileSetConnClosesIdleAndExcessFiles(c *check.C) {
+	dirName, err := ioutil.TempDir("", "bs-file-log")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dirName)
+	f := &fileForwarder{dir: dirName, maxOpen: 2, idleTimeout: time.Minute}
+	netConn, err := f.connect()
+	c.Assert(err, check.IsNil)
+	conn := netConn.(*fileSetConn)
+	defer conn.Close()
+	var files []*rotatingFile
+	for _, name := range []string{"a.log", "b.log", "c.log"} {
+		err = conn.write(filepath.Join(dirName, name), []byte("line\n"))
+		c.Assert(err, check.IsNil)
+		value, ok := conn.files.Peek(filepath.Join(dirName, name))
+		c.Assert(ok, check.Equals, true)
+		files = append(files, value.(*rotatingFile))
+	}
+	c.Assert(conn.files.Len(), check.Equals, 2)
+	c.Assert(files[0].file, check.IsNil)
+	c.Assert(files[1].file, check.NotNil)
+	files[1].lastWrite = time.Now().Add(-2 * time.Minute)
+	conn.closeIdle(time.Now())
+	c.Assert(conn.files.Len(), check.Equals, 1)
+	c.Assert(files[1].file, check.IsNil)
+	c.Assert(files[2].file, check.NotNil)
+	err = conn.write(filepath.Join(dirName, "b.log"), []byte("line\n"))
+	c.Assert(err, check.IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(dirName, "b.log"))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "line\nline\n")
+}
+
+func (s *S) TestSanitizePathElement(c *check.C) {
+	c.Assert(sanitizePathElement("myapp"), check.Equals, "myapp")
+	c.Assert(sanitizePathElement("a/b"), check.Equals, "a_b")
+	c.Assert(sanitizePathElement(""), check.Equals, "_")
+	c.Assert(sanitizePathElement(".."), check.Equals, "_..")
+}
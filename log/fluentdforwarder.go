@@ -0,0 +1,388 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/config"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	fluentdModeForward       = "forward"
+	fluentdModePackedForward = "packedforward"
+)
+
+// fluentdEventTimeExt is the MessagePack extension type of EventTime values
+// in the fluentd forward protocol.
+const fluentdEventTimeExt = 0
+
+var errFluentdHandshake = errors.New("fluentd handshake failed")
+
+func init() {
+	msgpack.RegisterExt(fluentdEventTimeExt, (*fluentdEventTime)(nil))
+}
+
+// fluentdEventTime is a timestamp encoded as a fluentd EventTime, keeping
+// the nanoseconds of the log message timestamp.
+type fluentdEventTime struct {
+	time.Time
+}
+
+func (t *fluentdEventTime) MarshalMsgpack() ([]byte, error) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, uint32(t.Unix()))
+	binary.BigEndian.PutUint32(data[4:], uint32(t.Nanosecond()))
+	return data, nil
+}
+
+func (t *fluentdEventTime) UnmarshalMsgpack(data []byte) error {
+	if len(data) != 8 {
+		return fmt.Errorf("invalid fluentd event time size %d", len(data))
+	}
+	t.Time = time.Unix(int64(binary.BigEndian.Uint32(data)), int64(binary.BigEndian.Uint32(data[4:])))
+	return nil
+}
+
+// msgpackMarshal encodes v using the smallest representation for integers
+// and sorted map keys.
+func msgpackMarshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.UseCompactInts(true)
+	enc.SetSortMapKeys(true)
+	err := enc.Encode(v)
+	return buf.Bytes(), err
+}
+
+type fluentdBackend struct {
+	backendStats
+	tagPrefix  string
+	msgCh      chan<- LogMessage
+	quitCh     chan<- bool
+	nextNotify *time.Timer
+}
+
+type fluentdForwarder struct {
+	url           *url.URL
+	packed        bool
+	requireAck    bool
+	ackTimeout    time.Duration
+	sharedKey     string
+	username      string
+	password      string
+	hostname      string
+	batchSize     int
+	batchInterval time.Duration
+	stats         *backendStats
+	retry         *batchRetry
+}
+
+type fluentdLogEntry struct {
+	tag    string
+	ts     time.Time
+	record map[string]interface{}
+}
+
+// fluentdConn keeps the decoder used to read handshake messages and acks
+// from the server, as buffered data must not be lost between reads.
+type fluentdConn struct {
+	net.Conn
+	dec *msgpack.Decoder
+}
+
+func (b *fluentdBackend) initialize() error {
+	bufferSize := config.IntEnvOrDefault(config.DefaultBufferSize, "LOG_FLUENTD_BUFFER_SIZE", "LOG_BUFFER_SIZE")
+	addr := config.StringEnvOrDefault("tcp://localhost:24224", "LOG_FLUENTD_ADDRESS")
+	forwardURL, err := url.Parse(addr)
+	if err != nil {
+		return fmt.Errorf("unable to parse %q: %s", addr, err)
+	}
+	if forwardURL.Scheme != "tcp" {
+		return fmt.Errorf("invalid protocol %q, expected tcp", forwardURL.Scheme)
+	}
+	mode := config.StringEnvOrDefault(fluentdModeForward, "LOG_FLUENTD_MODE")
+	if mode != fluentdModeForward && mode != fluentdModePackedForward {
+		return fmt.Errorf("invalid fluentd mode %q, expected %s or %s", mode, fluentdModeForward, fluentdModePackedForward)
+	}
+	requireAck, _ := strconv.ParseBool(config.StringEnvOrDefault("FALSE", "LOG_FLUENTD_REQUIRE_ACK"))
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	b.tagPrefix = config.StringEnvOrDefault("tsuru", "LOG_FLUENTD_TAG_PREFIX")
+	b.nextNotify = time.NewTimer(0)
+	b.msgCh, b.quitCh, err = processMessages(&fluentdForwarder{
+		url:           forwardURL,
+		packed:        mode == fluentdModePackedForward,
+		requireAck:    requireAck,
+		ackTimeout:    config.SecondsEnvOrDefault(10, "LOG_FLUENTD_ACK_TIMEOUT"),
+		sharedKey:     config.StringEnvOrDefault("", "LOG_FLUENTD_SHARED_KEY"),
+		username:      config.StringEnvOrDefault("", "LOG_FLUENTD_USERNAME"),
+		password:      config.StringEnvOrDefault("", "LOG_FLUENTD_PASSWORD"),
+		hostname:      hostname,
+		batchSize:     config.IntEnvOrDefault(100, "LOG_FLUENTD_BATCH_SIZE"),
+		batchInterval: config.SecondsEnvOrDefault(1, "LOG_FLUENTD_BATCH_INTERVAL"),
+		stats:         &b.backendStats,
+		retry:         newBatchRetry(bufferSize, &b.backendStats),
+	}, bufferSize, &b.backendStats)
+	return err
+}
+
+func (b *fluentdBackend) sendMessage(parts *rawLogParts, appName, processName, container string) {
+	if len(container) > containerIDTrimSize {
+		container = container[:containerIDTrimSize]
+	}
+	tag := b.tagPrefix + "." + appName
+	if processName != "" {
+		tag += "." + processName
+	}
+	priority, _ := strconv.Atoi(string(parts.priority))
+	msg := &fluentdLogEntry{
+		tag: tag,
+		ts:  parts.ts,
+		record: map[string]interface{}{
+			"app":       appName,
+			"process":   processName,
+			"container": container,
+			"priority":  priority,
+			"severity":  priority & severityMask,
+			"facility":  priority >> 3,
+			"message":   string(parts.content),
+		},
+	}
+	if parts.fields != nil {
+		msg.record["fields"] = parts.fields
+	}
+	if !b.enqueue(b.msgCh, msg, parts.ts) {
+		select {
+		case <-b.nextNotify.C:
+			bslog.Errorf("Dropping log messages to fluentd due to full channel buffer.")
+			b.nextNotify.Reset(time.Minute)
+		default:
+		}
+	}
+}
+
+func (b *fluentdBackend) stop() {
+	close(b.quitCh)
+}
+
+func (f *fluentdForwarder) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout(f.url.Scheme, f.url.Host, forwardConnDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("[log forwarder] unable to connect to %q: %s", f.url, err)
+	}
+	fConn := &fluentdConn{Conn: conn, dec: msgpack.NewDecoder(conn)}
+	if f.sharedKey != "" {
+		err = f.handshake(fConn)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("[log forwarder] unable to connect to %q: %s", f.url, err)
+		}
+	}
+	return newBatchConn(fConn, f.stats, f.retry, f.batchSize, 0, f.batchInterval, func(entries []batchEntry) error {
+		return f.send(fConn, entries)
+	}), nil
+}
+
+func (f *fluentdForwarder) process(conn net.Conn, msg LogMessage) error {
+	entry := msg.(*fluentdLogEntry)
+	data, err := msgpackMarshal([]interface{}{&fluentdEventTime{entry.ts}, entry.record})
+	if err != nil {
+		return fmt.Errorf("error encoding message: %s", err)
+	}
+	return conn.(*batchConn).add(batchEntry{key: entry.tag, data: data})
+}
+
+func (f *fluentdForwarder) close(conn net.Conn) {
+	conn.Close()
+}
+
+// send sends the entries of each tag as a separate message, acknowledged
+// separately when acks are required. When a tag fails, only the entries of
+// the tags not yet sent are kept to be sent again.
+func (f *fluentdForwarder) send(conn *fluentdConn, entries []batchEntry) error {
+	var tags []string
+	byTag := map[string][]batchEntry{}
+	for _, e := range entries {
+		if _, ok := byTag[e.key]; !ok {
+			tags = append(tags, e.key)
+		}
+		byTag[e.key] = append(byTag[e.key], e)
+	}
+	var sent []batchEntry
+	for i, tag := range tags {
+		err := f.sendTag(conn, tag, byTag[tag])
+		if err != nil {
+			if i == 0 {
+				return err
+			}
+			var unsent []batchEntry
+			for _, tag := range tags[i:] {
+				unsent = append(unsent, byTag[tag]...)
+			}
+			return partialBatchError{error: err, sent: sent, unsent: unsent}
+		}
+		sent = append(sent, byTag[tag]...)
+	}
+	return nil
+}
+
+func (f *fluentdForwarder) sendTag(conn *fluentdConn, tag string, entries []batchEntry) error {
+	option := map[string]interface{}{"size": len(entries)}
+	var chunk string
+	if f.requireAck {
+		id := make([]byte, 16)
+		_, err := rand.Read(id)
+		if err != nil {
+			return err
+		}
+		chunk = base64.StdEncoding.EncodeToString(id)
+		option["chunk"] = chunk
+	}
+	var msg bytes.Buffer
+	enc := msgpack.NewEncoder(&msg)
+	enc.UseCompactInts(true)
+	enc.SetSortMapKeys(true)
+	enc.EncodeArrayLen(3)
+	enc.EncodeString(tag)
+	if f.packed {
+		var events []byte
+		for _, e := range entries {
+			events = append(events, e.data...)
+		}
+		enc.EncodeBytes(events)
+	} else {
+		enc.EncodeArrayLen(len(entries))
+		for _, e := range entries {
+			msg.Write(e.data)
+		}
+	}
+	err := enc.Encode(option)
+	if err != nil {
+		return droppedBatchError{fmt.Errorf("error encoding batch: %s", err)}
+	}
+	buf := msg.Bytes()
+	err = conn.SetWriteDeadline(time.Now().Add(forwardConnWriteTimeout))
+	if err != nil {
+		return err
+	}
+	n, err := conn.Write(buf)
+	if err != nil {
+		return err
+	}
+	if n < len(buf) {
+		return fmt.Errorf("[log forwarder] short write trying to write log to %q", conn.RemoteAddr())
+	}
+	if !f.requireAck {
+		return nil
+	}
+	err = conn.SetReadDeadline(time.Now().Add(f.ackTimeout))
+	if err != nil {
+		return err
+	}
+	resp, err := conn.dec.DecodeInterfaceLoose()
+	if err != nil {
+		return fmt.Errorf("[log forwarder] unable to read ack from %q: %s", f.url, err)
+	}
+	respMap, _ := resp.(map[string]interface{})
+	if ack := msgpackString(respMap["ack"]); ack != chunk {
+		return fmt.Errorf("[log forwarder] invalid ack from %q: expected %q, got %q", f.url, chunk, ack)
+	}
+	return nil
+}
+
+func (f *fluentdForwarder) handshake(conn *fluentdConn) error {
+	err := conn.SetDeadline(time.Now().Add(f.ackTimeout))
+	if err != nil {
+		return err
+	}
+	defer conn.SetDeadline(time.Time{})
+	helo, err := conn.dec.DecodeInterfaceLoose()
+	if err != nil {
+		return fmt.Errorf("%s: unable to read HELO: %s", errFluentdHandshake, err)
+	}
+	heloArr, _ := helo.([]interface{})
+	if len(heloArr) != 2 || msgpackString(heloArr[0]) != "HELO" {
+		return fmt.Errorf("%s: invalid HELO message: %v", errFluentdHandshake, helo)
+	}
+	heloOpts, _ := heloArr[1].(map[string]interface{})
+	nonce := msgpackString(heloOpts["nonce"])
+	authSalt := msgpackString(heloOpts["auth"])
+	saltData := make([]byte, 16)
+	_, err = rand.Read(saltData)
+	if err != nil {
+		return err
+	}
+	salt := hex.EncodeToString(saltData)
+	var passwordDigest string
+	if f.username != "" {
+		passwordDigest = sha512Hex(authSalt, f.username, f.password)
+	}
+	ping, err := msgpackMarshal([]interface{}{
+		"PING",
+		f.hostname,
+		salt,
+		sha512Hex(salt, f.hostname, nonce, f.sharedKey),
+		f.username,
+		passwordDigest,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(ping)
+	if err != nil {
+		return err
+	}
+	pong, err := conn.dec.DecodeInterfaceLoose()
+	if err != nil {
+		return fmt.Errorf("%s: unable to read PONG: %s", errFluentdHandshake, err)
+	}
+	pongArr, _ := pong.([]interface{})
+	if len(pongArr) != 5 || msgpackString(pongArr[0]) != "PONG" {
+		return fmt.Errorf("%s: invalid PONG message: %v", errFluentdHandshake, pong)
+	}
+	if ok, _ := pongArr[1].(bool); !ok {
+		return fmt.Errorf("%s: %s", errFluentdHandshake, msgpackString(pongArr[2]))
+	}
+	serverHostname := msgpackString(pongArr[3])
+	if msgpackString(pongArr[4]) != sha512Hex(salt, serverHostname, nonce, f.sharedKey) {
+		return fmt.Errorf("%s: shared key mismatch", errFluentdHandshake)
+	}
+	return nil
+}
+
+func sha512Hex(values ...string) string {
+	h := sha512.New()
+	for _, v := range values {
+		h.Write([]byte(v))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func msgpackString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	}
+	return ""
+}
@@ -0,0 +1,306 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/check.v1"
+)
+
+type fakeFluentd struct {
+	listener  net.Listener
+	sharedKey string
+	messages  chan []interface{}
+	errors    chan error
+	// lostChunks is the number of chunks that are discarded without an ack,
+	// closing the connection.
+	lostChunks int32
+	// lostTag, when set, restricts the discarded chunks to the ones of the
+	// tag.
+	lostTag string
+}
+
+func msgpackMustMarshal(v interface{}) []byte {
+	data, err := msgpackMarshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// msgpackNormalize converts the integers decoded by msgpack to int64, as
+// compact integers are decoded to the smallest fitting type.
+func msgpackNormalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		for i := range v {
+			v[i] = msgpackNormalize(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = msgpackNormalize(v[k])
+		}
+	case int8, int16, int32, int64, uint8, uint16, uint32, uint64:
+		n, _ := strconv.ParseInt(fmt.Sprint(v), 10, 64)
+		return n
+	}
+	return v
+}
+
+func startFakeFluentd(c *check.C, sharedKey string) *fakeFluentd {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	f := &fakeFluentd{
+		listener:  listener,
+		sharedKey: sharedKey,
+		messages:  make(chan []interface{}, 10),
+		errors:    make(chan error, 10),
+	}
+	go f.serve()
+	return f
+}
+
+func (f *fakeFluentd) addr() string {
+	return "tcp://" + f.listener.Addr().String()
+}
+
+func (f *fakeFluentd) stop() {
+	f.listener.Close()
+}
+
+func (f *fakeFluentd) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeFluentd) handle(conn net.Conn) {
+	defer conn.Close()
+	dec := msgpack.NewDecoder(conn)
+	if f.sharedKey != "" {
+		conn.Write(msgpackMustMarshal([]interface{}{"HELO", map[string]interface{}{
+			"nonce":     []byte("mynonce"),
+			"auth":      "",
+			"keepalive": true,
+		}}))
+		ping, err := dec.DecodeInterfaceLoose()
+		if err != nil {
+			f.errors <- err
+			return
+		}
+		pingArr := ping.([]interface{})
+		salt := msgpackString(pingArr[2])
+		if msgpackString(pingArr[3]) != sha512Hex(salt, msgpackString(pingArr[1]), "mynonce", f.sharedKey) {
+			conn.Write(msgpackMustMarshal([]interface{}{"PONG", false, "shared key mismatch", "", ""}))
+			return
+		}
+		conn.Write(msgpackMustMarshal([]interface{}{"PONG", true, "", "fluentd-server",
+			sha512Hex(salt, "fluentd-server", "mynonce", f.sharedKey)}))
+	}
+	for {
+		msg, err := dec.DecodeInterfaceLoose()
+		if err != nil {
+			return
+		}
+		msgArr := msgpackNormalize(msg).([]interface{})
+		if option, ok := msgArr[len(msgArr)-1].(map[string]interface{}); ok {
+			if chunk, ok := option["chunk"]; ok {
+				if (f.lostTag == "" || msgArr[0] == f.lostTag) && atomic.AddInt32(&f.lostChunks, -1) >= 0 {
+					return
+				}
+				conn.Write(msgpackMustMarshal(map[string]interface{}{"ack": chunk}))
+			}
+		}
+		f.messages <- msgArr
+	}
+}
+
+func (f *fakeFluentd) recv(c *check.C) []interface{} {
+	select {
+	case msg := <-f.messages:
+		return msg
+	case err := <-f.errors:
+		c.Fatalf("fake fluentd error: %s", err)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for fluentd message")
+	}
+	return nil
+}
+
+func (s *S) checkFluentdEvent(c *check.C, event []interface{}, content string) {
+	c.Assert(event, check.HasLen, 2)
+	ts, ok := event[0].(*fluentdEventTime)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(ts.Equal(time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC)), check.Equals, true)
+	c.Assert(event[1], check.DeepEquals, map[string]interface{}{
+		"app":       "coolappname",
+		"process":   "procx",
+		"container": s.idShort,
+		"priority":  int64(30),
+		"severity":  int64(6),
+		"facility":  int64(3),
+		"message":   content,
+	})
+}
+
+func (s *S) TestFluentdForwarderForward(c *check.C) {
+	srv := startFakeFluentd(c, "")
+	defer srv.stop()
+	os.Setenv("LOG_FLUENTD_ADDRESS", srv.addr())
+	os.Setenv("LOG_FLUENTD_BATCH_SIZE", "2")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"fluentd"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg", "mymsg2")
+	msg := srv.recv(c)
+	c.Assert(msg, check.HasLen, 3)
+	c.Assert(msg[0], check.Equals, "tsuru.coolappname.procx")
+	events := msg[1].([]interface{})
+	c.Assert(events, check.HasLen, 2)
+	s.checkFluentdEvent(c, events[0].([]interface{}), "mymsg")
+	s.checkFluentdEvent(c, events[1].([]interface{}), "mymsg2")
+	c.Assert(msg[2], check.DeepEquals, map[string]interface{}{"size": int64(2)})
+}
+
+func (s *S) TestFluentdForwarderPackedForwardAckSharedKey(c *check.C) {
+	srv := startFakeFluentd(c, "secret")
+	defer srv.stop()
+	os.Setenv("LOG_FLUENTD_ADDRESS", srv.addr())
+	os.Setenv("LOG_FLUENTD_MODE", "packedforward")
+	os.Setenv("LOG_FLUENTD_REQUIRE_ACK", "true")
+	os.Setenv("LOG_FLUENTD_SHARED_KEY", "secret")
+	os.Setenv("LOG_FLUENTD_TAG_PREFIX", "myprefix")
+	os.Setenv("LOG_FLUENTD_BATCH_INTERVAL", "0.1")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"fluentd"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg")
+	msg := srv.recv(c)
+	c.Assert(msg, check.HasLen, 3)
+	c.Assert(msg[0], check.Equals, "myprefix.coolappname.procx")
+	packed, ok := msg[1].([]byte)
+	c.Assert(ok, check.Equals, true)
+	event, err := msgpack.NewDecoder(bytes.NewReader(packed)).DecodeInterfaceLoose()
+	c.Assert(err, check.IsNil)
+	s.checkFluentdEvent(c, msgpackNormalize(event).([]interface{}), "mymsg")
+	option := msg[2].(map[string]interface{})
+	c.Assert(option["size"], check.Equals, int64(1))
+	c.Assert(option["chunk"], check.Not(check.Equals), "")
+}
+
+func (s *S) TestFluentdForwarderResendsUnacknowledged(c *check.C) {
+	srv := startFakeFluentd(c, "")
+	srv.lostChunks = 1
+	defer srv.stop()
+	os.Setenv("LOG_FLUENTD_ADDRESS", srv.addr())
+	os.Setenv("LOG_FLUENTD_REQUIRE_ACK", "true")
+	os.Setenv("LOG_FLUENTD_ACK_TIMEOUT", "1")
+	os.Setenv("LOG_FLUENTD_BATCH_INTERVAL", "0.1")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"fluentd"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg")
+	msg := srv.recv(c)
+	c.Assert(msg, check.HasLen, 3)
+	events := msg[1].([]interface{})
+	c.Assert(events, check.HasLen, 1)
+	s.checkFluentdEvent(c, events[0].([]interface{}), "mymsg")
+	c.Assert(atomic.LoadInt32(&srv.lostChunks), check.Equals, int32(-1))
+	stats := lf.BackendStats()[0]
+	c.Assert(stats.Dropped, check.Equals, uint64(0))
+	c.Assert(stats.Reconnects, check.Equals, uint64(1))
+}
+
+func (s *S) TestFluentdForwarderSharedKeyMismatch(c *check.C) {
+	srv := startFakeFluentd(c, "secret")
+	defer srv.stop()
+	os.Setenv("LOG_FLUENTD_ADDRESS", srv.addr())
+	os.Setenv("LOG_FLUENTD_SHARED_KEY", "wrong")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"fluentd"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.ErrorMatches, `unable to initialize log backend "fluentd": \[log forwarder\] unable to connect to ".*": fluentd handshake failed: shared key mismatch`)
+}
+
+func (s *S) TestFluentdEventTimeRoundTrip(c *check.C) {
+	now := time.Unix(1433520827, 123456789)
+	data, err := msgpackMarshal([]interface{}{&fluentdEventTime{now}, "msg"})
+	c.Assert(err, check.IsNil)
+	c.Assert(data[1:3], check.DeepEquals, []byte{0xd7, fluentdEventTimeExt})
+	decoded, err := msgpack.NewDecoder(bytes.NewReader(data)).DecodeInterfaceLoose()
+	c.Assert(err, check.IsNil)
+	ts := decoded.([]interface{})[0].(*fluentdEventTime)
+	c.Assert(ts.Equal(now), check.Equals, true)
+}
+
+func (s *S) TestFluentdForwarderSendRetriesOnlyUnacknowledgedTags(c *check.C) {
+	srv := startFakeFluentd(c, "")
+	srv.lostChunks = 1
+	srv.lostTag = "tag2"
+	defer srv.stop()
+	f := &fluentdForwarder{
+		requireAck: true,
+		ackTimeout: time.Second,
+	}
+	entry := func(tag, msg string) batchEntry {
+		data := msgpackMustMarshal([]interface{}{&fluentdEventTime{time.Now()}, map[string]interface{}{"message": msg}})
+		return batchEntry{key: tag, data: data}
+	}
+	entries := []batchEntry{entry("tag1", "a"), entry("tag2", "b"), entry("tag1", "c")}
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	c.Assert(err, check.IsNil)
+	err = f.send(&fluentdConn{Conn: conn, dec: msgpack.NewDecoder(conn)}, entries)
+	conn.Close()
+	partial, ok := err.(partialBatchError)
+	c.Assert(ok, check.Equals, true, check.Commentf("%#v", err))
+	c.Assert(partial.sent, check.DeepEquals, []batchEntry{entries[0], entries[2]})
+	c.Assert(partial.unsent, check.DeepEquals, []batchEntry{entries[1]})
+	msg := srv.recv(c)
+	c.Assert(msg[0], check.Equals, "tag1")
+	c.Assert(msg[1], check.HasLen, 2)
+	conn, err = net.Dial("tcp", srv.listener.Addr().String())
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = f.send(&fluentdConn{Conn: conn, dec: msgpack.NewDecoder(conn)}, partial.unsent)
+	c.Assert(err, check.IsNil)
+	msg = srv.recv(c)
+	c.Assert(msg[0], check.Equals, "tag2")
+	c.Assert(msg[1], check.HasLen, 1)
+	select {
+	case msg = <-srv.messages:
+		c.Fatalf("unexpected message %#v", msg)
+	default:
+	}
+}
@@ -10,13 +10,75 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/tsuru/bs/telemetry"
 	"gopkg.in/mcuadros/go-syslog.v2/format"
 )
 
-type LenientFormat struct{}
+// isoLayouts are the ISO 8601 timestamp layouts accepted besides RFC 3339,
+// layouts without a time zone are interpreted in the input location.
+var isoLayouts = []string{
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04",
+}
+
+type LenientFormat struct {
+	// Location is used for timestamps without a time zone, time.Local is
+	// used if nil.
+	Location *time.Location
+	now      func() time.Time
+	// received and parseFailures count the parsed messages, when set.
+	received      telemetry.Counter
+	parseFailures telemetry.Counter
+}
 
 func (f *LenientFormat) GetParser(line []byte) format.LogParser {
-	return &LenientParser{line: line}
+	return &LenientParser{line: line, format: f}
+}
+
+func (f *LenientFormat) location() *time.Location {
+	if f == nil || f.Location == nil {
+		return time.Local
+	}
+	return f.Location
+}
+
+func (f *LenientFormat) currentTime() time.Time {
+	if f == nil || f.now == nil {
+		return time.Now()
+	}
+	return f.now()
+}
+
+// inferYear sets the year of a timestamp without one, the current year is used
+// unless the timestamp would be more than a month in the future, in which case
+// it belongs to the previous year, or more than eleven months in the past,
+// in which case it belongs to the next year.
+func (f *LenientFormat) inferYear(ts time.Time) time.Time {
+	now := f.currentTime().In(ts.Location())
+	ts = ts.AddDate(now.Year()-ts.Year(), 0, 0)
+	if ts.After(now.AddDate(0, 1, 0)) {
+		return ts.AddDate(-1, 0, 0)
+	}
+	if ts.Before(now.AddDate(0, -11, 0)) {
+		return ts.AddDate(1, 0, 0)
+	}
+	return ts
+}
+
+// parseISOTime parses RFC 3339 timestamps, with any number of fractional
+// second digits, and the ISO 8601 variants in isoLayouts.
+func (f *LenientFormat) parseISOTime(value string) (time.Time, error) {
+	ts, err := time.Parse(time.RFC3339Nano, value)
+	if err == nil {
+		return ts, nil
+	}
+	for _, layout := range isoLayouts {
+		if ts, layoutErr := time.ParseInLocation(layout, value, f.location()); layoutErr == nil {
+			return ts, nil
+		}
+	}
+	return ts, err
 }
 
 func (f *LenientFormat) GetSplitFunc() bufio.SplitFunc {
@@ -28,6 +90,7 @@ type rawLogParts struct {
 	priority  []byte
 	content   []byte
 	container []byte
+	fields    map[string]interface{}
 }
 
 func (p *rawLogParts) String() string {
@@ -35,8 +98,9 @@ func (p *rawLogParts) String() string {
 }
 
 type LenientParser struct {
-	line  []byte
-	parts rawLogParts
+	line   []byte
+	format *LenientFormat
+	parts  rawLogParts
 }
 
 type parseError struct {
@@ -49,23 +113,34 @@ func (e *parseError) Error() string {
 }
 
 func (p *LenientParser) Parse() error {
+	err := p.parse()
+	if p.format != nil && p.format.received != nil {
+		p.format.received.Inc()
+		if err != nil {
+			p.format.parseFailures.Inc()
+		}
+	}
+	return err
+}
+
+func (p *LenientParser) parse() error {
 	groups := parseLogLine(p.line)
 	if len(groups) != 7 {
 		return &parseError{line: p.line, msg: "invalid groups length"}
 	}
 	var err error
 	if len(groups[2]) == 0 {
-		p.parts.ts, err = time.Parse(time.RFC3339, string(groups[1]))
+		p.parts.ts, err = p.format.parseISOTime(string(groups[1]))
 		if err != nil {
 			return &parseError{line: p.line, msg: "unable to parse time as RFC3339"}
 		}
 	} else {
 		dt := string(bytes.Join(groups[1:3], []byte{' '}))
-		p.parts.ts, err = time.ParseInLocation(time.Stamp, dt, time.Local)
+		p.parts.ts, err = time.ParseInLocation(time.Stamp, dt, p.format.location())
 		if err != nil {
 			return &parseError{line: p.line, msg: "unable to parse time as Stamp"}
 		}
-		p.parts.ts = p.parts.ts.AddDate(time.Now().Year(), 0, 0)
+		p.parts.ts = p.format.inferYear(p.parts.ts)
 	}
 	p.parts.priority = groups[0]
 	p.parts.container = groups[4]
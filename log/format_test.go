@@ -5,6 +5,8 @@
 package log
 
 import (
+	"encoding/json"
+	"os"
 	"testing"
 	"time"
 
@@ -16,7 +18,7 @@ func (s *S) TestLenientFormatGetParser(c *check.C) {
 	lf := LenientFormat{}
 	line := []byte("abc")
 	parser := lf.GetParser(line)
-	c.Assert(parser, check.DeepEquals, &LenientParser{line: line})
+	c.Assert(parser, check.DeepEquals, &LenientParser{line: line, format: &lf})
 }
 
 func (s *S) TestLenientFormatGetSplitFunc(c *check.C) {
@@ -53,6 +55,9 @@ func BenchmarkLenientParserParseUnixFormat(b *testing.B) {
 }
 
 func (s *S) TestLenientParserParse(c *check.C) {
+	lf := &LenientFormat{now: func() time.Time {
+		return time.Date(2015, 8, 1, 0, 0, 0, 0, time.Local)
+	}}
 	examples := []string{
 		"<27>Jul 21 18:26:01 docker/091cafae73a9[927]: ",
 		"<30>May 13 21:10:17 docker/00dfa98fe8e0[10798]: hey",
@@ -68,37 +73,37 @@ func (s *S) TestLenientParserParse(c *check.C) {
 	}
 	expected := []format.LogParts{
 		{"parts": &rawLogParts{
-			ts:        time.Date(time.Now().Year(), 7, 21, 18, 26, 01, 0, time.Local),
+			ts:        time.Date(2015, 7, 21, 18, 26, 01, 0, time.Local),
 			priority:  []byte("27"),
 			content:   nil,
 			container: []byte("091cafae73a9"),
 		}},
 		{"parts": &rawLogParts{
-			ts:        time.Date(time.Now().Year(), 5, 13, 21, 10, 17, 0, time.Local),
+			ts:        time.Date(2015, 5, 13, 21, 10, 17, 0, time.Local),
 			priority:  []byte("30"),
 			content:   []byte("hey"),
 			container: []byte("00dfa98fe8e0"),
 		}},
 		{"parts": &rawLogParts{
-			ts:        time.Date(time.Now().Year(), 5, 13, 21, 10, 17, 0, time.Local),
+			ts:        time.Date(2015, 5, 13, 21, 10, 17, 0, time.Local),
 			priority:  []byte("30"),
 			content:   []byte("hey"),
 			container: []byte("00dfa98fe8e0"),
 		}},
 		{"parts": &rawLogParts{
-			ts:        time.Date(time.Now().Year(), 5, 13, 21, 10, 17, 0, time.Local),
+			ts:        time.Date(2015, 5, 13, 21, 10, 17, 0, time.Local),
 			priority:  []byte("30"),
 			content:   nil,
 			container: []byte("00dfa98fe8e0"),
 		}},
 		{"parts": &rawLogParts{
-			ts:        time.Date(time.Now().Year(), 5, 13, 21, 10, 17, 0, time.Local),
+			ts:        time.Date(2015, 5, 13, 21, 10, 17, 0, time.Local),
 			priority:  []byte("30"),
 			content:   []byte("hey"),
 			container: []byte("00dfa98fe8e0"),
 		}},
 		{"parts": &rawLogParts{
-			ts:        time.Date(time.Now().Year(), 5, 13, 21, 10, 17, 0, time.Local),
+			ts:        time.Date(2015, 5, 13, 21, 10, 17, 0, time.Local),
 			priority:  []byte("30"),
 			content:   []byte("hey"),
 			container: []byte("00dfa98fe8e0"),
@@ -122,23 +127,126 @@ func (s *S) TestLenientParserParse(c *check.C) {
 			container: []byte("00dfa98fe8e0"),
 		}},
 		{"parts": &rawLogParts{
-			ts:        time.Date(time.Now().Year(), 12, 26, 5, 8, 46, 0, time.Local),
+			ts:        time.Date(2014, 12, 26, 5, 8, 46, 0, time.Local),
 			priority:  []byte("31"),
 			content:   nil,
 			container: []byte("my_id"),
 		}},
 		{"parts": &rawLogParts{
-			ts:        time.Date(time.Now().Year(), 12, 26, 5, 8, 46, 0, time.Local),
+			ts:        time.Date(2014, 12, 26, 5, 8, 46, 0, time.Local),
 			priority:  []byte("31"),
 			content:   []byte("content"),
 			container: []byte("my_id"),
 		}},
 	}
 	for i, line := range examples {
-		lp := LenientParser{line: []byte(line)}
+		lp := LenientParser{line: []byte(line), format: lf}
 		err := lp.Parse()
 		c.Assert(err, check.IsNil, check.Commentf("error in %d", i))
 		parts := lp.Dump()
 		c.Check(parts, check.DeepEquals, expected[i], check.Commentf("error in %d", i))
 	}
 }
+
+func (s *S) TestLenientParserParseYearInference(c *check.C) {
+	tests := []struct {
+		now  time.Time
+		line string
+		ts   time.Time
+	}{
+		{time.Date(2016, 1, 1, 0, 0, 5, 0, time.UTC), "<30>Dec 31 23:59:58 docker/00dfa98fe8e0: hey", time.Date(2015, 12, 31, 23, 59, 58, 0, time.UTC)},
+		{time.Date(2015, 12, 31, 23, 59, 58, 0, time.UTC), "<30>Jan  1 00:00:01 docker/00dfa98fe8e0: hey", time.Date(2016, 1, 1, 0, 0, 1, 0, time.UTC)},
+		{time.Date(2015, 6, 5, 0, 0, 0, 0, time.UTC), "<30>Jun 20 10:00:00 docker/00dfa98fe8e0: hey", time.Date(2015, 6, 20, 10, 0, 0, 0, time.UTC)},
+		{time.Date(2015, 6, 5, 0, 0, 0, 0, time.UTC), "<30>Feb  1 10:00:00 docker/00dfa98fe8e0: hey", time.Date(2015, 2, 1, 10, 0, 0, 0, time.UTC)},
+	}
+	for i, tt := range tests {
+		now := tt.now
+		lf := &LenientFormat{Location: time.UTC, now: func() time.Time { return now }}
+		lp := lf.GetParser([]byte(tt.line))
+		err := lp.Parse()
+		c.Assert(err, check.IsNil, check.Commentf("error in %d", i))
+		c.Check(lp.Dump()["parts"].(*rawLogParts).ts, check.DeepEquals, tt.ts, check.Commentf("error in %d", i))
+	}
+}
+
+func (s *S) TestLenientParserParseTimestamps(c *check.C) {
+	location := time.FixedZone("BRT", -3*3600)
+	lf := &LenientFormat{Location: location, now: func() time.Time {
+		return time.Date(2015, 6, 5, 0, 0, 0, 0, time.UTC)
+	}}
+	tests := []struct {
+		stamp string
+		ts    time.Time
+	}{
+		{"2015-06-05T16:13:47.123456789Z", time.Date(2015, 6, 5, 16, 13, 47, 123456789, time.UTC)},
+		{"2015-06-05T16:13:47.5-02:00", time.Date(2015, 6, 5, 18, 13, 47, 500000000, time.UTC)},
+		{"2015-06-05T16:13:47.123+0100", time.Date(2015, 6, 5, 15, 13, 47, 123000000, time.UTC)},
+		{"2015-06-05T16:13:47", time.Date(2015, 6, 5, 19, 13, 47, 0, time.UTC)},
+		{"2015-06-05T16:13:47.25", time.Date(2015, 6, 5, 19, 13, 47, 250000000, time.UTC)},
+		{"2015-06-05T16:13", time.Date(2015, 6, 5, 19, 13, 0, 0, time.UTC)},
+		{"Jun  5 16:13:47", time.Date(2015, 6, 5, 19, 13, 47, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		lp := lf.GetParser([]byte("<30>" + tt.stamp + " myhost docker/00dfa98fe8e0: hey"))
+		err := lp.Parse()
+		c.Assert(err, check.IsNil, check.Commentf("error in %q", tt.stamp))
+		ts := lp.Dump()["parts"].(*rawLogParts).ts
+		c.Check(ts.Equal(tt.ts), check.Equals, true, check.Commentf("error in %q: %v", tt.stamp, ts))
+	}
+	lp := lf.GetParser([]byte("<30>2015-06-05 myhost docker/00dfa98fe8e0: hey"))
+	c.Assert(lp.Parse(), check.ErrorMatches, `could not parse .*: unable to parse time as RFC3339`)
+}
+
+func (s *S) TestLogForwarderCheckClockSkew(c *check.C) {
+	receivedAt := time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC)
+	lf := LogForwarder{maxClockSkew: time.Minute, clockSkewAction: clockSkewReplace}
+	parts := &rawLogParts{ts: receivedAt.Add(-time.Minute)}
+	lf.checkClockSkew(parts, receivedAt)
+	c.Assert(parts.ts, check.DeepEquals, receivedAt.Add(-time.Minute))
+	parts = &rawLogParts{ts: receivedAt.Add(time.Hour)}
+	lf.checkClockSkew(parts, receivedAt)
+	c.Assert(parts.ts, check.DeepEquals, receivedAt)
+	c.Assert(parts.fields, check.IsNil)
+	lf.clockSkewAction = clockSkewFlag
+	parts = &rawLogParts{ts: receivedAt.Add(-90 * time.Second), fields: map[string]interface{}{"level": "info"}}
+	lf.checkClockSkew(parts, receivedAt)
+	c.Assert(parts.ts, check.DeepEquals, receivedAt.Add(-90*time.Second))
+	c.Assert(parts.fields, check.DeepEquals, map[string]interface{}{"level": "info", "clock_skew": float64(-90)})
+}
+
+func (s *S) TestLogForwarderClockSkewFlagHTTPBackend(c *check.C) {
+	srv, reqCh := startHTTPReceiver(c, nil)
+	defer srv.Close()
+	os.Setenv("LOG_MAX_CLOCK_SKEW", "60")
+	os.Setenv("LOG_CLOCK_SKEW_ACTION", "flag")
+	os.Setenv("LOG_HTTP_URL", srv.URL)
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"http"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg")
+	req := recvHTTPTimeout(c, reqCh)
+	var entries []jsonLogEntry
+	err = json.Unmarshal(req.body, &entries)
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 1)
+	c.Assert(entries[0].Fields[clockSkewField].(float64) < -60, check.Equals, true)
+}
+
+func (s *S) TestLogForwarderInvalidTimestampConfig(c *check.C) {
+	lf := LogForwarder{
+		BindAddress:    "udp://127.0.0.1:59317",
+		DockerEndpoint: s.dockerServer.URL(),
+	}
+	os.Setenv("LOG_INPUT_TIMEZONE", "Mars/Olympus_Mons")
+	err := lf.Start()
+	c.Assert(err, check.ErrorMatches, `invalid input timezone "Mars/Olympus_Mons": .*`)
+	os.Unsetenv("LOG_INPUT_TIMEZONE")
+	os.Setenv("LOG_CLOCK_SKEW_ACTION", "drop")
+	err = lf.Start()
+	c.Assert(err, check.ErrorMatches, `invalid clock skew action "drop", expected replace or flag`)
+}
@@ -5,8 +5,18 @@
 package log
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -14,20 +24,80 @@ import (
 	"github.com/Graylog2/go-gelf/gelf"
 	"github.com/tsuru/bs/bslog"
 	"github.com/tsuru/bs/config"
+	"github.com/tsuru/bs/container"
 )
 
+const (
+	gelfChunkHeaderSize = 12
+	gelfMaxChunks       = 128
+)
+
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+// syslogFacilityNames are the facility names used by Graylog syslog inputs,
+// indexed by facility code.
+var syslogFacilityNames = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var gelfCompressions = map[string]gelf.CompressType{
+	"gzip": gelf.CompressGzip,
+	"zlib": gelf.CompressZlib,
+	"none": gelf.CompressNone,
+}
+
 type gelfBackend struct {
-	extra      json.RawMessage
-	host       string
-	msgCh      chan<- LogMessage
-	quitCh     chan<- bool
-	tryJSON    bool
-	nextNotify *time.Timer
+	backendStats
+	extra       json.RawMessage
+	hostname    string
+	url         *url.URL
+	compression gelf.CompressType
+	chunkSize   int
+	tlsConfig   *tls.Config
+	msgBuf      bytes.Buffer
+	zBuf        bytes.Buffer
+	msgCh       chan<- LogMessage
+	quitCh      chan<- bool
+	nextNotify  *time.Timer
 }
 
 func (b *gelfBackend) initialize() error {
 	bufferSize := config.IntEnvOrDefault(config.DefaultBufferSize, "LOG_GELF_BUFFER_SIZE", "LOG_BUFFER_SIZE")
-	b.host = config.StringEnvOrDefault("localhost:12201", "LOG_GELF_HOST")
+	host := config.StringEnvOrDefault("localhost:12201", "LOG_GELF_HOST")
+	if !strings.Contains(host, "://") {
+		host = "udp://" + host
+	}
+	var err error
+	b.url, err = url.Parse(host)
+	if err != nil {
+		return fmt.Errorf("unable to parse %q: %s", host, err)
+	}
+	switch b.url.Scheme {
+	case "udp", "tcp":
+	case "tls":
+		b.tlsConfig, err = config.TLSConfigFromEnv("LOG_GELF_TLS")
+		if err != nil {
+			return err
+		}
+		b.tlsConfig = config.TLSConfigForHost(b.tlsConfig, b.url.Hostname())
+	default:
+		return fmt.Errorf("invalid protocol %q, expected udp, tcp or tls", b.url.Scheme)
+	}
+	compression := config.StringEnvOrDefault("gzip", "LOG_GELF_COMPRESSION")
+	var ok bool
+	b.compression, ok = gelfCompressions[compression]
+	if !ok {
+		return fmt.Errorf("invalid gelf compression %q, expected gzip, zlib or none", compression)
+	}
+	b.chunkSize = config.IntEnvOrDefault(0, "LOG_GELF_CHUNK_SIZE")
+	if b.chunkSize <= 0 {
+		b.chunkSize = interfaceMTU("LOG_GELF_MTU_NETWORK_INTERFACE") - udpHeaderSz
+	}
+	if b.chunkSize <= gelfChunkHeaderSize {
+		return fmt.Errorf("invalid gelf chunk size %d", b.chunkSize)
+	}
 	extra := config.StringEnvOrDefault("", "LOG_GELF_EXTRA_TAGS")
 	if extra != "" {
 		data := map[string]interface{}{}
@@ -37,42 +107,70 @@ func (b *gelfBackend) initialize() error {
 			b.extra = json.RawMessage(extra)
 		}
 	}
-	b.tryJSON, _ = strconv.ParseBool(config.StringEnvOrDefault("FALSE", "LOG_GELF_TRY_JSON"))
+	b.hostname, err = os.Hostname()
+	if err != nil {
+		return err
+	}
 
 	b.nextNotify = time.NewTimer(0)
-	var err error
-	b.msgCh, b.quitCh, err = processMessages(b, bufferSize)
+	b.msgCh, b.quitCh, err = processMessages(b, bufferSize, &b.backendStats)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (b *gelfBackend) sendMessage(parts *rawLogParts, appName, processName, container string) {
-	if len(container) > containerIDTrimSize {
-		container = container[:containerIDTrimSize]
-	}
-	level := gelf.LOG_INFO
-	if s, err := strconv.Atoi(string(parts.priority)); err == nil {
-		if int32(s)&gelf.LOG_ERR == gelf.LOG_ERR {
-			level = gelf.LOG_ERR
-		}
+func (b *gelfBackend) sendMessage(parts *rawLogParts, appName, processName, containerID string) {
+	b.sendContainerMessage(parts, &container.Container{AppName: appName, ProcessName: processName}, containerID)
+}
+
+func (b *gelfBackend) sendContainerMessage(parts *rawLogParts, cont *container.Container, containerID string) {
+	if len(containerID) > containerIDTrimSize {
+		containerID = containerID[:containerIDTrimSize]
 	}
+	priority, _ := strconv.Atoi(string(parts.priority))
+	level := int32(priority & severityMask)
+	facility := priority >> 3
 	msg := &gelf.Message{
-		Version: "1.1",
-		Host:    container,
-		Short:   string(parts.content),
-		Level:   level,
+		Version:  "1.1",
+		Host:     containerID,
+		Short:    string(parts.content),
+		TimeUnix: float64(parts.ts.UnixNano()) / float64(time.Second),
+		Level:    level,
 		Extra: map[string]interface{}{
-			"_app": appName,
-			"_pid": processName,
+			"_app":            cont.AppName,
+			"_pid":            cont.ProcessName,
+			"_container_name": strings.TrimPrefix(cont.Name, "/"),
+			"_node":           b.hostname,
 		},
 		RawExtra: b.extra,
 	}
+	if facility < len(syslogFacilityNames) {
+		msg.Facility = syslogFacilityNames[facility]
+	}
+	if level == gelf.LOG_EMERG {
+		// Level is omitted by gelf.Message when empty, which Graylog
+		// interprets as alert.
+		msg.Extra["level"] = level
+	}
+	if cont.Config != nil {
+		msg.Extra["_image"] = cont.Config.Image
+	}
+	for k, v := range parts.fields {
+		name := gelfFieldName(k)
+		if native, reserved := msg.Extra[name]; reserved || name == "_id" {
+			if value, ok := v.(string); ok && native == value {
+				// Enrichment metadata already sent, like _node.
+				continue
+			}
+			// Fields must not replace the tsuru metadata streams are
+			// routed on.
+			name = gelfFieldName("field_" + k)
+		}
+		msg.Extra[name] = v
+	}
 
-	select {
-	case b.msgCh <- msg:
-	default:
+	if !b.enqueue(b.msgCh, msg, parts.ts) {
 		select {
 		case <-b.nextNotify.C:
 			bslog.Errorf("Dropping log messages to gelf due to full channel buffer.")
@@ -81,58 +179,140 @@ func (b *gelfBackend) sendMessage(parts *rawLogParts, appName, processName, cont
 		}
 	}
 }
-func (b *gelfBackend) stop() {
-	close(b.quitCh)
+
+// gelfFieldName returns the additional field name for an extracted field,
+// GELF field names may only contain word characters, dots and dashes.
+func gelfFieldName(key string) string {
+	name := []byte("_" + key)
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '-') {
+			name[i] = '_'
+		}
+	}
+	return string(name)
 }
 
-type gelfConnWrapper struct {
-	net.Conn
-	*gelf.Writer
+func (b *gelfBackend) stop() {
+	close(b.quitCh)
 }
 
-func (w *gelfConnWrapper) Close() error {
-	return w.Writer.Close()
+func (b *gelfBackend) connect() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if b.url.Scheme == "tls" {
+		dialer := &net.Dialer{Timeout: forwardConnDialTimeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", b.url.Host, b.tlsConfig)
+	} else {
+		conn, err = net.DialTimeout(b.url.Scheme, b.url.Host, forwardConnDialTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[log forwarder] unable to connect to %q: %s", b.url, err)
+	}
+	if b.url.Scheme != "udp" {
+		conn = newBufferedConn(conn, time.Second)
+	}
+	return conn, nil
 }
 
-func (w *gelfConnWrapper) Write(msg []byte) (int, error) {
-	return 0, nil
+func (b *gelfBackend) process(conn net.Conn, msg LogMessage) error {
+	message := msg.(*gelf.Message)
+	b.msgBuf.Reset()
+	err := message.MarshalJSONBuf(&b.msgBuf)
+	if err != nil {
+		return err
+	}
+	err = conn.SetWriteDeadline(time.Now().Add(forwardConnWriteTimeout))
+	if err != nil {
+		return err
+	}
+	if b.url.Scheme != "udp" {
+		// GELF over TCP doesn't support compression, messages are delimited
+		// by a null byte.
+		b.msgBuf.WriteByte(0)
+		return b.write(conn, b.msgBuf.Bytes())
+	}
+	data, err := b.compress(b.msgBuf.Bytes())
+	if err != nil {
+		return err
+	}
+	if len(data) <= b.chunkSize {
+		return b.write(conn, data)
+	}
+	return b.writeChunked(conn, data)
 }
 
-func (b *gelfBackend) connect() (net.Conn, error) {
-	writer, err := gelf.NewWriter(b.host)
+func (b *gelfBackend) compress(data []byte) ([]byte, error) {
+	var zw io.WriteCloser
+	var err error
+	b.zBuf.Reset()
+	switch b.compression {
+	case gelf.CompressGzip:
+		zw, err = gzip.NewWriterLevel(&b.zBuf, flate.BestSpeed)
+	case gelf.CompressZlib:
+		zw, err = zlib.NewWriterLevel(&b.zBuf, flate.BestSpeed)
+	default:
+		return data, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &gelfConnWrapper{Writer: writer}, nil
+	_, err = zw.Write(data)
+	if err != nil {
+		zw.Close()
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return b.zBuf.Bytes(), nil
 }
 
-func (b *gelfBackend) process(conn net.Conn, msg LogMessage) error {
-
-	var message *gelf.Message
-	message = msg.(*gelf.Message)
-
-	// Test if message has a JSON and parsing it in extra tags of GELF
-	if b.tryJSON {
-		first := strings.Index(message.Short, "{")
-		last := strings.LastIndex(message.Short, "}") + 1
-		if first >= 0 && last >= first {
-			jsonMessage := message.Short[first:last]
-			data := map[string]interface{}{}
-			if err := json.Unmarshal([]byte(jsonMessage), &data); err == nil {
-				for k, v := range data {
-					if k[0] != '_' {
-						message.Extra["_"+k] = v
-					} else {
-						message.Extra[k] = v
-					}
-				}
-			}
+// writeChunked sends data as GELF chunks, each one with the format:
+// 2-byte magic (0x1e 0x0f), 8-byte message id, 1-byte sequence number,
+// 1-byte sequence count, chunk data. Messages needing more than
+// gelfMaxChunks chunks are dropped, as they can't be reassembled by the
+// server.
+func (b *gelfBackend) writeChunked(conn net.Conn, data []byte) error {
+	dataSize := b.chunkSize - gelfChunkHeaderSize
+	nChunks := (len(data) + dataSize - 1) / dataSize
+	if nChunks > gelfMaxChunks {
+		return droppedMessageError{fmt.Errorf("gelf message too large, would need %d chunks", nChunks)}
+	}
+	chunk := make([]byte, gelfChunkHeaderSize, b.chunkSize)
+	copy(chunk, gelfChunkMagic)
+	_, err := rand.Read(chunk[2:10])
+	if err != nil {
+		return err
+	}
+	chunk[11] = byte(nChunks)
+	for i := 0; i < nChunks; i++ {
+		end := (i + 1) * dataSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk[10] = byte(i)
+		chunk = append(chunk[:gelfChunkHeaderSize], data[i*dataSize:end]...)
+		err = b.write(conn, chunk)
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	return conn.(*gelfConnWrapper).WriteMessage(message)
+func (b *gelfBackend) write(conn net.Conn, data []byte) error {
+	n, err := conn.Write(data)
+	if err != nil {
+		return err
+	}
+	if n < len(data) {
+		return fmt.Errorf("[log forwarder] short write trying to write log to %q", conn.RemoteAddr())
+	}
+	return nil
 }
 
 func (b *gelfBackend) close(conn net.Conn) {
+	conn.SetWriteDeadline(time.Time{})
 	conn.Close()
 }
@@ -0,0 +1,230 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Graylog2/go-gelf/gelf"
+	"gopkg.in/check.v1"
+)
+
+// startGelfStreamReceiver accepts a single connection on listener and sends
+// each null byte delimited message received.
+func startGelfStreamReceiver(listener net.Listener) chan *gelf.Message {
+	msgCh := make(chan *gelf.Message, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			data, err := reader.ReadBytes(0)
+			if err != nil {
+				return
+			}
+			var msg gelf.Message
+			if json.Unmarshal(data[:len(data)-1], &msg) == nil {
+				msgCh <- &msg
+			}
+		}
+	}()
+	return msgCh
+}
+
+func recvGelfTimeout(c *check.C, msgCh chan *gelf.Message) *gelf.Message {
+	select {
+	case msg := <-msgCh:
+		return msg
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for gelf message")
+	}
+	return nil
+}
+
+func (s *S) checkGelfMessage(c *check.C, msg *gelf.Message, content string) {
+	c.Assert(msg.Version, check.Equals, "1.1")
+	c.Assert(msg.Host, check.Equals, s.idShort)
+	c.Assert(msg.Short, check.Equals, content)
+	c.Assert(msg.Level, check.Equals, gelf.LOG_INFO)
+	c.Assert(msg.Extra["_app"], check.Equals, "coolappname")
+	c.Assert(msg.Extra["_pid"], check.Equals, "procx")
+	c.Assert(msg.Extra["_container_name"], check.Equals, "myContName")
+	c.Assert(msg.Extra["_image"], check.Equals, "myimg")
+	hostname, _ := os.Hostname()
+	c.Assert(msg.Extra["_node"], check.Equals, hostname)
+	c.Assert(msg.Facility, check.Equals, "daemon")
+	c.Assert(msg.TimeUnix, check.Equals, float64(time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC).Unix()))
+}
+
+func (s *S) TestGelfForwarderTCP(c *check.C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+	msgCh := startGelfStreamReceiver(listener)
+	os.Setenv("LOG_GELF_HOST", "tcp://"+listener.Addr().String())
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"gelf"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg", "mymsg2")
+	s.checkGelfMessage(c, recvGelfTimeout(c, msgCh), "mymsg")
+	s.checkGelfMessage(c, recvGelfTimeout(c, msgCh), "mymsg2")
+}
+
+func (s *S) TestGelfForwarderTLS(c *check.C) {
+	dir, err := ioutil.TempDir("", "bs-gelf-tls")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	cert := writeTestCert(c, dir)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+	msgCh := startGelfStreamReceiver(listener)
+	os.Setenv("LOG_GELF_HOST", "tls://"+listener.Addr().String())
+	os.Setenv("LOG_GELF_TLS_CA_FILE", filepath.Join(dir, "cert.pem"))
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"gelf"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg")
+	s.checkGelfMessage(c, recvGelfTimeout(c, msgCh), "mymsg")
+}
+
+func (s *S) TestGelfForwarderUDPChunked(c *check.C) {
+	reader, err := gelf.NewReader("127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	os.Setenv("LOG_GELF_HOST", "udp://"+reader.Addr())
+	os.Setenv("LOG_GELF_COMPRESSION", "none")
+	os.Setenv("LOG_GELF_CHUNK_SIZE", "200")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"gelf"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	content := strings.Repeat("mymsg", 200)
+	s.sendUDPMessages(c, content)
+	msg, err := reader.ReadMessage()
+	c.Assert(err, check.IsNil)
+	s.checkGelfMessage(c, msg, content)
+}
+
+func (s *S) TestGelfForwarderUDPTooManyChunks(c *check.C) {
+	reader, err := gelf.NewReader("127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	os.Setenv("LOG_GELF_HOST", "udp://"+reader.Addr())
+	os.Setenv("LOG_GELF_COMPRESSION", "none")
+	os.Setenv("LOG_GELF_CHUNK_SIZE", "20")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"gelf"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, strings.Repeat("mymsg", 400), "mymsg")
+	msg, err := reader.ReadMessage()
+	c.Assert(err, check.IsNil)
+	s.checkGelfMessage(c, msg, "mymsg")
+	stats := lf.BackendStats()[0]
+	c.Assert(stats.Dropped, check.Equals, uint64(1))
+	c.Assert(stats.Reconnects, check.Equals, uint64(0))
+}
+
+func (s *S) TestGelfForwarderUDPZlib(c *check.C) {
+	reader, err := gelf.NewReader("127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	os.Setenv("LOG_GELF_HOST", reader.Addr())
+	os.Setenv("LOG_GELF_COMPRESSION", "zlib")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"gelf"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg")
+	msg, err := reader.ReadMessage()
+	c.Assert(err, check.IsNil)
+	s.checkGelfMessage(c, msg, "mymsg")
+}
+
+func (s *S) TestGelfForwarderInvalidConfig(c *check.C) {
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"gelf"},
+	}
+	os.Setenv("LOG_GELF_HOST", "http://localhost:12201")
+	err := lf.Start()
+	c.Assert(err, check.ErrorMatches, `unable to initialize log backend "gelf": invalid protocol "http", expected udp, tcp or tls`)
+	os.Setenv("LOG_GELF_HOST", "udp://localhost:12201")
+	os.Setenv("LOG_GELF_COMPRESSION", "lz4")
+	err = lf.Start()
+	c.Assert(err, check.ErrorMatches, `unable to initialize log backend "gelf": invalid gelf compression "lz4", expected gzip, zlib or none`)
+}
+
+func (s *S) TestGelfForwarderSeverityAndTimestamp(c *check.C) {
+	reader, err := gelf.NewReader("127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	os.Setenv("LOG_GELF_HOST", reader.Addr())
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"gelf"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	tests := []struct {
+		priority int
+		level    int32
+		facility string
+	}{
+		{priority: 24, level: gelf.LOG_EMERG, facility: "daemon"},
+		{priority: 28, level: gelf.LOG_WARNING, facility: "daemon"},
+		{priority: 135, level: gelf.LOG_DEBUG, facility: "local0"},
+		{priority: 11, level: gelf.LOG_ERR, facility: "user"},
+	}
+	for _, tt := range tests {
+		msg := []byte(fmt.Sprintf("<%d>2015-06-05T16:13:47.123456Z myhost docker/%s: mymsg\n", tt.priority, s.id))
+		_, err = conn.Write(msg)
+		c.Assert(err, check.IsNil)
+		gelfMsg, err := reader.ReadMessage()
+		c.Assert(err, check.IsNil)
+		c.Check(gelfMsg.Level, check.Equals, tt.level)
+		c.Check(gelfMsg.Facility, check.Equals, tt.facility)
+		expectedTime := time.Date(2015, 6, 5, 16, 13, 47, 123456000, time.UTC)
+		c.Check(math.Abs(gelfMsg.TimeUnix-float64(expectedTime.UnixNano())/1e9) < 1e-6, check.Equals, true)
+	}
+}
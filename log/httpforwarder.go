@@ -0,0 +1,305 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/config"
+)
+
+const (
+	httpFormatJSON   = "json"
+	httpFormatNDJSON = "ndjson"
+
+	httpRetryBaseDelay = 100 * time.Millisecond
+	httpRetryMaxDelay  = 30 * time.Second
+)
+
+var errHTTPRetryAborted = errors.New("retry aborted")
+
+type httpBackend struct {
+	backendStats
+	msgCh      chan<- LogMessage
+	quitCh     chan<- bool
+	nextNotify *time.Timer
+}
+
+type httpForwarder struct {
+	url           string
+	contentType   string
+	encodeEntry   func(LogMessage) (batchEntry, error)
+	encodeEntries func(io.Writer, []batchEntry) error
+	headers       http.Header
+	gzip          bool
+	batchSize     int
+	batchBytes    int
+	batchInterval time.Duration
+	maxRetries    int
+	client        *http.Client
+	quitCh        <-chan bool
+	stats         *backendStats
+	retry         *batchRetry
+}
+
+type jsonLogEntry struct {
+	Date      time.Time              `json:"date"`
+	AppName   string                 `json:"app"`
+	Process   string                 `json:"process"`
+	Container string                 `json:"container"`
+	Priority  int                    `json:"priority"`
+	Message   string                 `json:"message"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+func (b *httpBackend) initialize() error {
+	url := config.StringEnvOrDefault("", "LOG_HTTP_URL")
+	if url == "" {
+		return fmt.Errorf("environment variable for LOG_HTTP_URL must be set")
+	}
+	bufferSize := config.IntEnvOrDefault(config.DefaultBufferSize, "LOG_HTTP_BUFFER_SIZE", "LOG_BUFFER_SIZE")
+	format := config.StringEnvOrDefault(httpFormatJSON, "LOG_HTTP_FORMAT")
+	if format != httpFormatJSON && format != httpFormatNDJSON {
+		return fmt.Errorf("invalid http log format %q, expected %s or %s", format, httpFormatJSON, httpFormatNDJSON)
+	}
+	headers, err := headersFromEnv("LOG_HTTP_HEADERS")
+	if err != nil {
+		return err
+	}
+	token := config.StringEnvOrDefault("", "LOG_HTTP_TOKEN")
+	if token != "" {
+		headers.Set("Authorization", "Bearer "+token)
+	}
+	useGzip, _ := strconv.ParseBool(config.StringEnvOrDefault("FALSE", "LOG_HTTP_GZIP"))
+	forwarder := &httpForwarder{
+		url:           url,
+		contentType:   "application/json",
+		encodeEntry:   encodeJSONEntry,
+		encodeEntries: encodeJSONArray,
+		headers:       headers,
+		gzip:          useGzip,
+		batchSize:     config.IntEnvOrDefault(100, "LOG_HTTP_BATCH_SIZE"),
+		batchBytes:    config.IntEnvOrDefault(1024*1024, "LOG_HTTP_BATCH_BYTES"),
+		batchInterval: config.SecondsEnvOrDefault(1, "LOG_HTTP_BATCH_INTERVAL"),
+		maxRetries:    config.IntEnvOrDefault(3, "LOG_HTTP_MAX_RETRIES"),
+		client: &http.Client{
+			Timeout: config.SecondsEnvOrDefault(10, "LOG_HTTP_TIMEOUT"),
+		},
+	}
+	if format == httpFormatNDJSON {
+		forwarder.contentType = "application/x-ndjson"
+		forwarder.encodeEntries = encodeNDJSON
+	}
+	forwarder.stats = &b.backendStats
+	forwarder.retry = newBatchRetry(bufferSize, &b.backendStats)
+	b.nextNotify = time.NewTimer(0)
+	b.msgCh, b.quitCh, err = processMessages(forwarder, bufferSize, &b.backendStats)
+	return err
+}
+
+// headersFromEnv parses a JSON object with extra request headers from the
+// given environment variable.
+func headersFromEnv(env string) (http.Header, error) {
+	headers := http.Header{}
+	value := config.StringEnvOrDefault("", env)
+	if value == "" {
+		return headers, nil
+	}
+	data := map[string]string{}
+	if err := json.Unmarshal([]byte(value), &data); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", env, err)
+	}
+	for k, v := range data {
+		headers.Set(k, v)
+	}
+	return headers, nil
+}
+
+func (b *httpBackend) sendMessage(parts *rawLogParts, appName, processName, container string) {
+	if len(container) > containerIDTrimSize {
+		container = container[:containerIDTrimSize]
+	}
+	priority, _ := strconv.Atoi(string(parts.priority))
+	msg := &jsonLogEntry{
+		Date:      parts.ts,
+		AppName:   appName,
+		Process:   processName,
+		Container: container,
+		Priority:  priority,
+		Message:   string(parts.content),
+		Fields:    parts.fields,
+	}
+	if !b.enqueue(b.msgCh, msg, parts.ts) {
+		select {
+		case <-b.nextNotify.C:
+			bslog.Errorf("Dropping log messages to http due to full channel buffer.")
+			b.nextNotify.Reset(time.Minute)
+		default:
+		}
+	}
+}
+
+func (b *httpBackend) stop() {
+	close(b.quitCh)
+}
+
+func (f *httpForwarder) initialize(quitCh <-chan bool) {
+	f.quitCh = quitCh
+}
+
+func (f *httpForwarder) connect() (net.Conn, error) {
+	return newBatchConn(nil, f.stats, f.retry, f.batchSize, f.batchBytes, f.batchInterval, f.send), nil
+}
+
+func (f *httpForwarder) process(conn net.Conn, msg LogMessage) error {
+	entry, err := f.encodeEntry(msg)
+	if err != nil {
+		return fmt.Errorf("error encoding message: %s", err)
+	}
+	return conn.(*batchConn).add(entry)
+}
+
+func (f *httpForwarder) close(conn net.Conn) {
+	conn.Close()
+}
+
+func (f *httpForwarder) encodeBatch(entries []batchEntry) ([]byte, error) {
+	var body bytes.Buffer
+	var w io.Writer = &body
+	var gzipWriter *gzip.Writer
+	if f.gzip {
+		gzipWriter = gzip.NewWriter(&body)
+		w = gzipWriter
+	}
+	err := f.encodeEntries(w, entries)
+	if err != nil {
+		return nil, err
+	}
+	if gzipWriter != nil {
+		err = gzipWriter.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return body.Bytes(), nil
+}
+
+func encodeJSONEntry(msg LogMessage) (batchEntry, error) {
+	data, err := json.Marshal(msg)
+	return batchEntry{data: data}, err
+}
+
+func encodeJSONArray(w io.Writer, entries []batchEntry) error {
+	w.Write([]byte{'['})
+	for i, entry := range entries {
+		if i > 0 {
+			w.Write([]byte{','})
+		}
+		w.Write(entry.data)
+	}
+	_, err := w.Write([]byte{']'})
+	return err
+}
+
+func encodeNDJSON(w io.Writer, entries []batchEntry) error {
+	for _, entry := range entries {
+		w.Write(entry.data)
+		_, err := w.Write([]byte{'\n'})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *httpForwarder) send(entries []batchEntry) error {
+	body, err := f.encodeBatch(entries)
+	if err != nil {
+		return droppedBatchError{fmt.Errorf("error encoding batch: %s", err)}
+	}
+	for attempt := 0; ; attempt++ {
+		var retryAfter time.Duration
+		retryAfter, err = f.post(body)
+		if err == nil {
+			return nil
+		}
+		if retryAfter < 0 || attempt >= f.maxRetries {
+			return droppedBatchError{err}
+		}
+		if retryAfter == 0 {
+			retryAfter = httpRetryBaseDelay << uint(attempt)
+		}
+		if retryAfter > httpRetryMaxDelay {
+			retryAfter = httpRetryMaxDelay
+		}
+		select {
+		case <-f.quitCh:
+			return droppedBatchError{fmt.Errorf("%s: %s", errHTTPRetryAborted, err)}
+		case <-time.After(retryAfter):
+		}
+	}
+}
+
+// post sends a single request with the encoded batch. The returned duration
+// is negative if the request must not be retried, zero if it may be retried
+// using the default backoff and positive if the server asked for a specific
+// delay using the Retry-After header.
+func (f *httpForwarder) post(body []byte) (time.Duration, error) {
+	request, err := http.NewRequest("POST", f.url, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	for k, v := range f.headers {
+		request.Header[k] = v
+	}
+	request.Header.Set("Content-Type", f.contentType)
+	if f.gzip {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := f.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, nil
+	}
+	err = fmt.Errorf("unexpected response from %q %d: %s", f.url, resp.StatusCode, strings.TrimSpace(string(respBody)))
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+		return -1, err
+	}
+	return parseRetryAfter(resp.Header.Get("Retry-After")), err
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := date.Sub(time.Now()); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
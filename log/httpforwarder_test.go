@@ -0,0 +1,222 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type httpRequestData struct {
+	header http.Header
+	body   []byte
+}
+
+func startHTTPReceiver(c *check.C, handler func(w http.ResponseWriter, r *http.Request) bool) (*httptest.Server, chan httpRequestData) {
+	reqCh := make(chan httpRequestData, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler != nil && !handler(w, r) {
+			return
+		}
+		var reader io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gzipReader, err := gzip.NewReader(r.Body)
+			c.Assert(err, check.IsNil)
+			reader = gzipReader
+		}
+		data, err := ioutil.ReadAll(reader)
+		c.Assert(err, check.IsNil)
+		reqCh <- httpRequestData{header: r.Header, body: data}
+	}))
+	return srv, reqCh
+}
+
+func recvHTTPTimeout(c *check.C, ch chan httpRequestData) httpRequestData {
+	select {
+	case data := <-ch:
+		return data
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for request")
+	}
+	return httpRequestData{}
+}
+
+func (s *S) sendUDPMessages(c *check.C, messages ...string) {
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	for _, m := range messages {
+		msg := []byte(fmt.Sprintf("<30>2015-06-05T16:13:47Z myhost docker/%s: %s\n", s.id, m))
+		_, err = conn.Write(msg)
+		c.Assert(err, check.IsNil)
+	}
+}
+
+func (s *S) TestHTTPForwarderJSONBatch(c *check.C) {
+	srv, reqCh := startHTTPReceiver(c, nil)
+	defer srv.Close()
+	os.Setenv("LOG_HTTP_URL", srv.URL)
+	os.Setenv("LOG_HTTP_BATCH_SIZE", "2")
+	os.Setenv("LOG_HTTP_HEADERS", `{"X-Custom": "myvalue"}`)
+	os.Setenv("LOG_HTTP_TOKEN", "mytoken")
+	defer os.Unsetenv("LOG_HTTP_BATCH_SIZE")
+	defer os.Unsetenv("LOG_HTTP_HEADERS")
+	defer os.Unsetenv("LOG_HTTP_TOKEN")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"http"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg", "mymsg2")
+	req := recvHTTPTimeout(c, reqCh)
+	c.Assert(req.header.Get("Content-Type"), check.Equals, "application/json")
+	c.Assert(req.header.Get("Authorization"), check.Equals, "Bearer mytoken")
+	c.Assert(req.header.Get("X-Custom"), check.Equals, "myvalue")
+	var entries []jsonLogEntry
+	err = json.Unmarshal(req.body, &entries)
+	c.Assert(err, check.IsNil)
+	baseTime := time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC)
+	c.Assert(entries, check.HasLen, 2)
+	for i, e := range entries {
+		c.Assert(e.Date.Equal(baseTime), check.Equals, true)
+		e.Date = baseTime
+		entries[i] = e
+	}
+	c.Assert(entries, check.DeepEquals, []jsonLogEntry{
+		{Date: baseTime, AppName: "coolappname", Process: "procx", Container: s.idShort, Priority: 30, Message: "mymsg"},
+		{Date: baseTime, AppName: "coolappname", Process: "procx", Container: s.idShort, Priority: 30, Message: "mymsg2"},
+	})
+}
+
+func (s *S) TestHTTPForwarderNDJSONGzipInterval(c *check.C) {
+	srv, reqCh := startHTTPReceiver(c, nil)
+	defer srv.Close()
+	os.Setenv("LOG_HTTP_URL", srv.URL)
+	os.Setenv("LOG_HTTP_FORMAT", "ndjson")
+	os.Setenv("LOG_HTTP_GZIP", "true")
+	os.Setenv("LOG_HTTP_BATCH_INTERVAL", "0.1")
+	defer os.Unsetenv("LOG_HTTP_FORMAT")
+	defer os.Unsetenv("LOG_HTTP_GZIP")
+	defer os.Unsetenv("LOG_HTTP_BATCH_INTERVAL")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"http"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg")
+	req := recvHTTPTimeout(c, reqCh)
+	c.Assert(req.header.Get("Content-Type"), check.Equals, "application/x-ndjson")
+	c.Assert(req.header.Get("Content-Encoding"), check.Equals, "gzip")
+	scanner := bufio.NewScanner(bytes.NewReader(req.body))
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	c.Assert(lines, check.HasLen, 1)
+	var entry jsonLogEntry
+	err = json.Unmarshal([]byte(lines[0]), &entry)
+	c.Assert(err, check.IsNil)
+	c.Assert(entry.Message, check.Equals, "mymsg")
+	c.Assert(entry.AppName, check.Equals, "coolappname")
+}
+
+func (s *S) TestHTTPForwarderRetry(c *check.C) {
+	var calls int32
+	srv, reqCh := startHTTPReceiver(c, func(w http.ResponseWriter, r *http.Request) bool {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return false
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return false
+		}
+		return true
+	})
+	defer srv.Close()
+	os.Setenv("LOG_HTTP_URL", srv.URL)
+	os.Setenv("LOG_HTTP_BATCH_SIZE", "1")
+	defer os.Unsetenv("LOG_HTTP_BATCH_SIZE")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"http"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg")
+	req := recvHTTPTimeout(c, reqCh)
+	var entries []jsonLogEntry
+	err = json.Unmarshal(req.body, &entries)
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 1)
+	c.Assert(entries[0].Message, check.Equals, "mymsg")
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(3))
+}
+
+func (s *S) TestHTTPForwarderNoRetryOnClientError(c *check.C) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	f := &httpForwarder{
+		url:           srv.URL,
+		contentType:   "application/json",
+		encodeEntry:   encodeJSONEntry,
+		encodeEntries: encodeJSONArray,
+		maxRetries:    3,
+		client:        http.DefaultClient,
+	}
+	err := f.send([]batchEntry{{data: []byte(`{}`)}})
+	c.Assert(err, check.ErrorMatches, `unexpected response from ".*" 400: `)
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(1))
+}
+
+func (s *S) TestHTTPForwarderInvalidConfig(c *check.C) {
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"http"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.ErrorMatches, `unable to initialize log backend "http": environment variable for LOG_HTTP_URL must be set`)
+	os.Setenv("LOG_HTTP_URL", "http://localhost")
+	os.Setenv("LOG_HTTP_FORMAT", "xml")
+	defer os.Unsetenv("LOG_HTTP_FORMAT")
+	err = lf.Start()
+	c.Assert(err, check.ErrorMatches, `unable to initialize log backend "http": invalid http log format "xml", expected json or ndjson`)
+}
+
+func (s *S) TestParseRetryAfter(c *check.C) {
+	c.Assert(parseRetryAfter(""), check.Equals, time.Duration(0))
+	c.Assert(parseRetryAfter("0"), check.Equals, time.Duration(0))
+	c.Assert(parseRetryAfter("3"), check.Equals, 3*time.Second)
+	c.Assert(parseRetryAfter("invalid"), check.Equals, time.Duration(0))
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	c.Assert(parseRetryAfter(future) > 59*time.Minute, check.Equals, true)
+}
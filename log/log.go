@@ -8,7 +8,9 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tsuru/bs/bslog"
@@ -23,14 +25,25 @@ const (
 	forwardConnWriteTimeout = time.Second
 	noneBackend             = "none"
 	containerIDTrimSize     = 12
+
+	clockSkewReplace = "replace"
+	clockSkewFlag    = "flag"
+	clockSkewField   = "clock_skew"
+
+	// eventPriority is daemon.notice, used for messages generated by bs.
+	eventPriority = "29"
 )
 
 var (
 	stopWg      sync.WaitGroup
 	logBackends = map[string]func() logBackend{
-		"syslog": func() logBackend { return &syslogBackend{} },
-		"tsuru":  func() logBackend { return &tsuruBackend{} },
-		"gelf":   func() logBackend { return &gelfBackend{} },
+		"syslog":  func() logBackend { return &syslogBackend{} },
+		"tsuru":   func() logBackend { return &tsuruBackend{} },
+		"gelf":    func() logBackend { return &gelfBackend{} },
+		"http":    func() logBackend { return &httpBackend{} },
+		"file":    func() logBackend { return &fileBackend{} },
+		"fluentd": func() logBackend { return &fluentdBackend{} },
+		"otlp":    func() logBackend { return &otlpBackend{} },
 	}
 )
 
@@ -40,10 +53,17 @@ type LogForwarder struct {
 	BindAddress     string
 	DockerEndpoint  string
 	EnabledBackends []string
+	// InfoClient is used instead of a client for DockerEndpoint when set,
+	// it's not closed when the forwarder stops.
+	InfoClient      *container.InfoClient
 	infoClient      *container.InfoClient
 	server          *syslog.Server
 	backends        []logBackend
 	formatter       *LenientFormat
+	extractor       *fieldExtractor
+	enricher        *fieldEnricher
+	maxClockSkew    time.Duration
+	clockSkewAction string
 	kubeStreamer    *kubernetesLogStreamer
 }
 
@@ -53,15 +73,24 @@ type forwarderBackend interface {
 	close(conn net.Conn)
 }
 
+// droppedMessageError is returned by process for messages that can't be
+// sent by the backend, like the ones too large. They are counted as dropped
+// and the connection is kept.
+type droppedMessageError struct {
+	error
+}
+
 type logBackend interface {
 	initialize() error
 	sendMessage(*rawLogParts, string, string, string)
 	stop()
+	stats() *backendStats
 }
 
-func processMessages(forwarder forwarderBackend, bufferSize int) (chan<- LogMessage, chan<- bool, error) {
+func processMessages(forwarder forwarderBackend, bufferSize int, stats *backendStats) (chan<- LogMessage, chan<- bool, error) {
 	ch := make(chan LogMessage, bufferSize)
 	quit := make(chan bool)
+	queue := stats.addQueue(ch)
 	if initializable, ok := forwarder.(interface {
 		initialize(<-chan bool)
 	}); ok {
@@ -71,10 +100,13 @@ func processMessages(forwarder forwarderBackend, bufferSize int) (chan<- LogMess
 	if err != nil {
 		return nil, nil, err
 	}
+	atomic.StoreInt32(&queue.connected, 1)
 	stopWg.Add(1)
 	go func() {
 		defer stopWg.Done()
 		var err error
+		nextNotify := time.NewTimer(0)
+		defer nextNotify.Stop()
 		for {
 			select {
 			case <-quit:
@@ -88,28 +120,63 @@ func processMessages(forwarder forwarderBackend, bufferSize int) (chan<- LogMess
 					time.Sleep(100 * time.Millisecond)
 					continue
 				}
+				atomic.AddUint64(&stats.reconnects, 1)
+				atomic.StoreInt32(&queue.connected, 1)
+			}
+			// batch connections count their messages as they are sent.
+			var failed <-chan struct{}
+			batch, _ := conn.(*batchConn)
+			if batch != nil {
+				failed = batch.failed
 			}
 		loop:
 			for {
 				select {
 				case <-quit:
 					break loop
+				case <-failed:
+					err = errBatchNotSent
+					break loop
 				case msg := <-ch:
 					if msg == nil {
 						break loop
 					}
+					var ts time.Time
+					if queued, ok := msg.(queuedMessage); ok {
+						msg, ts = queued.msg, queued.ts
+					}
+					if batch != nil {
+						batch.setTimestamp(ts)
+					}
 					err = forwarder.process(conn, msg)
+					if dropped, ok := err.(droppedMessageError); ok {
+						atomic.AddUint64(&stats.dropped, 1)
+						select {
+						case <-nextNotify.C:
+							bslog.Errorf("[log forwarder] dropping message: %s", dropped.error)
+							nextNotify.Reset(time.Minute)
+						default:
+						}
+						err = nil
+						continue
+					}
 					if err != nil {
 						break loop
 					}
+					if batch == nil {
+						stats.forwarded(ts)
+					}
 				}
 			}
+			atomic.StoreInt32(&queue.connected, 0)
 			forwarder.close(conn)
 			switch err {
 			case nil:
 				break
 			case errConnMaxAgeExceeded:
 				bslog.Warnf("[log forwarder] connection max age exceeded, forcing reconnection")
+			case errBatchNotSent:
+				bslog.Warnf("[log forwarder] %s", err)
 			default:
 				bslog.Errorf("[log forwarder] error writing to %#v: %s", forwarder, err)
 			}
@@ -134,6 +201,7 @@ func (l *LogForwarder) Start() (err error) {
 			return fmt.Errorf("invalid log backend: %s", backendName)
 		}
 		backend := constructor()
+		backend.stats().name = backendName
 		err = backend.initialize()
 		if err != nil {
 			return fmt.Errorf("unable to initialize log backend %q: %s", backendName, err)
@@ -143,12 +211,38 @@ func (l *LogForwarder) Start() (err error) {
 	if len(l.backends) == 0 {
 		bslog.Warnf("no log backend enabled, discarding all received log messages.")
 	}
-	l.infoClient, err = container.NewClient(l.DockerEndpoint)
+	l.registerMetrics()
+	l.extractor, err = newFieldExtractor(parserNamesFromEnv())
 	if err != nil {
-		err = fmt.Errorf("unable to initialize docker client %s: %s", l.DockerEndpoint, err)
 		return
 	}
+	l.enricher, err = newFieldEnricher(config.StringsEnvOrDefault(nil, "LOG_ENRICH_FIELDS"), config.StringsEnvOrDefault(nil, "LOG_ENRICH_LABELS"))
+	if err != nil {
+		return
+	}
+	l.infoClient = l.InfoClient
+	if l.infoClient == nil {
+		l.infoClient, err = container.NewClient(l.DockerEndpoint)
+		if err != nil {
+			err = fmt.Errorf("unable to initialize docker client %s: %s", l.DockerEndpoint, err)
+			return
+		}
+	}
+	if watchEvents, _ := strconv.ParseBool(config.StringEnvOrDefault("TRUE", "CONTAINER_CACHE_EVENTS")); watchEvents {
+		l.infoClient.WatchEvents()
+	}
 	l.formatter = &LenientFormat{}
+	if timezone := config.StringEnvOrDefault("", "LOG_INPUT_TIMEZONE"); timezone != "" {
+		l.formatter.Location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return fmt.Errorf("invalid input timezone %q: %s", timezone, err)
+		}
+	}
+	l.maxClockSkew = config.SecondsEnvOrDefault(0, "LOG_MAX_CLOCK_SKEW")
+	l.clockSkewAction = config.StringEnvOrDefault(clockSkewReplace, "LOG_CLOCK_SKEW_ACTION")
+	if l.clockSkewAction != clockSkewReplace && l.clockSkewAction != clockSkewFlag {
+		return fmt.Errorf("invalid clock skew action %q, expected %s or %s", l.clockSkewAction, clockSkewReplace, clockSkewFlag)
+	}
 	l.server = syslog.NewServer()
 	l.server.SetHandler(l)
 	l.server.SetFormat(l.formatter)
@@ -156,6 +250,8 @@ func (l *LogForwarder) Start() (err error) {
 	if err != nil {
 		return
 	}
+	l.formatter.received = messagesReceived.With(url.Scheme)
+	l.formatter.parseFailures = parseFailures.With(url.Scheme)
 	if url.Scheme == "tcp" {
 		err = l.server.ListenTCP(url.Host)
 	} else if url.Scheme == "udp" {
@@ -194,6 +290,9 @@ func (l *LogForwarder) Stop() {
 	if l.kubeStreamer != nil {
 		l.kubeStreamer.stop()
 	}
+	if l.infoClient != nil && l.InfoClient == nil {
+		l.infoClient.Close()
+	}
 }
 
 func (l *LogForwarder) stopWait() {
@@ -222,7 +321,61 @@ func (l *LogForwarder) Handle(logParts format.LogParts, _ int64, err error) {
 		bslog.Debugf("[log forwarder] ignored msg %v error to get appname: %s", parts, err)
 		return
 	}
+	if l.extractor != nil {
+		parts.fields = l.extractor.extract(parts.content)
+	}
+	if l.enricher != nil {
+		parts.fields = l.enricher.enrich(parts.fields, contData)
+	}
+	if l.maxClockSkew > 0 {
+		l.checkClockSkew(parts, time.Now())
+	}
+	l.sendToBackends(parts, contData, contStr)
+}
+
+// SendContainerEvent sends a message generated by bs about a container, like
+// an audit event, to every backend as if the container had logged it with
+// notice priority.
+func (l *LogForwarder) SendContainerEvent(cont *container.Container, message string, fields map[string]interface{}) {
+	parts := &rawLogParts{
+		ts:        time.Now(),
+		priority:  []byte(eventPriority),
+		content:   []byte(message),
+		container: []byte(cont.ID),
+		fields:    fields,
+	}
+	if l.enricher != nil {
+		parts.fields = l.enricher.enrich(parts.fields, cont)
+	}
+	l.sendToBackends(parts, cont, cont.ID)
+}
+
+func (l *LogForwarder) sendToBackends(parts *rawLogParts, contData *container.Container, contStr string) {
 	for _, backend := range l.backends {
+		if containerBackend, ok := backend.(interface {
+			sendContainerMessage(*rawLogParts, *container.Container, string)
+		}); ok {
+			containerBackend.sendContainerMessage(parts, contData, contStr)
+			continue
+		}
 		backend.sendMessage(parts, contData.AppName, contData.ProcessName, contStr)
 	}
 }
+
+// checkClockSkew replaces the message timestamp with the receive time, or adds
+// the skew in seconds as the clock_skew field, if the timestamp differs from
+// the receive time by more than the maximum clock skew.
+func (l *LogForwarder) checkClockSkew(parts *rawLogParts, receivedAt time.Time) {
+	skew := parts.ts.Sub(receivedAt)
+	if skew <= l.maxClockSkew && skew >= -l.maxClockSkew {
+		return
+	}
+	if l.clockSkewAction == clockSkewFlag {
+		if parts.fields == nil {
+			parts.fields = make(map[string]interface{}, 1)
+		}
+		parts.fields[clockSkewField] = skew.Seconds()
+		return
+	}
+	parts.ts = receivedAt
+}
@@ -10,6 +10,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -68,9 +69,10 @@ func serverWithContainer() (*dTesting.DockerServer, string, error) {
 		return nil, "", err
 	}
 	config := docker.Config{
-		Image: "myimg",
-		Cmd:   []string{"mycmd"},
-		Env:   []string{"ENV1=val1", "TSURU_PROCESSNAME=procx", "TSURU_APPNAME=coolappname"},
+		Image:  "myimg",
+		Cmd:    []string{"mycmd"},
+		Env:    []string{"ENV1=val1", "TSURU_PROCESSNAME=procx", "TSURU_APPNAME=coolappname"},
+		Labels: map[string]string{"label1": "val1", "label2": `v"2]`},
 	}
 	opts := docker.CreateContainerOptions{Name: "myContName", Config: &config}
 	cont, err := dockerClient.CreateContainer(opts)
@@ -168,6 +170,155 @@ func (s *S) TestLogForwarderStartWithTimezone(c *check.C) {
 	c.Assert(string(buffer[:n]), check.Equals, fmt.Sprintf("<30>Jun  5 12:13:47 %s coolappname[procx]: mymsg\n", s.idShort))
 }
 
+func (s *S) TestLogForwarderStartRFC5424(c *check.C) {
+	os.Setenv("LOG_SYSLOG_HOSTNAME", "mynode")
+	os.Setenv("LOG_SYSLOG_RFC5424_LABELS", "label1,label2,missing")
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	udpConn, err := net.ListenUDP("udp", addr)
+	c.Assert(err, check.IsNil)
+	defer udpConn.Close()
+	addr2, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	udpConn2, err := net.ListenUDP("udp", addr2)
+	c.Assert(err, check.IsNil)
+	defer udpConn2.Close()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", fmt.Sprintf("udp://%s?format=rfc5424,udp://%s", udpConn.LocalAddr(), udpConn2.LocalAddr()))
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	msg := []byte(fmt.Sprintf("<30>2015-06-05T16:13:47.123456Z myhost docker/%s: mymsg\n", s.id))
+	_, err = conn.Write(msg)
+	c.Assert(err, check.IsNil)
+	buffer := make([]byte, 1024)
+	udpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := udpConn.Read(buffer)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buffer[:n]), check.Equals, fmt.Sprintf(`<30>1 2015-06-05T13:13:47.123456-03:00 mynode coolappname procx - [tsuru@32473 container_id="%s" image="myimg" label1="val1" label2="v\"2\]"] mymsg`+"\n", s.id))
+	udpConn2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err = udpConn2.Read(buffer)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buffer[:n]), check.Equals, fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: mymsg\n", s.idShort))
+}
+
+func (s *S) TestLogForwarderInvalidSyslogFormat(c *check.C) {
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://127.0.0.1:1234?format=rfc1234")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.ErrorMatches, `unable to initialize log backend "syslog": invalid syslog format "rfc1234", expected rfc3164, rfc5424 or template`)
+}
+
+// writeTestCert writes the self-signed certificate used by httptest servers
+// and its key to dir, returning the certificate.
+func writeTestCert(c *check.C, dir string) tls.Certificate {
+	certSrv := httptest.NewUnstartedServer(nil)
+	certSrv.StartTLS()
+	certSrv.Close()
+	cert := certSrv.TLS.Certificates[0]
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyData, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	c.Assert(err, check.IsNil)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyData})
+	err = ioutil.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0600)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0600)
+	c.Assert(err, check.IsNil)
+	return cert
+}
+
+func (s *S) TestLogForwarderSyslogTLSOctetCounting(c *check.C) {
+	dir, err := ioutil.TempDir("", "bs-syslog-tls")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	cert := writeTestCert(c, dir)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+	type tlsResult struct {
+		serverName  string
+		clientCerts int
+		data        string
+	}
+	resultCh := make(chan tlsResult, 1)
+	go func() {
+		conn, acceptErr := listener.Accept()
+		if acceptErr != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		var result tlsResult
+		if tlsConn.Handshake() == nil {
+			state := tlsConn.ConnectionState()
+			result.serverName = state.ServerName
+			result.clientCerts = len(state.PeerCertificates)
+			buffer := make([]byte, 1024)
+			n, _ := io.ReadAtLeast(tlsConn, buffer, 20)
+			result.data = string(buffer[:n])
+		}
+		resultCh <- result
+	}()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", fmt.Sprintf("tls://%s?framing=octet-counting", listener.Addr()))
+	os.Setenv("LOG_SYSLOG_TLS_CA_FILE", filepath.Join(dir, "cert.pem"))
+	os.Setenv("LOG_SYSLOG_TLS_CERT_FILE", filepath.Join(dir, "cert.pem"))
+	os.Setenv("LOG_SYSLOG_TLS_KEY_FILE", filepath.Join(dir, "key.pem"))
+	os.Setenv("LOG_SYSLOG_TLS_SERVER_NAME", "example.com")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "my\nmsg")
+	expectedMsg := fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: my\nmsg", s.idShort)
+	select {
+	case result := <-resultCh:
+		c.Assert(result.serverName, check.Equals, "example.com")
+		c.Assert(result.clientCerts, check.Equals, 1)
+		c.Assert(result.data, check.Equals, fmt.Sprintf("%d %s", len(expectedMsg), expectedMsg))
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for tls syslog message")
+	}
+}
+
+func (s *S) TestLogForwarderSyslogInvalidFraming(c *check.C) {
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "tcp://127.0.0.1:1234?framing=nul")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.ErrorMatches, `unable to initialize log backend "syslog": invalid syslog framing "nul", expected newline or octet-counting`)
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://127.0.0.1:1234")
+	os.Setenv("LOG_SYSLOG_FRAMING", "octet-counting")
+	err = lf.Start()
+	c.Assert(err, check.ErrorMatches, `unable to initialize log backend "syslog": octet-counting framing is not supported for udp address "udp://127.0.0.1:1234"`)
+}
+
+func (s *S) TestAppendRFC5424Header(c *check.C) {
+	c.Assert(string(appendRFC5424Header(nil, "", 10)), check.Equals, "-")
+	c.Assert(string(appendRFC5424Header(nil, "my app", 10)), check.Equals, "my_app")
+	c.Assert(string(appendRFC5424Header(nil, "averylongname", 5)), check.Equals, "avery")
+}
+
 func (s *S) TestLogForwarderWSForwarderHTTP(c *check.C) {
 	testLogForwarderWSForwarder(s, c, httptest.NewServer)
 }
@@ -176,6 +327,39 @@ func (s *S) TestLogForwarderWSForwarderHTTPS(c *check.C) {
 	testLogForwarderWSForwarder(s, c, httptest.NewTLSServer)
 }
 
+func (s *S) TestLogForwarderWSForwarderFailover(c *check.C) {
+	closed := httptest.NewServer(nil)
+	closed.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "deploying", http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	bodyCh := make(chan string, 1)
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		scanner := bufio.NewScanner(ws)
+		for scanner.Scan() {
+			bodyCh <- scanner.Text()
+		}
+	}))
+	defer srv.Close()
+	os.Setenv("TSURU_ENDPOINT", strings.Join([]string{closed.URL, unavailable.URL, srv.URL}, ","))
+	os.Setenv("LOG_TSURU_PING_INTERVAL", "0.1")
+	os.Setenv("LOG_TSURU_PONG_INTERVAL", "2.0")
+	lf := LogForwarder{
+		EnabledBackends: []string{"tsuru"},
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg")
+	var logLine app.Applog
+	err = json.Unmarshal([]byte(recvTimeout(c, bodyCh)), &logLine)
+	c.Assert(err, check.IsNil)
+	c.Assert(logLine.Message, check.Equals, "mymsg")
+}
+
 func recvTimeout(c *check.C, ch chan string) string {
 	select {
 	case data := <-ch:
@@ -344,8 +528,13 @@ func (s *S) TestLogForwarderOverflow(c *check.C) {
 		}()
 	}
 	wg.Wait()
+	stats := lf.BackendStats()
 	lf.stopWait()
 	c.Assert(logBuf.String(), check.Matches, `(?s).*\[ERROR\] Dropping log messages to tsuru due to full channel buffer.*`)
+	c.Assert(stats, check.HasLen, 1)
+	c.Assert(stats[0].Name, check.Equals, "tsuru")
+	c.Assert(stats[0].Dropped > 0, check.Equals, true)
+	c.Assert(stats[0].Sent+stats[0].Dropped <= 32000, check.Equals, true)
 }
 
 func (s *S) TestLogForwarderHandleIgnoredInvalid(c *check.C) {
@@ -471,6 +660,8 @@ func (s *S) TestLogForwarderTableTennisNoPong(c *check.C) {
 						io.Copy(ioutil.Discard, trailer)
 					}
 				}
+			} else {
+				io.Copy(ioutil.Discard, frame)
 			}
 		}
 	}))
@@ -30,6 +30,7 @@ const (
 	facilityMask = 0xf8
 
 	podContainerName    = "POD"
+	kubernetesListener  = "kubernetes"
 	kubeSystemNamespace = "kube-system"
 )
 
@@ -127,10 +128,12 @@ func (m *fileMonitor) streamOutput() {
 		err := dec.Decode(&lineData)
 		if err != nil {
 			if err != io.EOF {
+				parseFailures.With(kubernetesListener).Inc()
 				bslog.Errorf("error decoding log file line: %v", err)
 			}
 			return
 		}
+		messagesReceived.With(kubernetesListener).Inc()
 		timeNano := lineData.Time.UnixNano()
 		if timeNano <= m.loadedLastTime {
 			continue
@@ -0,0 +1,28 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"net"
+
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/config"
+)
+
+// interfaceMTU returns the MTU of the network interface named in the given
+// environment variables, eth0 by default.
+func interfaceMTU(envs ...string) int {
+	mtu := udpMessageDefaultMTU
+	mtuInterface := config.StringEnvOrDefault("eth0", envs...)
+	if mtuInterface != "" {
+		iface, err := net.InterfaceByName(mtuInterface)
+		if err == nil && iface.MTU > 0 {
+			mtu = iface.MTU
+		} else {
+			bslog.Warnf("unable to read mtu from interface, using default %d: %s", mtu, err)
+		}
+	}
+	return mtu
+}
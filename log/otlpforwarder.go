@@ -0,0 +1,365 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/config"
+)
+
+const (
+	otlpProtocolProtobuf = "http/protobuf"
+	otlpProtocolJSON     = "http/json"
+
+	otlpLogsPath = "/v1/logs"
+)
+
+// otlpSeverities maps syslog severities to OpenTelemetry severity numbers and
+// their short names.
+var otlpSeverities = [8]struct {
+	number int
+	text   string
+}{
+	{24, "FATAL4"}, // emergency
+	{23, "FATAL3"}, // alert
+	{21, "FATAL"},  // critical
+	{17, "ERROR"},  // error
+	{13, "WARN"},   // warning
+	{10, "INFO2"},  // notice
+	{9, "INFO"},    // informational
+	{5, "DEBUG"},   // debug
+}
+
+type otlpBackend struct {
+	backendStats
+	msgCh      chan<- LogMessage
+	quitCh     chan<- bool
+	nextNotify *time.Timer
+}
+
+type otlpLogRecord struct {
+	appName     string
+	processName string
+	container   string
+	ts          time.Time
+	observedTs  time.Time
+	priority    int
+	body        string
+	fields      map[string]interface{}
+}
+
+// otlpResource holds the attributes identifying the source of a set of log
+// records, encoded in the batch entry key.
+type otlpResource struct {
+	appName     string
+	processName string
+	container   string
+}
+
+func (r otlpResource) key() string {
+	return strings.Join([]string{r.appName, r.processName, r.container}, "\x00")
+}
+
+func otlpResourceFromKey(key string) otlpResource {
+	parts := strings.SplitN(key, "\x00", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	return otlpResource{appName: parts[0], processName: parts[1], container: parts[2]}
+}
+
+func (r otlpResource) attributes(hostname string) [][2]string {
+	return [][2]string{
+		{"service.name", r.appName},
+		{"tsuru.process", r.processName},
+		{"container.id", r.container},
+		{"host.name", hostname},
+	}
+}
+
+func (b *otlpBackend) initialize() error {
+	bufferSize := config.IntEnvOrDefault(config.DefaultBufferSize, "LOG_OTLP_BUFFER_SIZE", "LOG_BUFFER_SIZE")
+	endpoint := strings.TrimRight(config.StringEnvOrDefault("http://localhost:4318", "LOG_OTLP_ENDPOINT"), "/")
+	if !strings.HasSuffix(endpoint, otlpLogsPath) {
+		endpoint += otlpLogsPath
+	}
+	protocol := config.StringEnvOrDefault(otlpProtocolProtobuf, "LOG_OTLP_PROTOCOL")
+	if protocol != otlpProtocolProtobuf && protocol != otlpProtocolJSON {
+		return fmt.Errorf("invalid otlp protocol %q, expected %s or %s", protocol, otlpProtocolProtobuf, otlpProtocolJSON)
+	}
+	headers, err := headersFromEnv("LOG_OTLP_HEADERS")
+	if err != nil {
+		return err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	useGzip, _ := strconv.ParseBool(config.StringEnvOrDefault("FALSE", "LOG_OTLP_GZIP"))
+	forwarder := &httpForwarder{
+		url:           endpoint,
+		contentType:   "application/x-protobuf",
+		encodeEntry:   encodeOTLPProtoRecord,
+		encodeEntries: otlpProtoEncoder(hostname),
+		headers:       headers,
+		gzip:          useGzip,
+		batchSize:     config.IntEnvOrDefault(100, "LOG_OTLP_BATCH_SIZE"),
+		batchBytes:    config.IntEnvOrDefault(1024*1024, "LOG_OTLP_BATCH_BYTES"),
+		batchInterval: config.SecondsEnvOrDefault(1, "LOG_OTLP_BATCH_INTERVAL"),
+		maxRetries:    config.IntEnvOrDefault(3, "LOG_OTLP_MAX_RETRIES"),
+		client: &http.Client{
+			Timeout: config.SecondsEnvOrDefault(10, "LOG_OTLP_TIMEOUT"),
+		},
+	}
+	if protocol == otlpProtocolJSON {
+		forwarder.contentType = "application/json"
+		forwarder.encodeEntry = encodeOTLPJSONRecord
+		forwarder.encodeEntries = otlpJSONEncoder(hostname)
+	}
+	forwarder.stats = &b.backendStats
+	b.nextNotify = time.NewTimer(0)
+	b.msgCh, b.quitCh, err = processMessages(forwarder, bufferSize, &b.backendStats)
+	return err
+}
+
+func (b *otlpBackend) sendMessage(parts *rawLogParts, appName, processName, container string) {
+	priority, _ := strconv.Atoi(string(parts.priority))
+	msg := &otlpLogRecord{
+		appName:     appName,
+		processName: processName,
+		container:   container,
+		ts:          parts.ts,
+		observedTs:  time.Now(),
+		priority:    priority,
+		body:        string(parts.content),
+		fields:      parts.fields,
+	}
+	if !b.enqueue(b.msgCh, msg, parts.ts) {
+		select {
+		case <-b.nextNotify.C:
+			bslog.Errorf("Dropping log messages to otlp due to full channel buffer.")
+			b.nextNotify.Reset(time.Minute)
+		default:
+		}
+	}
+}
+
+func (b *otlpBackend) stop() {
+	close(b.quitCh)
+}
+
+func (r *otlpLogRecord) resource() otlpResource {
+	return otlpResource{appName: r.appName, processName: r.processName, container: r.container}
+}
+
+func (r *otlpLogRecord) severity() (int, string) {
+	s := otlpSeverities[r.priority&severityMask]
+	return s.number, s.text
+}
+
+// groupByResource returns the batch entries grouped by their key, keeping
+// the order in which each key was first seen.
+func groupByResource(entries []batchEntry) ([]string, map[string][][]byte) {
+	var keys []string
+	grouped := map[string][][]byte{}
+	for _, e := range entries {
+		if _, ok := grouped[e.key]; !ok {
+			keys = append(keys, e.key)
+		}
+		grouped[e.key] = append(grouped[e.key], e.data)
+	}
+	return keys, grouped
+}
+
+// Protocol buffers encoding of the opentelemetry.proto.collector.logs.v1
+// ExportLogsServiceRequest message.
+
+const (
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+)
+
+func protoAppendTag(buf []byte, field int, wireType int) []byte {
+	return protoAppendVarint(buf, uint64(field<<3|wireType))
+}
+
+func protoAppendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func protoAppendBytes(buf []byte, field int, data []byte) []byte {
+	buf = protoAppendTag(buf, field, protoWireBytes)
+	buf = protoAppendVarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func protoAppendString(buf []byte, field int, s string) []byte {
+	buf = protoAppendTag(buf, field, protoWireBytes)
+	buf = protoAppendVarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func protoAppendFixed64(buf []byte, field int, v uint64) []byte {
+	buf = protoAppendTag(buf, field, protoWireFixed64)
+	var data [8]byte
+	binary.LittleEndian.PutUint64(data[:], v)
+	return append(buf, data[:]...)
+}
+
+func protoAppendUint(buf []byte, field int, v uint64) []byte {
+	buf = protoAppendTag(buf, field, protoWireVarint)
+	return protoAppendVarint(buf, v)
+}
+
+func protoStringValue(s string) []byte {
+	return protoAppendString(nil, 1, s)
+}
+
+func protoKeyValue(key, value string) []byte {
+	kv := protoAppendString(nil, 1, key)
+	return protoAppendBytes(kv, 2, protoStringValue(value))
+}
+
+func otlpUnixNano(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+func encodeOTLPProtoRecord(msg LogMessage) (batchEntry, error) {
+	r := msg.(*otlpLogRecord)
+	number, text := r.severity()
+	var buf []byte
+	buf = protoAppendFixed64(buf, 1, otlpUnixNano(r.ts))
+	buf = protoAppendUint(buf, 2, uint64(number))
+	buf = protoAppendString(buf, 3, text)
+	buf = protoAppendBytes(buf, 5, protoStringValue(r.body))
+	for _, key := range sortedFieldKeys(r.fields) {
+		buf = protoAppendBytes(buf, 6, protoKeyValue(key, fieldString(r.fields[key])))
+	}
+	buf = protoAppendFixed64(buf, 11, otlpUnixNano(r.observedTs))
+	return batchEntry{key: r.resource().key(), data: buf}, nil
+}
+
+func otlpProtoEncoder(hostname string) func(io.Writer, []batchEntry) error {
+	return func(w io.Writer, entries []batchEntry) error {
+		keys, grouped := groupByResource(entries)
+		var request []byte
+		for _, key := range keys {
+			var resource []byte
+			for _, attr := range otlpResourceFromKey(key).attributes(hostname) {
+				resource = protoAppendBytes(resource, 1, protoKeyValue(attr[0], attr[1]))
+			}
+			scopeLogs := protoAppendBytes(nil, 1, protoAppendString(nil, 1, "bs"))
+			for _, record := range grouped[key] {
+				scopeLogs = protoAppendBytes(scopeLogs, 2, record)
+			}
+			resourceLogs := protoAppendBytes(nil, 1, resource)
+			resourceLogs = protoAppendBytes(resourceLogs, 2, scopeLogs)
+			request = protoAppendBytes(request, 1, resourceLogs)
+		}
+		_, err := w.Write(request)
+		return err
+	}
+}
+
+// JSON encoding following the OTLP/HTTP JSON mapping, where 64 bit integers
+// are represented as decimal strings.
+
+type otlpJSONAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpJSONKeyValue struct {
+	Key   string           `json:"key"`
+	Value otlpJSONAnyValue `json:"value"`
+}
+
+type otlpJSONLogRecord struct {
+	TimeUnixNano         string             `json:"timeUnixNano"`
+	ObservedTimeUnixNano string             `json:"observedTimeUnixNano"`
+	SeverityNumber       int                `json:"severityNumber"`
+	SeverityText         string             `json:"severityText"`
+	Body                 otlpJSONAnyValue   `json:"body"`
+	Attributes           []otlpJSONKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpJSONScopeLogs struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	LogRecords []json.RawMessage `json:"logRecords"`
+}
+
+type otlpJSONResourceLogs struct {
+	Resource struct {
+		Attributes []otlpJSONKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeLogs []otlpJSONScopeLogs `json:"scopeLogs"`
+}
+
+type otlpJSONRequest struct {
+	ResourceLogs []otlpJSONResourceLogs `json:"resourceLogs"`
+}
+
+func encodeOTLPJSONRecord(msg LogMessage) (batchEntry, error) {
+	r := msg.(*otlpLogRecord)
+	number, text := r.severity()
+	record := otlpJSONLogRecord{
+		TimeUnixNano:         strconv.FormatUint(otlpUnixNano(r.ts), 10),
+		ObservedTimeUnixNano: strconv.FormatUint(otlpUnixNano(r.observedTs), 10),
+		SeverityNumber:       number,
+		SeverityText:         text,
+		Body:                 otlpJSONAnyValue{StringValue: r.body},
+	}
+	for _, key := range sortedFieldKeys(r.fields) {
+		record.Attributes = append(record.Attributes, otlpJSONKeyValue{
+			Key:   key,
+			Value: otlpJSONAnyValue{StringValue: fieldString(r.fields[key])},
+		})
+	}
+	data, err := json.Marshal(record)
+	return batchEntry{key: r.resource().key(), data: data}, err
+}
+
+func otlpJSONEncoder(hostname string) func(io.Writer, []batchEntry) error {
+	return func(w io.Writer, entries []batchEntry) error {
+		keys, grouped := groupByResource(entries)
+		request := otlpJSONRequest{ResourceLogs: make([]otlpJSONResourceLogs, 0, len(keys))}
+		for _, key := range keys {
+			var resourceLogs otlpJSONResourceLogs
+			for _, attr := range otlpResourceFromKey(key).attributes(hostname) {
+				resourceLogs.Resource.Attributes = append(resourceLogs.Resource.Attributes, otlpJSONKeyValue{
+					Key:   attr[0],
+					Value: otlpJSONAnyValue{StringValue: attr[1]},
+				})
+			}
+			scopeLogs := otlpJSONScopeLogs{LogRecords: make([]json.RawMessage, 0, len(grouped[key]))}
+			scopeLogs.Scope.Name = "bs"
+			for _, record := range grouped[key] {
+				scopeLogs.LogRecords = append(scopeLogs.LogRecords, json.RawMessage(record))
+			}
+			resourceLogs.ScopeLogs = []otlpJSONScopeLogs{scopeLogs}
+			request.ResourceLogs = append(request.ResourceLogs, resourceLogs)
+		}
+		return json.NewEncoder(w).Encode(request)
+	}
+}
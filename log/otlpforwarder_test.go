@@ -0,0 +1,160 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type protoField struct {
+	varint uint64
+	data   []byte
+}
+
+func decodeProto(c *check.C, data []byte) map[int][]protoField {
+	fields := map[int][]protoField{}
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		c.Assert(n > 0, check.Equals, true)
+		data = data[n:]
+		var f protoField
+		switch tag & 7 {
+		case protoWireVarint:
+			f.varint, n = binary.Uvarint(data)
+			c.Assert(n > 0, check.Equals, true)
+			data = data[n:]
+		case protoWireFixed64:
+			f.varint = binary.LittleEndian.Uint64(data[:8])
+			data = data[8:]
+		case protoWireBytes:
+			l, n := binary.Uvarint(data)
+			c.Assert(n > 0, check.Equals, true)
+			f.data = data[n : n+int(l)]
+			data = data[n+int(l):]
+		default:
+			c.Fatalf("unexpected wire type %d", tag&7)
+		}
+		fields[int(tag>>3)] = append(fields[int(tag>>3)], f)
+	}
+	return fields
+}
+
+func decodeProtoAttributes(c *check.C, fields []protoField) map[string]string {
+	attrs := map[string]string{}
+	for _, f := range fields {
+		kv := decodeProto(c, f.data)
+		value := decodeProto(c, kv[2][0].data)
+		attrs[string(kv[1][0].data)] = string(value[1][0].data)
+	}
+	return attrs
+}
+
+func (s *S) TestOTLPForwarderProtobuf(c *check.C) {
+	srv, reqCh := startHTTPReceiver(c, nil)
+	defer srv.Close()
+	os.Setenv("LOG_OTLP_ENDPOINT", srv.URL)
+	os.Setenv("LOG_OTLP_BATCH_SIZE", "2")
+	os.Setenv("LOG_OTLP_GZIP", "true")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"otlp"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg", "mymsg2")
+	req := recvHTTPTimeout(c, reqCh)
+	c.Assert(req.header.Get("Content-Type"), check.Equals, "application/x-protobuf")
+	hostname, _ := os.Hostname()
+	request := decodeProto(c, req.body)
+	c.Assert(request[1], check.HasLen, 1)
+	resourceLogs := decodeProto(c, request[1][0].data)
+	resource := decodeProto(c, resourceLogs[1][0].data)
+	c.Assert(decodeProtoAttributes(c, resource[1]), check.DeepEquals, map[string]string{
+		"service.name":  "coolappname",
+		"tsuru.process": "procx",
+		"container.id":  s.id,
+		"host.name":     hostname,
+	})
+	scopeLogs := decodeProto(c, resourceLogs[2][0].data)
+	c.Assert(string(decodeProto(c, scopeLogs[1][0].data)[1][0].data), check.Equals, "bs")
+	c.Assert(scopeLogs[2], check.HasLen, 2)
+	for i, content := range []string{"mymsg", "mymsg2"} {
+		record := decodeProto(c, scopeLogs[2][i].data)
+		c.Assert(record[1][0].varint, check.Equals, uint64(time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC).UnixNano()))
+		c.Assert(record[2][0].varint, check.Equals, uint64(9))
+		c.Assert(string(record[3][0].data), check.Equals, "INFO")
+		c.Assert(string(decodeProto(c, record[5][0].data)[1][0].data), check.Equals, content)
+		c.Assert(record[11][0].varint > 0, check.Equals, true)
+	}
+}
+
+func (s *S) TestOTLPForwarderJSON(c *check.C) {
+	srv, reqCh := startHTTPReceiver(c, nil)
+	defer srv.Close()
+	os.Setenv("LOG_OTLP_ENDPOINT", srv.URL+"/v1/logs")
+	os.Setenv("LOG_OTLP_PROTOCOL", "http/json")
+	os.Setenv("LOG_OTLP_BATCH_SIZE", "1")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"otlp"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg")
+	req := recvHTTPTimeout(c, reqCh)
+	c.Assert(req.header.Get("Content-Type"), check.Equals, "application/json")
+	var request struct {
+		ResourceLogs []struct {
+			Resource struct {
+				Attributes []otlpJSONKeyValue
+			}
+			ScopeLogs []struct {
+				LogRecords []otlpJSONLogRecord
+			}
+		}
+	}
+	err = json.Unmarshal(req.body, &request)
+	c.Assert(err, check.IsNil)
+	c.Assert(request.ResourceLogs, check.HasLen, 1)
+	c.Assert(request.ResourceLogs[0].Resource.Attributes[0], check.DeepEquals, otlpJSONKeyValue{
+		Key: "service.name", Value: otlpJSONAnyValue{StringValue: "coolappname"},
+	})
+	records := request.ResourceLogs[0].ScopeLogs[0].LogRecords
+	c.Assert(records, check.HasLen, 1)
+	c.Assert(records[0].TimeUnixNano, check.Equals, strconv.FormatInt(time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC).UnixNano(), 10))
+	c.Assert(records[0].SeverityNumber, check.Equals, 9)
+	c.Assert(records[0].SeverityText, check.Equals, "INFO")
+	c.Assert(records[0].Body.StringValue, check.Equals, "mymsg")
+}
+
+func (s *S) TestOTLPSeverityMapping(c *check.C) {
+	tests := []struct {
+		priority int
+		number   int
+		text     string
+	}{
+		{priority: 24, number: 24, text: "FATAL4"},
+		{priority: 27, number: 17, text: "ERROR"},
+		{priority: 28, number: 13, text: "WARN"},
+		{priority: 29, number: 10, text: "INFO2"},
+		{priority: 30, number: 9, text: "INFO"},
+		{priority: 135, number: 5, text: "DEBUG"},
+	}
+	for _, tt := range tests {
+		number, text := (&otlpLogRecord{priority: tt.priority}).severity()
+		c.Check(number, check.Equals, tt.number)
+		c.Check(text, check.Equals, tt.text)
+	}
+}
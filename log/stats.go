@@ -0,0 +1,154 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tsuru/bs/telemetry"
+)
+
+var (
+	messagesReceived = telemetry.NewCounterVec("bs_log_messages_received_total",
+		"Log messages received by each listener.", "listener")
+	parseFailures = telemetry.NewCounterVec("bs_log_parse_failures_total",
+		"Log messages received by each listener that could not be parsed.", "listener")
+	forwardLatency = telemetry.NewHistogramVec("bs_log_forward_latency_seconds",
+		"Time from the log message timestamp until it's written by the backend forwarder.",
+		[]float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300}, "backend")
+)
+
+// BackendStats are the state and message counters of a log backend.
+type BackendStats struct {
+	Name string `json:"name"`
+	// Connected is set when every forwarder of the backend is connected.
+	Connected bool `json:"connected"`
+	// QueueDepth is the number of messages waiting to be forwarded and
+	// QueueCapacity the maximum, after which messages are dropped.
+	QueueDepth    int    `json:"queue_depth"`
+	QueueCapacity int    `json:"queue_capacity"`
+	Accepted      uint64 `json:"accepted"`
+	Sent          uint64 `json:"sent"`
+	Dropped       uint64 `json:"dropped"`
+	Reconnects    uint64 `json:"reconnects"`
+}
+
+// backendStats is embedded in log backends to count their messages, the
+// forwarder queues are registered by processMessages.
+type backendStats struct {
+	name       string
+	accepted   uint64
+	sent       uint64
+	dropped    uint64
+	reconnects uint64
+	latency    telemetry.Histogram
+	mu         sync.Mutex
+	queues     []*forwarderQueue
+}
+
+type forwarderQueue struct {
+	ch        chan LogMessage
+	connected int32
+}
+
+// queuedMessage is a message with its timestamp, unwrapped by
+// processMessages to measure the forwarding latency.
+type queuedMessage struct {
+	msg LogMessage
+	ts  time.Time
+}
+
+func (s *backendStats) stats() *backendStats {
+	return s
+}
+
+func (s *backendStats) addQueue(ch chan LogMessage) *forwarderQueue {
+	queue := &forwarderQueue{ch: ch}
+	s.mu.Lock()
+	s.queues = append(s.queues, queue)
+	if s.latency == nil {
+		s.latency = forwardLatency.With(s.name)
+	}
+	s.mu.Unlock()
+	return queue
+}
+
+// enqueue queues the message logged at ts, returning false if it was dropped
+// because the queue is full.
+func (s *backendStats) enqueue(ch chan<- LogMessage, msg LogMessage, ts time.Time) bool {
+	select {
+	case ch <- queuedMessage{msg: msg, ts: ts}:
+		atomic.AddUint64(&s.accepted, 1)
+		return true
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		return false
+	}
+}
+
+// forwarded counts a message written by a forwarder.
+func (s *backendStats) forwarded(ts time.Time) {
+	atomic.AddUint64(&s.sent, 1)
+	if !ts.IsZero() {
+		s.latency.Observe(time.Since(ts).Seconds())
+	}
+}
+
+func (s *backendStats) snapshot() BackendStats {
+	result := BackendStats{
+		Name:       s.name,
+		Connected:  true,
+		Accepted:   atomic.LoadUint64(&s.accepted),
+		Sent:       atomic.LoadUint64(&s.sent),
+		Dropped:    atomic.LoadUint64(&s.dropped),
+		Reconnects: atomic.LoadUint64(&s.reconnects),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, queue := range s.queues {
+		result.QueueDepth += len(queue.ch)
+		result.QueueCapacity += cap(queue.ch)
+		if atomic.LoadInt32(&queue.connected) == 0 {
+			result.Connected = false
+		}
+	}
+	return result
+}
+
+// BackendStats returns the stats of the enabled log backends.
+func (l *LogForwarder) BackendStats() []BackendStats {
+	result := make([]BackendStats, len(l.backends))
+	for i, backend := range l.backends {
+		result[i] = backend.stats().snapshot()
+	}
+	return result
+}
+
+// registerMetrics exposes the stats of the backends as metrics.
+func (l *LogForwarder) registerMetrics() {
+	register := func(registerFunc func(string, string, []string, func() []telemetry.Sample), name, help string, value func(BackendStats) float64) {
+		registerFunc(name, help, []string{"backend"}, func() []telemetry.Sample {
+			var samples []telemetry.Sample
+			for _, stats := range l.BackendStats() {
+				samples = append(samples, telemetry.Sample{Values: []string{stats.Name}, Value: value(stats)})
+			}
+			return samples
+		})
+	}
+	register(telemetry.RegisterCounterFunc, "bs_log_messages_accepted_total", "Log messages queued by each backend.",
+		func(s BackendStats) float64 { return float64(s.Accepted) })
+	register(telemetry.RegisterCounterFunc, "bs_log_messages_sent_total", "Log messages written by each backend.",
+		func(s BackendStats) float64 { return float64(s.Sent) })
+	register(telemetry.RegisterCounterFunc, "bs_log_messages_dropped_total", "Log messages dropped by each backend.",
+		func(s BackendStats) float64 { return float64(s.Dropped) })
+	register(telemetry.RegisterCounterFunc, "bs_log_backend_reconnects_total", "Reconnections of each backend.",
+		func(s BackendStats) float64 { return float64(s.Reconnects) })
+	register(telemetry.RegisterGaugeFunc, "bs_log_queue_depth", "Log messages waiting in the queue of each backend.",
+		func(s BackendStats) float64 { return float64(s.QueueDepth) })
+	register(telemetry.RegisterGaugeFunc, "bs_log_queue_capacity", "Maximum number of log messages in the queue of each backend.",
+		func(s BackendStats) float64 { return float64(s.QueueCapacity) })
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"os"
+	"time"
+
+	"github.com/tsuru/bs/telemetry"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestLogForwarderBackendStats(c *check.C) {
+	srv, reqCh := startHTTPReceiver(c, nil)
+	defer srv.Close()
+	os.Setenv("LOG_HTTP_URL", srv.URL)
+	os.Setenv("LOG_HTTP_BATCH_SIZE", "2")
+	os.Setenv("LOG_HTTP_BUFFER_SIZE", "50")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"http"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg", "mymsg2")
+	recvHTTPTimeout(c, reqCh)
+	// The message is counted after the forwarder writes it.
+	var stats []BackendStats
+	for timeout := time.After(5 * time.Second); ; {
+		stats = lf.BackendStats()
+		if stats[0].Sent == 2 {
+			break
+		}
+		select {
+		case <-timeout:
+			c.Fatalf("timeout waiting for sent messages, got %#v", stats)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	c.Assert(stats, check.DeepEquals, []BackendStats{
+		{Name: "http", Connected: true, QueueCapacity: 50, Accepted: 2, Sent: 2},
+	})
+	var buf bytes.Buffer
+	err = telemetry.Default.Write(&buf)
+	c.Assert(err, check.IsNil)
+	metrics := buf.String()
+	c.Assert(metrics, check.Matches, `(?s).*\nbs_log_messages_sent_total\{backend="http"\} 2\n.*`)
+	c.Assert(metrics, check.Matches, `(?s).*\nbs_log_queue_capacity\{backend="http"\} 50\n.*`)
+	c.Assert(metrics, check.Matches, `(?s).*\nbs_log_messages_received_total\{listener="udp"\} \d+\n.*`)
+	c.Assert(metrics, check.Matches, `(?s).*\nbs_log_forward_latency_seconds_count\{backend="http"\} \d+\n.*`)
+}
+
+func (s *S) TestBackendStatsSnapshot(c *check.C) {
+	stats := backendStats{name: "syslog"}
+	q1 := stats.addQueue(make(chan LogMessage, 1))
+	stats.addQueue(make(chan LogMessage, 3))
+	q1.connected = 1
+	c.Assert(stats.enqueue(q1.ch, "msg", time.Now()), check.Equals, true)
+	c.Assert(stats.enqueue(q1.ch, "msg2", time.Now()), check.Equals, false)
+	stats.sent = 4
+	stats.reconnects = 1
+	c.Assert(stats.snapshot(), check.DeepEquals, BackendStats{
+		Name:          "syslog",
+		QueueDepth:    1,
+		QueueCapacity: 4,
+		Accepted:      1,
+		Sent:          4,
+		Dropped:       1,
+		Reconnects:    1,
+	})
+	queued := (<-q1.ch).(queuedMessage)
+	c.Assert(queued.msg, check.Equals, "msg")
+	c.Assert(time.Since(queued.ts) < time.Minute, check.Equals, true)
+}
+
+func (s *S) TestLenientParserCountsMessages(c *check.C) {
+	received := messagesReceived.With("parser-test")
+	failures := parseFailures.With("parser-test")
+	format := &LenientFormat{received: received, parseFailures: failures}
+	err := format.GetParser([]byte("<30>2015-06-05T16:13:47Z myhost docker/abc: msg")).Parse()
+	c.Assert(err, check.IsNil)
+	err = format.GetParser([]byte("invalid")).Parse()
+	c.Assert(err, check.NotNil)
+	var buf bytes.Buffer
+	err = telemetry.Default.Write(&buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Matches, `(?s).*\nbs_log_messages_received_total\{listener="parser-test"\} 2\n.*`)
+	c.Assert(buf.String(), check.Matches, `(?s).*\nbs_log_parse_failures_total\{listener="parser-test"\} 1\n.*`)
+}
@@ -5,37 +5,82 @@
 package log
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/tsuru/bs/bslog"
 	"github.com/tsuru/bs/config"
+	"github.com/tsuru/bs/container"
 )
 
 const (
 	udpMessageDefaultMTU = 1500
 	udpHeaderSz          = 100 // Exagerated a bit due to possibility of ipv6 extensions, ipsec, etc.
+
+	rfc5424TimeFormat = "2006-01-02T15:04:05.999999Z07:00"
+	// 32473 is the private enterprise number reserved for documentation by
+	// RFC 5612, operators may set their own using LOG_SYSLOG_RFC5424_SD_ID.
+	rfc5424DefaultSDID = "tsuru@32473"
+
+	syslogFramingNewline       = "newline"
+	syslogFramingOctetCounting = "octet-counting"
 )
 
+type syslogFormat int
+
+const (
+	syslogFormatRFC3164 syslogFormat = iota
+	syslogFormatRFC5424
+	syslogFormatTemplate
+	syslogFormatCount
+)
+
+var syslogFormatNames = map[string]syslogFormat{
+	"rfc3164":  syslogFormatRFC3164,
+	"rfc5424":  syslogFormatRFC5424,
+	"template": syslogFormatTemplate,
+}
+
 type syslogBackend struct {
+	backendStats
 	syslogLocation   *time.Location
 	syslogExtraStart []byte
 	syslogExtraEnd   []byte
+	hostname         string
+	sdID             string
+	sdLabels         []string
+	template         *template.Template
+	defaultFormat    syslogFormat
+	defaultFraming   string
+	mtu              int
+	tlsConfig        *tls.Config
 	msgChans         []chan<- LogMessage
+	formats          []syslogFormat
+	formatUsers      [syslogFormatCount]int
 	quitChans        []chan<- bool
 	bufferPool       sync.Pool
 	nextNotify       *time.Timer
+	// nextTemplateNotify throttles the template execution errors, logged
+	// apart from the full buffer ones.
+	nextTemplateNotify *time.Timer
 }
 
 type syslogForwarder struct {
-	url          *url.URL
-	bufferPool   *sync.Pool
-	mtu          int
-	messageLimit int
+	url           *url.URL
+	bufferPool    *sync.Pool
+	tlsConfig     *tls.Config
+	octetCounting bool
+	lenBuffer     []byte
+	mtu           int
+	messageLimit  int
 }
 
 func (b *syslogBackend) initialize() error {
@@ -62,52 +107,206 @@ func (b *syslogBackend) initialize() error {
 			bslog.Warnf("unable to parse syslog timezone format: %s", err)
 		}
 	}
-	mtu := udpMessageDefaultMTU
-	mtuInterface := config.StringEnvOrDefault("eth0", "LOG_SYSLOG_MTU_NETWORK_INTERFACE")
-	if mtuInterface != "" {
-		iface, err := net.InterfaceByName(mtuInterface)
-		if err == nil && iface.MTU > 0 {
-			mtu = iface.MTU
-		} else {
-			bslog.Warnf("unable to read mtu from interface, using default %d: %s", mtu, err)
-		}
-	}
 	b.bufferPool = sync.Pool{
 		New: func() interface{} {
 			return make([]byte, 200)
 		},
 	}
-	b.nextNotify = time.NewTimer(0)
-	for _, addr := range forwardAddresses {
-		forwardUrl, err := url.Parse(addr)
+	var err error
+	defaultFormatName := "rfc3164"
+	if templateText := config.StringEnvOrDefault("", "LOG_SYSLOG_TEMPLATE"); templateText != "" {
+		b.template, err = parseSyslogTemplate(templateText)
 		if err != nil {
-			return fmt.Errorf("unable to parse %q: %s", addr, err)
+			return err
 		}
-		forwardChan, quitChan, err := processMessages(&syslogForwarder{
-			url:        forwardUrl,
-			bufferPool: &b.bufferPool,
-			mtu:        mtu,
-		}, bufferSize)
+		defaultFormatName = "template"
+	}
+	b.defaultFormat, err = parseSyslogFormat(config.StringEnvOrDefault(defaultFormatName, "LOG_SYSLOG_FORMAT"))
+	if err != nil {
+		return err
+	}
+	b.hostname = config.StringEnvOrDefault("", "LOG_SYSLOG_HOSTNAME")
+	if b.hostname == "" {
+		b.hostname, err = os.Hostname()
+		if err != nil {
+			return err
+		}
+	}
+	b.sdID = config.StringEnvOrDefault(rfc5424DefaultSDID, "LOG_SYSLOG_RFC5424_SD_ID")
+	b.sdLabels = config.StringsEnvOrDefault(nil, "LOG_SYSLOG_RFC5424_LABELS")
+	b.defaultFraming = config.StringEnvOrDefault(syslogFramingNewline, "LOG_SYSLOG_FRAMING")
+	b.mtu = interfaceMTU("LOG_SYSLOG_MTU_NETWORK_INTERFACE")
+	defaultGroupMode := config.StringEnvOrDefault(syslogGroupFailover, "LOG_SYSLOG_GROUP_MODE")
+	groupRetryInterval := config.SecondsEnvOrDefault(30, "LOG_SYSLOG_GROUP_RETRY_INTERVAL")
+	b.nextNotify = time.NewTimer(0)
+	b.nextTemplateNotify = time.NewTimer(0)
+	for _, entry := range forwardAddresses {
+		mode, addrs := parseSyslogGroup(entry)
+		var forwarder forwarderBackend
+		var format syslogFormat
+		if mode == "" && len(addrs) == 1 {
+			forwarder, format, err = b.newForwarder(addrs[0])
+			if err != nil {
+				return err
+			}
+		} else {
+			if mode == "" {
+				mode = defaultGroupMode
+			}
+			forwarder, format, err = b.newGroupForwarder(entry, mode, addrs, groupRetryInterval)
+			if err != nil {
+				return err
+			}
+		}
+		forwardChan, quitChan, err := processMessages(forwarder, bufferSize, &b.backendStats)
 		if err != nil {
 			return err
 		}
 		b.msgChans = append(b.msgChans, forwardChan)
+		b.formats = append(b.formats, format)
+		b.formatUsers[format]++
 		b.quitChans = append(b.quitChans, quitChan)
 	}
 	return nil
 }
 
+func (b *syslogBackend) newForwarder(addr string) (*syslogForwarder, syslogFormat, error) {
+	forwardUrl, err := url.Parse(addr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to parse %q: %s", addr, err)
+	}
+	query := forwardUrl.Query()
+	format := b.defaultFormat
+	if formatName := query.Get("format"); formatName != "" {
+		format, err = parseSyslogFormat(formatName)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if format == syslogFormatTemplate && b.template == nil {
+		return nil, 0, fmt.Errorf("syslog format template for %q requires LOG_SYSLOG_TEMPLATE", addr)
+	}
+	framing := b.defaultFraming
+	if framingName := query.Get("framing"); framingName != "" {
+		framing = framingName
+	}
+	if framing != syslogFramingNewline && framing != syslogFramingOctetCounting {
+		return nil, 0, fmt.Errorf("invalid syslog framing %q, expected %s or %s", framing, syslogFramingNewline, syslogFramingOctetCounting)
+	}
+	if framing == syslogFramingOctetCounting && forwardUrl.Scheme == "udp" {
+		return nil, 0, fmt.Errorf("%s framing is not supported for udp address %q", framing, addr)
+	}
+	forwarder := &syslogForwarder{
+		url:           forwardUrl,
+		bufferPool:    &b.bufferPool,
+		octetCounting: framing == syslogFramingOctetCounting,
+		mtu:           b.mtu,
+	}
+	if forwardUrl.Scheme == "tls" {
+		if b.tlsConfig == nil {
+			b.tlsConfig, err = config.TLSConfigFromEnv("LOG_SYSLOG_TLS")
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		forwarder.tlsConfig = config.TLSConfigForHost(b.tlsConfig, forwardUrl.Hostname())
+	}
+	return forwarder, format, nil
+}
+
+func parseSyslogFormat(name string) (syslogFormat, error) {
+	format, ok := syslogFormatNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("invalid syslog format %q, expected rfc3164, rfc5424 or template", name)
+	}
+	return format, nil
+}
+
 type bufferWithIdx struct {
 	buffer     []byte
 	headerIdx  int
 	contentIdx int
 }
 
-func (b *syslogBackend) sendMessage(parts *rawLogParts, appName, processName, container string) {
+func (b *syslogBackend) sendMessage(parts *rawLogParts, appName, processName, containerID string) {
+	b.sendContainerMessage(parts, &container.Container{AppName: appName, ProcessName: processName}, containerID)
+}
+
+func (b *syslogBackend) sendContainerMessage(parts *rawLogParts, cont *container.Container, _ string) {
 	lenSyslogs := len(b.msgChans)
 	if lenSyslogs == 0 {
 		return
 	}
+	var built [syslogFormatCount]*bufferWithIdx
+	var failed [syslogFormatCount]bool
+	remaining := b.formatUsers
+	for i, ch := range b.msgChans {
+		format := b.formats[i]
+		if failed[format] {
+			continue
+		}
+		msg := built[format]
+		if msg == nil {
+			var bufIdx bufferWithIdx
+			switch format {
+			case syslogFormatRFC5424:
+				bufIdx = b.buildRFC5424(parts, cont)
+			case syslogFormatTemplate:
+				var err error
+				bufIdx, err = b.buildTemplate(parts, cont)
+				if err != nil {
+					select {
+					case <-b.nextTemplateNotify.C:
+						bslog.Errorf("[log forwarder] unable to execute syslog template: %s", err)
+						b.nextTemplateNotify.Reset(time.Minute)
+					default:
+					}
+					failed[format] = true
+					continue
+				}
+			default:
+				bufIdx = b.buildRFC3164(parts, cont)
+			}
+			msg = &bufIdx
+			built[format] = msg
+		}
+		remaining[format]--
+		chBuffer := msg.buffer
+		if remaining[format] > 0 {
+			chBuffer = b.bufferPool.Get().([]byte)[:0]
+			chBuffer = append(chBuffer, msg.buffer...)
+		}
+		queued := bufferWithIdx{
+			buffer:     chBuffer,
+			headerIdx:  msg.headerIdx,
+			contentIdx: msg.contentIdx,
+		}
+		if !b.enqueue(ch, queued, parts.ts) {
+			select {
+			case <-b.nextNotify.C:
+				bslog.Errorf("Dropping log messages to syslog due to full channel buffer.")
+				b.nextNotify.Reset(time.Minute)
+			default:
+			}
+		}
+	}
+}
+
+func (b *syslogBackend) appendContent(buffer []byte, parts *rawLogParts) bufferWithIdx {
+	buffer = append(buffer, b.syslogExtraStart...)
+	headerIdx := len(buffer)
+	buffer = append(buffer, parts.content...)
+	contentIdx := len(buffer)
+	buffer = append(buffer, b.syslogExtraEnd...)
+	buffer = append(buffer, '\n')
+	return bufferWithIdx{
+		buffer:     buffer,
+		headerIdx:  headerIdx,
+		contentIdx: contentIdx,
+	}
+}
+
+func (b *syslogBackend) buildRFC3164(parts *rawLogParts, cont *container.Container) bufferWithIdx {
 	contID := parts.container
 	if len(contID) > containerIDTrimSize {
 		contID = contID[:containerIDTrimSize]
@@ -120,39 +319,116 @@ func (b *syslogBackend) sendMessage(parts *rawLogParts, appName, processName, co
 	buffer = append(buffer, ' ')
 	buffer = append(buffer, contID...)
 	buffer = append(buffer, ' ')
-	buffer = append(buffer, appName...)
+	buffer = append(buffer, cont.AppName...)
 	buffer = append(buffer, '[')
-	buffer = append(buffer, processName...)
+	buffer = append(buffer, cont.ProcessName...)
 	buffer = append(buffer, ']', ':', ' ')
-	buffer = append(buffer, b.syslogExtraStart...)
-	headerIdx := len(buffer)
-	buffer = append(buffer, parts.content...)
-	contentIdx := len(buffer)
-	buffer = append(buffer, b.syslogExtraEnd...)
-	buffer = append(buffer, '\n')
-	for i, ch := range b.msgChans {
-		var chBuffer []byte
-		if i == lenSyslogs-1 {
-			chBuffer = buffer
-		} else {
-			chBuffer = b.bufferPool.Get().([]byte)[:0]
-			chBuffer = append(chBuffer, buffer...)
+	return b.appendContent(buffer, parts)
+}
+
+// buildRFC5424 builds a message with the format:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD-ID container_id="" image="" ...] MSG
+func (b *syslogBackend) buildRFC5424(parts *rawLogParts, cont *container.Container) bufferWithIdx {
+	buffer := b.bufferPool.Get().([]byte)[:0]
+	buffer = append(buffer, '<')
+	buffer = append(buffer, parts.priority...)
+	buffer = append(buffer, '>', '1', ' ')
+	buffer = append(buffer, parts.ts.In(b.syslogLocation).Format(rfc5424TimeFormat)...)
+	buffer = append(buffer, ' ')
+	buffer = appendRFC5424Header(buffer, b.hostname, 255)
+	buffer = append(buffer, ' ')
+	buffer = appendRFC5424Header(buffer, cont.AppName, 48)
+	buffer = append(buffer, ' ')
+	buffer = appendRFC5424Header(buffer, cont.ProcessName, 128)
+	buffer = append(buffer, ' ', '-', ' ', '[')
+	buffer = append(buffer, b.sdID...)
+	buffer = appendSDParam(buffer, "container_id", string(parts.container))
+	var labels map[string]string
+	var image string
+	if cont.Config != nil {
+		image = cont.Config.Image
+		if image != "" {
+			buffer = appendSDParam(buffer, "image", image)
 		}
-		select {
-		case ch <- bufferWithIdx{
-			buffer:     chBuffer,
-			headerIdx:  headerIdx,
-			contentIdx: contentIdx,
-		}:
-		default:
-			select {
-			case <-b.nextNotify.C:
-				bslog.Errorf("Dropping log messages to syslog due to full channel buffer.")
-				b.nextNotify.Reset(time.Minute)
-			default:
-			}
+		labels = cont.Config.Labels
+	}
+	for _, label := range b.sdLabels {
+		if value, ok := labels[label]; ok {
+			buffer = appendSDParam(buffer, label, value)
+		}
+	}
+	for _, key := range sortedFieldKeys(parts.fields) {
+		value := fieldString(parts.fields[key])
+		if b.rfc5424Native(key, value, image, labels) {
+			continue
+		}
+		buffer = appendSDParam(buffer, key, value)
+	}
+	buffer = append(buffer, ']', ' ')
+	return b.appendContent(buffer, parts)
+}
+
+// rfc5424Native returns whether the field is enrichment metadata already
+// sent in RFC 5424 messages, as the hostname or as a structured data param.
+func (b *syslogBackend) rfc5424Native(key, value, image string, labels map[string]string) bool {
+	switch key {
+	case enrichNode:
+		return value == b.hostname
+	case enrichImage:
+		return value == image
+	}
+	if !strings.HasPrefix(key, enrichLabelPrefix) {
+		return false
+	}
+	label := strings.TrimPrefix(key, enrichLabelPrefix)
+	for _, sdLabel := range b.sdLabels {
+		if sdLabel == label {
+			return value == labels[label]
+		}
+	}
+	return false
+}
+
+// appendRFC5424Header appends a header field restricted to printable ASCII
+// characters, using the nil value "-" for empty fields.
+func appendRFC5424Header(buffer []byte, value string, maxLen int) []byte {
+	if value == "" {
+		return append(buffer, '-')
+	}
+	if len(value) > maxLen {
+		value = value[:maxLen]
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < 33 || c > 126 {
+			c = '_'
+		}
+		buffer = append(buffer, c)
+	}
+	return buffer
+}
+
+func appendSDParam(buffer []byte, name, value string) []byte {
+	buffer = append(buffer, ' ')
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < 33 || c > 126 || c == '=' || c == ']' || c == '"' {
+			c = '_'
+		}
+		buffer = append(buffer, c)
+	}
+	buffer = append(buffer, '=', '"')
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == '"' || c == '\\' || c == ']' {
+			buffer = append(buffer, '\\')
 		}
+		buffer = append(buffer, c)
 	}
+	return append(buffer, '"')
 }
 
 func (b *syslogBackend) stop() {
@@ -162,25 +438,34 @@ func (b *syslogBackend) stop() {
 }
 
 func (f *syslogForwarder) connect() (net.Conn, error) {
-	conn, err := net.DialTimeout(f.url.Scheme, f.url.Host, forwardConnDialTimeout)
+	var conn net.Conn
+	var err error
+	if f.url.Scheme == "tls" {
+		dialer := &net.Dialer{Timeout: forwardConnDialTimeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", f.url.Host, f.tlsConfig)
+	} else {
+		conn, err = net.DialTimeout(f.url.Scheme, f.url.Host, forwardConnDialTimeout)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("[log forwarder] unable to connect to %q: %s", f.url, err)
 	}
-	if f.url.Scheme == "tcp" {
+	switch f.url.Scheme {
+	case "tcp", "tls":
 		conn = newBufferedConn(conn, time.Second)
-	} else {
+	default:
 		f.messageLimit = f.mtu - udpHeaderSz
 	}
 	return conn, nil
 }
 
+// splitParts writes the message, splitting it in multiple parts if it
+// doesn't fit the message limit. The message buffer is left untouched, so it
+// may be written again to another connection.
 func (f *syslogForwarder) splitParts(conn net.Conn, bufIdx bufferWithIdx) error {
 	fullLen := len(bufIdx.buffer)
 	if f.messageLimit <= 0 || fullLen <= f.messageLimit {
 		// Fast path, message fit, no manipulation needed.
-		err := f.writePart(conn, bufIdx.buffer)
-		f.bufferPool.Put(bufIdx.buffer)
-		return err
+		return f.writePart(conn, bufIdx.buffer)
 	}
 	headerBuf := bufIdx.buffer[:bufIdx.headerIdx]
 	trailerBuf := bufIdx.buffer[bufIdx.contentIdx:]
@@ -193,17 +478,14 @@ func (f *syslogForwarder) splitParts(conn net.Conn, bufIdx bufferWithIdx) error
 	}
 	i := 0
 	for contentSz > 0 {
-		var buffer []byte
 		i++
 		partElement := fmt.Sprintf(" (%d/%d)", i, nParts)
 		sizeToUse := availableSz - len(partElement)
 		if sizeToUse >= len(contentBuf) {
 			sizeToUse = len(contentBuf)
-			buffer = headerBuf
-		} else {
-			buffer = f.bufferPool.Get().([]byte)[:0]
-			buffer = append(buffer, headerBuf...)
 		}
+		buffer := f.bufferPool.Get().([]byte)[:0]
+		buffer = append(buffer, headerBuf...)
 		buffer = append(buffer, contentBuf[:sizeToUse]...)
 		buffer = append(buffer, partElement...)
 		buffer = append(buffer, trailerBuf...)
@@ -220,7 +502,9 @@ func (f *syslogForwarder) splitParts(conn net.Conn, bufIdx bufferWithIdx) error
 
 func (f *syslogForwarder) process(conn net.Conn, msg LogMessage) error {
 	bufIdx := msg.(bufferWithIdx)
-	return f.splitParts(conn, bufIdx)
+	err := f.splitParts(conn, bufIdx)
+	f.bufferPool.Put(bufIdx.buffer)
+	return err
 }
 
 func (f *syslogForwarder) writePart(conn net.Conn, buf []byte) error {
@@ -228,6 +512,17 @@ func (f *syslogForwarder) writePart(conn net.Conn, buf []byte) error {
 	if err != nil {
 		return err
 	}
+	if f.octetCounting {
+		// RFC 6587 octet-counting framing: MSG-LEN SP SYSLOG-MSG, the
+		// trailing newline is not part of the message.
+		buf = buf[:len(buf)-1]
+		f.lenBuffer = strconv.AppendInt(f.lenBuffer[:0], int64(len(buf)), 10)
+		f.lenBuffer = append(f.lenBuffer, ' ')
+		_, err = conn.Write(f.lenBuffer)
+		if err != nil {
+			return err
+		}
+	}
 	lenMsg := len(buf)
 	n, err := conn.Write(buf)
 	if err != nil {
@@ -0,0 +1,211 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/tsuru/bs/bslog"
+)
+
+const (
+	syslogGroupFailover   = "failover"
+	syslogGroupRoundRobin = "roundrobin"
+)
+
+var errSyslogGroupUnavailable = errors.New("no syslog address available in group")
+
+// syslogGroupForwarder sends each message to a single member of a group of
+// syslog addresses, either the first healthy one (failover) or the next
+// healthy one in turn (roundrobin). Members failing to connect or write are
+// marked as unhealthy and only retried after retryInterval, when every member
+// is unhealthy no message is sent until one of them is retried.
+type syslogGroupForwarder struct {
+	name          string
+	roundRobin    bool
+	members       []*syslogGroupMember
+	retryInterval time.Duration
+	next          int
+}
+
+type syslogGroupMember struct {
+	forwarder *syslogForwarder
+	downUntil time.Time
+}
+
+// syslogGroupConn holds the connections to each member of the group, nil
+// entries are members not connected yet or disconnected after a failure.
+type syslogGroupConn struct {
+	net.Conn
+	conns []net.Conn
+}
+
+// parseSyslogGroup parses entries in the format [mode:]addr1|addr2|...
+func parseSyslogGroup(entry string) (string, []string) {
+	var mode string
+	for _, m := range []string{syslogGroupFailover, syslogGroupRoundRobin} {
+		if strings.HasPrefix(entry, m+":") {
+			mode = m
+			entry = entry[len(m)+1:]
+			break
+		}
+	}
+	return mode, strings.Split(entry, "|")
+}
+
+func (b *syslogBackend) newGroupForwarder(name, mode string, addrs []string, retryInterval time.Duration) (*syslogGroupForwarder, syslogFormat, error) {
+	if mode != syslogGroupFailover && mode != syslogGroupRoundRobin {
+		return nil, 0, fmt.Errorf("invalid syslog group mode %q, expected %s or %s", mode, syslogGroupFailover, syslogGroupRoundRobin)
+	}
+	group := &syslogGroupForwarder{
+		name:          name,
+		roundRobin:    mode == syslogGroupRoundRobin,
+		retryInterval: retryInterval,
+	}
+	var groupFormat syslogFormat
+	for i, addr := range addrs {
+		forwarder, format, err := b.newForwarder(addr)
+		if err != nil {
+			return nil, 0, err
+		}
+		if i == 0 {
+			groupFormat = format
+		} else if format != groupFormat {
+			return nil, 0, fmt.Errorf("all addresses in syslog group %q must use the same format", name)
+		}
+		group.members = append(group.members, &syslogGroupMember{forwarder: forwarder})
+	}
+	return group, groupFormat, nil
+}
+
+func (m *syslogGroupMember) healthy(now time.Time) bool {
+	return !now.Before(m.downUntil)
+}
+
+func (g *syslogGroupForwarder) markDown(idx int, err error) {
+	member := g.members[idx]
+	if member.downUntil.IsZero() {
+		bslog.Warnf("[log forwarder] syslog address %q in group %q marked as unhealthy: %s", member.forwarder.url, g.name, err)
+	}
+	member.downUntil = time.Now().Add(g.retryInterval)
+}
+
+func (g *syslogGroupForwarder) markUp(idx int) {
+	member := g.members[idx]
+	if !member.downUntil.IsZero() {
+		bslog.Warnf("[log forwarder] syslog address %q in group %q is healthy again", member.forwarder.url, g.name)
+		member.downUntil = time.Time{}
+	}
+}
+
+// candidates returns the healthy members to be tried, in order.
+func (g *syslogGroupForwarder) candidates() []int {
+	start := 0
+	if g.roundRobin {
+		start = g.next % len(g.members)
+		g.next = start + 1
+	}
+	now := time.Now()
+	var healthy []int
+	for i := range g.members {
+		idx := (start + i) % len(g.members)
+		if g.members[idx].healthy(now) {
+			healthy = append(healthy, idx)
+		}
+	}
+	return healthy
+}
+
+func (g *syslogGroupForwarder) connectMember(conn *syslogGroupConn, idx int) (net.Conn, error) {
+	if conn.conns[idx] != nil {
+		return conn.conns[idx], nil
+	}
+	memberConn, err := g.members[idx].forwarder.connect()
+	if err != nil {
+		g.markDown(idx, err)
+		return nil, err
+	}
+	conn.conns[idx] = memberConn
+	return memberConn, nil
+}
+
+func (g *syslogGroupForwarder) connect() (net.Conn, error) {
+	conn := &syslogGroupConn{conns: make([]net.Conn, len(g.members))}
+	lastErr := fmt.Errorf("%s %q", errSyslogGroupUnavailable, g.name)
+	connected := false
+	for _, idx := range g.candidates() {
+		_, err := g.connectMember(conn, idx)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		connected = true
+		if !g.roundRobin {
+			break
+		}
+	}
+	if !connected {
+		return nil, lastErr
+	}
+	return conn, nil
+}
+
+func (g *syslogGroupForwarder) process(conn net.Conn, msg LogMessage) error {
+	groupConn := conn.(*syslogGroupConn)
+	bufIdx := msg.(bufferWithIdx)
+	defer g.members[0].forwarder.bufferPool.Put(bufIdx.buffer)
+	for _, idx := range g.candidates() {
+		memberConn, err := g.connectMember(groupConn, idx)
+		if err != nil {
+			continue
+		}
+		forwarder := g.members[idx].forwarder
+		err = forwarder.splitParts(memberConn, bufIdx)
+		if err == nil {
+			err = flushMember(memberConn)
+		}
+		if err == nil {
+			g.markUp(idx)
+			if !g.roundRobin {
+				g.closeOthers(groupConn, idx)
+			}
+			return nil
+		}
+		g.markDown(idx, err)
+		forwarder.close(memberConn)
+		groupConn.conns[idx] = nil
+	}
+	return fmt.Errorf("%s %q", errSyslogGroupUnavailable, g.name)
+}
+
+// flushMember writes the data buffered on TCP and TLS connections right away,
+// so a failing member is detected on the message written to it and the
+// message is sent to the next member instead of being lost in the buffer.
+func flushMember(conn net.Conn) error {
+	if bConn, ok := conn.(*bufferedConn); ok {
+		return bConn.Flush()
+	}
+	return nil
+}
+
+// closeOthers closes the connections to every member but keep. In failover
+// mode only the member written to is used, connections opened to other
+// members while it was unhealthy aren't kept once it's healthy again.
+func (g *syslogGroupForwarder) closeOthers(groupConn *syslogGroupConn, keep int) {
+	for idx, memberConn := range groupConn.conns {
+		if memberConn != nil && idx != keep {
+			g.members[idx].forwarder.close(memberConn)
+			groupConn.conns[idx] = nil
+		}
+	}
+}
+
+func (g *syslogGroupForwarder) close(conn net.Conn) {
+	g.closeOthers(conn.(*syslogGroupConn), -1)
+}
@@ -0,0 +1,192 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func recvSyslogTimeout(c *check.C, data chan string) string {
+	select {
+	case msg := <-data:
+		return msg
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for syslog message")
+	}
+	return ""
+}
+
+func (s *S) TestSyslogGroupFailover(c *check.C) {
+	deadListener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	deadAddr := deadListener.Addr().String()
+	deadListener.Close()
+	done := make(chan struct{})
+	data := make(chan string, 2)
+	secondary := startReceiver(2, done, data)
+	defer secondary.Close()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", fmt.Sprintf("tcp://%s|tcp://%s", deadAddr, secondary.Addr()))
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg", "mymsg2")
+	c.Assert(recvSyslogTimeout(c, data), check.Equals, fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: mymsg", s.idShort))
+	c.Assert(recvSyslogTimeout(c, data), check.Equals, fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: mymsg2", s.idShort))
+}
+
+func (s *S) TestSyslogGroupRoundRobin(c *check.C) {
+	done1 := make(chan struct{})
+	data1 := make(chan string, 2)
+	receiver1 := startReceiver(2, done1, data1)
+	defer receiver1.Close()
+	done2 := make(chan struct{})
+	data2 := make(chan string, 2)
+	receiver2 := startReceiver(2, done2, data2)
+	defer receiver2.Close()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", fmt.Sprintf("roundrobin:tcp://%s|tcp://%s", receiver1.Addr(), receiver2.Addr()))
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "msg1", "msg2", "msg3", "msg4")
+	for _, done := range []chan struct{}{done1, done2} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			c.Fatal("timeout waiting for syslog messages")
+		}
+	}
+	close(data1)
+	close(data2)
+	var messages []string
+	for _, data := range []chan string{data1, data2} {
+		count := 0
+		for msg := range data {
+			messages = append(messages, msg)
+			count++
+		}
+		c.Assert(count, check.Equals, 2)
+	}
+	sort.Strings(messages)
+	var expected []string
+	for i := 1; i <= 4; i++ {
+		expected = append(expected, fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: msg%d", s.idShort, i))
+	}
+	c.Assert(messages, check.DeepEquals, expected)
+}
+
+func (s *S) TestSyslogGroupInvalid(c *check.C) {
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://127.0.0.1:1234|udp://127.0.0.1:1235?format=rfc5424")
+	err := lf.Start()
+	c.Assert(err, check.ErrorMatches, `unable to initialize log backend "syslog": all addresses in syslog group ".*" must use the same format`)
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://127.0.0.1:1234|udp://127.0.0.1:1235")
+	os.Setenv("LOG_SYSLOG_GROUP_MODE", "random")
+	err = lf.Start()
+	c.Assert(err, check.ErrorMatches, `unable to initialize log backend "syslog": invalid syslog group mode "random", expected failover or roundrobin`)
+}
+
+func (s *S) TestParseSyslogGroup(c *check.C) {
+	mode, addrs := parseSyslogGroup("udp://a:514")
+	c.Assert(mode, check.Equals, "")
+	c.Assert(addrs, check.DeepEquals, []string{"udp://a:514"})
+	mode, addrs = parseSyslogGroup("roundrobin:tcp://a:514|tls://b:6514")
+	c.Assert(mode, check.Equals, syslogGroupRoundRobin)
+	c.Assert(addrs, check.DeepEquals, []string{"tcp://a:514", "tls://b:6514"})
+	mode, addrs = parseSyslogGroup("failover:udp://a:514")
+	c.Assert(mode, check.Equals, syslogGroupFailover)
+	c.Assert(addrs, check.DeepEquals, []string{"udp://a:514"})
+}
+
+func (s *S) TestSyslogGroupMarksUnhealthy(c *check.C) {
+	b := &syslogBackend{defaultFraming: syslogFramingNewline}
+	group, _, err := b.newGroupForwarder("g", syslogGroupFailover, []string{"tcp://127.0.0.1:1", "tcp://127.0.0.1:2"}, time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(group.candidates(), check.DeepEquals, []int{0, 1})
+	group.markDown(0, fmt.Errorf("myerr"))
+	c.Assert(group.candidates(), check.DeepEquals, []int{1})
+	group.markDown(1, fmt.Errorf("myerr"))
+	c.Assert(group.candidates(), check.HasLen, 0)
+	group.markUp(0)
+	c.Assert(group.candidates(), check.DeepEquals, []int{0})
+}
+
+func (s *S) TestSyslogGroupCloseOthers(c *check.C) {
+	b := &syslogBackend{defaultFraming: syslogFramingNewline}
+	group, _, err := b.newGroupForwarder("g", syslogGroupFailover, []string{"tcp://127.0.0.1:1", "tcp://127.0.0.1:2"}, time.Minute)
+	c.Assert(err, check.IsNil)
+	primary, primaryPeer := net.Pipe()
+	defer primaryPeer.Close()
+	secondary, secondaryPeer := net.Pipe()
+	defer secondaryPeer.Close()
+	conn := &syslogGroupConn{conns: []net.Conn{primary, secondary}}
+	group.closeOthers(conn, 0)
+	c.Assert(conn.conns, check.DeepEquals, []net.Conn{primary, nil})
+	_, err = secondary.Write([]byte("x"))
+	c.Assert(err, check.Equals, io.ErrClosedPipe)
+	group.close(conn)
+	c.Assert(conn.conns, check.DeepEquals, []net.Conn{nil, nil})
+	_, err = primary.Write([]byte("x"))
+	c.Assert(err, check.Equals, io.ErrClosedPipe)
+}
+
+func (s *S) TestSyslogGroupAllUnhealthy(c *check.C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+	b := &syslogBackend{defaultFraming: syslogFramingNewline}
+	group, _, err := b.newGroupForwarder("g", syslogGroupFailover, []string{"tcp://" + listener.Addr().String()}, time.Minute)
+	c.Assert(err, check.IsNil)
+	group.markDown(0, fmt.Errorf("myerr"))
+	conn, err := group.connect()
+	c.Assert(conn, check.IsNil)
+	c.Assert(err, check.ErrorMatches, `no syslog address available in group "g"`)
+	group.members[0].downUntil = time.Now()
+	conn, err = group.connect()
+	c.Assert(err, check.IsNil)
+	group.close(conn)
+}
+
+func (s *S) TestSyslogGroupFailoverOnFlushError(c *check.C) {
+	b := &syslogBackend{defaultFraming: syslogFramingNewline}
+	group, _, err := b.newGroupForwarder("g", syslogGroupFailover, []string{"tcp://127.0.0.1:1", "tcp://127.0.0.1:2"}, time.Minute)
+	c.Assert(err, check.IsNil)
+	primary, primaryPeer := net.Pipe()
+	primaryPeer.Close()
+	secondary, secondaryPeer := net.Pipe()
+	defer secondaryPeer.Close()
+	data := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 100)
+		n, _ := secondaryPeer.Read(buf)
+		data <- string(buf[:n])
+	}()
+	conn := &syslogGroupConn{conns: []net.Conn{newBufferedConn(primary, 0), secondary}}
+	err = group.process(conn, bufferWithIdx{buffer: []byte("mymsg\n")})
+	c.Assert(err, check.IsNil)
+	c.Assert(recvSyslogTimeout(c, data), check.Equals, "mymsg\n")
+	c.Assert(group.candidates(), check.DeepEquals, []int{1})
+	c.Assert(conn.conns[0], check.IsNil)
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/tsuru/bs/container"
+)
+
+// syslogTemplateData is the data available to LOG_SYSLOG_TEMPLATE.
+type syslogTemplateData struct {
+	Time          time.Time
+	Timestamp     string
+	Priority      int
+	Severity      int
+	Facility      int
+	App           string
+	Process       string
+	ContainerID   string
+	ContainerName string
+	Image         string
+	Labels        map[string]string
+	Hostname      string
+	Fields        map[string]interface{}
+	Content       *syslogTemplateContent
+}
+
+// syslogTemplateContent records where the content is written in the
+// rendered message, allowing udp messages to be split keeping the template
+// around each part.
+type syslogTemplateContent struct {
+	data     []byte
+	out      *syslogTemplateBuffer
+	startIdx int
+	endIdx   int
+}
+
+type syslogTemplateBuffer struct {
+	buf []byte
+}
+
+func (w *syslogTemplateBuffer) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func (c *syslogTemplateContent) String() string {
+	return string(c.data)
+}
+
+func (c *syslogTemplateContent) Format(f fmt.State, verb rune) {
+	if verb == 'v' || verb == 's' {
+		// Values are written to the output by the template engine right
+		// after being formatted.
+		c.startIdx = len(c.out.buf)
+		c.endIdx = c.startIdx + len(c.data)
+	}
+	fmt.Fprintf(f, fmt.FormatString(f, verb), string(c.data))
+}
+
+func parseSyslogTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("syslog").Funcs(template.FuncMap{
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+		"quote": strconv.Quote,
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse syslog template: %s", err)
+	}
+	return tmpl, nil
+}
+
+func (b *syslogBackend) buildTemplate(parts *rawLogParts, cont *container.Container) (bufferWithIdx, error) {
+	out := &syslogTemplateBuffer{buf: b.bufferPool.Get().([]byte)[:0]}
+	priority, _ := strconv.Atoi(string(parts.priority))
+	ts := parts.ts.In(b.syslogLocation)
+	data := syslogTemplateData{
+		Time:          ts,
+		Timestamp:     ts.Format(time.RFC3339Nano),
+		Priority:      priority,
+		Severity:      priority & severityMask,
+		Facility:      priority >> 3,
+		App:           cont.AppName,
+		Process:       cont.ProcessName,
+		ContainerID:   string(parts.container),
+		ContainerName: strings.TrimPrefix(cont.Name, "/"),
+		Hostname:      b.hostname,
+		Fields:        parts.fields,
+		Content:       &syslogTemplateContent{data: parts.content, out: out, startIdx: -1},
+	}
+	if cont.Config != nil {
+		data.Image = cont.Config.Image
+		data.Labels = cont.Config.Labels
+	}
+	err := b.template.Execute(out, data)
+	if err != nil {
+		b.bufferPool.Put(out.buf)
+		return bufferWithIdx{}, err
+	}
+	buffer := append(out.buf, '\n')
+	headerIdx, contentIdx := data.Content.startIdx, data.Content.endIdx
+	if headerIdx < 0 || contentIdx > len(buffer) || !bytes.Equal(buffer[headerIdx:contentIdx], parts.content) {
+		// Content was not written as is, split the whole message if needed.
+		headerIdx, contentIdx = 0, len(buffer)-1
+	}
+	return bufferWithIdx{
+		buffer:     buffer,
+		headerIdx:  headerIdx,
+		contentIdx: contentIdx,
+	}, nil
+}
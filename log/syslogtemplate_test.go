@@ -0,0 +1,146 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/container"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestSyslogTemplateForwarder(c *check.C) {
+	os.Setenv("LOG_SYSLOG_HOSTNAME", "mynode")
+	os.Setenv("LOG_SYSLOG_TEMPLATE", `<{{.Priority}}>{{.Time.Format "2006-01-02T15:04:05"}} sev={{.Severity}} fac={{.Facility}} app={{.App}} proc={{.Process}} `+
+		`cid={{.ContainerID}} name={{.ContainerName}} image={{.Image}} label1={{index .Labels "label1"}} node={{.Hostname}} msg={{quote .Content.String}}`)
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	udpConn, err := net.ListenUDP("udp", addr)
+	c.Assert(err, check.IsNil)
+	defer udpConn.Close()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://"+udpConn.LocalAddr().String())
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "my msg")
+	buffer := make([]byte, 1024)
+	udpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := udpConn.Read(buffer)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buffer[:n]), check.Equals, fmt.Sprintf(`<30>2015-06-05T13:13:47 sev=6 fac=3 app=coolappname proc=procx `+
+		`cid=%s name=myContName image=myimg label1=val1 node=mynode msg="my msg"`+"\n", s.id))
+}
+
+func (s *S) TestSyslogTemplateInvalid(c *check.C) {
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://127.0.0.1:1234")
+	os.Setenv("LOG_SYSLOG_TEMPLATE", "{{.App")
+	err := lf.Start()
+	c.Assert(err, check.ErrorMatches, `unable to initialize log backend "syslog": unable to parse syslog template: .*`)
+	os.Unsetenv("LOG_SYSLOG_TEMPLATE")
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://127.0.0.1:1234?format=template")
+	err = lf.Start()
+	c.Assert(err, check.ErrorMatches, `unable to initialize log backend "syslog": syslog format template for "udp://127.0.0.1:1234\?format=template" requires LOG_SYSLOG_TEMPLATE`)
+}
+
+func (s *S) TestSyslogTemplateContentIndexes(c *check.C) {
+	b := &syslogBackend{
+		syslogLocation: time.UTC,
+		bufferPool: sync.Pool{
+			New: func() interface{} {
+				return make([]byte, 200)
+			},
+		},
+	}
+	parts := &rawLogParts{
+		ts:        time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC),
+		priority:  []byte("30"),
+		container: []byte(s.id),
+		content:   []byte("mymsg"),
+	}
+	cont := &container.Container{
+		Container: docker.Container{Name: "/myContName"},
+		AppName:   "myapp",
+	}
+	tests := []struct {
+		template   string
+		expected   string
+		headerIdx  int
+		contentIdx int
+	}{
+		{template: "app={{.App}} msg={{.Content}} name={{.ContainerName}}", expected: "app=myapp msg=mymsg name=myContName\n", headerIdx: 14, contentIdx: 19},
+		{template: "{{.Content}}", expected: "mymsg\n", headerIdx: 0, contentIdx: 5},
+		{template: `app={{.App}} msg={{printf "%q" .Content}}`, expected: "app=myapp msg=\"mymsg\"\n", headerIdx: 0, contentIdx: 21},
+		{template: "app={{.App}}", expected: "app=myapp\n", headerIdx: 0, contentIdx: 9},
+	}
+	for _, tt := range tests {
+		var err error
+		b.template, err = parseSyslogTemplate(tt.template)
+		c.Assert(err, check.IsNil)
+		bufIdx, err := b.buildTemplate(parts, cont)
+		c.Assert(err, check.IsNil)
+		c.Check(string(bufIdx.buffer), check.Equals, tt.expected)
+		c.Check(bufIdx.headerIdx, check.Equals, tt.headerIdx)
+		c.Check(bufIdx.contentIdx, check.Equals, tt.contentIdx)
+	}
+}
+
+func (s *S) TestSyslogTemplateExecutionErrorThrottled(c *check.C) {
+	prevLog := bslog.Logger
+	logBuf := bytes.NewBuffer(nil)
+	bslog.Logger = log.New(logBuf, "", 0)
+	defer func() {
+		bslog.Logger = prevLog
+	}()
+	tmpl, err := parseSyslogTemplate(`{{index .Labels 1}}`)
+	c.Assert(err, check.IsNil)
+	ch := make(chan LogMessage, 10)
+	b := &syslogBackend{
+		syslogLocation:     time.UTC,
+		template:           tmpl,
+		msgChans:           []chan<- LogMessage{ch},
+		formats:            []syslogFormat{syslogFormatTemplate},
+		nextNotify:         time.NewTimer(0),
+		nextTemplateNotify: time.NewTimer(0),
+		bufferPool: sync.Pool{
+			New: func() interface{} {
+				return make([]byte, 200)
+			},
+		},
+	}
+	b.formatUsers[syslogFormatTemplate] = 1
+	// Timer channels are only ready once the timer runs when GODEBUG
+	// asynctimerchan=1 is in effect, the default in GOPATH mode before Go
+	// 1.27.
+	time.Sleep(10 * time.Millisecond)
+	parts := &rawLogParts{
+		ts:       time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC),
+		priority: []byte("30"),
+		content:  []byte("mymsg"),
+	}
+	cont := &container.Container{AppName: "myapp"}
+	b.sendContainerMessage(parts, cont, "")
+	b.sendContainerMessage(parts, cont, "")
+	c.Assert(ch, check.HasLen, 0)
+	c.Assert(strings.Count(logBuf.String(), "unable to execute syslog template"), check.Equals, 1)
+}
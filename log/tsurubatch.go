@@ -0,0 +1,211 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tsuru/bs/bslog"
+)
+
+const (
+	tsuruCompressionNone    = "none"
+	tsuruCompressionDeflate = "deflate"
+
+	// tsuruBatchProtocol is the websocket subprotocol used to send batches,
+	// compressed using permessage-deflate when it's negotiated. The legacy
+	// stream of JSON messages is used if the API does not select it.
+	tsuruBatchProtocol = "tsuru-logs-batch"
+)
+
+// tsuruLogBatch is the payload of each batch sent to the tsuru API, the API
+// acknowledges batches by sending a tsuruLogAck with the highest sequence
+// number received.
+type tsuruLogBatch struct {
+	Seq  uint64            `json:"seq"`
+	Logs []json.RawMessage `json:"logs"`
+}
+
+type tsuruLogAck struct {
+	Ack uint64 `json:"ack"`
+}
+
+// tsuruPendingBatch is a batch waiting for acknowledgement, its messages
+// are counted as sent when it's acknowledged using the timestamps in ts.
+type tsuruPendingBatch struct {
+	seq    uint64
+	data   []byte
+	ts     []time.Time
+	sentAt time.Time
+}
+
+// connectBatch wraps ws in a batchConn, ws is nil when the tsuru API refused
+// the websocket upgrade and batches must be sent using HTTP requests. Every
+// batch not yet acknowledged is sent again before new batches.
+func (f *wsForwarder) connectBatch(ws *websocket.Conn) (*batchConn, error) {
+	f.pendingMu.Lock()
+	pending := make([]*tsuruPendingBatch, len(f.pending))
+	copy(pending, f.pending)
+	f.pendingMu.Unlock()
+	for _, batch := range pending {
+		err := f.writeBatch(ws, batch)
+		if err != nil {
+			if ws != nil {
+				(&wsConn{Conn: ws}).Close()
+			}
+			return nil, fmt.Errorf("error resending batch %d: %s", batch.seq, err)
+		}
+	}
+	send := func(entries []batchEntry) error {
+		return f.sendBatch(ws, entries)
+	}
+	var conn *batchConn
+	if ws == nil {
+		conn = newBatchConn(nil, nil, nil, f.batchSize, 0, f.batchInterval, send)
+	} else {
+		conn = newBatchConn(&wsConn{Conn: ws}, nil, nil, f.batchSize, 0, f.batchInterval, send)
+	}
+	return conn, nil
+}
+
+// sendBatch queues entries as a new batch and writes it. The batch is kept
+// until acknowledged so it can be sent again after reconnecting, an error is
+// returned if an older batch was not acknowledged in time.
+func (f *wsForwarder) sendBatch(ws *websocket.Conn, entries []batchEntry) error {
+	batch, err := f.queueBatch(entries)
+	if err != nil {
+		return err
+	}
+	f.pendingMu.Lock()
+	oldest := f.pending[0]
+	expired := oldest != batch && !oldest.sentAt.IsZero() && time.Since(oldest.sentAt) > f.ackTimeout
+	f.pendingMu.Unlock()
+	if expired {
+		return fmt.Errorf("no acknowledgement for batch %d after %v", oldest.seq, f.ackTimeout)
+	}
+	return f.writeBatch(ws, batch)
+}
+
+func (f *wsForwarder) queueBatch(entries []batchEntry) (*tsuruPendingBatch, error) {
+	logs := make([]json.RawMessage, len(entries))
+	ts := make([]time.Time, len(entries))
+	for i, entry := range entries {
+		logs[i] = entry.data
+		ts[i] = entry.ts
+	}
+	f.pendingMu.Lock()
+	defer f.pendingMu.Unlock()
+	f.seq++
+	data, err := json.Marshal(tsuruLogBatch{Seq: f.seq, Logs: logs})
+	if err != nil {
+		return nil, droppedBatchError{fmt.Errorf("error encoding batch: %s", err)}
+	}
+	batch := &tsuruPendingBatch{seq: f.seq, data: data, ts: ts}
+	f.pending = append(f.pending, batch)
+	if len(f.pending) > f.maxPending {
+		bslog.Errorf("[log forwarder] dropping unacknowledged batch %d to tsuru, too many pending batches", f.pending[0].seq)
+		if f.stats != nil {
+			atomic.AddUint64(&f.stats.dropped, uint64(len(f.pending[0].ts)))
+		}
+		f.pending[0] = nil
+		f.pending = f.pending[1:]
+	}
+	return batch, nil
+}
+
+func (f *wsForwarder) writeBatch(ws *websocket.Conn, batch *tsuruPendingBatch) error {
+	if ws == nil {
+		err := f.postBatch(batch)
+		if err != nil {
+			return err
+		}
+		f.ack(batch.seq)
+		return nil
+	}
+	f.connMutex.Lock()
+	defer f.connMutex.Unlock()
+	err := ws.SetWriteDeadline(time.Now().Add(forwardConnWriteTimeout))
+	if err != nil {
+		return fmt.Errorf("error setting deadline: %s", err)
+	}
+	err = ws.WriteMessage(websocket.TextMessage, batch.data)
+	if err != nil {
+		return fmt.Errorf("error sending batch: %s", err)
+	}
+	f.pendingMu.Lock()
+	batch.sentAt = time.Now()
+	f.pendingMu.Unlock()
+	return nil
+}
+
+// postBatch sends a batch using a HTTP request, a successful response
+// acknowledges the batch.
+func (f *wsForwarder) postBatch(batch *tsuruPendingBatch) error {
+	body := batch.data
+	if f.compress {
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		writer.Write(body)
+		err := writer.Close()
+		if err != nil {
+			return fmt.Errorf("error compressing batch: %s", err)
+		}
+		body = buf.Bytes()
+	}
+	header := http.Header{}
+	header.Set("Authorization", "bearer "+f.token)
+	header.Set("Content-Type", "application/json")
+	if f.compress {
+		header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := f.endpoints.Do("POST", "/logs", header, body, f.ackTimeout)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response from %q %d: %s", resp.Request.URL, resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+// readAck handles a text frame received from the tsuru API in batch mode.
+func (f *wsForwarder) readAck(data []byte) {
+	var ack tsuruLogAck
+	err := json.Unmarshal(data, &ack)
+	if err != nil {
+		bslog.Warnf("[log forwarder] invalid acknowledgement from tsuru %q: %s", data, err)
+		return
+	}
+	f.ack(ack.Ack)
+}
+
+// ack removes every pending batch with a sequence number up to seq, counting
+// their messages as sent.
+func (f *wsForwarder) ack(seq uint64) {
+	f.pendingMu.Lock()
+	defer f.pendingMu.Unlock()
+	i := 0
+	for i < len(f.pending) && f.pending[i].seq <= seq {
+		if f.stats != nil {
+			for _, ts := range f.pending[i].ts {
+				f.stats.forwarded(ts)
+			}
+		}
+		f.pending[i] = nil
+		i++
+	}
+	f.pending = f.pending[i:]
+}
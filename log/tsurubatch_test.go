@@ -0,0 +1,294 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tsuru/tsuru/app"
+	"gopkg.in/check.v1"
+)
+
+type fakeTsuruBatch struct {
+	conn     int
+	protocol string
+	deflate  bool
+	header   http.Header
+	seq      uint64
+	messages []string
+	logs     []app.Applog
+}
+
+// startFakeTsuruAPI starts a server receiving log batches on /logs using
+// websockets, or using POST requests if refuseUpgrade is true. Websocket
+// connections accept permessage-deflate and batches received through them
+// are acknowledged unless shouldAck returns false.
+func startFakeTsuruAPI(c *check.C, refuseUpgrade bool, shouldAck func(conn int, seq uint64) bool) (*httptest.Server, chan fakeTsuruBatch) {
+	batchCh := make(chan fakeTsuruBatch, 10)
+	var conns int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, check.Equals, "/logs")
+		if r.Method == "GET" {
+			if refuseUpgrade {
+				http.Error(w, "websocket not supported", http.StatusForbidden)
+				return
+			}
+			upgrader := websocket.Upgrader{
+				Subprotocols:      []string{tsuruBatchProtocol},
+				EnableCompression: true,
+				CheckOrigin:       func(*http.Request) bool { return true },
+			}
+			ws, err := upgrader.Upgrade(w, r, nil)
+			c.Assert(err, check.IsNil)
+			defer ws.Close()
+			connID := int(atomic.AddInt32(&conns, 1))
+			for {
+				messageType, data, err := ws.ReadMessage()
+				if err != nil {
+					return
+				}
+				if messageType != websocket.TextMessage {
+					continue
+				}
+				batch := decodeFakeTsuruBatch(c, bytes.NewReader(data))
+				batch.conn = connID
+				batch.protocol = ws.Subprotocol()
+				batch.deflate = strings.Contains(r.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+				batch.header = r.Header
+				batchCh <- batch
+				if shouldAck == nil || shouldAck(connID, batch.seq) {
+					ws.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"ack": %d}`, batch.seq)))
+				}
+			}
+		}
+		var reader io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gzipReader, err := gzip.NewReader(r.Body)
+			c.Assert(err, check.IsNil)
+			reader = gzipReader
+		}
+		batch := decodeFakeTsuruBatch(c, reader)
+		batch.header = r.Header
+		batchCh <- batch
+	}))
+	return srv, batchCh
+}
+
+func decodeFakeTsuruBatch(c *check.C, reader io.Reader) fakeTsuruBatch {
+	data, err := ioutil.ReadAll(reader)
+	c.Assert(err, check.IsNil)
+	var payload struct {
+		Seq  uint64
+		Logs []app.Applog
+	}
+	err = json.Unmarshal(data, &payload)
+	c.Assert(err, check.IsNil)
+	batch := fakeTsuruBatch{seq: payload.Seq, logs: payload.Logs}
+	for _, l := range payload.Logs {
+		batch.messages = append(batch.messages, l.Message)
+	}
+	return batch
+}
+
+func recvTsuruBatchTimeout(c *check.C, ch chan fakeTsuruBatch) fakeTsuruBatch {
+	select {
+	case batch := <-ch:
+		return batch
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for batch")
+	}
+	return fakeTsuruBatch{}
+}
+
+func (s *S) setTsuruBatchEnvs(url string) {
+	os.Setenv("TSURU_ENDPOINT", url)
+	os.Setenv("TSURU_TOKEN", "mytoken")
+	os.Setenv("LOG_TSURU_PING_INTERVAL", "0.1")
+	os.Setenv("LOG_TSURU_PONG_INTERVAL", "2.0")
+}
+
+func (s *S) TestTsuruBatchDeflate(c *check.C) {
+	srv, batchCh := startFakeTsuruAPI(c, false, nil)
+	defer srv.Close()
+	s.setTsuruBatchEnvs(srv.URL)
+	os.Setenv("LOG_TSURU_BATCH_SIZE", "2")
+	os.Setenv("LOG_TSURU_COMPRESSION", "deflate")
+	lf := LogForwarder{
+		EnabledBackends: []string{"tsuru"},
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg", "mymsg2", "mymsg3", "mymsg4")
+	batch := recvTsuruBatchTimeout(c, batchCh)
+	c.Assert(batch.header.Get("Authorization"), check.Equals, "bearer mytoken")
+	c.Assert(batch.protocol, check.Equals, "tsuru-logs-batch")
+	c.Assert(batch.deflate, check.Equals, true)
+	c.Assert(batch.seq, check.Equals, uint64(1))
+	c.Assert(batch.logs, check.HasLen, 2)
+	c.Assert(batch.logs[0], check.DeepEquals, app.Applog{
+		Date:    time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC),
+		Message: "mymsg",
+		Source:  "procx",
+		AppName: "coolappname",
+		Unit:    s.idShort,
+	})
+	c.Assert(batch.messages, check.DeepEquals, []string{"mymsg", "mymsg2"})
+	batch = recvTsuruBatchTimeout(c, batchCh)
+	c.Assert(batch.seq, check.Equals, uint64(2))
+	c.Assert(batch.messages, check.DeepEquals, []string{"mymsg3", "mymsg4"})
+}
+
+func (s *S) TestTsuruBatchResendUnacknowledged(c *check.C) {
+	srv, batchCh := startFakeTsuruAPI(c, false, func(conn int, seq uint64) bool {
+		return conn != 1 || seq != 2
+	})
+	defer srv.Close()
+	s.setTsuruBatchEnvs(srv.URL)
+	os.Setenv("LOG_TSURU_BATCH_SIZE", "1")
+	os.Setenv("LOG_TSURU_ACK_TIMEOUT", "0.2")
+	lf := LogForwarder{
+		EnabledBackends: []string{"tsuru"},
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "m1", "m2")
+	batch := recvTsuruBatchTimeout(c, batchCh)
+	c.Assert(batch.protocol, check.Equals, "tsuru-logs-batch")
+	c.Assert(batch.deflate, check.Equals, false)
+	c.Assert([]interface{}{batch.conn, batch.seq, batch.messages}, check.DeepEquals, []interface{}{1, uint64(1), []string{"m1"}})
+	batch = recvTsuruBatchTimeout(c, batchCh)
+	c.Assert([]interface{}{batch.conn, batch.seq, batch.messages}, check.DeepEquals, []interface{}{1, uint64(2), []string{"m2"}})
+	time.Sleep(300 * time.Millisecond)
+	s.sendUDPMessages(c, "m3")
+	expected := []struct {
+		seq uint64
+		msg string
+	}{{2, "m2"}, {3, "m3"}}
+	for _, e := range expected {
+		batch = recvTsuruBatchTimeout(c, batchCh)
+		c.Assert([]interface{}{batch.conn, batch.seq, batch.messages}, check.DeepEquals, []interface{}{2, e.seq, []string{e.msg}})
+	}
+	s.sendUDPMessages(c, "m4")
+	batch = recvTsuruBatchTimeout(c, batchCh)
+	c.Assert([]interface{}{batch.conn, batch.seq, batch.messages}, check.DeepEquals, []interface{}{2, uint64(4), []string{"m4"}})
+}
+
+func (s *S) TestTsuruBatchCountsAcknowledgedMessages(c *check.C) {
+	stats := &backendStats{latency: forwardLatency.With("test")}
+	f := &wsForwarder{maxPending: 2, stats: stats}
+	ts := time.Now()
+	for _, entries := range [][]batchEntry{
+		{{data: []byte(`"m1"`), ts: ts}},
+		{{data: []byte(`"m2"`), ts: ts}, {data: []byte(`"m3"`), ts: ts}},
+		{{data: []byte(`"m4"`), ts: ts}},
+	} {
+		_, err := f.queueBatch(entries)
+		c.Assert(err, check.IsNil)
+	}
+	c.Assert(stats.dropped, check.Equals, uint64(1))
+	c.Assert(stats.sent, check.Equals, uint64(0))
+	f.ack(2)
+	c.Assert(stats.sent, check.Equals, uint64(2))
+	f.ack(3)
+	c.Assert(stats.sent, check.Equals, uint64(3))
+	c.Assert(f.pending, check.HasLen, 0)
+}
+
+func (s *S) TestTsuruBatchHTTPFallback(c *check.C) {
+	srv, batchCh := startFakeTsuruAPI(c, true, nil)
+	defer srv.Close()
+	s.setTsuruBatchEnvs(srv.URL)
+	os.Setenv("LOG_TSURU_BATCH_SIZE", "2")
+	os.Setenv("LOG_TSURU_COMPRESSION", "deflate")
+	lf := LogForwarder{
+		EnabledBackends: []string{"tsuru"},
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg", "mymsg2", "mymsg3", "mymsg4")
+	batch := recvTsuruBatchTimeout(c, batchCh)
+	c.Assert(batch.header.Get("Authorization"), check.Equals, "bearer mytoken")
+	c.Assert(batch.header.Get("Content-Type"), check.Equals, "application/json")
+	c.Assert(batch.header.Get("Content-Encoding"), check.Equals, "gzip")
+	c.Assert(batch.seq, check.Equals, uint64(1))
+	c.Assert(batch.messages, check.DeepEquals, []string{"mymsg", "mymsg2"})
+	batch = recvTsuruBatchTimeout(c, batchCh)
+	c.Assert(batch.seq, check.Equals, uint64(2))
+	c.Assert(batch.messages, check.DeepEquals, []string{"mymsg3", "mymsg4"})
+}
+
+func (s *S) TestTsuruBatchProtocolNotSelected(c *check.C) {
+	bodyCh := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{
+			CheckOrigin: func(*http.Request) bool { return true },
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		c.Assert(err, check.IsNil)
+		defer ws.Close()
+		c.Check(r.Header.Get("Sec-WebSocket-Protocol"), check.Equals, "tsuru-logs-batch")
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			for scanner.Scan() {
+				bodyCh <- scanner.Text()
+			}
+		}
+	}))
+	defer srv.Close()
+	s.setTsuruBatchEnvs(srv.URL)
+	os.Setenv("LOG_TSURU_BATCH_SIZE", "1")
+	os.Setenv("LOG_TSURU_COMPRESSION", "deflate")
+	lf := LogForwarder{
+		EnabledBackends: []string{"tsuru"},
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	s.sendUDPMessages(c, "mymsg")
+	var logLine app.Applog
+	err = json.Unmarshal([]byte(recvTimeout(c, bodyCh)), &logLine)
+	c.Assert(err, check.IsNil)
+	c.Assert(logLine.Message, check.Equals, "mymsg")
+}
+
+func (s *S) TestTsuruBatchInvalidCompression(c *check.C) {
+	os.Setenv("TSURU_ENDPOINT", "http://localhost:8080")
+	os.Setenv("LOG_TSURU_COMPRESSION", "lz4")
+	lf := LogForwarder{
+		EnabledBackends: []string{"tsuru"},
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+	}
+	err := lf.Start()
+	c.Assert(err, check.ErrorMatches, `unable to initialize log backend "tsuru": invalid tsuru compression "lz4", expected deflate or none`)
+}
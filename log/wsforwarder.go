@@ -5,22 +5,22 @@
 package log
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net"
-	"net/url"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/tsuru/bs/bslog"
 	"github.com/tsuru/bs/config"
+	"github.com/tsuru/bs/endpoint"
 	"github.com/tsuru/tsuru/app"
-	"golang.org/x/net/websocket"
 )
 
 var (
@@ -31,30 +31,56 @@ var (
 )
 
 type tsuruBackend struct {
+	backendStats
 	msgCh      chan<- LogMessage
 	quitCh     chan<- bool
 	nextNotify *time.Timer
 }
 
 type wsForwarder struct {
-	url           string
+	endpoints     *endpoint.Pool
 	token         string
 	connMutex     sync.Mutex
 	pingInterval  time.Duration
 	pongInterval  time.Duration
 	jsonEncoder   *json.Encoder
 	quitCh        <-chan bool
-	bufferConn    *bufferedConn
 	connCreatedAt time.Time
 	connMaxAge    time.Duration
 	expireConnCh  chan bool
+	batchSize     int
+	batchInterval time.Duration
+	compress      bool
+	ackTimeout    time.Duration
+	maxPending    int
+	stats         *backendStats
+	pendingMu     sync.Mutex
+	pending       []*tsuruPendingBatch
+	seq           uint64
+}
+
+// tsuruLogEntry is a message sent to the tsuru API, with the fields
+// extracted from its content.
+type tsuruLogEntry struct {
+	app.Applog
+	Fields map[string]interface{} `json:",omitempty"`
 }
 
 func (b *tsuruBackend) initialize() error {
 	config.LoadConfig()
-	if config.Config.TsuruEndpoint == "" {
+	var endpoints *endpoint.Pool
+	var err error
+	if testTlsConfig != nil {
+		endpoints, err = endpoint.NewPool(config.Config.TsuruEndpoints, testTlsConfig, 0)
+	} else {
+		endpoints, err = endpoint.NewPoolFromEnv()
+	}
+	if err == endpoint.ErrNoEndpoints {
 		return fmt.Errorf("environment variable for TSURU_ENDPOINT must be set")
 	}
+	if err != nil {
+		return err
+	}
 	bufferSize := config.IntEnvOrDefault(config.DefaultBufferSize, "LOG_TSURU_BUFFER_SIZE", "LOG_BUFFER_SIZE")
 	wsPingInterval := config.SecondsEnvOrDefault(config.DefaultWsPingInterval, "LOG_TSURU_PING_INTERVAL", "LOG_WS_PING_INTERVAL")
 	wsPongInterval := config.SecondsEnvOrDefault(0, "LOG_TSURU_PONG_INTERVAL", "LOG_WS_PONG_INTERVAL")
@@ -64,24 +90,29 @@ func (b *tsuruBackend) initialize() error {
 		wsPongInterval = newPongInterval
 	}
 	wsConnMaxAge := config.SecondsEnvOrDefault(-1, "LOG_TSURU_CONN_MAX_AGE")
-	b.nextNotify = time.NewTimer(0)
-	tsuruUrl, err := url.Parse(config.Config.TsuruEndpoint)
-	if err != nil {
-		return err
+	compression := config.StringEnvOrDefault(tsuruCompressionNone, "LOG_TSURU_COMPRESSION")
+	if compression != tsuruCompressionNone && compression != tsuruCompressionDeflate {
+		return fmt.Errorf("invalid tsuru compression %q, expected %s or %s", compression, tsuruCompressionDeflate, tsuruCompressionNone)
 	}
-	tsuruUrl.Path = "/logs"
-	if tsuruUrl.Scheme == "https" {
-		tsuruUrl.Scheme = "wss"
-	} else {
-		tsuruUrl.Scheme = "ws"
+	ackTimeout := config.SecondsEnvOrDefault(10, "LOG_TSURU_ACK_TIMEOUT")
+	maxPending := config.IntEnvOrDefault(100, "LOG_TSURU_MAX_PENDING_BATCHES")
+	if maxPending < 1 {
+		maxPending = 1
 	}
+	b.nextNotify = time.NewTimer(0)
 	forwardChan, quitChan, err := processMessages(&wsForwarder{
-		url:          tsuruUrl.String(),
-		token:        config.Config.TsuruToken,
-		pingInterval: wsPingInterval,
-		pongInterval: wsPongInterval,
-		connMaxAge:   wsConnMaxAge,
-	}, bufferSize)
+		endpoints:     endpoints,
+		token:         config.Config.TsuruToken,
+		pingInterval:  wsPingInterval,
+		pongInterval:  wsPongInterval,
+		connMaxAge:    wsConnMaxAge,
+		batchSize:     config.IntEnvOrDefault(0, "LOG_TSURU_BATCH_SIZE"),
+		batchInterval: config.SecondsEnvOrDefault(1, "LOG_TSURU_BATCH_INTERVAL"),
+		compress:      compression == tsuruCompressionDeflate,
+		ackTimeout:    ackTimeout,
+		maxPending:    maxPending,
+		stats:         &b.backendStats,
+	}, bufferSize, &b.backendStats)
 	if err != nil {
 		return err
 	}
@@ -94,16 +125,17 @@ func (b *tsuruBackend) sendMessage(parts *rawLogParts, appName, processName, con
 	if len(container) > containerIDTrimSize {
 		container = container[:containerIDTrimSize]
 	}
-	msg := &app.Applog{
-		Date:    parts.ts,
-		AppName: appName,
-		Message: string(parts.content),
-		Source:  processName,
-		Unit:    container,
+	msg := &tsuruLogEntry{
+		Applog: app.Applog{
+			Date:    parts.ts,
+			AppName: appName,
+			Message: string(parts.content),
+			Source:  processName,
+			Unit:    container,
+		},
+		Fields: parts.fields,
 	}
-	select {
-	case b.msgCh <- msg:
-	default:
+	if !b.enqueue(b.msgCh, msg, parts.ts) {
 		select {
 		case <-b.nextNotify.C:
 			bslog.Errorf("Dropping log messages to tsuru due to full channel buffer.")
@@ -121,75 +153,89 @@ func (f *wsForwarder) initialize(quitCh <-chan bool) {
 	f.quitCh = quitCh
 }
 
+// connect tries each tsuru endpoint target in turn, until a websocket
+// connection is established.
 func (f *wsForwarder) connect() (net.Conn, error) {
-	config, err := websocket.NewConfig(f.url, "ws://localhost/")
-	if err != nil {
-		return nil, err
-	}
-	if testTlsConfig != nil {
-		config.TlsConfig = testTlsConfig
-	}
-	config.Header.Add("Authorization", "bearer "+f.token)
-	var client net.Conn
-	host, port, _ := net.SplitHostPort(config.Location.Host)
-	if host == "" {
-		host = config.Location.Host
-	}
-	dialer := &net.Dialer{
-		Timeout:   forwardConnDialTimeout,
-		KeepAlive: 30 * time.Second,
-	}
-	switch config.Location.Scheme {
-	case "ws":
-		if port == "" {
-			port = "80"
-		}
-		client, err = dialer.Dial("tcp", fmt.Sprintf("%s:%s", host, port))
-	case "wss":
-		if port == "" {
-			port = "443"
+	var err error
+	for _, target := range f.endpoints.Targets() {
+		var conn net.Conn
+		conn, err = f.connectTarget(target)
+		if err == nil {
+			f.endpoints.MarkUp(target)
+			return conn, nil
 		}
-		client, err = tls.DialWithDialer(dialer, "tcp", fmt.Sprintf("%s:%s", host, port), config.TlsConfig)
-	default:
-		err = websocket.ErrBadScheme
+		f.endpoints.MarkDown(target, err)
 	}
+	return nil, err
+}
+
+func (f *wsForwarder) connectTarget(target endpoint.Target) (net.Conn, error) {
+	location := target.URLWithPath("/logs")
+	if location.Scheme == "https" {
+		location.Scheme = "wss"
+	} else {
+		location.Scheme = "ws"
+	}
+	header := http.Header{}
+	header.Set("Origin", "ws://localhost/")
+	header.Set("Authorization", "bearer "+f.token)
+	client, err := f.endpoints.Dial(target, forwardConnDialTimeout)
 	if err != nil {
 		return nil, err
 	}
 	f.connCreatedAt = time.Now()
-	f.expireConnCh = make(chan bool)
-	ws, err := websocket.NewClient(config, client)
-	if err != nil {
-		client.Close()
-		return nil, err
+	expireConnCh := make(chan bool)
+	f.expireConnCh = expireConnCh
+	// The pool already dialed the target, including the tls handshake for
+	// https endpoints, the dialer only performs the websocket handshake.
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return client, nil
+	}
+	dialer := &websocket.Dialer{
+		NetDialContext:    dial,
+		NetDialTLSContext: dial,
+		HandshakeTimeout:  forwardConnWriteTimeout,
+		EnableCompression: f.compress,
+	}
+	if f.batchSize > 0 {
+		dialer.Subprotocols = []string{tsuruBatchProtocol}
 	}
-	pingWriter, err := ws.NewFrameWriter(websocket.PingFrame)
+	ws, resp, err := dialer.Dial(location.String(), header)
 	if err != nil {
 		client.Close()
-		bslog.Errorf("[log forwarder] unable to create ping frame writer, closing websocket: %s", err)
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols && f.batchSize > 0 {
+			bslog.Warnf("[log forwarder] websocket upgrade refused by %s, sending logs using http requests", target)
+			return f.connectBatch(nil)
+		}
 		return nil, err
 	}
-	f.bufferConn = newBufferedConn(ws, time.Second)
+	batch := ws.Subprotocol() == tsuruBatchProtocol
+	if f.batchSize > 0 && !batch {
+		bslog.Warnf("[log forwarder] %s does not support the %s protocol, sending each log message as it's received", target, tsuruBatchProtocol)
+	}
 	lastPongTime := time.Now().UnixNano()
+	ws.SetPongHandler(func(string) error {
+		atomic.StoreInt64(&lastPongTime, time.Now().UnixNano())
+		return nil
+	})
 	stopWg.Add(2)
 	go func() {
 		defer stopWg.Done()
 		defer client.Close()
 		for {
-			frame, err := ws.NewFrameReader()
+			messageType, data, err := ws.ReadMessage()
 			if err != nil {
 				select {
-				case <-f.expireConnCh:
+				case <-expireConnCh:
 					return
 				default:
 				}
-				bslog.Errorf("[log forwarder] unable to create pong frame reader, closing websocket: %s", err)
+				bslog.Errorf("[log forwarder] unable to read from websocket, closing it: %s", err)
 				return
 			}
-			if frame.PayloadType() == websocket.PongFrame {
-				atomic.StoreInt64(&lastPongTime, time.Now().UnixNano())
+			if batch && messageType == websocket.TextMessage {
+				f.readAck(data)
 			}
-			io.Copy(ioutil.Discard, frame)
 		}
 	}()
 	go func() {
@@ -200,12 +246,12 @@ func (f *wsForwarder) connect() (net.Conn, error) {
 			case <-time.After(f.pingInterval):
 			case <-f.quitCh:
 				return
-			case <-f.expireConnCh:
+			case <-expireConnCh:
 				return
 			}
-			err := f.writeWithDeadline(ws, pingWriter, []byte{'z'})
+			err := ws.WriteControl(websocket.PingMessage, []byte{'z'}, time.Now().Add(forwardConnWriteTimeout))
 			if err != nil {
-				bslog.Errorf("[log forwarder] ping: %s", err)
+				bslog.Errorf("[log forwarder] ping: error sending message: %s", err)
 				return
 			}
 			mylastPongTime := atomic.LoadInt64(&lastPongTime)
@@ -217,41 +263,78 @@ func (f *wsForwarder) connect() (net.Conn, error) {
 			}
 		}
 	}()
-	f.jsonEncoder = json.NewEncoder(f.bufferConn)
-	return f.bufferConn, nil
+	if batch {
+		return f.connectBatch(ws)
+	}
+	bufferConn := newBufferedConn(&wsConn{Conn: ws}, time.Second)
+	f.jsonEncoder = json.NewEncoder(bufferConn)
+	return bufferConn, nil
 }
 
-func (f *wsForwarder) writeWithDeadline(conn net.Conn, writer io.WriteCloser, data []byte) error {
-	f.connMutex.Lock()
-	defer f.connMutex.Unlock()
-	f.bufferConn.mu.Lock()
-	defer f.bufferConn.mu.Unlock()
-	err := conn.SetWriteDeadline(time.Now().Add(forwardConnWriteTimeout))
+// wsConn adapts a websocket connection to net.Conn, each Write is sent as a
+// text message. Messages from the tsuru API are read by the forwarder, so
+// Read is not supported.
+type wsConn struct {
+	*websocket.Conn
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	return 0, errors.New("websocket: read not supported")
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	err := c.WriteMessage(websocket.TextMessage, p)
 	if err != nil {
-		return fmt.Errorf("error setting deadline: %s", err)
+		return 0, err
 	}
-	n, err := writer.Write(data)
+	return len(p), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
 	if err != nil {
-		return fmt.Errorf("error sending message: %s", err)
-	}
-	if n < len(data) {
-		return fmt.Errorf("short write trying to write log to %q", conn.RemoteAddr())
+		return err
 	}
-	return nil
+	return c.SetWriteDeadline(t)
+}
+
+// Close sends a normal closure message and closes the connection.
+func (c *wsConn) Close() error {
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(forwardConnWriteTimeout))
+	return c.Conn.Close()
 }
 
 func (f *wsForwarder) process(conn net.Conn, msg LogMessage) error {
+	if batch, ok := conn.(*batchConn); ok {
+		return f.processBatch(batch, msg)
+	}
 	f.connMutex.Lock()
 	defer f.connMutex.Unlock()
 	err := conn.SetWriteDeadline(time.Now().Add(forwardConnWriteTimeout))
 	if err != nil {
 		return fmt.Errorf("error setting deadline: %s", err)
 	}
-	entry := msg.(*app.Applog)
+	entry := msg.(*tsuruLogEntry)
 	err = f.jsonEncoder.Encode(entry)
 	if err != nil {
 		return fmt.Errorf("error sending message: %s", err)
 	}
+	return f.checkConnMaxAge()
+}
+
+func (f *wsForwarder) processBatch(conn *batchConn, msg LogMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("error encoding message: %s", err)
+	}
+	err = conn.add(batchEntry{data: data})
+	if err != nil {
+		return err
+	}
+	return f.checkConnMaxAge()
+}
+
+func (f *wsForwarder) checkConnMaxAge() error {
 	if time.Since(f.connCreatedAt) >= f.connMaxAge && f.connMaxAge >= 0 {
 		close(f.expireConnCh)
 		return errConnMaxAgeExceeded
@@ -260,6 +343,12 @@ func (f *wsForwarder) process(conn net.Conn, msg LogMessage) error {
 }
 
 func (f *wsForwarder) close(conn net.Conn) {
+	if _, ok := conn.(*batchConn); ok {
+		// Flushing the batch requires connMutex to write to the websocket,
+		// entries not written are sent again after reconnecting.
+		conn.Close()
+		return
+	}
 	// Reset deadline, if we don't do this the connection remains open
 	// on the other end (causing tests to fail) for some weird reason.
 	f.connMutex.Lock()
@@ -12,8 +12,11 @@ import (
 	"syscall"
 
 	"github.com/google/gops/agent"
+	"github.com/tsuru/bs/admin"
 	"github.com/tsuru/bs/bslog"
 	"github.com/tsuru/bs/config"
+	"github.com/tsuru/bs/container"
+	"github.com/tsuru/bs/endpoint"
 	"github.com/tsuru/bs/log"
 	"github.com/tsuru/bs/metric"
 	_ "github.com/tsuru/bs/metric/logstash"
@@ -45,6 +48,38 @@ func startSignalHandler(callback func(os.Signal), signals ...os.Signal) {
 	signal.Notify(sigChan, signals...)
 }
 
+// adminComponents describes the state of each service for the admin API.
+func adminComponents(lf *log.LogForwarder, reporter *status.Reporter, reporterErr error, mRunner interface{ LastRun() *metric.RunResult }, metricsErr error) []admin.Component {
+	return []admin.Component{
+		{
+			Name: "log_forwarder",
+			Status: func() interface{} {
+				return map[string]interface{}{
+					"listen_address": lf.BindAddress,
+					"backends":       lf.EnabledBackends,
+				}
+			},
+		},
+		{
+			Name: "status_reporter",
+			Err:  reporterErr,
+			Ready: func() bool {
+				return reporter.LastReport() != nil
+			},
+			Status: func() interface{} {
+				return map[string]interface{}{"last_report": reporter.LastReport()}
+			},
+		},
+		{
+			Name: "metrics_runner",
+			Err:  metricsErr,
+			Status: func() interface{} {
+				return map[string]interface{}{"last_run": mRunner.LastRun()}
+			},
+		},
+	}
+}
+
 func main() {
 	err := agent.Listen(&agent.Options{
 		NoShutdownCleanup: true,
@@ -58,10 +93,17 @@ func main() {
 		fmt.Printf("bs version %s\n", version)
 		return
 	}
+	// The log forwarder and the status reporter share the container cache
+	// and events stream.
+	infoClient, err := container.NewClient(config.Config.DockerEndpoint)
+	if err != nil {
+		bslog.Fatalf("Unable to initialize docker client: %s\n", err)
+	}
 	lf := log.LogForwarder{
 		BindAddress:     config.Config.SyslogListenAddress,
 		DockerEndpoint:  config.Config.DockerEndpoint,
 		EnabledBackends: config.Config.LogBackends,
+		InfoClient:      infoClient,
 	}
 	err = lf.Start()
 	if err != nil {
@@ -69,19 +111,54 @@ func main() {
 	}
 	mRunner := metric.NewRunner(config.Config.DockerEndpoint, config.Config.MetricsInterval,
 		config.Config.MetricsBackend)
-	err = mRunner.Start()
-	if err != nil {
-		bslog.Warnf("Unable to initialize metrics runner: %s\n", err)
+	metricsErr := mRunner.Start()
+	if metricsErr != nil {
+		bslog.Warnf("Unable to initialize metrics runner: %s\n", metricsErr)
+	}
+	var reporter *status.Reporter
+	tsuruEndpoints, err := endpoint.NewPoolFromEnv()
+	if err == nil {
+		reporter, err = status.NewReporter(&status.ReporterConfig{
+			TsuruEndpoint:         config.Config.TsuruEndpoint,
+			TsuruEndpoints:        tsuruEndpoints,
+			TsuruToken:            config.Config.TsuruToken,
+			DockerEndpoint:        config.Config.DockerEndpoint,
+			InfoClient:            infoClient,
+			Interval:              config.Config.StatusInterval,
+			EventsDebounce:        config.Config.StatusDebounce,
+			CrashLoopRestarts:     config.Config.CrashLoopRestarts,
+			CrashLoopWindow:       config.Config.CrashLoopWindow,
+			ZombieConfirmations:   config.Config.ZombieConfirmations,
+			ZombieGracePeriod:     config.Config.ZombieGracePeriod,
+			ZombieDryRun:          config.Config.ZombieDryRun,
+			ZombieProtectedLabels: config.Config.ZombieProtected,
+			ZombieMaxRemovals:     config.Config.ZombieMaxRemovals,
+			OnZombieRemoval: func(event status.ZombieEvent) {
+				lf.SendContainerEvent(event.Container, event.Message(), map[string]interface{}{
+					"event":   "zombie_removal",
+					"dry_run": event.DryRun,
+					"reports": event.Reports,
+				})
+			},
+		})
 	}
-	reporter, err := status.NewReporter(&status.ReporterConfig{
-		TsuruEndpoint:  config.Config.TsuruEndpoint,
-		TsuruToken:     config.Config.TsuruToken,
-		DockerEndpoint: config.Config.DockerEndpoint,
-		Interval:       config.Config.StatusInterval,
-	})
 	if err != nil {
 		bslog.Warnf("Unable to initialize status reporter: %s\n", err)
 	}
+	reporterErr := err
+	if config.Config.AdminListenAddress != "" {
+		adminServer := &admin.Server{
+			Address:    config.Config.AdminListenAddress,
+			Backends:   lf.BackendStats,
+			Components: adminComponents(&lf, reporter, reporterErr, mRunner, metricsErr),
+		}
+		err = adminServer.Start()
+		if err != nil {
+			bslog.Warnf("Unable to initialize admin API: %s\n", err)
+		} else {
+			defer adminServer.Stop()
+		}
+	}
 	monitorEl := []StopWaiter{&lf, mRunner}
 	if reporter != nil {
 		monitorEl = append(monitorEl, reporter)
@@ -20,7 +20,10 @@ type Reporter struct {
 	hostClient            *HostClient
 }
 
-func (r *Reporter) Do() {
+// Do sends the metrics of the containers and the host, returning the error
+// listing containers or getting host metrics. Errors of single containers are
+// only logged.
+func (r *Reporter) Do() error {
 	containers, err := r.infoClient.ListContainers()
 	if err != nil {
 		bslog.Errorf("failed to list containers: %s", err)
@@ -30,10 +33,12 @@ func (r *Reporter) Do() {
 		selectionEnvs = []string{r.containerSelectionEnv}
 	}
 	r.getMetrics(containers, selectionEnvs)
-	err = r.getHostMetrics()
-	if err != nil {
-		bslog.Errorf("failed to get host metrics: %s", err)
+	hostErr := r.getHostMetrics()
+	if hostErr != nil {
+		bslog.Errorf("failed to get host metrics: %s", hostErr)
+		return hostErr
 	}
+	return err
 }
 
 func (r *Reporter) getMetrics(containers []docker.APIContainers, selectionEnvs []string) {
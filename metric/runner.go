@@ -7,10 +7,19 @@ package metric
 import (
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/tsuru/bs/bslog"
 	"github.com/tsuru/bs/container"
+	"github.com/tsuru/bs/telemetry"
+)
+
+var (
+	runDuration = telemetry.NewHistogramVec("bs_metrics_run_duration_seconds",
+		"Duration of the runs collecting and sending container metrics.", nil)
+	runErrors = telemetry.NewCounterVec("bs_metrics_run_errors_total",
+		"Runs collecting and sending container metrics that failed.")
 )
 
 type runner struct {
@@ -19,6 +28,16 @@ type runner struct {
 	metricsBackend string
 	abort          chan struct{}
 	exit           chan struct{}
+	mu             sync.Mutex
+	lastRun        *RunResult
+}
+
+// RunResult is the outcome of a metrics run.
+type RunResult struct {
+	Time time.Time `json:"time"`
+	// Duration is how long the run took, in seconds.
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
 }
 
 func NewRunner(dockerEndpoint string, interval time.Duration, metricsBackend string) *runner {
@@ -67,7 +86,7 @@ func (r *runner) Start() (err error) {
 	}
 	go func() {
 		for {
-			reporter.Do()
+			r.run(reporter)
 			select {
 			case <-r.abort:
 				close(r.exit)
@@ -80,6 +99,27 @@ func (r *runner) Start() (err error) {
 	return
 }
 
+func (r *runner) run(reporter *Reporter) {
+	result := &RunResult{Time: time.Now()}
+	if err := reporter.Do(); err != nil {
+		result.Error = err.Error()
+		runErrors.With().Inc()
+	}
+	result.Duration = time.Since(result.Time).Seconds()
+	runDuration.With().Observe(result.Duration)
+	r.mu.Lock()
+	r.lastRun = result
+	r.mu.Unlock()
+}
+
+// LastRun returns the result of the last metrics run, nil before the first
+// one finishes.
+func (r *runner) LastRun() *RunResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastRun
+}
+
 // Stop stops the runner.
 func (r *runner) Stop() {
 	close(r.abort)
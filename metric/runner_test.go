@@ -27,9 +27,12 @@ func (s *S) TestRunner(c *check.C) {
 	defer dockerServer.Stop()
 	s.prepareStats(dockerServer, conts)
 	r := NewRunner(dockerServer.URL(), time.Second, "fake")
+	c.Assert(r.LastRun(), check.IsNil)
 	err := r.Start()
 	c.Assert(err, check.IsNil)
 	r.Stop()
+	c.Assert(r.LastRun(), check.NotNil)
+	c.Assert(r.LastRun().Time.IsZero(), check.Equals, false)
 	cpuStat := make([]*fakeStat, 0)
 	for i, stat := range fakeBackend.stats {
 		if stat.key == "cpu_max" {
@@ -0,0 +1,89 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package status
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/container"
+)
+
+// isStatusEvent returns whether the container event action may change the
+// status of a unit.
+func isStatusEvent(action string) bool {
+	switch action {
+	case "start", "die", "oom":
+		return true
+	}
+	return strings.HasPrefix(action, "health_status")
+}
+
+// handleEvent queues the container of a status event to be reported once no
+// status events are received for the debounce interval, so a burst of events
+// results in a single update.
+func (r *Reporter) handleEvent(event *docker.APIEvents) {
+	action, id := container.EventAction(event)
+	if id == "" || !isStatusEvent(action) {
+		return
+	}
+	r.eventsMu.Lock()
+	defer r.eventsMu.Unlock()
+	if r.eventsStopped {
+		return
+	}
+	r.pendingUnits[id] = event.Actor.Attributes["name"]
+	if r.eventsTimer == nil {
+		r.eventsTimer = time.AfterFunc(r.config.EventsDebounce, r.reportPendingUnits)
+	} else {
+		r.eventsTimer.Reset(r.config.EventsDebounce)
+	}
+}
+
+// reportPendingUnits sends the status of the units affected by events since
+// the last update, along with the last host check results, without running
+// the host checks.
+func (r *Reporter) reportPendingUnits() {
+	r.eventsMu.Lock()
+	pending := r.pendingUnits
+	r.pendingUnits = make(map[string]string)
+	r.eventsTimer = nil
+	stopped := r.eventsStopped
+	r.eventsMu.Unlock()
+	if stopped || len(pending) == 0 {
+		return
+	}
+	containers := make([]docker.APIContainers, 0, len(pending))
+	for id, name := range pending {
+		containers = append(containers, docker.APIContainers{ID: id, Names: []string{name}})
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].ID < containers[j].ID
+	})
+	r.reportMu.Lock()
+	defer r.reportMu.Unlock()
+	units := r.retrieveContainerStatuses(containers)
+	if len(units) == 0 {
+		return
+	}
+	bslog.Debugf("[status reporter] sending status of %d units changed by docker events", len(units))
+	r.sendStatus(&hostStatus{Addrs: r.addrs, Units: units, Checks: r.checks.Last()}, false)
+}
+
+// stopEvents stops watching docker events, discarding pending updates.
+func (r *Reporter) stopEvents() {
+	r.eventsMu.Lock()
+	r.eventsStopped = true
+	if r.eventsTimer != nil {
+		r.eventsTimer.Stop()
+	}
+	r.eventsMu.Unlock()
+	if r.config.InfoClient == nil {
+		r.infoClient.Close()
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package status
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/config"
+)
+
+// Exit codes of Nagios plugins.
+const (
+	nagiosOK       = 0
+	nagiosWarning  = 1
+	nagiosCritical = 2
+	nagiosUnknown  = 3
+)
+
+const defaultExecCheckTimeout = 10
+
+var nagiosStates = map[int]string{
+	nagiosOK:       "OK",
+	nagiosWarning:  "WARNING",
+	nagiosCritical: "CRITICAL",
+	nagiosUnknown:  "UNKNOWN",
+}
+
+// checkWarning is returned by checks that succeeded with a warning, the
+// check is reported as successful along with the message.
+type checkWarning struct {
+	message string
+}
+
+func (w *checkWarning) Error() string {
+	return w.message
+}
+
+// execCheck runs a command following the Nagios plugin conventions: exit
+// code 0 is ok, 1 a warning, 2 critical and 3 unknown. The first line of the
+// standard output, without performance data, describes the result.
+//
+// The command is killed after timeout, the check collection does not apply
+// another timeout to exec checks.
+type execCheck struct {
+	name     string
+	command  string
+	args     []string
+	timeout  time.Duration
+	interval time.Duration
+}
+
+// execChecksFromEnv returns the checks named in HOSTCHECK_EXEC, each
+// configured by HOSTCHECK_EXEC_<NAME>_COMMAND, _ARGS, _TIMEOUT and
+// _INTERVAL.
+func execChecksFromEnv() []*execCheck {
+	var checks []*execCheck
+	for _, name := range config.StringsEnvOrDefault(nil, "HOSTCHECK_EXEC") {
+		prefix := "HOSTCHECK_EXEC_" + envName(name) + "_"
+		command := config.StringEnvOrDefault("", prefix+"COMMAND")
+		if command == "" {
+			bslog.Warnf("[host check] ignoring exec check %q: %sCOMMAND is not set", name, prefix)
+			continue
+		}
+		checks = append(checks, &execCheck{
+			name:     name,
+			command:  command,
+			args:     config.StringsEnvOrDefault(nil, prefix+"ARGS"),
+			timeout:  config.SecondsEnvOrDefault(defaultExecCheckTimeout, prefix+"TIMEOUT"),
+			interval: config.SecondsEnvOrDefault(0, prefix+"INTERVAL"),
+		})
+	}
+	return checks
+}
+
+// envName converts a check name to the form used in environment variables.
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Run runs the command, killing it after the timeout. Its standard error is
+// only used to describe the result when nothing is written to the standard
+// output.
+func (c *execCheck) Run() error {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(c.command, c.args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Start()
+	if err != nil {
+		return fmt.Errorf("UNKNOWN: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case err = <-done:
+	case <-timer.C:
+		// Children of the command may keep its output open after it's
+		// killed, so Wait is left running in background.
+		cmd.Process.Kill()
+		return fmt.Errorf("UNKNOWN: timeout running %s after %s", c.command, c.timeout)
+	}
+	code := nagiosOK
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return fmt.Errorf("UNKNOWN: %s", err)
+		}
+		code = exitErr.ExitCode()
+	}
+	message := firstLine(stdout.Bytes())
+	if message == "" {
+		message = firstLine(stderr.Bytes())
+	}
+	if message == "" {
+		state, ok := nagiosStates[code]
+		if !ok {
+			state = nagiosStates[nagiosUnknown]
+		}
+		message = fmt.Sprintf("%s: exit status %d", state, code)
+	}
+	switch code {
+	case nagiosOK:
+		return nil
+	case nagiosWarning:
+		return &checkWarning{message: message}
+	default:
+		return fmt.Errorf("%s", message)
+	}
+}
+
+// firstLine returns the first line of a plugin output, without the
+// performance data following "|".
+func firstLine(output []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	if !scanner.Scan() {
+		return ""
+	}
+	line := scanner.Text()
+	if i := strings.Index(line, "|"); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
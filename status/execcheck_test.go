@@ -0,0 +1,142 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package status
+
+import (
+	"os"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func shellCheck(script string) *execCheck {
+	return &execCheck{name: "test", command: "sh", args: []string{"-c", script}, timeout: 5 * time.Second}
+}
+
+func (s S) TestExecCheckRunOK(c *check.C) {
+	c.Assert(shellCheck("echo 'NFS OK - all mounted'").Run(), check.IsNil)
+}
+
+func (s S) TestExecCheckRunWarning(c *check.C) {
+	err := shellCheck("echo 'DISK WARNING - 80% used | used=80;75;90'; echo details; exit 1").Run()
+	c.Assert(err, check.FitsTypeOf, &checkWarning{})
+	c.Assert(err, check.ErrorMatches, "DISK WARNING - 80% used")
+}
+
+func (s S) TestExecCheckRunCritical(c *check.C) {
+	err := shellCheck("echo 'IPTABLES CRITICAL - missing rule' >&2; exit 2").Run()
+	c.Assert(err, check.ErrorMatches, "IPTABLES CRITICAL - missing rule")
+	_, ok := err.(*checkWarning)
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s S) TestExecCheckRunPrefersStdout(c *check.C) {
+	err := shellCheck("echo 'warning: deprecated option' >&2; echo 'NTP CRITICAL - offset 3s'; exit 2").Run()
+	c.Assert(err, check.ErrorMatches, "NTP CRITICAL - offset 3s")
+}
+
+func (s S) TestExecCheckRunWithoutOutput(c *check.C) {
+	c.Assert(shellCheck("exit 3").Run(), check.ErrorMatches, "UNKNOWN: exit status 3")
+	c.Assert(shellCheck("exit 2").Run(), check.ErrorMatches, "CRITICAL: exit status 2")
+	c.Assert(shellCheck("exit 42").Run(), check.ErrorMatches, "UNKNOWN: exit status 42")
+}
+
+func (s S) TestExecCheckRunTimeout(c *check.C) {
+	execCheck := shellCheck("sleep 10")
+	execCheck.timeout = 100 * time.Millisecond
+	c.Assert(execCheck.Run(), check.ErrorMatches, `UNKNOWN: timeout running sh after 100ms`)
+}
+
+func (s S) TestExecCheckRunTimeoutChildKeepsOutput(c *check.C) {
+	execCheck := shellCheck("sleep 10 & sleep 10")
+	execCheck.timeout = 100 * time.Millisecond
+	start := time.Now()
+	c.Assert(execCheck.Run(), check.ErrorMatches, `UNKNOWN: timeout running sh after 100ms`)
+	c.Assert(time.Since(start) < 2*time.Second, check.Equals, true)
+}
+
+func (s S) TestExecCheckRunInvalidCommand(c *check.C) {
+	execCheck := &execCheck{name: "test", command: "/some/invalid/command", timeout: time.Second}
+	c.Assert(execCheck.Run(), check.ErrorMatches, "UNKNOWN: .*no such file or directory")
+}
+
+func (s S) TestExecChecksFromEnv(c *check.C) {
+	envs := map[string]string{
+		"HOSTCHECK_EXEC":                       "nfs-mounts, iptables, missing",
+		"HOSTCHECK_EXEC_NFS_MOUNTS_COMMAND":    "/usr/lib/nagios/plugins/check_nfs",
+		"HOSTCHECK_EXEC_NFS_MOUNTS_ARGS":       "-w, 5, -c, 10",
+		"HOSTCHECK_EXEC_NFS_MOUNTS_TIMEOUT":    "3",
+		"HOSTCHECK_EXEC_NFS_MOUNTS_INTERVAL":   "60",
+		"HOSTCHECK_EXEC_IPTABLES_COMMAND":      "/usr/local/bin/check_iptables",
+		"HOSTCHECK_EXEC_WRITABLEROOT_COMMAND":  "/bin/true",
+		"HOSTCHECK_EXEC_CREATECONTAINER_ARGS":  "x",
+		"HOSTCHECK_EXEC_MISSING_ARGS":          "x",
+		"HOSTCHECK_EXEC_NFS_MOUNTS_UNUSED_KEY": "x",
+	}
+	for k, v := range envs {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	checks := execChecksFromEnv()
+	c.Assert(checks, check.DeepEquals, []*execCheck{
+		{
+			name:     "nfs-mounts",
+			command:  "/usr/lib/nagios/plugins/check_nfs",
+			args:     []string{"-w", "5", "-c", "10"},
+			timeout:  3 * time.Second,
+			interval: time.Minute,
+		},
+		{
+			name:    "iptables",
+			command: "/usr/local/bin/check_iptables",
+			timeout: 10 * time.Second,
+		},
+	})
+}
+
+func (s S) TestCheckCollectionRunExecChecks(c *check.C) {
+	checkColl := &checkCollection{
+		checks: map[string]hostCheck{
+			"ok":       shellCheck("echo fine"),
+			"warning":  shellCheck("echo 'almost full'; exit 1"),
+			"critical": shellCheck("echo 'broken'; exit 2"),
+		},
+	}
+	resultsMap := map[string]hostCheckResult{}
+	for _, result := range checkColl.Run() {
+		result.Duration, result.LastRun = 0, time.Time{}
+		resultsMap[result.Name] = result
+	}
+	c.Assert(resultsMap, check.DeepEquals, map[string]hostCheckResult{
+		"ok":       {Name: "ok", Successful: true},
+		"warning":  {Name: "warning", Err: "almost full", Successful: true},
+		"critical": {Name: "critical", Err: "broken", Successful: false},
+	})
+}
+
+func (s S) TestNewCheckCollectionExecChecks(c *check.C) {
+	os.Setenv("HOSTCHECK_EXEC", "nfs, writableRoot")
+	os.Setenv("HOSTCHECK_EXEC_NFS_COMMAND", "/bin/true")
+	os.Setenv("HOSTCHECK_EXEC_NFS_INTERVAL", "30")
+	os.Setenv("HOSTCHECK_EXEC_WRITABLEROOT_COMMAND", "/bin/true")
+	os.Setenv("HOSTCHECK_TIMEOUT", "5")
+	defer os.Unsetenv("HOSTCHECK_EXEC")
+	defer os.Unsetenv("HOSTCHECK_EXEC_NFS_COMMAND")
+	defer os.Unsetenv("HOSTCHECK_EXEC_NFS_INTERVAL")
+	defer os.Unsetenv("HOSTCHECK_EXEC_WRITABLEROOT_COMMAND")
+	defer os.Unsetenv("HOSTCHECK_TIMEOUT")
+	checkColl := NewCheckCollection(nil, nil)
+	c.Assert(checkColl.checks, check.HasLen, 3)
+	c.Assert(checkColl.checks["nfs"], check.FitsTypeOf, &execCheck{})
+	c.Assert(checkColl.states["nfs"].timeout, check.Equals, time.Duration(0))
+	c.Assert(checkColl.states["nfs"].interval, check.Equals, 30*time.Second)
+	c.Assert(checkColl.states["writableRoot"].timeout, check.Equals, 5*time.Second)
+	c.Assert(checkColl.checks["writableRoot"], check.FitsTypeOf, &writableCheck{})
+}
+
+func (s S) TestEnvName(c *check.C) {
+	c.Assert(envName("nfs-mounts"), check.Equals, "NFS_MOUNTS")
+	c.Assert(envName("check.iptables2"), check.Equals, "CHECK_IPTABLES2")
+}
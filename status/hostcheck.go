@@ -5,18 +5,29 @@
 package status
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/mem"
 	"github.com/tsuru/bs/bslog"
 	"github.com/tsuru/bs/config"
+	"github.com/tsuru/bs/container"
+	"github.com/tsuru/bs/endpoint"
 )
 
 type hostCheck interface {
@@ -24,21 +35,48 @@ type hostCheck interface {
 }
 
 type checkCollection struct {
-	checks      map[string]hostCheck
-	timeout     time.Duration
-	errChannels map[string]chan error
+	checks    map[string]hostCheck
+	timeout   time.Duration
+	mu        sync.Mutex
+	states    map[string]*checkState
+	startOnce sync.Once
+	quit      chan struct{}
+}
+
+// checkState is the schedule of a check, its run in progress and its last
+// result.
+type checkState struct {
+	timeout  time.Duration
+	interval time.Duration
+	// pending receives the result of the run started at started, it's kept
+	// across runs while the check times out.
+	pending chan error
+	started time.Time
+	last    *hostCheckResult
+	// ready is closed after the first background run of a check with an
+	// interval.
+	ready chan struct{}
 }
 
 type hostCheckResult struct {
 	Name       string
 	Err        string
 	Successful bool
+	// Duration is how long the check ran, in seconds, and LastRun when it
+	// started.
+	Duration float64   `form:",omitempty"`
+	LastRun  time.Time `form:",omitempty"`
 }
 
-var cgroupIDRegexp = regexp.MustCompile(`(?ms)/docker/(.*?)$`)
+const (
+	defaultCheckTimeout   = 30
+	defaultNetworkTimeout = 5
+)
 
-func NewCheckCollection(client *docker.Client) *checkCollection {
-	hostCheckTimeout := config.SecondsEnvOrDefault(0, "HOSTCHECK_TIMEOUT")
+var cgroupIDRegexp = regexp.MustCompile(`(?ms)/(?:docker/|cri-containerd-)(.*?)(?:\.scope)?$`)
+
+func NewCheckCollection(client *container.InfoClient, endpoints *endpoint.Pool) *checkCollection {
+	hostCheckTimeout := config.SecondsEnvOrDefault(defaultCheckTimeout, "HOSTCHECK_TIMEOUT")
 	baseContainerName := config.StringEnvOrDefault("", "HOSTCHECK_BASE_CONTAINER_NAME")
 	rootPathOverride := config.StringEnvOrDefault("/", "HOSTCHECK_ROOT_PATH_OVERRIDE")
 	containerCheckMessage := config.StringEnvOrDefault("ok", "HOSTCHECK_CONTAINER_MESSAGE")
@@ -47,51 +85,236 @@ func NewCheckCollection(client *docker.Client) *checkCollection {
 			"writableRoot":    &writableCheck{path: rootPathOverride},
 			"createContainer": &createContainerCheck{client: client, baseContID: baseContainerName, message: containerCheckMessage},
 		},
-		timeout:     hostCheckTimeout,
-		errChannels: make(map[string]chan error),
+		timeout: hostCheckTimeout,
+		states:  make(map[string]*checkState),
 	}
 	extraPaths := config.StringsEnvOrDefault(nil, "HOSTCHECK_EXTRA_PATHS")
 	for i, p := range extraPaths {
 		checkColl.checks[fmt.Sprintf("writableCustomPath%d", i+1)] = &writableCheck{path: p}
 	}
+	diskChecks := map[string]*diskSpaceCheck{}
+	diskCheck := func(path string) *diskSpaceCheck {
+		if diskChecks[path] == nil {
+			diskChecks[path] = &diskSpaceCheck{path: path}
+			checkColl.checks["diskSpace:"+path] = diskChecks[path]
+		}
+		return diskChecks[path]
+	}
+	for path, minFree := range percentsPerPathEnv("HOSTCHECK_DISK_MIN_FREE") {
+		diskCheck(path).minFreePercent = minFree
+	}
+	for path, minFree := range percentsPerPathEnv("HOSTCHECK_INODES_MIN_FREE") {
+		diskCheck(path).minFreeInodesPercent = minFree
+	}
+	networkTimeout := config.SecondsEnvOrDefault(defaultNetworkTimeout, "HOSTCHECK_NETWORK_TIMEOUT")
+	if names := config.StringsEnvOrDefault(nil, "HOSTCHECK_DNS_NAMES"); len(names) > 0 {
+		checkColl.checks["dnsResolution"] = &dnsCheck{names: names, timeout: networkTimeout}
+	}
+	if addrs := config.StringsEnvOrDefault(nil, "HOSTCHECK_TCP_ENDPOINTS"); len(addrs) > 0 {
+		checkColl.checks["tcpConnect"] = &tcpCheck{addrs: addrs, timeout: networkTimeout}
+	}
+	if maxLatency := config.SecondsEnvOrDefault(0, "HOSTCHECK_DOCKER_MAX_LATENCY"); maxLatency > 0 {
+		checkColl.checks["dockerLatency"] = &latencyCheck{runtime: client.Runtime(), maxLatency: maxLatency}
+	}
+	if maxSkew := config.SecondsEnvOrDefault(0, "HOSTCHECK_CLOCK_MAX_SKEW"); maxSkew > 0 && endpoints != nil {
+		checkColl.checks["clockSkew"] = &clockSkewCheck{endpoints: endpoints, maxSkew: maxSkew, timeout: networkTimeout}
+	}
+	if minAvailable := config.IntEnvOrDefault(0, "HOSTCHECK_MEMORY_MIN_AVAILABLE"); minAvailable > 0 {
+		checkColl.checks["memoryPressure"] = &memoryCheck{minAvailablePercent: float64(minAvailable)}
+	}
+	for _, check := range execChecksFromEnv() {
+		if _, ok := checkColl.checks[check.name]; ok {
+			bslog.Warnf("[host check] ignoring exec check %q: name already in use", check.name)
+			continue
+		}
+		checkColl.checks[check.name] = check
+	}
+	for name, check := range checkColl.checks {
+		if execCheck, ok := check.(*execCheck); ok {
+			checkColl.states[name] = &checkState{interval: execCheck.interval}
+			continue
+		}
+		checkColl.states[name] = &checkState{
+			timeout:  checkDurationEnv(name, "TIMEOUT", hostCheckTimeout),
+			interval: checkDurationEnv(name, "INTERVAL", 0),
+		}
+	}
 	return checkColl
 }
 
+// checkDurationEnv returns the duration in seconds set in
+// HOSTCHECK_<NAME>_<setting> for the check, or defaultValue.
+func checkDurationEnv(name, setting string, defaultValue time.Duration) time.Duration {
+	env := "HOSTCHECK_" + envName(name) + "_" + setting
+	if os.Getenv(env) == "" {
+		return defaultValue
+	}
+	return config.SecondsEnvOrDefault(defaultValue.Seconds(), env)
+}
+
+// percentsPerPathEnv parses a list of path:percent entries in env, invalid
+// entries are ignored.
+func percentsPerPathEnv(env string) map[string]float64 {
+	result := map[string]float64{}
+	for _, entry := range config.StringsEnvOrDefault(nil, env) {
+		i := strings.LastIndex(entry, ":")
+		if i <= 0 {
+			bslog.Warnf("invalid entry %q in %s, expected path:percent", entry, env)
+			continue
+		}
+		percent, err := strconv.ParseFloat(entry[i+1:], 64)
+		if err != nil || percent < 0 || percent > 100 {
+			bslog.Warnf("invalid entry %q in %s, expected path:percent", entry, env)
+			continue
+		}
+		result[entry[:i]] = percent
+	}
+	return result
+}
+
+// Run runs the checks concurrently, returning their results sorted by name.
+// Checks with an interval run in the background instead, started on the first
+// call, and their last result is returned.
 func (c *checkCollection) Run() []hostCheckResult {
-	result := make([]hostCheckResult, len(c.checks))
-	i := 0
-	for name, check := range c.checks {
-		checkResult := hostCheckResult{Name: name}
-		if c.errChannels[name] == nil {
-			c.errChannels[name] = make(chan error)
-			go func(hc hostCheck, errCh chan error) {
-				errCh <- hc.Run()
-			}(check, c.errChannels[name])
-		}
-		var timeoutCh <-chan time.Time
-		if c.timeout > 0 {
-			timeoutCh = time.After(c.timeout)
+	c.startOnce.Do(c.startScheduled)
+	names := make([]string, 0, len(c.checks))
+	for name := range c.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]hostCheckResult, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			state := c.state(name)
+			if state.ready == nil {
+				result[i] = c.runCheck(name)
+				return
+			}
+			<-state.ready
+			c.mu.Lock()
+			result[i] = *state.last
+			c.mu.Unlock()
+		}(i, name)
+	}
+	wg.Wait()
+	return result
+}
+
+// startScheduled starts running the checks with an interval in the
+// background, until Stop is called.
+func (c *checkCollection) startScheduled() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.quit = make(chan struct{})
+	for name, state := range c.states {
+		if state.interval > 0 {
+			state.ready = make(chan struct{})
+			go c.runScheduled(name, state, c.quit)
 		}
+	}
+}
+
+func (c *checkCollection) runScheduled(name string, state *checkState, quit <-chan struct{}) {
+	ticker := time.NewTicker(state.interval)
+	defer ticker.Stop()
+	c.runCheck(name)
+	close(state.ready)
+	for {
 		select {
-		case err := <-c.errChannels[name]:
-			checkResult.Successful = err == nil
-			if err != nil {
-				bslog.Errorf("[host check] failure running %q check: %s", name, err)
-				checkResult.Err = err.Error()
-			}
-			c.errChannels[name] = nil
-		case <-timeoutCh:
-			checkResult.Successful = false
-			errMsg := fmt.Sprintf("[host check] timeout running %q check", name)
-			bslog.Errorf(errMsg)
-			checkResult.Err = errMsg
+		case <-quit:
+			return
+		case <-ticker.C:
+			c.runCheck(name)
+		}
+	}
+}
+
+// Stop stops running the checks with an interval in the background, Run
+// must not be called afterwards.
+func (c *checkCollection) Stop() {
+	c.startOnce.Do(func() {})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.quit != nil {
+		close(c.quit)
+		c.quit = nil
+	}
+}
+
+// Last returns the last result of each check that already ran, sorted by
+// name, without running them.
+func (c *checkCollection) Last() []hostCheckResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var result []hostCheckResult
+	for _, state := range c.states {
+		if state.last != nil {
+			result = append(result, *state.last)
 		}
-		result[i] = checkResult
-		i++
 	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
 	return result
 }
 
+func (c *checkCollection) state(name string) *checkState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.states == nil {
+		c.states = make(map[string]*checkState)
+	}
+	state, ok := c.states[name]
+	if !ok {
+		state = &checkState{timeout: c.timeout}
+		c.states[name] = state
+	}
+	return state
+}
+
+func (c *checkCollection) runCheck(name string) hostCheckResult {
+	state := c.state(name)
+	if state.pending == nil {
+		pending := make(chan error, 1)
+		state.pending = pending
+		state.started = time.Now()
+		go func(hc hostCheck) {
+			pending <- hc.Run()
+		}(c.checks[name])
+	}
+	var timeoutCh <-chan time.Time
+	if state.timeout > 0 {
+		timeoutCh = time.After(state.timeout)
+	}
+	checkResult := hostCheckResult{Name: name, LastRun: state.started}
+	select {
+	case err := <-state.pending:
+		state.pending = nil
+		checkResult.Successful = err == nil
+		if warning, ok := err.(*checkWarning); ok {
+			bslog.Warnf("[host check] warning running %q check: %s", name, warning)
+			checkResult.Successful = true
+			checkResult.Err = warning.Error()
+		} else if err != nil {
+			bslog.Errorf("[host check] failure running %q check: %s", name, err)
+			checkResult.Err = err.Error()
+		}
+	case <-timeoutCh:
+		checkResult.Successful = false
+		errMsg := fmt.Sprintf("[host check] timeout running %q check", name)
+		bslog.Errorf(errMsg)
+		checkResult.Err = errMsg
+	}
+	checkResult.Duration = time.Since(state.started).Seconds()
+	c.mu.Lock()
+	state.last = &checkResult
+	c.mu.Unlock()
+	return checkResult
+}
+
 type writableCheck struct {
 	path string
 }
@@ -120,7 +343,7 @@ func (c *writableCheck) Run() error {
 }
 
 type createContainerCheck struct {
-	client     *docker.Client
+	client     *container.InfoClient
 	baseContID string
 	message    string
 }
@@ -146,56 +369,223 @@ func (c *createContainerCheck) setBaseContainerID() error {
 	return nil
 }
 
+// removeContainerNamed removes the containers left by previous runs, looking
+// their IDs up by name as runtimes like CRI only remove containers by ID.
+func (c *createContainerCheck) removeContainerNamed(name string) error {
+	containers, err := c.client.ListAllContainers()
+	if err != nil {
+		return err
+	}
+	for _, cont := range containers {
+		for _, contName := range cont.Names {
+			if strings.TrimPrefix(contName, "/") == name {
+				err = c.client.RemoveContainer(cont.ID)
+				if err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// containerRunner is implemented by runtimes able to run a created container
+// and return its output.
+type containerRunner interface {
+	RunContainer(id string) (string, error)
+}
+
 func (c *createContainerCheck) Run() error {
 	err := c.setBaseContainerID()
 	if err != nil {
 		return err
 	}
 	contName := "bs-hostcheck-container"
-	removeErr := c.client.RemoveContainer(docker.RemoveContainerOptions{ID: contName, Force: true})
-	baseContInfo, err := c.client.InspectContainer(c.baseContID)
+	removeErr := c.removeContainerNamed(contName)
+	baseCont, err := c.client.GetContainer(c.baseContID, false, nil)
 	if err != nil {
 		return err
 	}
-	opts := docker.CreateContainerOptions{
-		Name: "bs-hostcheck-container",
-		Config: &docker.Config{
-			AttachStdout: true,
-			AttachStderr: true,
-			Image:        baseContInfo.Image,
-			Entrypoint:   []string{},
-			Cmd:          []string{"echo", "-n", c.message},
-		},
-	}
-	cont, err := c.client.CreateContainer(opts)
+	contID, err := c.client.CreateContainer(container.CreateOptions{
+		Name: contName,
+		Base: &baseCont.Container,
+		Cmd:  []string{"echo", "-n", c.message},
+	})
 	if err != nil {
 		if err == docker.ErrContainerAlreadyExists && removeErr != nil {
 			return fmt.Errorf("failed to remove old container: %v", removeErr)
 		}
 		return err
 	}
-	output := bytes.NewBuffer(nil)
-	defer c.client.RemoveContainer(docker.RemoveContainerOptions{ID: cont.ID, Force: true})
-	attachOptions := docker.AttachToContainerOptions{
-		Container:    cont.ID,
-		OutputStream: output,
-		Stream:       true,
-		Stdout:       true,
-		Success:      make(chan struct{}),
+	defer c.client.RemoveContainer(contID)
+	runner, ok := c.client.Runtime().(containerRunner)
+	if !ok {
+		return nil
 	}
-	waiter, err := c.client.AttachToContainerNonBlocking(attachOptions)
+	output, err := runner.RunContainer(contID)
 	if err != nil {
 		return err
 	}
-	<-attachOptions.Success
-	close(attachOptions.Success)
-	err = c.client.StartContainer(cont.ID, nil)
+	if output != c.message {
+		return fmt.Errorf("unexpected container response: %q", output)
+	}
+	return nil
+}
+
+type diskSpaceCheck struct {
+	path                 string
+	minFreePercent       float64
+	minFreeInodesPercent float64
+}
+
+func (c *diskSpaceCheck) Run() error {
+	usage, err := disk.DiskUsage(c.path)
 	if err != nil {
 		return err
 	}
-	waiter.Wait()
-	if output.String() != c.message {
-		return fmt.Errorf("unexpected container response: %q", output.String())
+	if usage.Total > 0 {
+		free := float64(usage.Free) * 100 / float64(usage.Total)
+		if free < c.minFreePercent {
+			return fmt.Errorf("%.1f%% of disk space free in %s, expected at least %.1f%%", free, c.path, c.minFreePercent)
+		}
+	}
+	if usage.InodesTotal > 0 {
+		free := float64(usage.InodesFree) * 100 / float64(usage.InodesTotal)
+		if free < c.minFreeInodesPercent {
+			return fmt.Errorf("%.1f%% of inodes free in %s, expected at least %.1f%%", free, c.path, c.minFreeInodesPercent)
+		}
+	}
+	return nil
+}
+
+type dnsCheck struct {
+	names   []string
+	timeout time.Duration
+}
+
+func (c *dnsCheck) Run() error {
+	var failures []string
+	for _, name := range c.names {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		addrs, err := net.DefaultResolver.LookupHost(ctx, name)
+		cancel()
+		if err == nil && len(addrs) == 0 {
+			err = errors.New("no addresses found")
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("unable to resolve names: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+type tcpCheck struct {
+	addrs   []string
+	timeout time.Duration
+}
+
+func (c *tcpCheck) Run() error {
+	var failures []string
+	for _, addr := range c.addrs {
+		conn, err := net.DialTimeout("tcp", dialAddr(addr), c.timeout)
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		conn.Close()
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("unable to connect: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// dialAddr returns the host:port to dial for addr, which may also be an url
+// with the port implied by its scheme.
+func dialAddr(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return addr
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+type latencyCheck struct {
+	runtime    container.Runtime
+	maxLatency time.Duration
+}
+
+func (c *latencyCheck) Run() error {
+	start := time.Now()
+	_, err := c.runtime.ListContainers(false)
+	if err != nil {
+		return err
+	}
+	if latency := time.Since(start); latency > c.maxLatency {
+		return fmt.Errorf("listing containers took %s, expected at most %s", latency, c.maxLatency)
+	}
+	return nil
+}
+
+type clockSkewCheck struct {
+	endpoints *endpoint.Pool
+	maxSkew   time.Duration
+	timeout   time.Duration
+}
+
+// Run compares the local clock to the Date header sent by the tsuru API,
+// assuming the header was generated halfway through the request.
+func (c *clockSkewCheck) Run() error {
+	start := time.Now()
+	resp, err := c.endpoints.Do("GET", "/", nil, nil, c.timeout)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	end := time.Now()
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return fmt.Errorf("invalid Date header in tsuru API response: %q", resp.Header.Get("Date"))
+	}
+	// The Date header has second precision.
+	remote := date.Add(500 * time.Millisecond)
+	local := start.Add(end.Sub(start) / 2)
+	skew := local.Sub(remote)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > c.maxSkew+500*time.Millisecond {
+		return fmt.Errorf("clock is %s off the tsuru API clock, expected at most %s", skew.Truncate(time.Millisecond), c.maxSkew)
+	}
+	return nil
+}
+
+type memoryCheck struct {
+	minAvailablePercent float64
+}
+
+func (c *memoryCheck) Run() error {
+	memory, err := mem.VirtualMemory()
+	if err != nil {
+		return err
+	}
+	if memory.Total == 0 {
+		return errors.New("unable to read memory usage")
+	}
+	available := float64(memory.Available) * 100 / float64(memory.Total)
+	if available < c.minAvailablePercent {
+		return fmt.Errorf("%.1f%% of memory available, expected at least %.1f%%", available, c.minAvailablePercent)
 	}
 	return nil
 }
@@ -5,15 +5,26 @@
 package status
 
 import (
+	"bytes"
+	"errors"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/bs/container"
+	"github.com/tsuru/bs/container/containertest"
+	"github.com/tsuru/bs/endpoint"
+	"github.com/tsuru/bs/telemetry"
 	"gopkg.in/check.v1"
 )
 
 func (s S) TestNewCheckCollection(c *check.C) {
-	checkColl := NewCheckCollection(nil)
+	checkColl := NewCheckCollection(nil, nil)
 	c.Assert(checkColl.checks, check.HasLen, 2)
 	writableCheck := checkColl.checks["writableRoot"].(*writableCheck)
 	ccCheck := checkColl.checks["createContainer"].(*createContainerCheck)
@@ -21,12 +32,14 @@ func (s S) TestNewCheckCollection(c *check.C) {
 	c.Assert(ccCheck.baseContID, check.Equals, "")
 	c.Assert(ccCheck.client, check.IsNil)
 	c.Assert(ccCheck.message, check.Equals, "ok")
+	c.Assert(checkColl.timeout, check.Equals, 30*time.Second)
+	c.Assert(checkColl.states["createContainer"].timeout, check.Equals, 30*time.Second)
 }
 
 func (s S) TestNewCheckCollectionExtraPaths(c *check.C) {
 	os.Setenv("HOSTCHECK_EXTRA_PATHS", "/var/log, /var/lib/docker")
 	defer os.Unsetenv("HOSTCHECK_EXTRA_PATHS")
-	checkColl := NewCheckCollection(nil)
+	checkColl := NewCheckCollection(nil, nil)
 	c.Assert(checkColl.checks, check.HasLen, 4)
 	writableCheck1, ok := checkColl.checks["writableCustomPath1"].(*writableCheck)
 	c.Assert(ok, check.Equals, true)
@@ -39,7 +52,7 @@ func (s S) TestNewCheckCollectionExtraPaths(c *check.C) {
 func (s S) TestNewCheckCollectionBaseContainerName(c *check.C) {
 	os.Setenv("HOSTCHECK_BASE_CONTAINER_NAME", "big-sibling")
 	defer os.Unsetenv("HOSTCHECK_BASE_CONTAINER_NAME")
-	checkColl := NewCheckCollection(nil)
+	checkColl := NewCheckCollection(nil, nil)
 	c.Assert(checkColl.checks, check.HasLen, 2)
 	ccCheck := checkColl.checks["createContainer"].(*createContainerCheck)
 	c.Assert(ccCheck.baseContID, check.Equals, "big-sibling")
@@ -69,8 +82,10 @@ func (s S) TestCreateContainerCheckRun(c *check.C) {
 	client, err := docker.NewClient(dockerServer.URL())
 	c.Assert(err, check.IsNil)
 	done := stopContainer(client, conts[0].ID, c)
+	infoClient, err := container.NewClient(dockerServer.URL())
+	c.Assert(err, check.IsNil)
 	contCheck := createContainerCheck{
-		client:     client,
+		client:     infoClient,
 		baseContID: conts[0].ID,
 		message:    "Container is not running\nWhat happened?\nSomething happened\n",
 	}
@@ -79,6 +94,41 @@ func (s S) TestCreateContainerCheckRun(c *check.C) {
 	<-done
 }
 
+func (s S) TestCreateContainerCheckRunCreateOnly(c *check.C) {
+	runtime := containertest.NewFakeRuntime()
+	baseID := runtime.AddContainer(docker.Container{
+		Name:   "/x1",
+		Config: &docker.Config{Image: "tsuru/python"},
+		State:  docker.State{Running: true},
+	})
+	oldID := runtime.AddContainer(docker.Container{Name: "/bs-hostcheck-container"})
+	infoClient, err := container.NewClientWithRuntime(runtime)
+	c.Assert(err, check.IsNil)
+	contCheck := createContainerCheck{client: infoClient, baseContID: "x1", message: "ok"}
+	err = contCheck.Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(runtime.Removed, check.HasLen, 2)
+	c.Assert(runtime.Removed[0], check.Equals, oldID)
+	containers, err := runtime.ListContainers(true)
+	c.Assert(err, check.IsNil)
+	c.Assert(containers, check.HasLen, 1)
+	c.Assert(containers[0].ID, check.Equals, baseID)
+	var buf bytes.Buffer
+	err = telemetry.Default.Write(&buf)
+	c.Assert(err, check.IsNil)
+	for _, call := range []string{"list_all", "inspect", "create", "remove"} {
+		c.Assert(buf.String(), check.Matches, `(?s).*\nbs_container_api_call_duration_seconds_count\{call="`+call+`"\} \d+\n.*`)
+	}
+}
+
+func (s S) TestCreateContainerCheckRunBaseNotFound(c *check.C) {
+	infoClient, err := container.NewClientWithRuntime(containertest.NewFakeRuntime())
+	c.Assert(err, check.IsNil)
+	contCheck := createContainerCheck{client: infoClient, baseContID: "x1", message: "ok"}
+	err = contCheck.Run()
+	c.Assert(err, check.ErrorMatches, "No such container: x1")
+}
+
 func (s S) TestCheckCollectionRun(c *check.C) {
 	baseConts := []bogusContainer{
 		{name: "x1", config: docker.Config{Image: "tsuru/python"}, state: docker.State{Running: true}},
@@ -96,7 +146,9 @@ func (s S) TestCheckCollectionRun(c *check.C) {
 	defer os.Unsetenv("HOSTCHECK_ROOT_PATH_OVERRIDE")
 	defer os.Unsetenv("HOSTCHECK_BASE_CONTAINER_NAME")
 	defer os.Unsetenv("HOSTCHECK_CONTAINER_MESSAGE")
-	checkColl := NewCheckCollection(client)
+	infoClient, err := container.NewClient(dockerServer.URL())
+	c.Assert(err, check.IsNil)
+	checkColl := NewCheckCollection(infoClient, nil)
 	results := checkColl.Run()
 	for _, result := range results {
 		c.Assert(result.Err, check.Equals, "")
@@ -110,8 +162,6 @@ func (s S) TestCheckCollectionRunTimeout(c *check.C) {
 		{name: "x1", config: docker.Config{Image: "tsuru/python"}, state: docker.State{Running: true}},
 	}
 	dockerServer, _ := s.startDockerServer(baseConts, nil, c)
-	client, err := docker.NewClient(dockerServer.URL())
-	c.Assert(err, check.IsNil)
 	tmpdir, err := ioutil.TempDir("", "hostcheck")
 	c.Assert(err, check.IsNil)
 	defer os.RemoveAll(tmpdir)
@@ -123,10 +173,14 @@ func (s S) TestCheckCollectionRunTimeout(c *check.C) {
 	defer os.Unsetenv("HOSTCHECK_ROOT_PATH_OVERRIDE")
 	defer os.Unsetenv("HOSTCHECK_BASE_CONTAINER_NAME")
 	defer os.Unsetenv("HOSTCHECK_CONTAINER_MESSAGE")
-	checkColl := NewCheckCollection(client)
+	infoClient, err := container.NewClient(dockerServer.URL())
+	c.Assert(err, check.IsNil)
+	checkColl := NewCheckCollection(infoClient, nil)
 	results := checkColl.Run()
 	resultsMap := map[string]hostCheckResult{}
 	for _, result := range results {
+		c.Assert(result.LastRun.IsZero(), check.Equals, false)
+		result.Duration, result.LastRun = 0, time.Time{}
 		resultsMap[result.Name] = result
 	}
 	c.Assert(resultsMap, check.DeepEquals, map[string]hostCheckResult{
@@ -154,3 +208,238 @@ func stopContainer(client *docker.Client, exceptID string, c *check.C) chan bool
 	}()
 	return done
 }
+
+func (s S) TestNewCheckCollectionOptionalChecks(c *check.C) {
+	envs := map[string]string{
+		"HOSTCHECK_DISK_MIN_FREE":        "/:10, /var/lib/docker:15, invalid, /tmp:200",
+		"HOSTCHECK_INODES_MIN_FREE":      "/var/lib/docker:5, /data:2.5",
+		"HOSTCHECK_DNS_NAMES":            "registry.example.com, tsuru.example.com",
+		"HOSTCHECK_TCP_ENDPOINTS":        "registry.example.com:5000, https://tsuru.example.com",
+		"HOSTCHECK_NETWORK_TIMEOUT":      "2",
+		"HOSTCHECK_DOCKER_MAX_LATENCY":   "1.5",
+		"HOSTCHECK_CLOCK_MAX_SKEW":       "3",
+		"HOSTCHECK_MEMORY_MIN_AVAILABLE": "5",
+	}
+	for k, v := range envs {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	runtime := containertest.NewFakeRuntime()
+	infoClient, err := container.NewClientWithRuntime(runtime)
+	c.Assert(err, check.IsNil)
+	endpoints, err := endpoint.NewPool([]string{"http://tsuru.example.com"}, nil, time.Second)
+	c.Assert(err, check.IsNil)
+	checkColl := NewCheckCollection(infoClient, endpoints)
+	c.Assert(checkColl.checks, check.HasLen, 10)
+	c.Assert(checkColl.checks["diskSpace:/"], check.DeepEquals, &diskSpaceCheck{path: "/", minFreePercent: 10})
+	c.Assert(checkColl.checks["diskSpace:/var/lib/docker"], check.DeepEquals, &diskSpaceCheck{path: "/var/lib/docker", minFreePercent: 15, minFreeInodesPercent: 5})
+	c.Assert(checkColl.checks["diskSpace:/data"], check.DeepEquals, &diskSpaceCheck{path: "/data", minFreeInodesPercent: 2.5})
+	c.Assert(checkColl.checks["dnsResolution"], check.DeepEquals, &dnsCheck{names: []string{"registry.example.com", "tsuru.example.com"}, timeout: 2 * time.Second})
+	c.Assert(checkColl.checks["tcpConnect"], check.DeepEquals, &tcpCheck{addrs: []string{"registry.example.com:5000", "https://tsuru.example.com"}, timeout: 2 * time.Second})
+	c.Assert(checkColl.checks["dockerLatency"], check.DeepEquals, &latencyCheck{runtime: runtime, maxLatency: 1500 * time.Millisecond})
+	c.Assert(checkColl.checks["clockSkew"], check.DeepEquals, &clockSkewCheck{endpoints: endpoints, maxSkew: 3 * time.Second, timeout: 2 * time.Second})
+	c.Assert(checkColl.checks["memoryPressure"], check.DeepEquals, &memoryCheck{minAvailablePercent: 5})
+	checkColl = NewCheckCollection(infoClient, nil)
+	c.Assert(checkColl.checks["clockSkew"], check.IsNil)
+}
+
+func (s S) TestDiskSpaceCheckRun(c *check.C) {
+	dir, err := os.Getwd()
+	c.Assert(err, check.IsNil)
+	diskCheck := diskSpaceCheck{path: dir}
+	c.Assert(diskCheck.Run(), check.IsNil)
+	diskCheck = diskSpaceCheck{path: dir, minFreePercent: 100.1}
+	c.Assert(diskCheck.Run(), check.ErrorMatches, `[0-9.]+% of disk space free in .*, expected at least 100.1%`)
+	diskCheck = diskSpaceCheck{path: "/some/invalid/dir/dont/create/it"}
+	c.Assert(diskCheck.Run(), check.ErrorMatches, "no such file or directory")
+}
+
+func (s S) TestMemoryCheckRun(c *check.C) {
+	memCheck := memoryCheck{minAvailablePercent: 0.001}
+	c.Assert(memCheck.Run(), check.IsNil)
+	memCheck = memoryCheck{minAvailablePercent: 100.1}
+	c.Assert(memCheck.Run(), check.ErrorMatches, `[0-9.]+% of memory available, expected at least 100.1%`)
+}
+
+func (s S) TestDNSCheckRun(c *check.C) {
+	dnsCheck := dnsCheck{names: []string{"localhost"}, timeout: time.Second}
+	c.Assert(dnsCheck.Run(), check.IsNil)
+	dnsCheck.names = append(dnsCheck.names, "bs-hostcheck.invalid")
+	c.Assert(dnsCheck.Run(), check.ErrorMatches, `unable to resolve names: bs-hostcheck\.invalid: .*`)
+}
+
+func (s S) TestTCPCheckRun(c *check.C) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	tcpCheck := tcpCheck{addrs: []string{server.URL, server.Listener.Addr().String()}, timeout: time.Second}
+	c.Assert(tcpCheck.Run(), check.IsNil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	closedAddr := listener.Addr().String()
+	listener.Close()
+	tcpCheck.addrs = append(tcpCheck.addrs, closedAddr)
+	c.Assert(tcpCheck.Run(), check.ErrorMatches, `unable to connect: dial tcp .*: connection refused`)
+}
+
+func (s S) TestDialAddr(c *check.C) {
+	tests := map[string]string{
+		"registry.example.com:5000":      "registry.example.com:5000",
+		"http://tsuru.example.com":       "tsuru.example.com:80",
+		"https://tsuru.example.com":      "tsuru.example.com:443",
+		"https://tsuru.example.com:8443": "tsuru.example.com:8443",
+		"tcp://10.0.0.1:2375":            "10.0.0.1:2375",
+	}
+	for addr, expected := range tests {
+		c.Check(dialAddr(addr), check.Equals, expected, check.Commentf(addr))
+	}
+}
+
+func (s S) TestLatencyCheckRun(c *check.C) {
+	latencyCheck := latencyCheck{runtime: containertest.NewFakeRuntime(), maxLatency: time.Minute}
+	c.Assert(latencyCheck.Run(), check.IsNil)
+	latencyCheck.maxLatency = time.Nanosecond
+	c.Assert(latencyCheck.Run(), check.ErrorMatches, `listing containers took .*, expected at most 1ns`)
+}
+
+func (s S) TestClockSkewCheckRun(c *check.C) {
+	var date atomic.Value
+	date.Store(time.Now())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", date.Load().(time.Time).UTC().Format(http.TimeFormat))
+	}))
+	defer server.Close()
+	endpoints, err := endpoint.NewPool([]string{server.URL}, nil, time.Second)
+	c.Assert(err, check.IsNil)
+	skewCheck := clockSkewCheck{endpoints: endpoints, maxSkew: 2 * time.Second, timeout: time.Second}
+	c.Assert(skewCheck.Run(), check.IsNil)
+	date.Store(time.Now().Add(-time.Hour))
+	c.Assert(skewCheck.Run(), check.ErrorMatches, `clock is 59m5[0-9.]+s off the tsuru API clock, expected at most 2s|clock is 1h0m[0-9.]+s off the tsuru API clock, expected at most 2s`)
+}
+
+type funcCheck func() error
+
+func (f funcCheck) Run() error {
+	return f()
+}
+
+func (s S) TestCheckCollectionRunParallel(c *check.C) {
+	sleepCheck := funcCheck(func() error {
+		time.Sleep(300 * time.Millisecond)
+		return nil
+	})
+	checkColl := &checkCollection{checks: map[string]hostCheck{"c": sleepCheck, "a": sleepCheck, "b": sleepCheck}}
+	start := time.Now()
+	results := checkColl.Run()
+	c.Assert(time.Since(start) < 600*time.Millisecond, check.Equals, true)
+	c.Assert(results, check.HasLen, 3)
+	for i, name := range []string{"a", "b", "c"} {
+		c.Assert(results[i].Name, check.Equals, name)
+		c.Assert(results[i].Successful, check.Equals, true)
+		c.Assert(results[i].Duration >= 0.3, check.Equals, true)
+		c.Assert(results[i].LastRun.After(start.Add(-time.Millisecond)), check.Equals, true)
+	}
+}
+
+func (s S) TestCheckCollectionRunPerCheckTimeout(c *check.C) {
+	release := make(chan struct{})
+	checkColl := &checkCollection{
+		checks: map[string]hostCheck{
+			"fast": funcCheck(func() error { return nil }),
+			"slow": funcCheck(func() error {
+				<-release
+				return errors.New("slow failure")
+			}),
+		},
+		states: map[string]*checkState{
+			"slow": {timeout: 100 * time.Millisecond},
+		},
+	}
+	results := checkColl.Run()
+	c.Assert(results[0].Successful, check.Equals, true)
+	c.Assert(results[1].Successful, check.Equals, false)
+	c.Assert(results[1].Err, check.Equals, `[host check] timeout running "slow" check`)
+	firstRun := results[1].LastRun
+	close(release)
+	results = checkColl.Run()
+	c.Assert(results[1].Err, check.Equals, "slow failure")
+	c.Assert(results[1].LastRun, check.Equals, firstRun)
+	results = checkColl.Run()
+	c.Assert(results[1].Err, check.Equals, "slow failure")
+	c.Assert(results[1].LastRun.After(firstRun), check.Equals, true)
+}
+
+func (s S) TestCheckCollectionRunInterval(c *check.C) {
+	var runs int32
+	checkColl := &checkCollection{
+		checks: map[string]hostCheck{
+			"scheduled": funcCheck(func() error {
+				atomic.AddInt32(&runs, 1)
+				return errors.New("failed")
+			}),
+			"unscheduled": funcCheck(func() error { return nil }),
+		},
+		states: map[string]*checkState{
+			"scheduled": {interval: 200 * time.Millisecond},
+		},
+	}
+	defer checkColl.Stop()
+	first := checkColl.Run()
+	second := checkColl.Run()
+	c.Assert(atomic.LoadInt32(&runs), check.Equals, int32(1))
+	c.Assert(second[0], check.DeepEquals, first[0])
+	c.Assert(second[0].Err, check.Equals, "failed")
+	c.Assert(second[1].LastRun.After(first[1].LastRun), check.Equals, true)
+	time.Sleep(500 * time.Millisecond)
+	c.Assert(atomic.LoadInt32(&runs), check.Equals, int32(3))
+	third := checkColl.Run()
+	c.Assert(third[0].LastRun.After(first[0].LastRun), check.Equals, true)
+	checkColl.Stop()
+	time.Sleep(300 * time.Millisecond)
+	c.Assert(atomic.LoadInt32(&runs), check.Equals, int32(3))
+}
+
+func (s S) TestCheckCollectionRunIntervalDoesNotWait(c *check.C) {
+	var runs int32
+	release := make(chan struct{})
+	checkColl := &checkCollection{
+		checks: map[string]hostCheck{
+			"scheduled": funcCheck(func() error {
+				if atomic.AddInt32(&runs, 1) > 1 {
+					<-release
+				}
+				return nil
+			}),
+		},
+		states: map[string]*checkState{
+			"scheduled": {interval: 50 * time.Millisecond},
+		},
+	}
+	defer close(release)
+	defer checkColl.Stop()
+	first := checkColl.Run()
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(atomic.LoadInt32(&runs), check.Equals, int32(2))
+	start := time.Now()
+	second := checkColl.Run()
+	c.Assert(time.Since(start) < 50*time.Millisecond, check.Equals, true)
+	c.Assert(second, check.DeepEquals, first)
+	c.Assert(second[0].Successful, check.Equals, true)
+}
+
+func (s S) TestNewCheckCollectionSchedules(c *check.C) {
+	envs := map[string]string{
+		"HOSTCHECK_TIMEOUT":                  "10",
+		"HOSTCHECK_CREATECONTAINER_TIMEOUT":  "60",
+		"HOSTCHECK_CREATECONTAINER_INTERVAL": "300",
+		"HOSTCHECK_WRITABLEROOT_INTERVAL":    "invalid",
+	}
+	for k, v := range envs {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	checkColl := NewCheckCollection(nil, nil)
+	c.Assert(checkColl.states, check.DeepEquals, map[string]*checkState{
+		"writableRoot":    {timeout: 10 * time.Second},
+		"createContainer": {timeout: time.Minute, interval: 5 * time.Minute},
+	})
+}
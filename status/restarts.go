@@ -0,0 +1,59 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package status
+
+import (
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// restartHistory is the last restart count seen for a container and when it
+// increased, within the crash loop window.
+type restartHistory struct {
+	count    int
+	restarts []time.Time
+}
+
+// isCrashLooping records the restart count of the container, returning
+// whether it was restarted at least CrashLoopRestarts times within
+// CrashLoopWindow. The first count seen for a container is the baseline, as
+// there's no way to know when previous restarts happened.
+func (r *Reporter) isCrashLooping(id string, restartCount int, now time.Time) bool {
+	if r.config.CrashLoopRestarts <= 0 {
+		return false
+	}
+	history, ok := r.restarts[id]
+	if !ok {
+		r.restarts[id] = &restartHistory{count: restartCount}
+		return false
+	}
+	if restartCount < history.count {
+		history.restarts = nil
+	}
+	for i := history.count; i < restartCount && i-history.count < r.config.CrashLoopRestarts; i++ {
+		history.restarts = append(history.restarts, now)
+	}
+	history.count = restartCount
+	cutoff := now.Add(-r.config.CrashLoopWindow)
+	for len(history.restarts) > 0 && history.restarts[0].Before(cutoff) {
+		history.restarts = history.restarts[1:]
+	}
+	return len(history.restarts) >= r.config.CrashLoopRestarts
+}
+
+// pruneRestarts forgets the restarts of containers not in the list of all
+// containers.
+func (r *Reporter) pruneRestarts(containers []docker.APIContainers) {
+	existing := make(map[string]struct{}, len(containers))
+	for _, c := range containers {
+		existing[c.ID] = struct{}{}
+	}
+	for id := range r.restarts {
+		if _, ok := existing[id]; !ok {
+			delete(r.restarts, id)
+		}
+	}
+}
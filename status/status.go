@@ -10,7 +10,6 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"strings"
 	"sync"
@@ -20,7 +19,9 @@ import (
 	"github.com/fsouza/go-dockerclient"
 	"github.com/tsuru/bs/bslog"
 	"github.com/tsuru/bs/container"
+	"github.com/tsuru/bs/endpoint"
 	node "github.com/tsuru/bs/node"
+	"github.com/tsuru/bs/telemetry"
 	"github.com/tsuru/tsuru/provision"
 )
 
@@ -28,6 +29,18 @@ type containerStatus struct {
 	ID     string
 	Name   string
 	Status string
+	// RestartCount is the number of times the runtime restarted the
+	// container, CrashLooping is set when it keeps increasing.
+	RestartCount int  `json:",omitempty" form:",omitempty"`
+	CrashLooping bool `json:",omitempty" form:",omitempty"`
+	// ExitCode and OOMKilled describe the last exit of the container.
+	ExitCode  int       `json:",omitempty" form:",omitempty"`
+	OOMKilled bool      `json:",omitempty" form:",omitempty"`
+	StartedAt time.Time `json:",omitzero" form:",omitempty"`
+	// Health is the docker health check status and HealthOutput the output
+	// of its last probe.
+	Health       string `json:",omitempty" form:",omitempty"`
+	HealthOutput string `json:",omitempty" form:",omitempty"`
 }
 
 type respUnit struct {
@@ -40,6 +53,33 @@ type ReporterConfig struct {
 	DockerEndpoint string
 	TsuruEndpoint  string
 	TsuruToken     string
+	// TsuruEndpoints is used instead of TsuruEndpoint when set.
+	TsuruEndpoints *endpoint.Pool
+	// InfoClient is used instead of a client for DockerEndpoint when set,
+	// sharing its cache and events stream with other components. It's not
+	// closed when the reporter stops.
+	InfoClient *container.InfoClient
+	// EventsDebounce is how long to wait after a docker event changing the
+	// status of a unit before reporting it, zero disables reporting units
+	// on docker events.
+	EventsDebounce time.Duration
+	// A unit is reported as crash-looping when its container is restarted
+	// CrashLoopRestarts times within CrashLoopWindow, zero disables it.
+	CrashLoopRestarts int
+	CrashLoopWindow   time.Duration
+	// A container reported as not found by tsuru is only removed after
+	// ZombieConfirmations consecutive reports spanning ZombieGracePeriod.
+	// ZombieDryRun only logs the removals, ZombieProtectedLabels, either
+	// label names or name=value, protect containers from being removed and
+	// ZombieMaxRemovals limits the removals per report, zero is unlimited.
+	ZombieConfirmations   int
+	ZombieGracePeriod     time.Duration
+	ZombieDryRun          bool
+	ZombieProtectedLabels []string
+	ZombieMaxRemovals     int
+	// OnZombieRemoval is called after each zombie container removal, or
+	// would-be removal in dry run mode.
+	OnZombieRemoval func(ZombieEvent)
 }
 
 type Reporter struct {
@@ -49,9 +89,34 @@ type Reporter struct {
 	checks     *checkCollection
 	addrs      []string
 	infoClient *container.InfoClient
-	httpClient *http.Client
+	endpoints  *endpoint.Pool
 	mu         sync.Mutex
 	removeMap  map[string]chan struct{}
+	// reportMu serializes full reports and reports of units changed by
+	// docker events.
+	reportMu      sync.Mutex
+	eventsMu      sync.Mutex
+	eventsTimer   *time.Timer
+	eventsStopped bool
+	pendingUnits  map[string]string
+	// restarts are the restarts seen for each container, guarded by
+	// reportMu.
+	restarts map[string]*restartHistory
+	// zombies are the containers reported as not found by tsuru, guarded
+	// by reportMu.
+	zombies    map[string]*zombieState
+	lastMu     sync.Mutex
+	lastReport *ReportResult
+}
+
+// ReportResult is the outcome of a full status report.
+type ReportResult struct {
+	Time time.Time `json:"time"`
+	// Duration is how long the report took, in seconds.
+	Duration     float64 `json:"duration"`
+	Units        int     `json:"units"`
+	FailedChecks int     `json:"failed_checks"`
+	Error        string  `json:"error,omitempty"`
 }
 
 type hostStatus struct {
@@ -61,49 +126,67 @@ type hostStatus struct {
 }
 
 const (
-	dialTimeout = 10 * time.Second
 	fullTimeout = 1 * time.Minute
+
+	healthStarting  = "starting"
+	healthUnhealthy = "unhealthy"
 )
 
 var errRouteNotFound = errors.New("route not found")
 
+var (
+	reportsTotal = telemetry.NewCounterVec("bs_status_reports_total",
+		"Full status reports by result, success or error.", "result")
+	reportDuration = telemetry.NewHistogramVec("bs_status_report_duration_seconds",
+		"Duration of the full status reports.", nil)
+)
+
 // NewReporter starts the status reporter. It will run intermitently, sending a
 // message in the exit channel in case it exits. It's possible to arbitrarily
 // interrupt the reporter by sending a message in the abort channel.
 func NewReporter(config *ReporterConfig) (*Reporter, error) {
-	if config.TsuruEndpoint == "" {
-		return nil, errors.New("tsuru endpoint must be set for status reporting")
+	endpoints := config.TsuruEndpoints
+	if endpoints == nil {
+		var err error
+		endpoints, err = endpoint.NewPool(strings.Split(config.TsuruEndpoint, ","), nil, 30*time.Second)
+		if err == endpoint.ErrNoEndpoints {
+			return nil, errors.New("tsuru endpoint must be set for status reporting")
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
 	abort := make(chan struct{})
 	exit := make(chan struct{})
-	infoClient, err := container.NewClient(config.DockerEndpoint)
-	if err != nil {
-		return nil, err
+	infoClient := config.InfoClient
+	if infoClient == nil {
+		var err error
+		infoClient, err = container.NewClient(config.DockerEndpoint)
+		if err != nil {
+			return nil, err
+		}
 	}
-	checks := NewCheckCollection(infoClient.GetClient())
+	checks := NewCheckCollection(infoClient, endpoints)
 	addrs, err := node.GetNodeAddrs()
 	if err != nil {
 		return nil, fmt.Errorf("[status reporter] unable to get network addresses: %s", err)
 	}
-	transport := http.Transport{
-		Dial: (&net.Dialer{
-			Timeout:   dialTimeout,
-			KeepAlive: 30 * time.Second,
-		}).Dial,
-		TLSHandshakeTimeout: dialTimeout,
-	}
 	reporter := Reporter{
-		config:     config,
-		abort:      abort,
-		exit:       exit,
-		infoClient: infoClient,
-		checks:     checks,
-		addrs:      addrs,
-		httpClient: &http.Client{
-			Transport: &transport,
-			Timeout:   fullTimeout,
-		},
-		removeMap: make(map[string]chan struct{}),
+		config:       config,
+		abort:        abort,
+		exit:         exit,
+		infoClient:   infoClient,
+		checks:       checks,
+		addrs:        addrs,
+		endpoints:    endpoints,
+		removeMap:    make(map[string]chan struct{}),
+		pendingUnits: make(map[string]string),
+		restarts:     make(map[string]*restartHistory),
+		zombies:      make(map[string]*zombieState),
+	}
+	if config.EventsDebounce > 0 {
+		infoClient.OnEvent(reporter.handleEvent)
+		infoClient.WatchEvents()
 	}
 	go func(abort <-chan struct{}) {
 		for {
@@ -122,8 +205,10 @@ func NewReporter(config *ReporterConfig) (*Reporter, error) {
 // Stop stops the reporter. It will block until it actually stops (i.e. there's
 // no need to call Wait after calling Stop).
 func (r *Reporter) Stop() {
+	r.stopEvents()
 	close(r.abort)
 	<-r.exit
+	r.checks.Stop()
 }
 
 // Wait blocks until the reporter stops.
@@ -132,80 +217,146 @@ func (r *Reporter) Wait() {
 }
 
 func (r *Reporter) reportStatus() {
-	client := r.infoClient.GetClient()
-	opts := docker.ListContainersOptions{All: true}
-	containers, err := client.ListContainers(opts)
+	r.reportMu.Lock()
+	defer r.reportMu.Unlock()
+	result := &ReportResult{Time: time.Now()}
+	defer func() {
+		result.Duration = time.Since(result.Time).Seconds()
+		reportDuration.With().Observe(result.Duration)
+		if result.Error == "" {
+			reportsTotal.With("success").Inc()
+		} else {
+			reportsTotal.With("error").Inc()
+		}
+		r.lastMu.Lock()
+		r.lastReport = result
+		r.lastMu.Unlock()
+	}()
+	containers, err := r.infoClient.ListAllContainers()
 	if err != nil {
 		bslog.Errorf("[status reporter] failed to list containers in the Docker server at %q: %s", r.config.DockerEndpoint, err)
+		result.Error = err.Error()
 		return
 	}
 	containerStatuses := r.retrieveContainerStatuses(containers)
+	r.pruneRestarts(containers)
+	r.pruneZombies(containers)
 	hostChecks := r.checks.Run()
-	hostData := &hostStatus{
+	result.Units = len(containerStatuses)
+	for _, hostCheck := range hostChecks {
+		if !hostCheck.Successful {
+			result.FailedChecks++
+		}
+	}
+	err = r.sendStatus(&hostStatus{
 		Addrs:  r.addrs,
 		Units:  containerStatuses,
 		Checks: hostChecks,
+	}, true)
+	if err != nil {
+		result.Error = err.Error()
 	}
+}
+
+// LastReport returns the result of the last full status report, nil before
+// the first one finishes.
+func (r *Reporter) LastReport() *ReportResult {
+	r.lastMu.Lock()
+	defer r.lastMu.Unlock()
+	return r.lastReport
+}
+
+// sendStatus sends the status to tsuru, full is false for reports of only
+// some of the units, which don't confirm zombie containers.
+func (r *Reporter) sendStatus(hostData *hostStatus, full bool) error {
 	resp, err := r.updateNode(hostData)
 	if err == errRouteNotFound {
 		resp, err = r.updateUnits(hostData.Units)
 	}
 	if err != nil {
-		bslog.Errorf("[status reporter] failed to send data to the tsuru server at %q: %s", r.config.TsuruEndpoint, err)
-		return
+		bslog.Errorf("[status reporter] failed to send data to the tsuru server: %s", err)
+		return err
 	}
-	err = r.handleTsuruResponse(resp)
+	err = r.handleTsuruResponse(resp, full)
 	if err != nil {
 		bslog.Errorf("[status reporter] failed to handle tsuru response: %s", err)
 	}
+	return err
 }
 
 func (r *Reporter) retrieveContainerStatuses(containers []docker.APIContainers) []containerStatus {
 	statuses := make([]containerStatus, 0, len(containers))
+	now := time.Now()
 	for _, c := range containers {
-		var status provision.Status
 		cont, err := r.infoClient.GetAppContainer(c.ID, false)
 		if err == container.ErrTsuruVariablesNotFound {
 			continue
 		}
-		if err != nil {
-			bslog.Errorf("[status reporter] failed to inspect container %q: %s", c.ID, err)
-			status = provision.StatusError
-		} else {
-			if cont.Container.State.Restarting ||
-				cont.Container.State.Dead ||
-				cont.Container.State.RemovalInProgress {
-				status = provision.StatusError
-			} else if cont.Container.State.Running {
-				status = provision.StatusStarted
-			} else if cont.Container.State.StartedAt.IsZero() {
-				status = provision.StatusCreated
-			} else {
-				status = provision.StatusStopped
-			}
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			// Removed since listed, or since the docker event.
+			continue
 		}
 		var name string
 		if len(c.Names) > 0 {
 			name = strings.TrimPrefix(c.Names[0], "/")
 		}
-		statuses = append(statuses, containerStatus{ID: c.ID, Name: name, Status: status.String()})
+		unit := containerStatus{ID: c.ID, Name: name}
+		if err != nil {
+			bslog.Errorf("[status reporter] failed to inspect container %q: %s", c.ID, err)
+			unit.Status = provision.StatusError.String()
+		} else {
+			r.fillContainerStatus(&unit, cont, now)
+		}
+		statuses = append(statuses, unit)
 	}
 	return statuses
 }
 
+func (r *Reporter) fillContainerStatus(unit *containerStatus, cont *container.Container, now time.Time) {
+	state := cont.Container.State
+	unit.RestartCount = cont.Container.RestartCount
+	unit.CrashLooping = r.isCrashLooping(cont.ID, unit.RestartCount, now)
+	unit.ExitCode = state.ExitCode
+	unit.OOMKilled = state.OOMKilled
+	unit.StartedAt = state.StartedAt
+	if cont.Health != nil {
+		unit.Health = cont.Health.Status
+		if result := cont.Health.LastResult(); result != nil {
+			unit.HealthOutput = strings.TrimSpace(result.Output)
+		}
+	}
+	var status provision.Status
+	if unit.CrashLooping ||
+		state.Restarting ||
+		state.Dead ||
+		state.RemovalInProgress {
+		status = provision.StatusError
+	} else if state.Running {
+		switch unit.Health {
+		case healthUnhealthy:
+			status = provision.StatusError
+		case healthStarting:
+			status = provision.StatusStarting
+		default:
+			status = provision.StatusStarted
+		}
+	} else if state.StartedAt.IsZero() {
+		status = provision.StatusCreated
+	} else {
+		status = provision.StatusStopped
+	}
+	unit.Status = status.String()
+}
+
 func (r *Reporter) updateNode(payload *hostStatus) (*http.Response, error) {
 	bodyContent, err := form.EncodeToString(payload)
 	if err != nil {
 		return nil, err
 	}
-	url := fmt.Sprintf("%s/node/status", strings.TrimRight(r.config.TsuruEndpoint, "/"))
-	request, err := http.NewRequest("POST", url, strings.NewReader(bodyContent))
-	if err != nil {
-		return nil, err
-	}
-	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	request.Header.Add("Authorization", "bearer "+r.config.TsuruToken)
-	resp, err := r.httpClient.Do(request)
+	header := http.Header{}
+	header.Add("Content-Type", "application/x-www-form-urlencoded")
+	header.Add("Authorization", "bearer "+r.config.TsuruToken)
+	resp, err := r.endpoints.Do("POST", "/node/status", header, []byte(bodyContent), fullTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -221,21 +372,17 @@ func (r *Reporter) updateUnits(payload []containerStatus) (*http.Response, error
 	if err != nil {
 		return nil, err
 	}
-	url := fmt.Sprintf("%s/units/status", strings.TrimRight(r.config.TsuruEndpoint, "/"))
-	request, err := http.NewRequest("POST", url, &body)
-	if err != nil {
-		return nil, err
-	}
-	request.Header.Add("Content-Type", "application/json")
-	request.Header.Add("Authorization", "bearer "+r.config.TsuruToken)
-	resp, err := r.httpClient.Do(request)
+	header := http.Header{}
+	header.Add("Content-Type", "application/json")
+	header.Add("Authorization", "bearer "+r.config.TsuruToken)
+	resp, err := r.endpoints.Do("POST", "/units/status", header, body.Bytes(), fullTimeout)
 	if err != nil {
 		return nil, err
 	}
 	return resp, err
 }
 
-func (r *Reporter) tryRemoveContainer(id string) {
+func (r *Reporter) tryRemoveContainer(id string, done func(error)) {
 	r.mu.Lock()
 	if _, inSet := r.removeMap[id]; inSet {
 		r.mu.Unlock()
@@ -251,12 +398,13 @@ func (r *Reporter) tryRemoveContainer(id string) {
 			delete(r.removeMap, id)
 			r.mu.Unlock()
 		}()
-		client := r.infoClient.GetClient()
-		opts := docker.RemoveContainerOptions{ID: id, Force: true}
-		err := client.RemoveContainer(opts)
+		err := r.infoClient.RemoveContainer(id)
 		if err != nil {
 			bslog.Errorf("[status reporter] failed to remove invalid container %q: %s", id, err)
 		}
+		if done != nil {
+			done(err)
+		}
 	}()
 }
 
@@ -268,7 +416,7 @@ func (r *Reporter) waitPendingRemovals() {
 	}
 }
 
-func (r *Reporter) handleTsuruResponse(resp *http.Response) error {
+func (r *Reporter) handleTsuruResponse(resp *http.Response, full bool) error {
 	var statusResp []respUnit
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
@@ -279,10 +427,9 @@ func (r *Reporter) handleTsuruResponse(resp *http.Response) error {
 	if err != nil {
 		return fmt.Errorf("unable to parse tsuru response: %s", err)
 	}
-	for _, unit := range statusResp {
-		if !unit.Found {
-			r.tryRemoveContainer(unit.ID)
-		}
+	// Units missing from partial reports are not zombies.
+	if full {
+		r.handleZombies(statusResp, time.Now())
 	}
 	return nil
 }
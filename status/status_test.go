@@ -23,6 +23,8 @@ import (
 	"github.com/fsouza/go-dockerclient"
 	dtesting "github.com/fsouza/go-dockerclient/testing"
 	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/container"
+	"github.com/tsuru/bs/container/containertest"
 	"gopkg.in/check.v1"
 )
 
@@ -38,9 +40,10 @@ func (s S) TestReportStatus(c *check.C) {
 	var logOutput bytes.Buffer
 	bslog.Logger = log.New(&logOutput, "", 0)
 	defer func() { bslog.Logger = log.New(os.Stderr, "", log.LstdFlags) }()
+	startedAt := time.Now().Add(-time.Hour).UTC()
 	bogusContainers := []bogusContainer{
 		{name: "x1", config: docker.Config{Image: "tsuru/python", Env: []string{"HOME=/", "TSURU_APPNAME=someapp"}}, state: docker.State{Running: true}},
-		{name: "x2", config: docker.Config{Image: "tsuru/python", Env: []string{"HOME=/", "TSURU_APPNAME=someapp"}}, state: docker.State{Running: false, ExitCode: -1, StartedAt: time.Now().Add(-time.Hour)}},
+		{name: "x2", config: docker.Config{Image: "tsuru/python", Env: []string{"HOME=/", "TSURU_APPNAME=someapp"}}, state: docker.State{Running: false, ExitCode: -1, StartedAt: startedAt}},
 		{name: "x3", config: docker.Config{Image: "tsuru/python", Env: []string{"HOME=/", "TSURU_APPNAME=someapp"}}, state: docker.State{Running: true, Restarting: true, ExitCode: -1}},
 		{name: "x4", config: docker.Config{Image: "tsuru/python", Env: []string{"HOME=/", "TSURU_APPNAME=someapp"}}, state: docker.State{Running: true}},
 		{name: "x5", config: docker.Config{Image: "tsuru/python", Env: []string{"HOME=/"}}, state: docker.State{Running: false, ExitCode: 2}},
@@ -67,6 +70,10 @@ func (s S) TestReportStatus(c *check.C) {
 	reporter.Stop()
 	reporter.reportStatus()
 	c.Log(logOutput.String())
+	lastReport := reporter.LastReport()
+	c.Assert(lastReport, check.NotNil)
+	// The response body was consumed by the report before stopping.
+	c.Assert(lastReport.Error, check.Equals, "unable to parse tsuru response: EOF")
 	req := <-requests
 	c.Assert(req.request.Header.Get("Authorization"), check.Equals, "bearer some-token")
 	c.Assert(req.request.Header.Get("Content-Type"), check.Equals, "application/x-www-form-urlencoded")
@@ -75,8 +82,8 @@ func (s S) TestReportStatus(c *check.C) {
 	expected := hostStatus{
 		Units: []containerStatus{
 			{ID: containers[0].ID, Status: "started", Name: "x1"},
-			{ID: containers[1].ID, Status: "stopped", Name: "x2"},
-			{ID: containers[2].ID, Status: "error", Name: "x3"},
+			{ID: containers[1].ID, Status: "stopped", Name: "x2", ExitCode: -1, StartedAt: startedAt},
+			{ID: containers[2].ID, Status: "error", Name: "x3", ExitCode: -1},
 			{ID: containers[3].ID, Status: "started", Name: "x4"},
 			{ID: containers[5].ID, Status: "created", Name: "x6"},
 		},
@@ -108,9 +115,10 @@ func (s S) TestReportStatus404OnHostStatus(c *check.C) {
 	var logOutput bytes.Buffer
 	bslog.Logger = log.New(&logOutput, "", 0)
 	defer func() { bslog.Logger = log.New(os.Stderr, "", log.LstdFlags) }()
+	startedAt := time.Now().Add(-time.Hour).UTC()
 	bogusContainers := []bogusContainer{
 		{name: "x1", config: docker.Config{Image: "tsuru/python", Env: []string{"HOME=/", "TSURU_APPNAME=someapp"}}, state: docker.State{Running: true}},
-		{name: "x2", config: docker.Config{Image: "tsuru/python", Env: []string{"HOME=/", "TSURU_APPNAME=someapp"}}, state: docker.State{Running: false, ExitCode: -1, StartedAt: time.Now().Add(-time.Hour)}},
+		{name: "x2", config: docker.Config{Image: "tsuru/python", Env: []string{"HOME=/", "TSURU_APPNAME=someapp"}}, state: docker.State{Running: false, ExitCode: -1, StartedAt: startedAt}},
 		{name: "x3", config: docker.Config{Image: "tsuru/python", Env: []string{"HOME=/", "TSURU_APPNAME=someapp"}}, state: docker.State{Running: true, Restarting: true, ExitCode: -1}},
 		{name: "x4", config: docker.Config{Image: "tsuru/python", Env: []string{"HOME=/", "TSURU_APPNAME=someapp"}}, state: docker.State{Running: true}},
 		{name: "x5", config: docker.Config{Image: "tsuru/python", Env: []string{"HOME=/"}}, state: docker.State{Running: false, ExitCode: 2}},
@@ -156,8 +164,8 @@ func (s S) TestReportStatus404OnHostStatus(c *check.C) {
 	var input []containerStatus
 	expected := []containerStatus{
 		{ID: containers[0].ID, Status: "started", Name: "x1"},
-		{ID: containers[1].ID, Status: "stopped", Name: "x2"},
-		{ID: containers[2].ID, Status: "error", Name: "x3"},
+		{ID: containers[1].ID, Status: "stopped", Name: "x2", ExitCode: -1, StartedAt: startedAt},
+		{ID: containers[2].ID, Status: "error", Name: "x3", ExitCode: -1},
 		{ID: containers[3].ID, Status: "started", Name: "x4"},
 		{ID: containers[5].ID, Status: "created", Name: "x6"},
 	}
@@ -226,7 +234,8 @@ func (s S) TestReportStatusMultipleRemovals(c *check.C) {
 	resp.Body = ioutil.NopCloser(bytes.NewBuffer(data))
 	reporter.reportStatus()
 	reporter.waitPendingRemovals()
-	c.Assert(deleteCount, check.Equals, int32(6))
+	// Already removed containers are not removed again.
+	c.Assert(deleteCount, check.Equals, int32(3))
 	dockerClient, err := docker.NewClient(dockerServer.URL())
 	c.Assert(err, check.IsNil)
 	apiContainers, err := dockerClient.ListContainers(docker.ListContainersOptions{All: true})
@@ -234,6 +243,49 @@ func (s S) TestReportStatusMultipleRemovals(c *check.C) {
 	c.Assert(apiContainers, check.HasLen, 0)
 }
 
+func (s S) TestReportStatusEndpointFailover(c *check.C) {
+	var logOutput bytes.Buffer
+	bslog.Logger = log.New(&logOutput, "", 0)
+	defer func() { bslog.Logger = log.New(os.Stderr, "", log.LstdFlags) }()
+	dockerServer, _ := s.startDockerServer(nil, nil, c)
+	defer dockerServer.Stop()
+	unavailableServer, unavailableRequests := s.startTsuruServer(&http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(&bytes.Buffer{}),
+	})
+	defer unavailableServer.Close()
+	tsuruServer, requests := s.startTsuruServer(func(req *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(bytes.NewBufferString("[]")),
+		}
+	})
+	defer tsuruServer.Close()
+	reporter, err := NewReporter(&ReporterConfig{
+		Interval:       10 * time.Minute,
+		DockerEndpoint: dockerServer.URL(),
+		TsuruEndpoint:  unavailableServer.URL + "," + tsuruServer.URL,
+		TsuruToken:     "some-token",
+	})
+	c.Assert(err, check.IsNil)
+	reporter.Stop()
+	<-unavailableRequests
+	req := <-requests
+	c.Assert(req.request.URL.Path, check.Equals, "/node/status")
+	reporter.reportStatus()
+	req = <-requests
+	c.Assert(req.request.URL.Path, check.Equals, "/node/status")
+	c.Assert(req.request.Header.Get("Authorization"), check.Equals, "bearer some-token")
+	select {
+	case <-unavailableRequests:
+		c.Fatal("unexpected request to unavailable endpoint")
+	default:
+	}
+	c.Assert(logOutput.String(), check.Not(check.Matches), `(?s).*failed to send data.*`)
+}
+
 type tsuruRequest struct {
 	request *http.Request
 	body    []byte
@@ -288,3 +340,255 @@ func (S) startDockerServer(containers []bogusContainer, hook func(*http.Request)
 	}
 	return server, createdContainers
 }
+
+func (s S) TestReportStatusDockerEvents(c *check.C) {
+	startedAt := time.Now().Add(-time.Hour).UTC()
+	bogusContainers := []bogusContainer{
+		{name: "x1", config: docker.Config{Image: "tsuru/python", Env: []string{"HOME=/", "TSURU_APPNAME=someapp"}}, state: docker.State{Running: false, ExitCode: 1, StartedAt: startedAt}},
+		{name: "x2", config: docker.Config{Image: "tsuru/python", Env: []string{"HOME=/", "TSURU_APPNAME=someapp"}}, state: docker.State{Running: true}},
+		{name: "x3", config: docker.Config{Image: "tsuru/python", Env: []string{"HOME=/"}}, state: docker.State{Running: false}},
+	}
+	dockerServer, containers := s.startDockerServer(bogusContainers, nil, c)
+	defer dockerServer.Stop()
+	eventsCh := make(chan string, 10)
+	dockerServer.CustomHandler("/events", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event := <-eventsCh:
+				fmt.Fprintln(w, event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	tsuruServer, requests := s.startTsuruServer(func(req *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(bytes.NewBufferString("[]")),
+		}
+	})
+	defer tsuruServer.Close()
+	reporter, err := NewReporter(&ReporterConfig{
+		Interval:       10 * time.Minute,
+		DockerEndpoint: dockerServer.URL(),
+		TsuruEndpoint:  tsuruServer.URL,
+		TsuruToken:     "some-token",
+		EventsDebounce: 200 * time.Millisecond,
+	})
+	c.Assert(err, check.IsNil)
+	defer reporter.Stop()
+	var input hostStatus
+	req := <-requests
+	err = form.DecodeString(&input, string(req.body))
+	c.Assert(err, check.IsNil)
+	c.Assert(input.Units, check.HasLen, 2)
+	c.Assert(input.Checks, check.HasLen, 2)
+	checks := input.Checks
+	event := `{"Type": "container", "Action": "%s", "Actor": {"ID": "%s", "Attributes": {"name": "%s"}}, "time": %d}`
+	now := time.Now().Unix()
+	eventsCh <- fmt.Sprintf(event, "die", containers[0].ID, "x1", now)
+	eventsCh <- fmt.Sprintf(event, "exec_start: sh", containers[1].ID, "x2", now)
+	eventsCh <- fmt.Sprintf(event, "oom", containers[0].ID, "x1", now)
+	eventsCh <- fmt.Sprintf(event, "die", containers[2].ID, "x3", now)
+	eventsCh <- fmt.Sprintf(event, "health_status: unhealthy", containers[1].ID, "x2", now)
+	select {
+	case req = <-requests:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for status update")
+	}
+	c.Assert(req.request.URL.Path, check.Equals, "/node/status")
+	input = hostStatus{}
+	err = form.DecodeString(&input, string(req.body))
+	c.Assert(err, check.IsNil)
+	c.Assert(len(input.Addrs) > 0, check.Equals, true)
+	c.Assert(input.Checks, check.DeepEquals, checks)
+	expected := []containerStatus{
+		{ID: containers[0].ID, Status: "stopped", Name: "x1", ExitCode: 1, StartedAt: startedAt},
+		{ID: containers[1].ID, Status: "started", Name: "x2"},
+	}
+	sort.Slice(expected, func(i, j int) bool { return expected[i].ID < expected[j].ID })
+	c.Assert(input.Units, check.DeepEquals, expected)
+	select {
+	case req = <-requests:
+		c.Fatalf("unexpected request: %s", req.body)
+	case <-time.After(400 * time.Millisecond):
+	}
+}
+
+func (s S) TestReportStatusDockerEventsDebounceSharedClient(c *check.C) {
+	runtime := containertest.NewFakeRuntime()
+	id := runtime.AddContainer(docker.Container{
+		Name:   "/x1",
+		Config: &docker.Config{Env: []string{"TSURU_APPNAME=someapp"}},
+		State:  docker.State{Running: true},
+	})
+	infoClient, err := container.NewClientWithRuntime(runtime)
+	c.Assert(err, check.IsNil)
+	infoClient.WatchEvents()
+	defer infoClient.Close()
+	tsuruServer, requests := s.startTsuruServer(func(req *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf(`[{"ID": %q, "Found": false}]`, id))),
+		}
+	})
+	defer tsuruServer.Close()
+	reporter, err := NewReporter(&ReporterConfig{
+		Interval:            10 * time.Minute,
+		TsuruEndpoint:       tsuruServer.URL,
+		TsuruToken:          "some-token",
+		InfoClient:          infoClient,
+		EventsDebounce:      200 * time.Millisecond,
+		ZombieConfirmations: 5,
+	})
+	c.Assert(err, check.IsNil)
+	<-requests
+	event := &docker.APIEvents{
+		Type:   "container",
+		Action: "die",
+		Actor:  docker.APIActor{ID: id, Attributes: map[string]string{"name": "x1"}},
+	}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		runtime.SendEvent(event)
+		time.Sleep(150 * time.Millisecond)
+	}
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for status update")
+	}
+	c.Assert(time.Since(start) >= 450*time.Millisecond, check.Equals, true)
+	reporter.Stop()
+	reporter.reportMu.Lock()
+	c.Assert(reporter.zombies[id].reports, check.Equals, 1)
+	reporter.reportMu.Unlock()
+	delivered := make(chan struct{})
+	go func() {
+		runtime.SendEvent(event)
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		c.Fatal("shared client stopped watching events")
+	}
+}
+
+func (s S) TestRetrieveContainerStatusesDetails(c *check.C) {
+	runtime := containertest.NewFakeRuntime()
+	env := []string{"TSURU_APPNAME=someapp"}
+	startedAt := time.Now().Add(-time.Minute).UTC()
+	healthyID := runtime.AddContainer(docker.Container{
+		Name:         "/healthy",
+		Config:       &docker.Config{Env: env},
+		State:        docker.State{Running: true, StartedAt: startedAt},
+		RestartCount: 2,
+	})
+	runtime.SetHealth(healthyID, &container.Health{
+		Status: "healthy",
+		Log:    []container.HealthResult{{Output: "old"}, {Output: "ok\n"}},
+	})
+	unhealthyID := runtime.AddContainer(docker.Container{
+		Name:   "/unhealthy",
+		Config: &docker.Config{Env: env},
+		State:  docker.State{Running: true, StartedAt: startedAt},
+	})
+	runtime.SetHealth(unhealthyID, &container.Health{
+		Status:        "unhealthy",
+		FailingStreak: 3,
+		Log:           []container.HealthResult{{ExitCode: 1, Output: "connection refused"}},
+	})
+	startingID := runtime.AddContainer(docker.Container{
+		Name:   "/starting",
+		Config: &docker.Config{Env: env},
+		State:  docker.State{Running: true, StartedAt: startedAt},
+	})
+	runtime.SetHealth(startingID, &container.Health{Status: "starting"})
+	oomID := runtime.AddContainer(docker.Container{
+		Name:   "/oom",
+		Config: &docker.Config{Env: env},
+		State:  docker.State{ExitCode: 137, OOMKilled: true, StartedAt: startedAt},
+	})
+	infoClient, err := container.NewClientWithRuntime(runtime)
+	c.Assert(err, check.IsNil)
+	reporter := Reporter{
+		config:     &ReporterConfig{CrashLoopRestarts: 3, CrashLoopWindow: time.Minute},
+		infoClient: infoClient,
+		restarts:   make(map[string]*restartHistory),
+	}
+	containers, err := runtime.ListContainers(true)
+	c.Assert(err, check.IsNil)
+	statuses := reporter.retrieveContainerStatuses(containers)
+	c.Assert(statuses, check.DeepEquals, []containerStatus{
+		{ID: healthyID, Name: "healthy", Status: "started", RestartCount: 2, StartedAt: startedAt, Health: "healthy", HealthOutput: "ok"},
+		{ID: unhealthyID, Name: "unhealthy", Status: "error", StartedAt: startedAt, Health: "unhealthy", HealthOutput: "connection refused"},
+		{ID: startingID, Name: "starting", Status: "starting", StartedAt: startedAt, Health: "starting"},
+		{ID: oomID, Name: "oom", Status: "stopped", ExitCode: 137, OOMKilled: true, StartedAt: startedAt},
+	})
+}
+
+func (s S) TestRetrieveContainerStatusesCrashLooping(c *check.C) {
+	runtime := containertest.NewFakeRuntime()
+	id := runtime.AddContainer(docker.Container{
+		Name:         "/x1",
+		Config:       &docker.Config{Env: []string{"TSURU_APPNAME=someapp"}},
+		State:        docker.State{Running: true, StartedAt: time.Now()},
+		RestartCount: 10,
+	})
+	infoClient, err := container.NewClientWithRuntime(runtime)
+	c.Assert(err, check.IsNil)
+	reporter := Reporter{
+		config:     &ReporterConfig{CrashLoopRestarts: 3, CrashLoopWindow: time.Minute},
+		infoClient: infoClient,
+		restarts:   make(map[string]*restartHistory),
+	}
+	containers := []docker.APIContainers{{ID: id, Names: []string{"/x1"}}}
+	statuses := reporter.retrieveContainerStatuses(containers)
+	c.Assert(statuses[0].Status, check.Equals, "started")
+	c.Assert(statuses[0].CrashLooping, check.Equals, false)
+	for _, count := range []int{11, 12} {
+		runtime.UpdateContainer(id, func(cont *docker.Container) { cont.RestartCount = count })
+		statuses = reporter.retrieveContainerStatuses(containers)
+		c.Assert(statuses[0].CrashLooping, check.Equals, false)
+	}
+	runtime.UpdateContainer(id, func(cont *docker.Container) { cont.RestartCount = 13 })
+	statuses = reporter.retrieveContainerStatuses(containers)
+	c.Assert(statuses[0].Status, check.Equals, "error")
+	c.Assert(statuses[0].CrashLooping, check.Equals, true)
+	c.Assert(statuses[0].RestartCount, check.Equals, 13)
+	reporter.restarts[id].restarts = []time.Time{time.Now().Add(-2 * time.Minute)}
+	statuses = reporter.retrieveContainerStatuses(containers)
+	c.Assert(statuses[0].Status, check.Equals, "started")
+	c.Assert(statuses[0].CrashLooping, check.Equals, false)
+	reporter.pruneRestarts(nil)
+	c.Assert(reporter.restarts, check.HasLen, 0)
+}
+
+func (s S) TestRetrieveContainerStatusesCrashLoopingDisabled(c *check.C) {
+	runtime := containertest.NewFakeRuntime()
+	id := runtime.AddContainer(docker.Container{
+		Name:   "/x1",
+		Config: &docker.Config{Env: []string{"TSURU_APPNAME=someapp"}},
+		State:  docker.State{Running: true, StartedAt: time.Now()},
+	})
+	infoClient, err := container.NewClientWithRuntime(runtime)
+	c.Assert(err, check.IsNil)
+	reporter := Reporter{
+		config:     &ReporterConfig{},
+		infoClient: infoClient,
+		restarts:   make(map[string]*restartHistory),
+	}
+	containers := []docker.APIContainers{{ID: id, Names: []string{"/x1"}}}
+	for count := 1; count < 10; count++ {
+		runtime.UpdateContainer(id, func(cont *docker.Container) { cont.RestartCount = count })
+		statuses := reporter.retrieveContainerStatuses(containers)
+		c.Assert(statuses[0].CrashLooping, check.Equals, false)
+	}
+	c.Assert(reporter.restarts, check.HasLen, 0)
+}
@@ -0,0 +1,144 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package status
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/container"
+)
+
+// zombieState is how many consecutive times tsuru reported a container as
+// not found and when it first did.
+type zombieState struct {
+	reports   int
+	firstSeen time.Time
+}
+
+// ZombieEvent describes the removal of a container not known by tsuru.
+type ZombieEvent struct {
+	Container *container.Container
+	// Reports is how many consecutive times tsuru reported the container as
+	// not found, since FirstSeen.
+	Reports   int
+	FirstSeen time.Time
+	// DryRun is set when the container was kept because of
+	// ReporterConfig.ZombieDryRun.
+	DryRun bool
+	// Err is the error removing the container, if any.
+	Err error
+}
+
+// Message describes the event in a log line.
+func (e *ZombieEvent) Message() string {
+	action := "removed"
+	if e.DryRun {
+		action = "would remove (dry run)"
+	}
+	msg := fmt.Sprintf("bs %s container %s not found in tsuru after %d reports since %s",
+		action, e.Container.ID, e.Reports, e.FirstSeen.UTC().Format(time.RFC3339))
+	if e.Err != nil {
+		msg += fmt.Sprintf(": %s", e.Err)
+	}
+	return msg
+}
+
+// handleZombies removes the containers reported as not found by tsuru, once
+// they were reported ZombieConfirmations consecutive times over at least
+// ZombieGracePeriod. Protected containers are never removed and at most
+// ZombieMaxRemovals are removed per call. Only the responses to full periodic
+// reports are handled, as partial reports don't list every unit.
+func (r *Reporter) handleZombies(units []respUnit, now time.Time) {
+	removals := 0
+	for _, unit := range units {
+		if unit.Found {
+			delete(r.zombies, unit.ID)
+			continue
+		}
+		state, ok := r.zombies[unit.ID]
+		if !ok {
+			state = &zombieState{firstSeen: now}
+			r.zombies[unit.ID] = state
+		}
+		state.reports++
+		if state.reports < r.config.ZombieConfirmations || now.Sub(state.firstSeen) < r.config.ZombieGracePeriod {
+			bslog.Debugf("[status reporter] container %q not found in tsuru, %d reports since %s", unit.ID, state.reports, state.firstSeen)
+			continue
+		}
+		cont, err := r.infoClient.GetContainer(unit.ID, false, nil)
+		if err != nil {
+			if _, ok := err.(*docker.NoSuchContainer); ok {
+				delete(r.zombies, unit.ID)
+			} else {
+				bslog.Errorf("[status reporter] failed to inspect zombie container %q: %s", unit.ID, err)
+			}
+			continue
+		}
+		if label, ok := r.protectedBy(cont); ok {
+			bslog.Warnf("[status reporter] not removing zombie container %q, protected by label %q", unit.ID, label)
+			continue
+		}
+		if r.config.ZombieMaxRemovals > 0 && removals >= r.config.ZombieMaxRemovals {
+			bslog.Warnf("[status reporter] not removing zombie container %q, reached the limit of %d removals", unit.ID, r.config.ZombieMaxRemovals)
+			continue
+		}
+		removals++
+		event := ZombieEvent{
+			Container: cont,
+			Reports:   state.reports,
+			FirstSeen: state.firstSeen,
+			DryRun:    r.config.ZombieDryRun,
+		}
+		if event.DryRun {
+			bslog.Warnf("[status reporter] %s", event.Message())
+			r.auditZombie(event)
+			continue
+		}
+		r.tryRemoveContainer(unit.ID, func(err error) {
+			event.Err = err
+			r.auditZombie(event)
+		})
+	}
+}
+
+// protectedBy returns the entry of ZombieProtectedLabels, either a label name
+// or name=value, matching the labels of the container.
+func (r *Reporter) protectedBy(cont *container.Container) (string, bool) {
+	if cont.Config == nil {
+		return "", false
+	}
+	for _, protected := range r.config.ZombieProtectedLabels {
+		name, value, hasValue := strings.Cut(protected, "=")
+		contValue, ok := cont.Config.Labels[name]
+		if ok && (!hasValue || contValue == value) {
+			return protected, true
+		}
+	}
+	return "", false
+}
+
+func (r *Reporter) auditZombie(event ZombieEvent) {
+	if r.config.OnZombieRemoval != nil {
+		r.config.OnZombieRemoval(event)
+	}
+}
+
+// pruneZombies forgets the containers not found by tsuru that no longer
+// exist.
+func (r *Reporter) pruneZombies(containers []docker.APIContainers) {
+	existing := make(map[string]struct{}, len(containers))
+	for _, c := range containers {
+		existing[c.ID] = struct{}{}
+	}
+	for id := range r.zombies {
+		if _, ok := existing[id]; !ok {
+			delete(r.zombies, id)
+		}
+	}
+}
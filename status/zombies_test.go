@@ -0,0 +1,190 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package status
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/container"
+	"github.com/tsuru/bs/container/containertest"
+	"gopkg.in/check.v1"
+)
+
+type zombieAudit struct {
+	mu     sync.Mutex
+	events []ZombieEvent
+}
+
+func (a *zombieAudit) record(event ZombieEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events = append(a.events, event)
+}
+
+func newZombieReporter(c *check.C, runtime *containertest.FakeRuntime, config *ReporterConfig) *Reporter {
+	infoClient, err := container.NewClientWithRuntime(runtime)
+	c.Assert(err, check.IsNil)
+	return &Reporter{
+		config:     config,
+		infoClient: infoClient,
+		removeMap:  make(map[string]chan struct{}),
+		zombies:    make(map[string]*zombieState),
+	}
+}
+
+func (s S) TestHandleZombiesConfirmations(c *check.C) {
+	runtime := containertest.NewFakeRuntime()
+	id := runtime.AddContainer(docker.Container{Name: "/x1", Config: &docker.Config{Env: []string{"TSURU_APPNAME=someapp"}}})
+	var audit zombieAudit
+	reporter := newZombieReporter(c, runtime, &ReporterConfig{
+		ZombieConfirmations: 3,
+		ZombieGracePeriod:   time.Minute,
+		OnZombieRemoval:     audit.record,
+	})
+	now := time.Now()
+	reporter.handleZombies([]respUnit{{ID: id}}, now)
+	reporter.handleZombies([]respUnit{{ID: id}}, now.Add(10*time.Second))
+	reporter.handleZombies([]respUnit{{ID: id, Found: true}}, now.Add(20*time.Second))
+	c.Assert(reporter.zombies, check.HasLen, 0)
+	reporter.handleZombies([]respUnit{{ID: id}}, now.Add(30*time.Second))
+	reporter.handleZombies([]respUnit{{ID: id}}, now.Add(40*time.Second))
+	reporter.handleZombies([]respUnit{{ID: id}}, now.Add(50*time.Second))
+	reporter.waitPendingRemovals()
+	c.Assert(runtime.Removed, check.HasLen, 0)
+	c.Assert(reporter.zombies[id].reports, check.Equals, 3)
+	reporter.handleZombies([]respUnit{{ID: id}}, now.Add(90*time.Second))
+	reporter.waitPendingRemovals()
+	c.Assert(runtime.Removed, check.DeepEquals, []string{id})
+	c.Assert(audit.events, check.HasLen, 1)
+	event := audit.events[0]
+	c.Assert(event.Container.ID, check.Equals, id)
+	c.Assert(event.Container.AppName, check.Equals, "someapp")
+	c.Assert(event.Reports, check.Equals, 4)
+	c.Assert(event.FirstSeen.Equal(now.Add(30*time.Second)), check.Equals, true)
+	c.Assert(event.DryRun, check.Equals, false)
+	c.Assert(event.Err, check.IsNil)
+	reporter.handleZombies([]respUnit{{ID: id}}, now.Add(100*time.Second))
+	c.Assert(reporter.zombies, check.HasLen, 0)
+}
+
+func (s S) TestHandleTsuruResponseCountsOnlyFullReports(c *check.C) {
+	runtime := containertest.NewFakeRuntime()
+	id := runtime.AddContainer(docker.Container{Name: "/x1", Config: &docker.Config{Env: []string{"TSURU_APPNAME=someapp"}}})
+	reporter := newZombieReporter(c, runtime, &ReporterConfig{
+		ZombieConfirmations: 2,
+		ZombieGracePeriod:   time.Nanosecond,
+	})
+	response := func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf(`[{"ID": %q, "Found": false}]`, id))),
+		}
+	}
+	for i := 0; i < 3; i++ {
+		err := reporter.handleTsuruResponse(response(), false)
+		c.Assert(err, check.IsNil)
+	}
+	c.Assert(reporter.zombies, check.HasLen, 0)
+	err := reporter.handleTsuruResponse(response(), true)
+	c.Assert(err, check.IsNil)
+	c.Assert(reporter.zombies[id].reports, check.Equals, 1)
+	err = reporter.handleTsuruResponse(response(), false)
+	c.Assert(err, check.IsNil)
+	c.Assert(reporter.zombies[id].reports, check.Equals, 1)
+	reporter.waitPendingRemovals()
+	c.Assert(runtime.Removed, check.HasLen, 0)
+}
+
+func (s S) TestHandleZombiesDefaultConfig(c *check.C) {
+	runtime := containertest.NewFakeRuntime()
+	id1 := runtime.AddContainer(docker.Container{Name: "/x1"})
+	id2 := runtime.AddContainer(docker.Container{Name: "/x2"})
+	reporter := newZombieReporter(c, runtime, &ReporterConfig{})
+	reporter.handleZombies([]respUnit{{ID: id1}, {ID: id2, Found: true}}, time.Now())
+	reporter.waitPendingRemovals()
+	c.Assert(runtime.Removed, check.DeepEquals, []string{id1})
+}
+
+func (s S) TestHandleZombiesDryRun(c *check.C) {
+	var logOutput bytes.Buffer
+	bslog.Logger = log.New(&logOutput, "", 0)
+	defer func() { bslog.Logger = log.New(os.Stderr, "", log.LstdFlags) }()
+	runtime := containertest.NewFakeRuntime()
+	id := runtime.AddContainer(docker.Container{Name: "/x1"})
+	var audit zombieAudit
+	reporter := newZombieReporter(c, runtime, &ReporterConfig{
+		ZombieDryRun:    true,
+		OnZombieRemoval: audit.record,
+	})
+	reporter.handleZombies([]respUnit{{ID: id}}, time.Now())
+	reporter.waitPendingRemovals()
+	c.Assert(runtime.Removed, check.HasLen, 0)
+	c.Assert(audit.events, check.HasLen, 1)
+	c.Assert(audit.events[0].DryRun, check.Equals, true)
+	c.Assert(audit.events[0].Message(), check.Matches, `bs would remove \(dry run\) container `+id+` not found in tsuru after 1 reports since .*`)
+	c.Assert(logOutput.String(), check.Matches, `(?s).*\[WARNING\] \[status reporter\] bs would remove \(dry run\) container `+id+`.*`)
+}
+
+func (s S) TestHandleZombiesProtectedLabels(c *check.C) {
+	runtime := containertest.NewFakeRuntime()
+	keepID := runtime.AddContainer(docker.Container{Name: "/keep", Config: &docker.Config{Labels: map[string]string{"keep": ""}}})
+	dbID := runtime.AddContainer(docker.Container{Name: "/db", Config: &docker.Config{Labels: map[string]string{"tier": "db"}}})
+	webID := runtime.AddContainer(docker.Container{Name: "/web", Config: &docker.Config{Labels: map[string]string{"tier": "web"}}})
+	reporter := newZombieReporter(c, runtime, &ReporterConfig{
+		ZombieProtectedLabels: []string{"keep", "tier=db"},
+	})
+	reporter.handleZombies([]respUnit{{ID: keepID}, {ID: dbID}, {ID: webID}}, time.Now())
+	reporter.waitPendingRemovals()
+	c.Assert(runtime.Removed, check.DeepEquals, []string{webID})
+}
+
+func (s S) TestHandleZombiesMaxRemovals(c *check.C) {
+	runtime := containertest.NewFakeRuntime()
+	var units []respUnit
+	for i := 0; i < 5; i++ {
+		units = append(units, respUnit{ID: runtime.AddContainer(docker.Container{})})
+	}
+	var audit zombieAudit
+	reporter := newZombieReporter(c, runtime, &ReporterConfig{
+		ZombieMaxRemovals: 2,
+		OnZombieRemoval:   audit.record,
+	})
+	reporter.handleZombies(units, time.Now())
+	reporter.waitPendingRemovals()
+	c.Assert(runtime.Removed, check.HasLen, 2)
+	c.Assert(audit.events, check.HasLen, 2)
+	reporter.handleZombies(units, time.Now())
+	reporter.waitPendingRemovals()
+	c.Assert(runtime.Removed, check.HasLen, 4)
+}
+
+func (s S) TestPruneZombies(c *check.C) {
+	reporter := &Reporter{zombies: map[string]*zombieState{
+		"id1": {reports: 1},
+		"id2": {reports: 2},
+	}}
+	reporter.pruneZombies([]docker.APIContainers{{ID: "id2"}})
+	c.Assert(reporter.zombies, check.DeepEquals, map[string]*zombieState{"id2": {reports: 2}})
+}
+
+func (s S) TestZombieEventMessage(c *check.C) {
+	event := ZombieEvent{
+		Container: &container.Container{Container: docker.Container{ID: "abc"}},
+		Reports:   3,
+		FirstSeen: time.Date(2017, 5, 1, 10, 0, 0, 0, time.UTC),
+		Err:       errors.New("device busy"),
+	}
+	c.Assert(event.Message(), check.Equals, "bs removed container abc not found in tsuru after 3 reports since 2017-05-01T10:00:00Z: device busy")
+}
@@ -0,0 +1,12 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package telemetry
+
+import "github.com/prometheus/client_golang/prometheus/collectors"
+
+func init() {
+	Default.register("go", collectors.NewGoCollector())
+	Default.register("process", collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
@@ -0,0 +1,191 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package telemetry keeps metrics about bs itself and exposes them in the
+// Prometheus text format.
+package telemetry
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// DefBuckets are the default histogram buckets, in seconds.
+var DefBuckets = prometheus.DefBuckets
+
+// Default is the registry holding the metrics of bs.
+var Default = NewRegistry()
+
+// Counter is a value that only increases.
+type Counter = prometheus.Counter
+
+// Histogram counts observations in buckets.
+type Histogram = prometheus.Observer
+
+// Registry holds metrics by name.
+type Registry struct {
+	mu         sync.Mutex
+	registry   *prometheus.Registry
+	collectors map[string]prometheus.Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		registry:   prometheus.NewRegistry(),
+		collectors: make(map[string]prometheus.Collector),
+	}
+}
+
+// register adds the collector, replacing any metric with the same name.
+func (r *Registry) register(name string, c prometheus.Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, replaced := r.collectors[name]
+	r.collectors[name] = c
+	if !replaced {
+		r.registry.MustRegister(c)
+		return
+	}
+	// prometheus.Registry keeps the label names of unregistered metrics, so
+	// a replaced metric is registered in a new registry.
+	r.registry = prometheus.NewRegistry()
+	for _, collector := range r.collectors {
+		r.registry.MustRegister(collector)
+	}
+}
+
+// Gather implements prometheus.Gatherer.
+func (r *Registry) Gather() ([]*dto.MetricFamily, error) {
+	r.mu.Lock()
+	registry := r.registry
+	r.mu.Unlock()
+	return registry.Gather()
+}
+
+// Write writes every metric in the text format, sorted by name.
+func (r *Registry) Write(w io.Writer) error {
+	families, err := r.Gather()
+	if err != nil {
+		return err
+	}
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the metrics of the registry.
+func (r *Registry) Handler() http.Handler {
+	return promhttp.HandlerFor(r, promhttp.HandlerOpts{})
+}
+
+func checkLabels(name string, labels, values []string) {
+	if len(values) != len(labels) {
+		panic("telemetry: wrong number of label values for " + name)
+	}
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	*prometheus.CounterVec
+	name   string
+	labels []string
+}
+
+// NewCounterVec creates a counter registered in the default registry.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		CounterVec: prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels),
+		name:       name,
+		labels:     labels,
+	}
+	Default.register(name, c.CounterVec)
+	return c
+}
+
+// With returns the counter for the label values, in the order of the labels.
+func (c *CounterVec) With(values ...string) Counter {
+	checkLabels(c.name, c.labels, values)
+	return c.WithLabelValues(values...)
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	*prometheus.HistogramVec
+	name   string
+	labels []string
+}
+
+// NewHistogramVec creates a histogram registered in the default registry,
+// using DefBuckets when buckets is nil.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		HistogramVec: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels),
+		name:         name,
+		labels:       labels,
+	}
+	Default.register(name, h.HistogramVec)
+	return h
+}
+
+// With returns the histogram for the label values, in the order of the
+// labels.
+func (h *HistogramVec) With(values ...string) Histogram {
+	checkLabels(h.name, h.labels, values)
+	return h.WithLabelValues(values...)
+}
+
+// Sample is a value with the label values of a metric collected by a
+// function.
+type Sample struct {
+	Values []string
+	Value  float64
+}
+
+// funcCollector collects the samples of a metric by calling collect on each
+// scrape.
+type funcCollector struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	collect   func() []Sample
+}
+
+func (f *funcCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- f.desc
+}
+
+func (f *funcCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, sample := range f.collect() {
+		ch <- prometheus.MustNewConstMetric(f.desc, f.valueType, sample.Value, sample.Values...)
+	}
+}
+
+func registerFunc(name, help string, valueType prometheus.ValueType, labels []string, collect func() []Sample) {
+	Default.register(name, &funcCollector{
+		desc:      prometheus.NewDesc(name, help, labels, nil),
+		valueType: valueType,
+		collect:   collect,
+	})
+}
+
+// RegisterCounterFunc registers a counter in the default registry whose
+// samples are collected by calling collect, replacing any metric with the
+// same name.
+func RegisterCounterFunc(name, help string, labels []string, collect func() []Sample) {
+	registerFunc(name, help, prometheus.CounterValue, labels, collect)
+}
+
+// RegisterGaugeFunc registers a gauge in the default registry whose samples
+// are collected by calling collect, replacing any metric with the same name.
+func RegisterGaugeFunc(name, help string, labels []string, collect func() []Sample) {
+	registerFunc(name, help, prometheus.GaugeValue, labels, collect)
+}
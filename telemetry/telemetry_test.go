@@ -0,0 +1,105 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package telemetry
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/check.v1"
+)
+
+var _ = check.Suite(S{})
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type S struct{}
+
+func write(c *check.C, r *Registry) string {
+	var buf bytes.Buffer
+	err := r.Write(&buf)
+	c.Assert(err, check.IsNil)
+	return buf.String()
+}
+
+// metricLines returns the lines of the metric called name in the text format.
+func metricLines(text, name string) string {
+	var lines []string
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if strings.HasPrefix(line, name) || strings.HasPrefix(line, "# HELP "+name+" ") || strings.HasPrefix(line, "# TYPE "+name+" ") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+func (S) TestCounterVec(c *check.C) {
+	counter := NewCounterVec("test_counter_total", "A counter.\nWith two lines.", "listener", "kind")
+	counter.With("udp", "app").Inc()
+	counter.With("udp", "app").Add(2)
+	counter.With(`quo"te`, "x").Inc()
+	c.Assert(metricLines(write(c, Default), "test_counter_total"), check.Equals, `# HELP test_counter_total A counter.\nWith two lines.
+# TYPE test_counter_total counter
+test_counter_total{kind="app",listener="udp"} 3
+test_counter_total{kind="x",listener="quo\"te"} 1
+`)
+}
+
+func (S) TestCounterVecWrongLabels(c *check.C) {
+	counter := NewCounterVec("test_wrong_labels_total", "A counter.", "listener")
+	c.Assert(func() { counter.With("udp", "app") }, check.PanicMatches, "telemetry: wrong number of label values for test_wrong_labels_total")
+}
+
+func (S) TestHistogramVec(c *check.C) {
+	histogram := NewHistogramVec("test_duration_seconds", "A histogram.", []float64{0.1, 1})
+	histogram.With().Observe(0.05)
+	histogram.With().Observe(0.1)
+	histogram.With().Observe(0.5)
+	histogram.With().Observe(2)
+	c.Assert(metricLines(write(c, Default), "test_duration_seconds"), check.Equals, `# HELP test_duration_seconds A histogram.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 2
+test_duration_seconds_bucket{le="1"} 3
+test_duration_seconds_bucket{le="+Inf"} 4
+test_duration_seconds_sum 2.65
+test_duration_seconds_count 4
+`)
+}
+
+func (S) TestRegisterGaugeFunc(c *check.C) {
+	RegisterGaugeFunc("test_queue_depth", "A gauge.", []string{"backend"}, func() []Sample {
+		return []Sample{{Values: []string{"tsuru"}, Value: 2}, {Values: []string{"syslog"}, Value: 0}}
+	})
+	c.Assert(metricLines(write(c, Default), "test_queue_depth"), check.Equals, `# HELP test_queue_depth A gauge.
+# TYPE test_queue_depth gauge
+test_queue_depth{backend="syslog"} 0
+test_queue_depth{backend="tsuru"} 2
+`)
+	RegisterGaugeFunc("test_queue_depth", "A gauge.", nil, func() []Sample {
+		return []Sample{{Value: 1}}
+	})
+	c.Assert(metricLines(write(c, Default), "test_queue_depth"), check.Equals, `# HELP test_queue_depth A gauge.
+# TYPE test_queue_depth gauge
+test_queue_depth 1
+`)
+}
+
+func (S) TestHandler(c *check.C) {
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/metrics", nil)
+	c.Assert(err, check.IsNil)
+	Default.Handler().ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Matches, `text/plain; version=0\.0\.4; charset=utf-8.*`)
+	body := recorder.Body.String()
+	c.Assert(metricLines(body, "go_goroutines"), check.Matches, "# HELP go_goroutines .*\n# TYPE go_goroutines gauge\ngo_goroutines [0-9]+\n")
+	c.Assert(metricLines(body, "go_info"), check.Matches, `(?s).*go_info\{version="go.*"\} 1\n`)
+	c.Assert(body, check.Matches, `(?s).*\ngo_memstats_alloc_bytes [0-9e+.]+\n.*`)
+}